@@ -0,0 +1,78 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"tonika/core"
+)
+
+// runExport writes the identity file (and the home directory, if asked for)
+// into an encrypted bundle
+func runExport(dbfile, passfile, homedir, out string) os.Error {
+	dbpass, err := unlockPassphrase(dbfile, passfile, false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Tonika: Choose a passphrase to encrypt the bundle\n")
+	pass, err := promptNewPassphrase()
+	if err != nil {
+		return err
+	}
+	if pass == nil {
+		return os.ErrorString("bundles must be encrypted")
+	}
+	return core.ExportBundle(dbfile, dbpass, homedir, out, pass)
+}
+
+// runImport restores a bundle into the identity file and the home directory
+func runImport(in, dbfile, passfile, homedir string, dryrun, force bool) os.Error {
+	pass, err := promptPassphrase("Tonika: Passphrase for bundle " + in + ": ")
+	if err != nil {
+		return err
+	}
+	dbpass, err := unlockPassphrase(dbfile, passfile, false)
+	if err != nil {
+		return err
+	}
+	if dbpass == nil && !dryrun {
+		fmt.Fprintf(os.Stderr, "Tonika: Choose a passphrase for the restored identity file\n")
+		if dbpass, err = promptNewPassphrase(); err != nil {
+			return err
+		}
+	}
+	r, err := core.ImportBundle(in, pass, dbfile, dbpass, homedir, dryrun, force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Tonika: Bundle has identity %s (%s), %d friends, %d home files\n",
+		r.Id.String(), r.Name, r.Friends, r.Files)
+	for _, c := range r.Conflicts {
+		fmt.Fprintf(os.Stderr, "Tonika: Conflict: %s\n", c)
+	}
+	switch {
+	case dryrun:
+		fmt.Fprintf(os.Stderr, "Tonika: Dry run, nothing was written\n")
+	case len(r.Conflicts) > 0 && !force:
+		return os.ErrorString("conflicts found, use -force to overwrite")
+	default:
+		fmt.Fprintf(os.Stderr, "Tonika: Bundle imported\n")
+	}
+	return nil
+}
@@ -24,10 +24,12 @@ import (
 	"path"
 	"tonika/core"
 	"tonika/sys"
-	//"tonika/util/signal"
+	"tonika/util/signal"
 )
 
 var (
+	flagConfig   = flag.String("config", "", 
+		"Configuration file (json). Send SIGHUP to reload it. Flags override it.")
 	flagAddr     = flag.String("addr", "", 
 		"Address and port of " + sys.Name + " client")
 	flagDbFile   = flag.String("id", "MyTonikaIdentity", 
@@ -43,21 +45,108 @@ var (
 	flagFEAllow  = flag.String("fe-allow", "127.0.0.1,::1", 
 		"Comma-separated list of hosts allowed to access the Front End. " +
 		"Both IPv4 and IPv6 must be added if specifying IP's.")
+	flagEncrypt  = flag.Bool("encrypt", false, 
+		"Encrypt your identity file with a passphrase (asked for at start)")
+	flagPassFile = flag.String("passfile", "", 
+		"File containing the passphrase of your identity file, instead of asking for it")
+	flagPasswd   = flag.Bool("passwd", false, 
+		"Change the passphrase of your identity file and exit")
+	flagExportHome = flag.Bool("export-home", false, 
+		"With the export command, include your home directory in the bundle")
+	flagDryRun   = flag.Bool("dry-run", false, 
+		"With the import command, only validate the bundle and report conflicts")
+	flagForce    = flag.Bool("force", false, 
+		"With the import command, overwrite conflicting identity and home files")
+	flagRevCert  = flag.String("revcert", "", 
+		"Write a revocation certificate for your identity to this file and exit. " +
+		"Keep it safe; publishing it tells your friends to stop trusting your key.")
+	flagRevReason = flag.String("revcert-reason", "key compromised", 
+		"Reason stated in the revocation certificate made with -revcert")
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: tonika [flags]\n"+
+		"       tonika [flags] export bundle   export your identity and friends, and exit\n"+
+		"       tonika [flags] import bundle   import an identity bundle, and exit\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
 func main() {
-	//signal.InstallCtrlCPanic()
 	fmt.Fprintf(os.Stderr, 
 		"%s, 2009-10, Build %s, Released %s, by Petar Maymounkov, Homepage: %s\n", 
 		sys.Name, sys.Build, sys.Released, sys.WWWURL)
+	flag.Usage = usage
 	flag.Parse()
+	cmd := flag.Arg(0)
+	switch {
+	case cmd == "" && flag.NArg() == 0:
+	case (cmd == "export" || cmd == "import") && flag.NArg() == 2:
+	default:
+		usage()
+	}
 
-	if *flagHomeDir == "" {
+	cfg := core.DefaultConfig()
+	if *flagConfig != "" {
+		if err := core.ReadConfig(*flagConfig, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Could not read config file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	overrideConfig(cfg)
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Tonika: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *flagPasswd {
+		if err := changePassphrase(cfg.DbFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Could not change passphrase: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Tonika: Passphrase changed\n")
+		os.Exit(0)
+	}
+	if *flagRevCert != "" {
+		pass, err := unlockPassphrase(cfg.DbFile, *flagPassFile, false)
+		if err == nil {
+			err = core.WriteRevocationCert(cfg.DbFile, pass, *flagRevCert, *flagRevReason)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Could not make revocation certificate: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Tonika: Revocation certificate written to %s\n", *flagRevCert)
+		os.Exit(0)
+	}
+	if cmd == "export" {
+		hdir := ""
+		if *flagExportHome {
+			hdir = cfg.HomeDir
+		}
+		if err := runExport(cfg.DbFile, *flagPassFile, hdir, flag.Arg(1)); err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Export failed: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Tonika: Exported to %s\n", flag.Arg(1))
+		os.Exit(0)
+	}
+	if cmd == "import" {
+		err := runImport(flag.Arg(1), cfg.DbFile, *flagPassFile, cfg.HomeDir, 
+			*flagDryRun, *flagForce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Import failed: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.HomeDir == "" {
 		fmt.Fprintf(os.Stderr, 
 			"Tonika: You forgot to specify your home directory. Use -hdir='dirhere'")
 		os.Exit(1)
 	}
-	if *flagCacheDir == "" {
+	if cfg.CacheDir == "" {
 		fmt.Fprintf(os.Stderr, 
 			"Tonika: You forgot to specify a cache directory. Use -cdir='dirhere'")
 		os.Exit(1)
@@ -66,28 +155,101 @@ func main() {
 	fmt.Fprintf(os.Stderr, 
 		"What's next:\n" +
 		"  * Make sure to configure your browser's proxy to %s\n" +
-		"  * To use Tonika, open your browser and go to http://a."+ sys.Host +"\n", *flagFEAddr)
+		"  * To use Tonika, open your browser and go to http://a."+ sys.Host +"\n", cfg.FEAddr)
 
 	go func() {
-		if !askForGreenLight() {
+		green, err := askForGreenLight(cfg.UpdateURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Bad UpdateURL: %s\n", err)
+			os.Exit(1)
+		}
+		if !green {
 			fmt.Fprintf(os.Stderr, "Tonika: Your version of Tonika is too old. Please update!\n")
 			os.Exit(1)
 		}
 	}()
 
+	pass, err := unlockPassphrase(cfg.DbFile, *flagPassFile, *flagEncrypt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tonika: Could not read passphrase: %s\n", err)
+		os.Exit(1)
+	}
+
+	passes := make([][]byte, len(cfg.Identities))
+	for i, ic := range cfg.Identities {
+		passes[i], err = unlockPassphrase(ic.DbFile, ic.PassFile, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Tonika: Could not read passphrase of %s: %s\n", 
+				ic.DbFile, err)
+			os.Exit(1)
+		}
+	}
+
 	cargs := &core.Args {
-		Addr:     *flagAddr,
-		DbFile:   *flagDbFile,
-		HomeDir:  *flagHomeDir,
-		CacheDir: *flagCacheDir,
-		FEDir:    path.Join(*flagPDir, "fe"),
-		FEAddr:   *flagFEAddr,
-		FEAllow:  *flagFEAllow,
+		Config:     *cfg,
+		ConfigFile: *flagConfig,
+		Override:   overrideConfig,
+		Pass:       pass,
+		Passes:     passes,
 	}
-	_,err := core.MakeCore(cargs)
+	c, err := core.MakeCore(cargs)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Tonika: Error starting: %s\n", err)
 		os.Exit(1)
 	}
-	<-make(chan int)
+	waitForSignals(c, cfg.ShutdownTimeout*1e9)
+}
+
+// waitForSignals reloads the configuration on SIGHUP, and shuts down on
+// SIGINT or SIGTERM. The exit status is 0 after a clean shutdown, 1 if some
+// subsystem did not stop in time, and 2 if a second signal cut the
+// shutdown short.
+func waitForSignals(c *core.Core, timeout int64) {
+	stopping := false
+	for {
+		sig, what := signal.Next()
+		switch what {
+		case signal.Reload:
+			if !stopping {
+				c.ReloadConfig()
+			}
+		case signal.Stop:
+			if stopping {
+				fmt.Fprintf(os.Stderr, "Tonika: Shutdown interrupted\n")
+				os.Exit(2)
+			}
+			stopping = true
+			fmt.Fprintf(os.Stderr, "Tonika: Shutting down (%s again to force) ...\n", sig)
+			go func() {
+				if err := c.Stop(timeout); err != nil {
+					fmt.Fprintf(os.Stderr, "Tonika: Shutdown was not clean: %s\n", err)
+					os.Exit(1)
+				}
+				fmt.Fprintf(os.Stderr, "Tonika: Bye\n")
+				os.Exit(0)
+			}()
+		}
+	}
+}
+
+// overrideConfig applies the flags given on the command line to cfg
+func overrideConfig(cfg *core.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *flagAddr
+		case "id":
+			cfg.DbFile = *flagDbFile
+		case "hdir":
+			cfg.HomeDir = *flagHomeDir
+		case "cdir":
+			cfg.CacheDir = *flagCacheDir
+		case "pdir":
+			cfg.FEDir = path.Join(*flagPDir, "fe")
+		case "fe":
+			cfg.FEAddr = *flagFEAddr
+		case "fe-allow":
+			cfg.FEAllow = *flagFEAllow
+		}
+	})
 }
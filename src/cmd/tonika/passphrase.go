@@ -0,0 +1,118 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"tonika/core"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// setEcho turns terminal echo on or off, if we are talking to a terminal
+func setEcho(on bool) {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	pid, err := os.ForkExec("/bin/stty", []string{"stty", arg}, os.Environ(), "",
+		[]*os.File{os.Stdin, os.Stdout, os.Stderr})
+	if err == nil {
+		os.Wait(pid, 0)
+	}
+}
+
+func promptPassphrase(prompt string) ([]byte, os.Error) {
+	fmt.Fprintf(os.Stderr, "%s", prompt)
+	setEcho(false)
+	line, err := stdin.ReadString('\n')
+	setEcho(true)
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil {
+		return nil, err
+	}
+	return trimNewline([]byte(line)), nil
+}
+
+func promptNewPassphrase() ([]byte, os.Error) {
+	for {
+		p1, err := promptPassphrase("Tonika: New passphrase (empty for none): ")
+		if err != nil {
+			return nil, err
+		}
+		p2, err := promptPassphrase("Tonika: Repeat new passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(p1) == string(p2) {
+			if len(p1) == 0 {
+				return nil, nil
+			}
+			return p1, nil
+		}
+		fmt.Fprintf(os.Stderr, "Tonika: Passphrases do not match, try again\n")
+	}
+	panic("unreach")
+}
+
+func trimNewline(p []byte) []byte {
+	for len(p) > 0 && (p[len(p)-1] == '\n' || p[len(p)-1] == '\r') {
+		p = p[0 : len(p)-1]
+	}
+	return p
+}
+
+// unlockPassphrase returns the passphrase that the identity file should be
+// opened with, or nil if it is not (and should not become) encrypted.
+func unlockPassphrase(dbfile, passfile string, encrypt bool) ([]byte, os.Error) {
+	if passfile != "" {
+		p, err := ioutil.ReadFile(passfile)
+		if err != nil {
+			return nil, err
+		}
+		return trimNewline(p), nil
+	}
+	if core.IsFriendDbSealed(dbfile) {
+		return promptPassphrase("Tonika: Passphrase for " + dbfile + ": ")
+	}
+	if encrypt {
+		fmt.Fprintf(os.Stderr, "Tonika: Choose a passphrase to encrypt %s\n", dbfile)
+		return promptNewPassphrase()
+	}
+	return nil, nil
+}
+
+// changePassphrase re-encrypts the identity file under a new passphrase
+func changePassphrase(dbfile string) os.Error {
+	var old []byte
+	var err os.Error
+	if core.IsFriendDbSealed(dbfile) {
+		old, err = promptPassphrase("Tonika: Current passphrase for " + dbfile + ": ")
+		if err != nil {
+			return err
+		}
+	}
+	pass, err := promptNewPassphrase()
+	if err != nil {
+		return err
+	}
+	return core.ChangeFriendDbPassphrase(dbfile, old, pass)
+}
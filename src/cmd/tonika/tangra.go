@@ -19,15 +19,24 @@ package main
 
 import (
 	"net"
+	"os"
 	"strings"
 	"tonika/http"
 	"tonika/sys"
 )
 
-func askForGreenLight() bool {
-	url,err := http.ParseURL(sys.TangraServerURL)
+// askForGreenLight asks the update server whether this build may run. An
+// unreachable server is no reason to stop, but a malformed URL is an error.
+func askForGreenLight(tangraURL string) (bool, os.Error) {
+	if tangraURL == "" {
+		return true, nil
+	}
+	url,err := http.ParseURL(tangraURL)
 	if err != nil {
-		panic("tangra, bad URL")
+		return false, err
+	}
+	if url.Host == "" {
+		return false, os.ErrorString("no host in " + tangraURL)
 	}
 	req := &http.Request{
 		Method: "GET",
@@ -45,7 +54,7 @@ func askForGreenLight() bool {
 		if conn != nil {
 			conn.Close()
 		}
-		return true
+		return true, nil
 	}
 	cc := http.NewClientConn(conn,nil)
 
@@ -54,27 +63,27 @@ func askForGreenLight() bool {
 	if err != nil {
 		cc.Close()
 		conn.Close()
-		return true
+		return true, nil
 	}
 	resp,err := cc.Read()
 	if err != nil {
 		cc.Close()
 		conn.Close()
-		return true
+		return true, nil
 	}
 	cc.Close()
 	conn.Close()
 
 	if resp.Header == nil {
-		return true
+		return true, nil
 	}
 	green, ok := resp.Header["Green"]
 	if !ok {
-		return true
+		return true, nil
 	}
 	green = strings.TrimSpace(green)
 	if green == "Halt" {
-		return false
+		return false, nil
 	}
-	return true
+	return true, nil
 }
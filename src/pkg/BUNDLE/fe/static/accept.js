@@ -3,6 +3,12 @@ function acceptResultOK(data) {
 
         if (data.ErrMsg != "") {
                 $('#f_err').text(data.ErrMsg);
+                if (data.FieldErrs) {
+                        $.each(data.FieldErrs, function(i, fe) {
+                                $('#f_err').append($('<br/>')).append(
+                                        document.createTextNode(fe.Field + ": " + fe.Reason));
+                        });
+                }
                 $('#notice').show();
         }
         
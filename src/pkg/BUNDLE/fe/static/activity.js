@@ -0,0 +1,4 @@
+$(document).ready(function(){
+        mainReady();
+        window.setInterval('window.location.reload()', 30000)
+});
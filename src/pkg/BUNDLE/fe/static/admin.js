@@ -19,8 +19,75 @@ function onUpdate(event) {
         });
 }
 
+function groupAPI(q) {
+        $.ajax({
+                url: '/api/group?' + q,
+                success: function(data) {
+                        if (data.ErrMsg) {
+                                alert(data.ErrMsg);
+                        }
+                        window.location = AdminURL;
+                },
+                error: ajaxError,
+                dataType: 'json',
+        });
+}
+
+function onGroupMake(event) {
+        event.preventDefault();
+        groupAPI('op=make&g=' + $.URLEncode($('#g_name').val()));
+}
+
+function onGroupRename(event) {
+        event.preventDefault();
+        g = $(this).attr('title');
+        n = prompt('New name for group ' + g + ':', g);
+        if (n == null || n == '' || n == g) {
+                return;
+        }
+        groupAPI('op=rename&g=' + $.URLEncode(g) + '&n=' + $.URLEncode(n));
+}
+
+function onGroupRemove(event) {
+        event.preventDefault();
+        g = $(this).attr('title');
+        if (!confirm('Delete group ' + g + '? Its contacts are not affected.')) {
+                return;
+        }
+        groupAPI('op=remove&g=' + $.URLEncode(g));
+}
+
+function introAPI(q) {
+        $.ajax({
+                url: '/api/intro?' + q,
+                success: function(data) {
+                        if (data != 'OK') {
+                                alert(data);
+                        }
+                        window.location = AdminURL;
+                },
+                error: ajaxError,
+                dataType: 'text',
+        });
+}
+
+function onIntroAccept(event) {
+        event.preventDefault();
+        introAPI('op=accept&fp=' + $(this).attr('title'));
+}
+
+function onIntroDecline(event) {
+        event.preventDefault();
+        introAPI('op=decline&fp=' + $(this).attr('title'));
+}
+
 $(document).ready(function(){
         mainReady();
         $('#f_add').click(function(){ window.location = AdminURL+"/add"; });
         $('#f_update').click(onUpdate);
+        $('#g_make').click(onGroupMake);
+        $('.g_rename').click(onGroupRename);
+        $('.g_remove').click(onGroupRemove);
+        $('.i_accept').click(onIntroAccept);
+        $('.i_decline').click(onIntroDecline);
 });
@@ -0,0 +1,35 @@
+function downloadAPI(q) {
+        $.ajax({
+                url: '/api/download?' + q,
+                success: function(data) {
+                        if (data != 'OK') {
+                                alert(data);
+                        }
+                        window.location.reload();
+                },
+                dataType: 'text',
+        });
+}
+
+function onAdd(event) {
+        event.preventDefault();
+        var q = 'op=add&u=' + $.URLEncode($('#f_url').val());
+        if ($('#f_swarm').is(':checked')) {
+                q += '&swarm=1';
+        }
+        downloadAPI(q);
+}
+
+function onOp(event) {
+        event.preventDefault();
+        downloadAPI('op=' + $(this).attr('name') + '&d=' + $(this).attr('title'));
+}
+
+$(document).ready(function(){
+        mainReady();
+        $('#f_add').click(onAdd);
+        $('.d_op').click(onOp);
+        if ($('#f_refresh').val() != '') {
+                window.setInterval('window.location.reload()', 2000)
+        }
+});
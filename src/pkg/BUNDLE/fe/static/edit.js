@@ -6,6 +6,14 @@ function ajaxError(data) {
         window.location = AdminURL;
 }
 
+function editDone(data) {
+        if (data.ErrMsg) {
+                alert(data.ErrMsg);
+                return;
+        }
+        window.location = AdminURL;
+}
+
 function onRevoke(event) {
         event.preventDefault();
         $.ajax({
@@ -23,12 +31,44 @@ function onUpdate(event) {
         a = $.URLEncode($('#f_addr').val());
         $.ajax({
                 url: '/api/update?s='+$('#f_slot').val()+"&n="+n+"&e="+e+"&a="+a,
-                success: ajaxDone,
+                success: editDone,
                 error: ajaxError,
                 dataType: 'json',
         });
 }
 
+function onGroup(event) {
+        op = 'leave';
+        if ($(this).is(':checked')) {
+                op = 'join';
+        }
+        $.ajax({
+                url: '/api/group?op=' + op + '&g=' + $.URLEncode($(this).attr('title')) +
+                        '&s=' + $('#f_slot').val(),
+                success: function(data) {
+                        if (data.ErrMsg) {
+                                alert(data.ErrMsg);
+                        }
+                },
+                dataType: 'json',
+        });
+}
+
+function onIntroduce(event) {
+        event.preventDefault();
+        $.ajax({
+                url: '/api/intro?op=introduce&a=' + $('#f_slot').val() + '&b=' + $('#f_other').val(),
+                success: function(data) {
+                        if (data == 'OK') {
+                                alert('Introductions sent.');
+                        } else {
+                                alert(data);
+                        }
+                },
+                dataType: 'text',
+        });
+}
+
 $(document).ready(function(){
         mainReady();
 
@@ -49,4 +89,6 @@ $(document).ready(function(){
         $('#f_cancel').click(function(){ window.location = AdminURL; });
         $('#f_revoke').click(onRevoke);
         $('#f_update').click(onUpdate);
+        $('.f_group').change(onGroup);
+        $('#f_introduce').click(onIntroduce);
 });
@@ -0,0 +1,12 @@
+function onFilter(event) {
+        event.preventDefault();
+        window.location = AdminURL + '/logs?lv=' + $('#f_lv').val() +
+                '&sys=' + $.URLEncode($('#f_sys').val()) +
+                '&id=' + $.URLEncode($('#f_id').val()) +
+                '&q=' + $.URLEncode($('#f_q').val());
+}
+
+$(document).ready(function(){
+        mainReady();
+        $('#f_filter').click(onFilter);
+});
@@ -1,4 +1,6 @@
-var AdminURL = 'http://a.5ttt.org'
+// Admin pages are served from a.5ttt.org, or from a.<id>.5ttt.org when
+// Tonika hosts several identities
+var AdminURL = 'http://' + window.location.host
 
 function mainReady() {
         $('#social li').hover(
@@ -14,7 +14,18 @@ function refresh() {
         });
 }
 
+function onReload(event) {
+        event.preventDefault();
+        $.ajax({
+                url: '/api/reload',
+                success: function(data) { $('#f_reloaded').text(data) },
+                error: function() { $('#f_reloaded').text('Reload failed') },
+                dataType: 'text',
+        });
+}
+
 $(document).ready(function(){
         mainReady();
+        $('#f_reload').click(onReload);
         window.setInterval('refresh()', 1000)
 });
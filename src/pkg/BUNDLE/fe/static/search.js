@@ -0,0 +1,15 @@
+function onSearch(event) {
+        event.preventDefault();
+        window.location = AdminURL + '/search?q=' + $.URLEncode($('#f_q').val()) +
+                '&hops=' + $('#f_hops').val();
+}
+
+$(document).ready(function(){
+        mainReady();
+        $('#f_search').click(onSearch);
+        $('#f_q').keypress(function(event) {
+                if (event.which == 13) {
+                        onSearch(event);
+                }
+        });
+});
@@ -29,10 +29,13 @@ import (
 	"tonika/dialer"
 	"tonika/prof"
 	"tonika/routing"
+	"tonika/slog"
 	"tonika/sys"
 	//"tonika/util/term"
 )
 
+var logger = slog.For("compass")
+
 type Compass interface {
 	//QueryMeasure(s,t sys.Id) *sys.Id
 	QueryQuantize(s,t sys.Id) *sys.Id
@@ -43,6 +46,7 @@ type Compass0 struct {
 	d        dialer.Dialer
 	algo     routing.Algorithm
 	liaisons map[sys.Id]*liaison
+	log      *slog.Logger
 	lk       prof.Mutex
 }
 
@@ -57,11 +61,12 @@ const (
 	sweepFrequency = 2 // 2 clock ticks = 2 min
 )
 
-func MakeCompass0(id sys.Id, d dialer.Dialer) *Compass0 {
+func MakeCompass0(id sys.Id, d dialer.Dialer, algo routing.Algorithm) *Compass0 {
 	c := &Compass0{
 		d:        d,
-		algo:     routing.MakeOneHopRouting(id),
+		algo:     algo,
 		liaisons: make(map[sys.Id]*liaison),
+		log:      logger.Local(id),
 	}
 	c.w.Init()
 	go c.connectLoop()
@@ -291,6 +296,24 @@ func (c *Compass0) isHealthy() dialer.Dialer {
 	return c.d
 }
 
+// SetAlgorithm replaces the routing algorithm with algo, which learns of
+// all current neighbors. Algorithms that need a different band setup than
+// the current one cannot be switched to while running.
+func (c *Compass0) SetAlgorithm(algo routing.Algorithm) os.Error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if algo.NeedBand() != c.algo.NeedBand() {
+		return os.ErrorString("compass, algorithm needs a restart")
+	}
+	for id, _ := range c.liaisons {
+		algo.OnAddNeighbor(id)
+	}
+	c.algo = algo
+	c.w.SetSources(c.algo.SourceCount())
+	c.log.Infof("Switched routing algorithm")
+	return nil
+}
+
 func (c *Compass0) ShutDown() {
 	c.lk.Lock()
 	defer c.lk.Unlock()
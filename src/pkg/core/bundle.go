@@ -0,0 +1,513 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"tonika/crypto"
+	"tonika/sys"
+)
+
+// A bundle is a single encrypted file that carries an identity, its friends
+// (with all their keys and metadata) and, optionally, the home directory.
+// It is used to move a Tonika installation to another machine.
+//
+// A bundle is a sealed stream (see crypto.SealWriter) whose text is a JSON
+// line of type jsonBundle followed by the contents of the home files, one
+// after the other, in the order and with the sizes listed in the line. Home
+// directories are never held in memory as a whole.
+
+const (
+	bundleFormat  = "tonika-bundle"
+	bundleVersion = 2
+)
+
+type jsonBundle struct {
+	Format  string
+	Version int
+	Build   string
+	Created int64 // nanoseconds since epoch
+	Db      jsonDb
+	Home    []jsonBundleFile
+}
+
+type jsonBundleFile struct {
+	Path string // relative to the home directory
+	Size int64
+}
+
+// BundleReport describes what an import did, or would do in a dry run
+type BundleReport struct {
+	Id        sys.Id
+	Name      string
+	Friends   int
+	Files     int
+	Conflicts []string
+}
+
+func (r *BundleReport) addConflict(s string) {
+	c := make([]string, len(r.Conflicts)+1)
+	copy(c, r.Conflicts)
+	c[len(r.Conflicts)] = s
+	r.Conflicts = c
+}
+
+// ExportBundle writes the identity file at dbfile (opened with dbpass) into
+// a bundle at out, encrypted with pass. If homedir is not empty, the files
+// under it are included as well. Symbolic links are not followed.
+func ExportBundle(dbfile string, dbpass []byte, homedir string, out string, pass []byte) os.Error {
+	if pass == nil || len(pass) == 0 {
+		return os.ErrorString("bundle, a passphrase is required")
+	}
+	db, err := ReadFriendDb(dbfile, dbpass)
+	if err != nil {
+		return err
+	}
+	b := &jsonBundle{
+		Format:  bundleFormat,
+		Version: bundleVersion,
+		Build:   sys.Build,
+		Created: time.Nanoseconds(),
+		Db:      *db.toJSON(),
+	}
+	if homedir != "" {
+		if b.Home, err = listHomeFiles(homedir, ""); err != nil {
+			return &Error{ErrLoad, err}
+		}
+	}
+	line, err := json.Marshal(b)
+	if err != nil {
+		return &Error{ErrEncode, err}
+	}
+	f, err := os.Open(out, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+	if err != nil {
+		return &Error{ErrSave, err}
+	}
+	err = writeBundle(f, pass, line, homedir, b.Home)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
+
+func writeBundle(f *os.File, pass, line []byte, homedir string, files []jsonBundleFile) os.Error {
+	bw := bufio.NewWriter(f)
+	w, err := crypto.NewSealWriter(bw, pass)
+	if err != nil {
+		return &Error{ErrEncode, err}
+	}
+	if _, err = w.Write(line); err != nil {
+		return &Error{ErrSave, err}
+	}
+	if _, err = w.Write([]byte{'\n'}); err != nil {
+		return &Error{ErrSave, err}
+	}
+	for _, hf := range files {
+		in, err := os.Open(path.Join(homedir, hf.Path), os.O_RDONLY, 0)
+		if err != nil {
+			return &Error{ErrLoad, err}
+		}
+		_, err = io.Copyn(w, in, hf.Size)
+		in.Close()
+		if err != nil {
+			return &Error{ErrLoad, hf.Path + " changed while exporting: " + err.String()}
+		}
+	}
+	if err = w.Close(); err != nil {
+		return &Error{ErrSave, err}
+	}
+	if err = bw.Flush(); err != nil {
+		return &Error{ErrSave, err}
+	}
+	return nil
+}
+
+// ImportBundle restores the bundle at in, encrypted with pass, into the
+// identity file dbfile (saved with dbpass) and into homedir. An existing
+// identity file, whether for the same identity (whose friends would be
+// replaced by those of the bundle) or another one, and existing home files
+// with different content, are conflicts and nothing is written unless
+// force is set. In a dry run, the bundle is validated and the report is
+// returned without writing anything.
+//
+// The bundle is read twice: once to authenticate it and find conflicts, and
+// once to restore it. An existing identity file is backed up before anything
+// is written. Home files are written next to their destination and only
+// renamed into place once the whole bundle has been authenticated; the files
+// they replace are kept aside until the identity file is saved, and put
+// back if anything fails.
+func ImportBundle(in string, pass []byte, dbfile string, dbpass []byte, homedir string,
+	dryrun, force bool) (*BundleReport, os.Error) {
+
+	// First pass
+	var r *BundleReport
+	var db *buttress
+	err := readBundle(in, pass, func(b *jsonBundle, body io.Reader) os.Error {
+		var err os.Error
+		if db, err = checkBundle(b, dbfile, dbpass); err != nil {
+			return err
+		}
+		r = &BundleReport{
+			Id:      db.me.Id,
+			Name:    db.me.Name,
+			Friends: len(db.recs),
+			Files:   len(b.Home),
+		}
+		if isFile(dbfile) {
+			old, err := ReadFriendDb(dbfile, dbpass)
+			switch {
+			case IsPassphraseError(err):
+				r.addConflict("identity file " + dbfile + " exists and is locked")
+			case err != nil:
+				r.addConflict("identity file " + dbfile + " exists and is unreadable")
+			case old.me.Id != db.me.Id:
+				r.addConflict("identity file " + dbfile + " belongs to " + old.me.Id.String())
+			default:
+				r.addConflict(fmt.Sprintf("identity file %s exists; its %d friends "+
+					"would be replaced by the %d of the bundle", dbfile, len(old.recs), len(db.recs)))
+			}
+		}
+		for _, hf := range b.Home {
+			full := "" // the file is read and authenticated all the same
+			if homedir != "" {
+				if err := safeHomeTarget(homedir, hf.Path); err != nil {
+					return &Error{ErrDecode, err}
+				}
+				full = path.Join(homedir, hf.Path)
+			}
+			same, err := sameContent(full, body, hf.Size)
+			if err != nil {
+				return err
+			}
+			if !same {
+				r.addConflict("home file " + hf.Path + " exists with different content")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dryrun || (len(r.Conflicts) > 0 && !force) {
+		return r, nil
+	}
+
+	if isFile(dbfile) {
+		b, err := copyDbBackup(dbfile)
+		if err != nil {
+			return r, &Error{ErrSave, err}
+		}
+		logger.Infof("Identity file \"%s\" backed up to \"%s\"", dbfile, b)
+	}
+
+	// Second pass: stage the home files
+	var parts []string
+	if homedir != "" {
+		err = readBundle(in, pass, func(b *jsonBundle, body io.Reader) os.Error {
+			if len(b.Home) != r.Files {
+				return &Error{ErrDecode, "bundle changed while importing"}
+			}
+			for _, hf := range b.Home {
+				part, err := writePart(homedir, hf, body)
+				if part != "" {
+					parts = appendString(parts, part)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		removeParts(parts)
+		return r, err
+	}
+
+	// Commit
+	if err = installParts(parts); err != nil {
+		return r, err
+	}
+	if err = db.Save(); err != nil {
+		uninstallParts(parts)
+		return r, err
+	}
+	for _, part := range parts {
+		os.Remove(partTarget(part) + bundleOldSuffix)
+	}
+	logger.Infof("Imported identity %s with %d friends and %d files",
+		r.Id.String(), r.Friends, r.Files)
+	return r, nil
+}
+
+const (
+	bundlePartSuffix = ".tonika-import" // a home file being imported
+	bundleOldSuffix  = ".tonika-old"    // a home file being replaced
+)
+
+// partTarget returns the home file that the staged part replaces
+func partTarget(part string) string { return part[0 : len(part)-len(bundlePartSuffix)] }
+
+func removeParts(parts []string) {
+	for _, part := range parts {
+		os.Remove(part)
+	}
+}
+
+// installParts renames the staged parts into place, moving the files they
+// replace aside. If a rename fails, the parts installed so far are undone
+// and the others removed.
+func installParts(parts []string) os.Error {
+	for i, part := range parts {
+		full := partTarget(part)
+		old := full + bundleOldSuffix
+		os.Remove(old) // left by an import that crashed
+		if isFile(full) {
+			if err := os.Rename(full, old); err != nil {
+				uninstallParts(parts[0:i])
+				removeParts(parts[i:])
+				return &Error{ErrSave, err}
+			}
+		}
+		if err := os.Rename(part, full); err != nil {
+			os.Rename(old, full)
+			uninstallParts(parts[0:i])
+			removeParts(parts[i:])
+			return &Error{ErrSave, err}
+		}
+	}
+	return nil
+}
+
+// uninstallParts undoes installParts, putting back the files that were
+// replaced
+func uninstallParts(parts []string) {
+	for _, part := range parts {
+		full := partTarget(part)
+		old := full + bundleOldSuffix
+		if isFile(old) {
+			if err := os.Rename(old, full); err != nil {
+				logger.Errorf("Cannot restore home file \"%s\", it is in \"%s\"", full, old)
+			}
+		} else {
+			os.Remove(full)
+		}
+	}
+}
+
+// readBundle authenticates and parses the bundle at in, and calls f with
+// its JSON line and a reader for the home files that follow. f must read
+// exactly the home files. The bundle is rejected if it was tampered with,
+// after f has returned.
+func readBundle(in string, pass []byte, f func(*jsonBundle, io.Reader) os.Error) os.Error {
+	file, err := os.Open(in, os.O_RDONLY, 0)
+	if err != nil {
+		return &Error{ErrLoad, err}
+	}
+	defer file.Close()
+	sr, err := crypto.NewSealReader(bufio.NewReader(file), pass)
+	if err != nil {
+		return &Error{ErrPass, err}
+	}
+	br := bufio.NewReader(sr)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return &Error{ErrPass, err}
+	}
+	b := &jsonBundle{}
+	if err = json.Unmarshal(line, b); err != nil {
+		return &Error{ErrDecode, err}
+	}
+	if b.Format != bundleFormat {
+		return &Error{ErrDecode, "not a bundle"}
+	}
+	if b.Version != bundleVersion {
+		return &Error{ErrDecode, "bundle made by another build " + b.Build}
+	}
+	for _, hf := range b.Home {
+		if !validHomePath(hf.Path) || hf.Size < 0 {
+			return &Error{ErrDecode, "bad path " + hf.Path}
+		}
+	}
+	if err = f(b, br); err != nil {
+		return err
+	}
+	// Nothing may follow the home files, and the HMAC must match
+	if n, err := br.Read(make([]byte, 1)); n != 0 || err != os.EOF {
+		return &Error{ErrPass, "bundle is corrupt or the passphrase is wrong"}
+	}
+	return nil
+}
+
+// checkBundle parses the identity in b
+func checkBundle(b *jsonBundle, dbfile string, dbpass []byte) (*buttress, os.Error) {
+	if err := migrateDb(&b.Db); err != nil {
+		return nil, err
+	}
+	db, err := parseFriendDb(&b.Db, dbfile, dbpass)
+	if err != nil {
+		return nil, err
+	}
+	if !sys.VerifyKeyAndId(db.me.Id, *db.me.SignatureKey.RsaPubKey()) {
+		return nil, &Error{ErrDecode, "identity does not match its signature key"}
+	}
+	return db, nil
+}
+
+// sameContent reads size bytes from r and returns false if the file full
+// exists with a different content. full may be empty.
+func sameContent(full string, r io.Reader, size int64) (bool, os.Error) {
+	var f *os.File
+	var ferr os.Error = os.ENOENT
+	if full != "" {
+		if f, ferr = os.Open(full, os.O_RDONLY, 0); ferr == nil {
+			defer f.Close()
+		}
+	}
+	same := ferr == nil
+	buf, have := make([]byte, 32*1024), make([]byte, 32*1024)
+	for size > 0 {
+		n := len(buf)
+		if int64(n) > size {
+			n = int(size)
+		}
+		if _, err := io.ReadFull(r, buf[0:n]); err != nil {
+			return false, &Error{ErrPass, "bundle is corrupt or the passphrase is wrong"}
+		}
+		if same {
+			if _, err := io.ReadFull(f, have[0:n]); err != nil || !bytes.Equal(buf[0:n], have[0:n]) {
+				same = false
+			}
+		}
+		size -= int64(n)
+	}
+	if same {
+		// the file must not be longer
+		if n, _ := f.Read(have[0:1]); n != 0 {
+			same = false
+		}
+	}
+	return same || ferr != nil, nil
+}
+
+// writePart copies hf from r next to its destination under homedir, and
+// returns the name of the copy
+func writePart(homedir string, hf jsonBundleFile, r io.Reader) (string, os.Error) {
+	if err := safeHomeTarget(homedir, hf.Path); err != nil {
+		return "", &Error{ErrDecode, err}
+	}
+	full := path.Join(homedir, hf.Path)
+	if err := os.MkdirAll(path.Dir(full), 0700); err != nil {
+		return "", &Error{ErrSave, err}
+	}
+	// MkdirAll follows links, so check again
+	if err := safeHomeTarget(homedir, hf.Path); err != nil {
+		return "", &Error{ErrDecode, err}
+	}
+	part := full + bundlePartSuffix
+	f, err := os.Open(part, os.O_WRONLY|os.O_CREAT|os.O_EXCL, 0600)
+	if err != nil {
+		return "", &Error{ErrSave, err}
+	}
+	_, err = io.Copyn(f, r, hf.Size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return part, &Error{ErrSave, err}
+	}
+	return part, nil
+}
+
+// listHomeFiles recursively lists the regular files in dir/rel. Links are
+// left out.
+func listHomeFiles(dir, rel string) ([]jsonBundleFile, os.Error) {
+	infos, err := ioutil.ReadDir(path.Join(dir, rel))
+	if err != nil {
+		return nil, err
+	}
+	var r []jsonBundleFile
+	for _, fi := range infos {
+		name := path.Join(rel, fi.Name)
+		var more []jsonBundleFile
+		switch {
+		case fi.IsDirectory():
+			if more, err = listHomeFiles(dir, name); err != nil {
+				return nil, err
+			}
+		case fi.IsRegular():
+			more = []jsonBundleFile{jsonBundleFile{name, fi.Size}}
+		}
+		s := make([]jsonBundleFile, len(r)+len(more))
+		copy(s, r)
+		copy(s[len(r):], more)
+		r = s
+	}
+	return r, nil
+}
+
+// validHomePath makes sure a bundle cannot write outside the home directory
+func validHomePath(p string) bool {
+	if p == "" || p[0] == '/' || path.Clean(p) != p {
+		return false
+	}
+	return p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// safeHomeTarget makes sure that writing p under homedir does not go
+// through a link, and that p itself is a regular file if it exists
+func safeHomeTarget(homedir, p string) os.Error {
+	parts := strings.Split(p, "/", -1)
+	cur := homedir
+	for i, part := range parts {
+		cur = path.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if err != nil {
+			return nil // nothing there yet, nor below
+		}
+		last := i == len(parts)-1
+		if (!last && !fi.IsDirectory()) || (last && !fi.IsRegular()) {
+			return os.ErrorString("home path " + p + " goes through a link or special file")
+		}
+	}
+	return nil
+}
+
+func appendString(l []string, s string) []string {
+	r := make([]string, len(l)+1)
+	copy(r, l)
+	r[len(l)] = s
+	return r
+}
+
+func isFile(p string) bool {
+	dir, err := os.Lstat(p)
+	return err == nil && dir != nil && !dir.IsDirectory()
+}
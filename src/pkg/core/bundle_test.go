@@ -0,0 +1,133 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+// testDir returns an empty directory for a test
+func testDir(t *testing.T, name string) string {
+	dir := path.Join(os.TempDir(), name)
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	return dir
+}
+
+// testDb saves a new identity with one friend at p
+func testDb(t *testing.T, p string, pass []byte) *buttress {
+	db, err := MakeFriendDb(p, pass)
+	if err != nil {
+		t.Fatalf("make db: %s", err)
+	}
+	db.Attach(db.UnusedSlot(), &friend{Friend: sys.Friend{Name: "Alice"}})
+	if err = db.Save(); err != nil {
+		t.Fatalf("save db: %s", err)
+	}
+	return db
+}
+
+func writeTestFile(t *testing.T, p, text string) {
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := ioutil.WriteFile(p, []byte(text), 0600); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+}
+
+func checkTestFile(t *testing.T, p, text string) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil || string(data) != text {
+		t.Errorf("%s: expected %q, got %q (%v)", p, text, data, err)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	dir := testDir(t, "tonika-bundle-test")
+	defer os.RemoveAll(dir)
+	pass := []byte("bundle pass")
+	dbfile := path.Join(dir, "db")
+	db := testDb(t, dbfile, []byte("db pass"))
+	home := path.Join(dir, "home")
+	writeTestFile(t, path.Join(home, "a.txt"), "a")
+	writeTestFile(t, path.Join(home, "b/c.txt"), "c")
+	out := path.Join(dir, "bundle")
+	if err := ExportBundle(dbfile, []byte("db pass"), home, out, pass); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+
+	// Round trip into a new place
+	dbfile2, home2 := path.Join(dir, "db2"), path.Join(dir, "home2")
+	r, err := ImportBundle(out, pass, dbfile2, nil, home2, false, false)
+	if err != nil {
+		t.Fatalf("import: %s", err)
+	}
+	if r.Id != db.me.Id || r.Friends != 1 || r.Files != 2 || len(r.Conflicts) != 0 {
+		t.Errorf("bad report %v", r)
+	}
+	db2, err := ReadFriendDb(dbfile2, nil)
+	if err != nil || db2.me.Id != db.me.Id || len(db2.recs) != 1 {
+		t.Fatalf("imported db: %v", err)
+	}
+	checkTestFile(t, path.Join(home2, "a.txt"), "a")
+	checkTestFile(t, path.Join(home2, "b/c.txt"), "c")
+	if _, err = ImportBundle(out, []byte("wrong"), dbfile2, nil, home2, true, false); err == nil {
+		t.Errorf("wrong passphrase accepted")
+	}
+
+	// Conflicts stop an import unless forced
+	writeTestFile(t, path.Join(home2, "a.txt"), "changed")
+	r, err = ImportBundle(out, pass, dbfile2, nil, home2, false, false)
+	if err != nil || len(r.Conflicts) != 2 {
+		t.Fatalf("conflicts: %v %v", r, err)
+	}
+	checkTestFile(t, path.Join(home2, "a.txt"), "changed")
+
+	// A failed save puts the home files back
+	if err = os.Mkdir(dbfile2+".tmp", 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if _, err = ImportBundle(out, pass, dbfile2, nil, home2, false, true); err == nil {
+		t.Fatalf("import over a broken save")
+	}
+	checkTestFile(t, path.Join(home2, "a.txt"), "changed")
+	for _, p := range []string{"a.txt" + bundlePartSuffix, "a.txt" + bundleOldSuffix} {
+		if isFile(path.Join(home2, p)) {
+			t.Errorf("%s left behind", p)
+		}
+	}
+	os.Remove(dbfile2 + ".tmp")
+
+	// A forced import backs up the identity file first
+	for _, b := range listDbBackups(dbfile2) {
+		os.Remove(b)
+	}
+	if _, err = ImportBundle(out, pass, dbfile2, nil, home2, false, true); err != nil {
+		t.Fatalf("forced import: %s", err)
+	}
+	checkTestFile(t, path.Join(home2, "a.txt"), "a")
+	if len(listDbBackups(dbfile2)) != 1 {
+		t.Errorf("no backup of the identity file")
+	}
+}
@@ -0,0 +1,423 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"tonika/http"
+	"tonika/routing"
+	"tonika/slog"
+	"tonika/sys"
+)
+
+// Config holds the settings of the daemon. It is read from a json file, in
+// which any field may be left out to keep its default. Reloading the file
+// (see ReloadConfig) applies changes to the running subsystems; the
+// identity file, the cache and Front End directories and the update URL
+// are only read at startup.
+type Config struct {
+	Addr     string // address the dialer listens on
+	DbFile   string // identity file
+	HomeDir  string // published files
+	CacheDir string
+	FEDir    string // Front End templates and static files
+	FEAddr   string // address of the Front End web proxy
+	FEAllow  string // comma-separated hosts allowed to use the Front End
+
+	DialerFDLimit   int
+	VaultFDLimit    int
+	FEServerFDLimit int
+	FEClientFDLimit int
+
+	VaultCacheSize int64 // bytes of friends' vault content kept; 0 turns caching off
+
+	InboxDir   string // folder of HomeDir friends upload into; empty turns uploads off
+	InboxGroup string // group of the friends who may upload
+	InboxQuota int64  // bytes each friend may upload
+
+	MonitorURL       string // empty turns monitor reports off
+	MonitorFrequency int64  // seconds between monitor reports
+	UpdateURL        string // asked at startup whether this build may run
+
+	Routing string // routing algorithm, see routing.MakeAlgorithm
+
+	ShutdownTimeout int64 // seconds to wait for subsystems on shutdown
+
+	LogLevel   string // least level logged: debug, info, warn or error
+	LogMaxSize int64  // bytes after which a new log file is started
+	LogMaxAge  int64  // seconds after which a new log file is started
+	LogKeep    int    // number of log files kept
+
+	Identities []*IdentityConfig // further identities hosted by this process
+}
+
+// IdentityConfig holds the settings of an identity hosted next to the main
+// one. It runs its own dialer, vault and compass, and has its admin pages at
+// a.<id>.5ttt.org on the shared Front End. All other settings are taken from
+// the main Config.
+type IdentityConfig struct {
+	DbFile   string // identity file
+	Addr     string // address its dialer listens on, a random port if empty
+	HomeDir  string // its published files
+	CacheDir string // defaults to CacheDir/<name of DbFile>
+	PassFile string // holds the passphrase of DbFile, if it is encrypted
+}
+
+// identityConfig returns the settings of the i-th extra identity
+func (cfg *Config) identityConfig(i int) *Config {
+	ic := cfg.Identities[i]
+	r := *cfg
+	r.Identities = nil
+	r.DbFile, r.Addr, r.HomeDir, r.CacheDir = ic.DbFile, ic.Addr, ic.HomeDir, ic.CacheDir
+	if r.CacheDir == "" {
+		r.CacheDir = path.Join(cfg.CacheDir, path.Base(ic.DbFile))
+	}
+	return &r
+}
+
+// DefaultConfig returns the settings used for fields a config file leaves out
+func DefaultConfig() *Config {
+	return &Config{
+		DbFile:           "MyTonikaIdentity",
+		FEDir:            "fe",
+		FEAddr:           ":4949",
+		FEAllow:          "127.0.0.1,::1",
+		DialerFDLimit:    100,
+		VaultFDLimit:     30,
+		FEServerFDLimit:  100,
+		FEClientFDLimit:  60,
+		VaultCacheSize:   100 * 1024 * 1024,
+		InboxDir:         "inbox",
+		InboxGroup:       "upload",
+		InboxQuota:       100 * 1024 * 1024,
+		MonitorURL:       sys.MonitorServerURL,
+		MonitorFrequency: sys.MonitorFrequency / 1e9,
+		UpdateURL:        sys.TangraServerURL,
+		Routing:          "onehop",
+		ShutdownTimeout:  10,
+		LogLevel:         "info",
+		LogMaxSize:       10 * 1024 * 1024,
+		LogMaxAge:        24 * 60 * 60,
+		LogKeep:          7,
+	}
+}
+
+// ReadConfig overlays the settings in the json file at path onto cfg
+func ReadConfig(path string, cfg *Config) os.Error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return &Error{ErrLoad, err}
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return &Error{ErrDecode, err}
+	}
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+	return cfg.checkIdentities()
+}
+
+// checkIdentities makes sure that no two identity files hold the same
+// identity. Encrypted files cannot be read yet; MakeCore checks them once
+// they are unlocked.
+func (cfg *Config) checkIdentities() os.Error {
+	seen := make(map[string]string)
+	files := make([]string, len(cfg.Identities)+1)
+	files[0] = cfg.DbFile
+	for i, ic := range cfg.Identities {
+		files[i+1] = ic.DbFile
+	}
+	for _, f := range files {
+		id := peekFriendDbId(f)
+		if id == "" {
+			continue
+		}
+		if g, ok := seen[id]; ok {
+			return os.ErrorString("config, " + g + " and " + f + " hold the same identity " + id)
+		}
+		seen[id] = f
+	}
+	return nil
+}
+
+// Validate checks that the settings make sense
+func (cfg *Config) Validate() os.Error {
+	if cfg.Addr != "" && !validListenAddr(cfg.Addr) {
+		return os.ErrorString("config, bad Addr " + cfg.Addr)
+	}
+	if !validListenAddr(cfg.FEAddr) {
+		return os.ErrorString("config, bad FEAddr " + cfg.FEAddr)
+	}
+	if cfg.DbFile == "" {
+		return os.ErrorString("config, DbFile missing")
+	}
+	if cfg.DialerFDLimit <= 0 || cfg.VaultFDLimit <= 0 ||
+		cfg.FEServerFDLimit <= 0 || cfg.FEClientFDLimit <= 0 {
+		return os.ErrorString("config, file descriptor limits must be positive")
+	}
+	if cfg.VaultCacheSize < 0 {
+		return os.ErrorString("config, VaultCacheSize must not be negative")
+	}
+	if cfg.InboxDir != "" {
+		d := path.Clean(cfg.InboxDir)
+		if d == "." || d == ".." || d[0] == '/' || strings.HasPrefix(d, "../") {
+			return os.ErrorString("config, InboxDir must be a folder inside HomeDir")
+		}
+	}
+	if cfg.InboxQuota < 0 {
+		return os.ErrorString("config, InboxQuota must not be negative")
+	}
+	if cfg.UpdateURL != "" {
+		u, err := http.ParseURL(cfg.UpdateURL)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return os.ErrorString("config, bad UpdateURL " + cfg.UpdateURL)
+		}
+	}
+	if cfg.MonitorFrequency <= 0 {
+		return os.ErrorString("config, MonitorFrequency must be positive")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return os.ErrorString("config, ShutdownTimeout must not be negative")
+	}
+	if _, err := slog.ParseLevel(cfg.LogLevel); err != nil {
+		return os.ErrorString("config, unknown LogLevel " + cfg.LogLevel)
+	}
+	if cfg.LogMaxSize <= 0 || cfg.LogMaxAge <= 0 || cfg.LogKeep <= 0 {
+		return os.ErrorString("config, LogMaxSize, LogMaxAge and LogKeep must be positive")
+	}
+	if _, err := routing.MakeAlgorithm(cfg.Routing, 0); err != nil {
+		return os.ErrorString("config, unknown Routing " + cfg.Routing)
+	}
+	dbs := map[string]bool{cfg.DbFile: true}
+	addrs := map[string]bool{cfg.Addr: cfg.Addr != ""}
+	caches := map[string]bool{cfg.CacheDir: true}
+	for i, ic := range cfg.Identities {
+		if ic == nil || ic.DbFile == "" {
+			return os.ErrorString("config, identity " + strconv.Itoa(i) + " has no DbFile")
+		}
+		if dbs[ic.DbFile] {
+			return os.ErrorString("config, identity file used twice " + ic.DbFile)
+		}
+		dbs[ic.DbFile] = true
+		if ic.Addr != "" {
+			if !validListenAddr(ic.Addr) || addrs[ic.Addr] {
+				return os.ErrorString("config, bad or repeated Addr " + ic.Addr)
+			}
+			addrs[ic.Addr] = true
+		}
+		if ic.HomeDir == "" {
+			return os.ErrorString("config, identity " + ic.DbFile + " has no HomeDir")
+		}
+		c := cfg.identityConfig(i).CacheDir
+		if caches[c] {
+			return os.ErrorString("config, cache directory used twice " + c)
+		}
+		caches[c] = true
+	}
+	return nil
+}
+
+// validListenAddr accepts host:port, where the host may be empty
+func validListenAddr(addr string) bool {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return false
+	}
+	p, err := strconv.Atoi(addr[i+1:])
+	return err == nil && p > 0 && p < 65536
+}
+
+// ReloadConfig re-reads the config file the core was started with and
+// applies what changed to the running subsystems of all identities
+func (c *Core) ReloadConfig() os.Error {
+	if c.host != nil {
+		return c.host.ReloadConfig()
+	}
+	c.cfglk.Lock()
+	defer c.cfglk.Unlock()
+	if c.cfgfile == "" {
+		return os.ErrorString("config, no config file")
+	}
+	cfg := DefaultConfig()
+	err := ReadConfig(c.cfgfile, cfg)
+	if err == nil && c.override != nil {
+		c.override(cfg)
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logger.Errorf("Config not reloaded: %s", err)
+		return err
+	}
+	err = c.applyConfig(cfg)
+	if err != nil {
+		logger.Warnf("Config partially reloaded: %s", err)
+		c.publish(sys.EvConfigReloaded, sys.MySlot, "partially: " + err.String())
+		return err
+	}
+	c.publish(sys.EvConfigReloaded, sys.MySlot, c.cfgfile)
+	return nil
+}
+
+// applyConfig adjusts the subsystems to cfg. Settings are applied one by one,
+// and the first failure is returned after trying the rest.
+func (c *Core) applyConfig(cfg *Config) os.Error {
+	old := c.cfg
+	var first os.Error
+	fail := func(err os.Error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	fail(c.applyStack(cfg, old))
+	fail(c.applyFE(cfg, old))
+	fail(c.applyPeers(cfg, old))
+	c.cfg = cfg
+	return first
+}
+
+// applyStack adjusts the dialer, vault, compass and monitor of one identity
+func (c *Core) applyStack(cfg, old *Config) os.Error {
+	var first os.Error
+	fail := func(err os.Error) {
+		if first == nil {
+			first = err
+		}
+	}
+	if cfg.Addr != old.Addr && cfg.Addr != "" {
+		c.lk.Lock()
+		me := c.db.GetMe()
+		err := c.dialer.Bind(me, cfg.Addr)
+		if err == nil {
+			me.Addr = cfg.Addr
+			c.db.Save()
+		}
+		c.lk.Unlock()
+		if err != nil {
+			c.publish(sys.EvDialerError, sys.MySlot, 
+				"cannot bind to " + cfg.Addr + ": " + err.String())
+			fail(err)
+			cfg.Addr = old.Addr
+		}
+	}
+	if cfg.DialerFDLimit != old.DialerFDLimit {
+		c.dialer.SetFDLimit(cfg.DialerFDLimit)
+	}
+	if cfg.VaultFDLimit != old.VaultFDLimit {
+		c.vault.SetFDLimit(cfg.VaultFDLimit)
+	}
+	if cfg.VaultCacheSize != old.VaultCacheSize {
+		c.vault.SetCacheSize(cfg.VaultCacheSize)
+	}
+	if cfg.InboxDir != old.InboxDir || cfg.InboxGroup != old.InboxGroup ||
+		cfg.InboxQuota != old.InboxQuota {
+		fail(c.vault.SetInbox(cfg.InboxDir, cfg.InboxGroup, cfg.InboxQuota))
+	}
+	if cfg.HomeDir != old.HomeDir {
+		if err := c.vault.SetHomeDir(cfg.HomeDir); err != nil {
+			fail(err)
+			cfg.HomeDir = old.HomeDir
+		}
+	}
+	if cfg.MonitorURL != old.MonitorURL || cfg.MonitorFrequency != old.MonitorFrequency {
+		if err := c.monitor.SetReport(cfg.MonitorURL, cfg.MonitorFrequency*1e9); err != nil {
+			fail(err)
+			cfg.MonitorURL, cfg.MonitorFrequency = old.MonitorURL, old.MonitorFrequency
+		}
+	}
+	if cfg.Routing != old.Routing {
+		algo, err := routing.MakeAlgorithm(cfg.Routing, c.GetMyId())
+		if err == nil {
+			err = c.compass.SetAlgorithm(algo)
+		}
+		if err != nil {
+			fail(err)
+			cfg.Routing = old.Routing
+		}
+	}
+	if cfg.DbFile != old.DbFile || cfg.CacheDir != old.CacheDir {
+		c.log.Infof("Changes to DbFile and CacheDir take effect on restart")
+		cfg.DbFile, cfg.CacheDir = old.DbFile, old.CacheDir
+	}
+	c.applyLog(cfg, old)
+	return first
+}
+
+// applyFE adjusts the shared Front End
+func (c *Core) applyFE(cfg, old *Config) os.Error {
+	var first os.Error
+	if cfg.FEAddr != old.FEAddr {
+		if err := c.fe.Rebind(cfg.FEAddr); err != nil {
+			first = err
+			cfg.FEAddr = old.FEAddr
+		}
+	}
+	if cfg.FEAllow != old.FEAllow {
+		c.fe.SetAllow(cfg.FEAllow)
+	}
+	if cfg.FEServerFDLimit != old.FEServerFDLimit || cfg.FEClientFDLimit != old.FEClientFDLimit {
+		c.fe.SetFDLimits(cfg.FEServerFDLimit, cfg.FEClientFDLimit)
+	}
+	if cfg.FEDir != old.FEDir || cfg.UpdateURL != old.UpdateURL {
+		logger.Infof("Changes to FEDir and UpdateURL take effect on restart")
+		cfg.FEDir, cfg.UpdateURL = old.FEDir, old.UpdateURL
+	}
+	return first
+}
+
+// applyLog adjusts the level and rotation of the log of one identity
+func (c *Core) applyLog(cfg, old *Config) {
+	s := c.logSink()
+	if cfg.LogLevel != old.LogLevel {
+		l, _ := slog.ParseLevel(cfg.LogLevel)
+		s.SetLevel(l)
+	}
+	if cfg.LogMaxSize != old.LogMaxSize || cfg.LogMaxAge != old.LogMaxAge ||
+		cfg.LogKeep != old.LogKeep {
+		s.SetRotation(cfg.LogMaxSize, cfg.LogMaxAge*1e9, cfg.LogKeep)
+	}
+}
+
+// applyPeers adjusts the other identities. Adding or removing identities
+// takes effect on restart.
+func (c *Core) applyPeers(cfg, old *Config) os.Error {
+	same := len(cfg.Identities) == len(old.Identities)
+	for i := 0; same && i < len(cfg.Identities); i++ {
+		same = cfg.Identities[i].DbFile == old.Identities[i].DbFile
+	}
+	if !same {
+		logger.Infof("Changes to the list of Identities take effect on restart")
+		cfg.Identities = old.Identities
+		return nil
+	}
+	var first os.Error
+	for i, p := range c.peers {
+		pcfg := cfg.identityConfig(i)
+		if err := p.applyStack(pcfg, p.cfg); err != nil && first == nil {
+			first = err
+		}
+		p.cfg = pcfg
+		ic := *cfg.Identities[i]
+		ic.Addr, ic.HomeDir = pcfg.Addr, pcfg.HomeDir
+		cfg.Identities[i] = &ic
+	}
+	return first
+}
@@ -0,0 +1,114 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		set func(cfg *Config)
+		ok  bool
+	}{
+		{func(cfg *Config) {}, true},
+		{func(cfg *Config) { cfg.Addr = ":9000" }, true},
+		{func(cfg *Config) { cfg.Addr = "nowhere" }, false},
+		{func(cfg *Config) { cfg.FEAddr = ":70000" }, false},
+		{func(cfg *Config) { cfg.DbFile = "" }, false},
+		{func(cfg *Config) { cfg.VaultFDLimit = 0 }, false},
+		{func(cfg *Config) { cfg.VaultCacheSize = 0 }, true},
+		{func(cfg *Config) { cfg.VaultCacheSize = -1 }, false},
+		{func(cfg *Config) { cfg.InboxDir = "" }, true},
+		{func(cfg *Config) { cfg.InboxDir = "../up" }, false},
+		{func(cfg *Config) { cfg.InboxDir = "/up" }, false},
+		{func(cfg *Config) { cfg.InboxDir = "." }, false},
+		{func(cfg *Config) { cfg.InboxQuota = -1 }, false},
+		{func(cfg *Config) { cfg.UpdateURL = "" }, true},
+		{func(cfg *Config) { cfg.UpdateURL = "ftp://5ttt.org/" }, false},
+		{func(cfg *Config) { cfg.MonitorFrequency = 0 }, false},
+		{func(cfg *Config) { cfg.ShutdownTimeout = -1 }, false},
+		{func(cfg *Config) { cfg.LogLevel = "loud" }, false},
+		{func(cfg *Config) { cfg.LogKeep = 0 }, false},
+		{func(cfg *Config) { cfg.Routing = "nowhere" }, false},
+		{func(cfg *Config) {
+			cfg.Identities = []*IdentityConfig{&IdentityConfig{DbFile: "b", HomeDir: "hb"}}
+		}, true},
+		{func(cfg *Config) {
+			cfg.Identities = []*IdentityConfig{&IdentityConfig{DbFile: "b"}}
+		}, false},
+		{func(cfg *Config) {
+			cfg.Identities = []*IdentityConfig{&IdentityConfig{DbFile: cfg.DbFile, HomeDir: "hb"}}
+		}, false},
+		{func(cfg *Config) {
+			cfg.Addr = ":9000"
+			cfg.Identities = []*IdentityConfig{&IdentityConfig{DbFile: "b", HomeDir: "hb",
+				Addr: ":9000"}}
+		}, false},
+		{func(cfg *Config) {
+			cfg.CacheDir = "cache"
+			cfg.Identities = []*IdentityConfig{&IdentityConfig{DbFile: "b", HomeDir: "hb",
+				CacheDir: "cache"}}
+		}, false},
+		{func(cfg *Config) {
+			cfg.Identities = []*IdentityConfig{nil}
+		}, false},
+	}
+	for i, tt := range tests {
+		cfg := DefaultConfig()
+		tt.set(cfg)
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d: expected ok=%v, got %v", i, tt.ok, err)
+		}
+	}
+}
+
+func TestReloadConfigKeepsOld(t *testing.T) {
+	dir := testDir(t, "tonika-config-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "config")
+	old := DefaultConfig()
+	c := testCore(nil)
+	c.cfg, c.cfgfile = old, p
+
+	bad := []string{
+		"",
+		"{\"LogLevel\": ",
+		"{\"LogLevel\": \"loud\"}",
+		"{\"Identities\": [{\"DbFile\": \"MyTonikaIdentity\", \"HomeDir\": \"h\"}]}",
+	}
+	for i, text := range bad {
+		if i > 0 {
+			writeTestFile(t, p, text)
+		}
+		if err := c.ReloadConfig(); err == nil {
+			t.Errorf("%d: bad config reloaded", i)
+		}
+		if c.cfg != old {
+			t.Errorf("%d: config replaced", i)
+		}
+	}
+
+	// A good file made bad by the override
+	writeTestFile(t, p, "{\"LogLevel\": \"debug\"}")
+	c.override = func(cfg *Config) { cfg.LogKeep = 0 }
+	if err := c.ReloadConfig(); err == nil || c.cfg != old {
+		t.Errorf("config broken by the override reloaded")
+	}
+}
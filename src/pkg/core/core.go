@@ -19,18 +19,19 @@ package core
 
 import (
 	//"json"
-	"log"
 	"os"
 	"path"
 	"rand"
 	"strconv"
-	//"sync"
+	"sync"
 	"time"
 	"tonika/sys"
 	"tonika/monitor"
 	"tonika/dialer"
 	"tonika/compass"
 	"tonika/prof"
+	"tonika/routing"
+	"tonika/slog"
 	"tonika/vault"
 	"tonika/fe"
 )
@@ -46,60 +47,194 @@ type Core struct {
 	dialer  *dialer.Dialer0
 	compass *compass.Compass0
 	vault   *vault.Vault0
-	fe      *fe.FrontEnd
+	fe      *fe.FrontEnd // shared by all identities
+	guard   *sys.EnvelopeGuard
+	bus     *sys.EventBus
+	evlog   *eventLog
+	logpath string
+	log     *slog.Logger // tags records with this identity
+	sink    *slog.Sink   // for peers, the sink of their records
+	stopped bool
 	lk      prof.Mutex
+
+	cfg      *Config
+	cfgfile  string
+	override func(*Config)
+	cfglk    sync.Mutex // serializes reloads
+	peers    []*Core    // the other identities in this process, see Config.Identities
+	host     *Core      // for peers, the core that hosts them
 }
 
 type Args struct {
-	Addr     string
-	DbFile   string
-	HomeDir  string
-	CacheDir string
-	FEDir    string
-	FEAddr   string
-	FEAllow  string
+	Config
+	ConfigFile string         // where Config was read from, for reloads
+	Override   func(*Config) // applied to Config after every reload
+	Pass       []byte         // passphrase of the friends file, nil if not encrypted
+	Passes     [][]byte       // passphrases of Config.Identities, in order
 }
 
+// MakeCore starts the identity in args.DbFile, as well as every identity in
+// args.Identities. Each identity runs its own dialer, compass and vault, and
+// they share one Front End. The returned core stands for all of them.
 func MakeCore(args *Args) (core *Core, err os.Error) {
+	cfg := args.Config
+	if err = openLog(&cfg, slog.Shared()); err != nil {
+		return nil, err
+	}
+	c, err := makeCore(&cfg, args.Pass, false)
+	if err != nil {
+		return nil, err
+	}
+	c.logpath = path.Join(cfg.CacheDir, "tonika.prof")
+	c.cfgfile = args.ConfigFile
+	c.override = args.Override
+	c.peers = make([]*Core, len(cfg.Identities))
+	for i := range cfg.Identities {
+		pcfg := cfg.identityConfig(i)
+		if err = os.MkdirAll(pcfg.CacheDir, 0700); err != nil {
+			logger.Errorf("Problem making cache directory %s: %s", pcfg.CacheDir, err)
+			return nil, err
+		}
+		var pass []byte
+		if i < len(args.Passes) {
+			pass = args.Passes[i]
+		}
+		c.peers[i], err = makeCore(pcfg, pass, true)
+		if err != nil {
+			logger.Errorf("Problem starting identity %s: %s", pcfg.DbFile, err)
+			c.peers = c.peers[0:i]
+			c.abandonAll()
+			return nil, err
+		}
+		c.peers[i].host = c
+		for _, k := range c.all()[0 : i+1] {
+			if k.db.GetMe().Id == c.peers[i].db.GetMe().Id {
+				logger.Errorf("Identity file %s holds the same identity as %s",
+					pcfg.DbFile, k.cfg.DbFile)
+				c.peers = c.peers[0 : i+1]
+				c.abandonAll()
+				return nil, os.ErrorString("identity files with the same identity")
+			}
+		}
+	}
+
+	// Front End
+	fe, err := fe.MakeFrontEnd(cfg.FEDir+"/tmpl", cfg.FEDir+"/static", 
+		cfg.FEAddr, cfg.FEAllow, cfg.FEServerFDLimit, cfg.FEClientFDLimit)
+	if err != nil {
+		logger.Errorf("Problem starting Front End System: %s", err)
+		c.abandonAll()
+		return nil, err
+	}
+	for _, k := range c.all() {
+		k.lk.Lock()
+		k.fe = fe
+		k.lk.Unlock()
+		fe.AddIdentity(k, k.vault)
+	}
+	if err = fe.SetDownloadDir(path.Join(cfg.CacheDir, "downloads")); err != nil {
+		logger.Warnf("Problem with the download directory: %s", err)
+	}
+
+	for _, k := range c.all() {
+		k.start()
+	}
+	go c.logLoop(c.logpath)
+	return c, nil
+}
+
+// makeCore brings up the dialer, compass and vault of one identity. The
+// records of a peer are kept in a log of their own, in its cache directory.
+func makeCore(cfg *Config, pass []byte, peer bool) (core *Core, err os.Error) {
 	// Db
-	db, err := ReadFriendDb(args.DbFile)
+	db, err := LoadFriendDb(cfg.DbFile, pass)
+	if IsPassphraseError(err) {
+		logger.Errorf("Friends file is encrypted and could not be unlocked")
+		return nil, err
+	}
+	if IsNewerError(err) {
+		logger.Errorf("Friends file was written by a newer version of Tonika, please update")
+		return nil, err
+	}
+	if e, ok := err.(*Error); ok && e.no == ErrCorrupt {
+		logger.Errorf("Friends file is damaged, refusing to make a new identity over it")
+		return nil, err
+	}
 	if err != nil {
-		log.Stderrf("Friends file is either missing or corrupt, making new one")
-		db, err = MakeFriendDb(args.DbFile)
+		logger.Infof("Friends file is missing, making new one")
+		db, err = MakeFriendDb(cfg.DbFile, pass)
 		if err != nil {
-			log.Stderrf("Couldn't create the friends file, sorry mate")
+			logger.Errorf("Couldn't create the friends file, sorry mate")
 			return nil, err
 		}
 	}
 	me := db.GetMe()
-	if args.Addr != "" {
-		me.Addr = args.Addr
+
+	// Log
+	log := logger.Local(*me.GetId())
+	var sink *slog.Sink
+	if peer {
+		sink = slog.Open(*me.GetId())
+		if err = openLog(cfg, sink); err != nil {
+			logger.Errorf("Problem opening the log of %s: %s", cfg.DbFile, err)
+			sink.Close()
+			return nil, err
+		}
+	}
+	closeSink := func() {
+		if sink != nil {
+			sink.Close()
+		}
+	}
+
+	if cfg.Addr != "" {
+		me.Addr = cfg.Addr
 	}
 	if me.Addr == "" {
 		port := 20000 + rand.Intn(20000)
-		log.Stderrf("Tonika: Bounding Tonika to localhost port %d", port)
+		log.Infof("Bounding Tonika to localhost port %d", port)
 		me.Addr = ":" + strconv.Itoa(port)
 		if err = db.Save(); err != nil {
-			log.Stderrf("We failed to save your friend file")
+			log.Errorf("We failed to save your friend file")
+			closeSink()
 			return nil, err
 		}
 	}
 
+	// Events
+	bus, evlog := makeEventBus(path.Join(cfg.CacheDir, "events.log"))
+
 	// Dialer
-	dialer, err := dialer.MakeDialer0(me, me.Addr, 100) // limit file descriptors to 100
+	dialer, err := dialer.MakeDialer0(me, me.Addr, cfg.DialerFDLimit)
 	if err != nil {
-		log.Stderrf("Problem starting the Dialer System: %s\n", err)
+		log.Errorf("Problem starting the Dialer System: %s", err)
+		bus.Publish(&sys.Event{Topic: sys.EvDialerError, Slot: sys.MySlot, 
+			Msg: "cannot bind to " + me.Addr + ": " + err.String()})
+		evlog.Close()
+		closeSink()
 		return nil, err
 	}
 
 	// Compass
-	compass := compass.MakeCompass0(*me.GetId(), dialer)
+	algo, err := routing.MakeAlgorithm(cfg.Routing, *me.GetId())
+	if err != nil {
+		log.Errorf("Problem starting the Compass System: %s", err)
+		dialer.Shutdown(0)
+		evlog.Close()
+		closeSink()
+		return nil, err
+	}
+	compass := compass.MakeCompass0(*me.GetId(), dialer, algo)
 
 	// Vault
-	vault, err := vault.MakeVault0(*me.GetId(), args.HomeDir,
-		args.CacheDir, 30, dialer, compass)
+	vault, err := vault.MakeVault0(*me.GetId(), cfg.HomeDir,
+		cfg.CacheDir, cfg.VaultFDLimit, dialer, compass)
 	if err != nil {
-		log.Stderrf("Problem starting Vault System: %s\n", err)
+		log.Errorf("Problem starting Vault System: %s", err)
+		compass.ShutDown()
+		dialer.Shutdown(0)
+		evlog.Close()
+		closeSink()
 		return nil, err
 	}
 
@@ -110,29 +245,72 @@ func MakeCore(args *Args) (core *Core, err os.Error) {
 		dialer:  dialer,
 		compass: compass,
 		vault:   vault,
+		guard:   sys.MakeEnvelopeGuard(path.Join(cfg.CacheDir, "envelopes.seen")),
+		bus:     bus,
+		evlog:   evlog,
+		log:     log,
+		sink:    sink,
+	}
+	mycfg := *cfg
+	mycfg.Addr = me.Addr
+	c.cfg = &mycfg
+	vault.SetGroups(c)
+	vault.SetCacheSize(cfg.VaultCacheSize)
+	vault.SetSigKey(me.GetSignatureKey())
+	vault.SetNeighbors(c)
+	if err = vault.SetInbox(cfg.InboxDir, cfg.InboxGroup, cfg.InboxQuota); err != nil {
+		log.Errorf("Problem setting up the vault inbox: %s", err)
+		c.abandon()
+		return nil, err
 	}
 
 	// Monitor
-	c.monitor = monitor.MakeMonitor(c, sys.MonitorServerURL, sys.MonitorFrequency)
-
-	myid := c.GetMyId()
-	c.lk.Lock() // Block usage of methods until we exit from init
-
-	// Front End
-	fe, err := fe.MakeFrontEnd(args.FEDir+"/tmpl", args.FEDir+"/static", 
-		args.FEAddr, args.FEAllow, c, vault, myid)
+	c.monitor, err = monitor.MakeMonitor(c, cfg.MonitorURL, cfg.MonitorFrequency*1e9)
 	if err != nil {
-		log.Stderrf("Problem starting Front End System: %s\n", err)
+		log.Errorf("Problem starting the Monitor: %s", err)
+		c.abandon()
 		return nil, err
 	}
-	c.fe = fe
-	c.lk.Unlock()
+	return c, nil
+}
+
+// abandon tears down an identity that was made but never started, so that
+// its port and descriptors are freed
+func (c *Core) abandon() {
+	c.compass.ShutDown()
+	c.vault.ShutDown()
+	c.dialer.Shutdown(0)
+	c.evlog.Close()
+	if c.sink != nil {
+		c.sink.Close()
+	}
+}
+
+// abandonAll abandons the host and the peers made so far, when another
+// identity could not be brought up
+func (c *Core) abandonAll() {
+	for _, k := range c.all() {
+		k.abandon()
+	}
+}
+
+// start hands the friends to the dialer and starts the loops of an identity
+func (c *Core) start() {
 	c.syncAll()
 	c.Save()
-	
-	go c.logLoop(path.Join(args.CacheDir, "tonika.log"))
 	go c.loop()
-	return c, nil
+	go c.revokeLoop()
+	go c.introLoop()
+	go c.errorLoop(sys.EvDialerError, func() os.Error { return c.dialer.WaitForError() })
+	go c.errorLoop(sys.EvVaultError, func() os.Error { return c.vault.WaitForError() })
+}
+
+// all returns c followed by the other identities hosted with it
+func (c *Core) all() []*Core {
+	r := make([]*Core, len(c.peers)+1)
+	r[0] = c
+	copy(r[1:], c.peers)
+	return r
 }
 
 func (c *Core) loop() {
@@ -143,8 +321,13 @@ func (c *Core) loop() {
 		su := d.WaitForStatus()
 		c.lk.Lock()
 		r := c.db.GetById(su.Id)
-		if r != nil {
+		if r != nil && r.IsOnline() != su.Online {
 			r.SetOnline(su.Online)
+			if su.Online {
+				c.publish(sys.EvFriendOnline, r.Slot, r.Name)
+			} else {
+				c.publish(sys.EvFriendOffline, r.Slot, r.Name)
+			}
 		}
 		c.lk.Unlock()
 	}
@@ -167,6 +350,12 @@ func (c *Core) GetMyId() sys.Id {
 	return (*c.db.GetMe().GetId())
 }
 
+func (c *Core) GetMyFingerprint() *sys.Fingerprint {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.GetMe().GetFingerprint()
+}
+
 func (c *Core) GetMySignatureKey() *sys.SigPubKey {
 	c.lk.Lock()
 	defer c.lk.Unlock()
@@ -197,35 +386,30 @@ func (c *Core) GetMyExtAddr() string {
 	return c.db.GetMe().GetExtAddr()
 }
 
-func (c *Core) SetMy(key string, v interface{}) {
+func (c *Core) GetBySlot(slot int) (sys.View, os.Error) {
 	c.lk.Lock()
 	defer c.lk.Unlock()
-	switch key {
-	case "Name":
-		c.db.GetMe().Name = v.(string)
-	case "Email":
-		c.db.GetMe().Email = v.(string)
-	case "ExtAddr":
-		c.db.GetMe().ExtAddr = v.(string)
-	default:
-		panic("logic")
+	r := c.db.GetBySlot(slot)
+	if r != nil {
+		return r, nil
 	}
+	return nil, os.EINVAL
 }
 
-func (c *Core) GetBySlot(slot int) (sys.View, os.Error) {
+func (c *Core) GetById(id sys.Id) (sys.View, os.Error) {
 	c.lk.Lock()
 	defer c.lk.Unlock()
-	r := c.db.GetBySlot(slot)
+	r := c.db.GetById(id)
 	if r != nil {
 		return r, nil
 	}
 	return nil, os.EINVAL
 }
 
-func (c *Core) GetById(id sys.Id) (sys.View, os.Error) {
+func (c *Core) GetByFingerprint(fp *sys.Fingerprint) (sys.View, os.Error) {
 	c.lk.Lock()
 	defer c.lk.Unlock()
-	r := c.db.GetById(id)
+	r := c.db.GetByFingerprint(fp)
 	if r != nil {
 		return r, nil
 	}
@@ -260,6 +444,7 @@ func (c *Core) Revoke(slot int) {
 		return
 	}
 	c.db.Remove(slot)
+	c.publish(sys.EvFriendRemoved, slot, f.Name)
 	if f.GetId() != nil {
 		c.dialer.Revoke(*f.GetId())
 	}
@@ -275,64 +460,101 @@ func (c *Core) Reserve() sys.View {
 	c.lk.Lock()
 	defer c.lk.Unlock()
 	slot := c.db.UnusedSlot()
-	f := &friend{sys.Friend{Slot: slot},false}
+	f := &friend{Friend: sys.Friend{Slot: slot}}
 	f.Init()
 	if c.db.Attach(slot, f) != nil {
 		panic("c")
 	}
+	c.publish(sys.EvFriendAdded, slot, "")
 	return f
 }
 
-// TODO: Note that dialkey, etc. are passed on as *DialKey, *SigKey, etc.
-func (c *Core) Write(slot int, key string, v interface{}) (sys.View, os.Error) {
+func (c *Core) Save() {
 	c.lk.Lock()
 	defer c.lk.Unlock()
-	f := c.db.GetBySlot(slot)
-	if f == nil {
-		return nil, os.EINVAL
-	}
-	switch key {
-	case "Name":
-		f.Name = v.(string)
-	case "Email":
-		f.Email = v.(string)
-	case "Addr":
-		f.Addr = v.(string)
-	case "Id":
-		panic("disabled")
-		if f.Id != nil {
-			return nil, os.EINVAL
-		}
-		id := v.(sys.Id)
-		f.Id = &id
-	case "SignatureKey":
-		// For now we'll allow overriding an old SignatureKey
-		/*
-		if f.SignatureKey != nil {
-			return nil, os.EINVAL
-		}
-		*/
-		f.SignatureKey = v.(*sys.SigPubKey)
-		id := f.SignatureKey.Id()
-		f.Id = &id
-	case "DialKey":
-		// For now we'll allow overriding an old SignatureKey
-		/*
-		if f.DialKey != nil {
-			return nil, os.EINVAL
-		}
-		*/
-		f.DialKey = v.(*sys.DialKey)
-	default:
-		return nil, os.EINVAL
+	if c.stopped {
+		return
 	}
-	return f, nil
+	c.db.Save()
 }
 
-func (c *Core) Save() {
+func (c *Core) isStopped() bool {
 	c.lk.Lock()
 	defer c.lk.Unlock()
-	c.db.Save()
+	return c.stopped
+}
+
+// Stop shuts Tonika down. The Front End and the vaults stop serving, the
+// dialers hang up on all friends, and the friends files and the logs are
+// written out one last time, for every identity. Subsystems that have not
+// stopped within ns nanoseconds are abandoned, and an error is returned to
+// say the shutdown was not clean.
+func (c *Core) Stop(ns int64) os.Error {
+	c.cfglk.Lock() // no reloads from here on
+	deadline := time.Nanoseconds() + ns
+	left := func() int64 {
+		if t := deadline - time.Nanoseconds(); t > 0 {
+			return t
+		}
+		return 0
+	}
+	var first os.Error
+	fail := func(err os.Error) {
+		logger.Errorf("Shutdown: %s", err)
+		if first == nil {
+			first = err
+		}
+	}
+	all := c.all()
+	for _, k := range all {
+		k.publish(sys.EvShutdown, sys.MySlot, "")
+	}
+
+	c.fe.Shutdown()
+	for _, k := range all {
+		k.monitor.Stop()
+		k.compass.ShutDown()
+		k.vault.ShutDown()
+	}
+	for _, k := range all {
+		if k.vault.Drain(left()) != nil {
+			fail(os.ErrorString("vault transfers still open"))
+		}
+	}
+	for _, k := range all {
+		if k.dialer.Shutdown(left()) != nil {
+			fail(os.ErrorString("dialer did not hang up in time"))
+		}
+	}
+
+	for _, k := range all {
+		k.lk.Lock()
+		if err := k.db.Save(); err != nil {
+			fail(err)
+		}
+		k.stopped = true
+		k.lk.Unlock()
+	}
+
+	if err := c.writeLog(c.logpath); err != nil {
+		fail(err)
+	}
+	for _, k := range all {
+		if err := k.evlog.Close(); err != nil {
+			fail(err)
+		}
+	}
+	for _, k := range c.peers {
+		k.log.Infof("Stopped")
+		if err := k.sink.Close(); err != nil {
+			fail(err)
+		}
+	}
+	logger.Infof("Stopped")
+	if err := slog.Close(); err != nil {
+		fail(err)
+	}
+	return first
 }
 
 func (c *Core) SyncAddr(slot int) {
@@ -357,5 +579,8 @@ func (c *Core) Sync(slot int) {
 	g := *f // copy the friend structure
 	id := *g.GetId()
 	c.dialer.Revoke(id)
+	if g.IsRevoked() {
+		return
+	}
 	c.dialer.Add(&g, g.Addr)
 }
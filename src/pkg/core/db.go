@@ -18,14 +18,12 @@
 package core
 
 import (
-	"bytes"
-	"io"
-	"io/ioutil"
-	"log"
 	"json"
 	"os"
+	"sort"
 	"strconv"
 	"rand"
+	"tonika/crypto"
 	"tonika/sys"
 )
 
@@ -33,12 +31,19 @@ type buttress struct {
 	me   *sys.Me         // ourselves
 	recs map[int]*friend // friends table
 	path string          // filename with db on disk
+	pass []byte          // passphrase for encryption at rest, nil if none
+	from int             // format version the db was read in
+	groups map[string]map[int]bool // group name to member slots
+	audit  []*sys.Change           // recent changes, oldest first
+	intros []*sys.Introduction     // waiting for an answer, oldest first
+	revoked map[sys.Fingerprint]bool // identities never accepted again
 }
 
 // (===) Reading/writing and json representation
 
 type jsonMe struct {
 	Id      string
+	Fingerprint string // Hex encoding, derived from SigKey
 	SigKey  string // Base64 encoding
 	Name    string
 	Addr    string
@@ -49,6 +54,7 @@ type jsonMe struct {
 type jsonFriend struct {
 	Slot      string
 	Id        string // Eye64 encoding of Id
+	Fingerprint string // Hex encoding of full key hash
 	Name      string
 	Email     string
 	Addr      string
@@ -56,28 +62,78 @@ type jsonFriend struct {
 	DialKey   string
 	AcceptKey string
 	HelloKey  string
+	Revocation string // Base64 encoding of revocation certificate
 	Rest      map[string]string
 }
 
 type jsonDb struct {
+	Version int // Format version, see migrate.go
 	Me      jsonMe
 	Friends []jsonFriend
+	Groups  []jsonGroup
+	Audit   []jsonChange
+	Intros  []jsonIntro
+	Revoked []string // Hex fingerprints of revoked identities
 }
 
 // Creates a blank friend db with no friends. Populates the Me structure with a
 // generic name and a newly generated Id and corresponding private key.
-func MakeFriendDb(path string) (*buttress, os.Error) {
+// If pass is not nil, the db will be encrypted with it when saved.
+func MakeFriendDb(path string, pass []byte) (*buttress, os.Error) {
 	me := &sys.Me{}
-	log.Stderrf("Generating identity information for you ...")
+	logger.Infof("Generating identity information for you ...")
 	me.Init()
 	return &buttress{
 		me:   me,
 		recs: make(map[int]*friend),
 		path: path,
+		pass: pass,
+		from: dbVersion,
+		groups: make(map[string]map[int]bool),
+		revoked: make(map[sys.Fingerprint]bool),
 	},
 		nil
 }
 
+// IsFriendDbSealed returns true if the friends file at path exists and is
+// encrypted with a passphrase.
+func IsFriendDbSealed(path string) bool {
+	data, err := readDbFile(path)
+	if err != nil {
+		return false
+	}
+	return crypto.IsSealed(data)
+}
+
+// peekFriendDbId returns the identity in the friends file at path, or ""
+// if the file is missing, unreadable or encrypted
+func peekFriendDbId(path string) string {
+	data, err := readDbFile(path)
+	if err != nil || crypto.IsSealed(data) {
+		return ""
+	}
+	book := jsonDb{}
+	if json.Unmarshal(data, &book) != nil {
+		return ""
+	}
+	return book.Me.Id
+}
+
+// ChangeFriendDbPassphrase re-encrypts the friends file at path under pass.
+// If the file is encrypted, old must be its current passphrase. A nil pass
+// stores the file in the clear.
+func ChangeFriendDbPassphrase(path string, old, pass []byte) os.Error {
+	db, err := LoadFriendDb(path, old)
+	if err != nil {
+		return err
+	}
+	db.SetPassphrase(pass)
+	return db.Save()
+}
+
+// SetPassphrase changes the passphrase used on subsequent saves
+func (db *buttress) SetPassphrase(pass []byte) { db.pass = pass }
+
 func (db *buttress) UnusedSlot() int {
 	for {
 		s := rand.Int()
@@ -88,22 +144,55 @@ func (db *buttress) UnusedSlot() int {
 	panic("unreach")
 }
 
-func ReadFriendDb(path string) (*buttress, os.Error) {
+// Reads the friends file at path. Encrypted files are unlocked with pass.
+// Files that are still in the clear are read as they are; if pass is not nil
+// they will be encrypted on the next Save.
+func ReadFriendDb(path string, pass []byte) (*buttress, os.Error) {
 	// Read contents
-	bytes, err := ioutil.ReadFile(path)
+	bytes, err := readDbFile(path)
 	if err != nil {
-		log.Stderrf("Cannot read from friends file \"%s\"\n", path)
-		return nil, &Error{ErrLoad, err}
+		logger.Warnf("Cannot read from friends file \"%s\": %s", path, err)
+		return nil, err
+	}
+	if crypto.IsSealed(bytes) {
+		if pass == nil {
+			logger.Errorf("Friends file \"%s\" is encrypted, passphrase needed", path)
+			return nil, &Error{ErrLocked, path}
+		}
+		bytes, err = crypto.OpenWithPassphrase(bytes, pass)
+		if err != nil {
+			logger.Errorf("Cannot unlock friends file \"%s\": %s", path, err)
+			return nil, &Error{ErrPass, err}
+		}
+	} else if pass != nil {
+		logger.Infof("Friends file \"%s\" is not encrypted, it will be on next save", path)
 	}
 	// Unmarshal json
 	book := jsonDb{}
 	if err := json.Unmarshal(bytes, &book); err != nil {
-		log.Stderrf("Error decoding friends file [%s] json. "+
-			"Offending token [%s].\n",
+		logger.Errorf("Error decoding friends file [%s] json. "+
+			"Offending token [%s].",
 			path, err)
 		return nil, &Error{ErrDecode, err}
 	}
-	db := &buttress{me: &sys.Me{}, recs: make(map[int]*friend), path: path}
+	from := book.Version
+	if err = migrateDb(&book); err != nil {
+		logger.Errorf("Cannot migrate friends file \"%s\": %s", path, err)
+		return nil, err
+	}
+	db, err := parseFriendDb(&book, path, pass)
+	if err != nil {
+		return nil, err
+	}
+	db.from = from
+	return db, nil
+}
+
+// parseFriendDb deep-parses the json representation of a friends file
+func parseFriendDb(book *jsonDb, path string, pass []byte) (*buttress, os.Error) {
+	db := &buttress{me: &sys.Me{}, recs: make(map[int]*friend), path: path, pass: pass, 
+		from: dbVersion, groups: make(map[string]map[int]bool),
+		revoked: make(map[sys.Fingerprint]bool)}
 
 	// Deep parse me-data
 	db.me = &sys.Me{
@@ -114,17 +203,37 @@ func ReadFriendDb(path string) (*buttress, os.Error) {
 	}
 	id, err := sys.ParseId(book.Me.Id)
 	if err != nil {
-		log.Stderrf("Error [%v] decoding my ID [%s]\n", err, book.Me.Id)
+		logger.Errorf("Error [%v] decoding my ID [%s]", err, book.Me.Id)
 		return nil, &Error{ErrDecode, book.Me.Id}
 	}
 	db.me.Id = id
 	pk, err := sys.ParseSigKey(book.Me.SigKey)
 	if err != nil {
-		log.Stderrf("Error [%v] decoding my signature key [%s]\n",
+		logger.Errorf("Error [%v] decoding my signature key [%s]",
 			err, book.Me.SigKey)
 		return nil, &Error{ErrDecode, book.Me.SigKey}
 	}
 	db.me.SignatureKey = pk
+	if pk == nil || db.me.Id != pk.Id() {
+		logger.Errorf("My ID [%s] does not match my signature key", book.Me.Id)
+		return nil, &Error{ErrDecode, book.Me.Id}
+	}
+	myfp, err := sys.ParseFingerprint(book.Me.Fingerprint)
+	if err != nil || !sys.VerifyKeyAndFingerprint(myfp, *pk.RsaPubKey()) {
+		logger.Errorf("My fingerprint [%s] does not match my signature key",
+			book.Me.Fingerprint)
+		return nil, &Error{ErrDecode, book.Me.Fingerprint}
+	}
+
+	// Revoked identities, before friends since these are checked against them
+	for _, s := range book.Revoked {
+		fp, err := sys.ParseFingerprint(s)
+		if err != nil {
+			logger.Warnf("db, invalid revoked fingerprint [%s], skipping", s)
+			continue
+		}
+		db.revoked[*fp] = true
+	}
 
 	// Deep parse friends
 	if book.Friends != nil {
@@ -132,7 +241,7 @@ func ReadFriendDb(path string) (*buttress, os.Error) {
 			// slot
 			slot, err := strconv.Atoi(book.Friends[i].Slot)
 			if err != nil || slot < 0 {
-				log.Stderrf("db, invalid slot number, skipping friends")
+				logger.Warnf("db, invalid slot number, skipping friends")
 				continue
 			}
 			// id
@@ -154,13 +263,55 @@ func ReadFriendDb(path string) (*buttress, os.Error) {
 			// hello key
 			hellok, err := sys.ParseHelloKey(book.Friends[i].HelloKey)
 
+			// fingerprint, which must match the signature key. A friend
+			// whose key does not match is kept but flagged, so that saving
+			// the file does not lose them.
+			var fp *sys.Fingerprint
+			mismatch := ""
+			if sigk != nil {
+				fp1 := sigk.Fingerprint()
+				fp = &fp1
+				fp2, err := sys.ParseFingerprint(book.Friends[i].Fingerprint)
+				if err != nil || !fp2.Equal(fp) {
+					logger.Warnf("db, fingerprint does not match key, flagging friend %s",
+						book.Friends[i].Name)
+					mismatch = book.Friends[i].Fingerprint
+					if mismatch == "" {
+						mismatch = "(none)"
+					}
+					fp = fp2
+				}
+				if fp != nil {
+					id1 = fp.Id()
+					id = &id1
+				}
+			}
+
+			// revocation certificate, which must be signed by the sig key.
+			// A bad one is dropped, and the friend kept; they are still
+			// revoked if their fingerprint is.
+			var rc *sys.RevocationCert
+			if book.Friends[i].Revocation != "" {
+				rc, err = sys.ParseRevocationCert(book.Friends[i].Revocation)
+				if err == nil && (sigk == nil || rc.Verify(sigk) != nil) {
+					err = os.ErrorString("bad signature")
+				}
+				if err != nil {
+					logger.Warnf("db, invalid revocation certificate of friend %s, dropping it",
+						book.Friends[i].Name)
+					rc = nil
+				}
+			}
+
 			// make
 			fr := &friend{
 				Friend: sys.Friend{
 					Slot:         slot,
 					Id:           id,
+					Fingerprint:  fp,
 					SignatureKey: sigk,
 					HelloKey:     hellok,
+					Revocation:   rc,
 					DialKey:      dkey,
 					AcceptKey:    akey,
 					Name:         book.Friends[i].Name,
@@ -168,33 +319,40 @@ func ReadFriendDb(path string) (*buttress, os.Error) {
 					Addr:         book.Friends[i].Addr,
 					Rest:         book.Friends[i].Rest,
 				},
-				online: false,
+				online:   false,
+				mismatch: mismatch,
+				revoked:  fp != nil && db.revoked[*fp],
 			}
 			_, present := db.recs[fr.Slot]
 			if present {
-				log.Stderrf("Duplicate friend, using latest\n")
+				logger.Warnf("Duplicate friend, using latest")
 			}
 			db.recs[fr.Slot] = fr
 		} // for
 	}
+
+	// Groups, after friends since members refer to them
+	db.parseGroups(book.Groups)
+	db.parseAudit(book.Audit)
+	db.parseIntros(book.Intros)
 	return db, nil
 }
 
 
-// Saves the database to the friend db file that was used to read it
-// TODO: This should be checkpointed to prevent data loss
-func (db *buttress) Save() os.Error {
-	// Convert to json
+// toJSON converts the database to its json representation
+func (db *buttress) toJSON() *jsonDb {
 	me := db.me
 	jm := jsonMe{
 		Id:      me.Id.String(),
+		Fingerprint: me.GetFingerprint().String(),
 		SigKey:  me.SignatureKey.String(),
 		Name:    me.Name,
 		Email:   me.Email,
 		Addr:    me.Addr,
 		ExtAddr: me.ExtAddr,
 	}
-	book := &jsonDb{jm, make([]jsonFriend, len(db.recs))}
+	book := &jsonDb{dbVersion, jm, make([]jsonFriend, len(db.recs)), db.groupsToJSON(),
+		db.auditToJSON(), db.introsToJSON(), db.revokedToJSON()}
 	k := 0
 	for _, v := range db.recs {
 		jf := jsonFriend{
@@ -207,6 +365,12 @@ func (db *buttress) Save() os.Error {
 		if v.Id != nil {
 			jf.Id = v.Id.String()
 		}
+		if v.Fingerprint != nil {
+			jf.Fingerprint = v.Fingerprint.String()
+		}
+		if v.mismatch != "" {
+			jf.Fingerprint = v.mismatch
+		}
 		if v.SignatureKey != nil {
 			jf.SigKey = v.SignatureKey.String()
 		}
@@ -216,32 +380,35 @@ func (db *buttress) Save() os.Error {
 		if v.DialKey != nil {
 			jf.DialKey = v.DialKey.String()
 		}
+		if v.Revocation != nil {
+			jf.Revocation = v.Revocation.String()
+		}
 		if v.AcceptKey != nil {
 			jf.AcceptKey = v.AcceptKey.String()
 		}
 		book.Friends[k] = jf
 		k++
 	}
-	// Open file
-	file, err := os.Open(db.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Stderrf("Cannot open friends file \"%s\"\n", db.path)
-		return &Error{ErrSave, err}
-	}
+	return book
+}
+
+// Saves the database to the friend db file that was used to read it
+func (db *buttress) Save() os.Error {
+	// Convert to json
+	book := db.toJSON()
+
 	// Marshal to json string
-	data, err := json.Marshal(&book)
+	data, err := json.Marshal(book)
 	if err != nil {
 		return &Error{ErrEncode, err}
 	}
-	bf := bytes.NewBuffer(data)
-	n,err := io.Copy(file, bf)
-	if err != nil || n != int64(len(data)) {
-		return &Error{ErrEncode, err}
-	}
-	if err := file.Close(); err != nil {
-		return &Error{ErrSave, err}
+	if db.pass != nil {
+		data, err = crypto.SealWithPassphrase(data, db.pass)
+		if err != nil {
+			return &Error{ErrEncode, err}
+		}
 	}
-	return nil
+	return writeDbFile(db.path, data)
 }
 
 func (db *buttress) GetMe() *sys.Me { return db.me }
@@ -256,7 +423,10 @@ func (db *buttress) Enumerate() []sys.View {
 	return r
 }
 
-func (db *buttress) Remove(slot int) { db.recs[slot] = nil, false }
+func (db *buttress) Remove(slot int) {
+	db.recs[slot] = nil, false
+	db.forgetSlot(slot)
+}
 
 func (db *buttress) GetById(id sys.Id) *friend {
 	for _, f := range db.recs {
@@ -267,6 +437,33 @@ func (db *buttress) GetById(id sys.Id) *friend {
 	return nil
 }
 
+func (db *buttress) GetByFingerprint(fp *sys.Fingerprint) *friend {
+	for _, f := range db.recs {
+		if f.GetFingerprint() != nil && f.GetFingerprint().Equal(fp) {
+			return f
+		}
+	}
+	return nil
+}
+
+// CheckCollision returns an error if the short Id of fp is already taken
+// by ourselves, or by a friend other than u with a different fingerprint.
+func (db *buttress) CheckCollision(u *friend, fp *sys.Fingerprint) os.Error {
+	id := fp.Id()
+	if id == db.me.Id {
+		return &Error{ErrDup, id}
+	}
+	for _, f := range db.recs {
+		if f == u || f.GetId() == nil || *f.GetId() != id {
+			continue
+		}
+		if f.GetFingerprint() == nil || !f.GetFingerprint().Equal(fp) {
+			return &Error{ErrDup, id}
+		}
+	}
+	return nil
+}
+
 func (db *buttress) GetByAcceptKey(key *sys.DialKey) *friend {
 	for _, f := range db.recs {
 		if f.GetAcceptKey() != nil && f.GetAcceptKey().Equal(*key) {
@@ -297,6 +494,12 @@ func (db *buttress) Attach(slot int, u *friend) os.Error {
 	if _, present := db.recs[slot]; present {
 		return os.ErrorString("db, slot busy")
 	}
+	if u.GetFingerprint() != nil && db.IsRevoked(u.GetFingerprint()) {
+		return os.ErrorString("db, Fingerprint revoked")
+	}
+	if u.GetFingerprint() != nil && db.GetByFingerprint(u.GetFingerprint()) != nil {
+		return os.ErrorString("db, Duplicate Fingerprint present")
+	}
 	if u.GetId() != nil {
 		for _, f := range db.recs {
 			if f.GetId() != nil && *f.GetId() == *u.GetId() {
@@ -308,3 +511,19 @@ func (db *buttress) Attach(slot int, u *friend) os.Error {
 	db.recs[slot] = u
 	return nil
 }
+
+// Revoke remembers that the identity with fingerprint fp is revoked. It is
+// never accepted again, even after its friend record is removed.
+func (db *buttress) Revoke(fp *sys.Fingerprint) { db.revoked[*fp] = true }
+
+func (db *buttress) IsRevoked(fp *sys.Fingerprint) bool { return db.revoked[*fp] }
+
+func (db *buttress) revokedToJSON() []string {
+	r := make([]string, 0, len(db.revoked))
+	for fp, _ := range db.revoked {
+		r = r[0 : len(r)+1]
+		r[len(r)-1] = fp.String()
+	}
+	sort.SortStrings(r)
+	return r
+}
@@ -0,0 +1,66 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package core
+
+import (
+	"os"
+	"tonika/sys"
+)
+
+// SealEnvelope signs and encrypts a payload for the given friends
+func (c *Core) SealEnvelope(to []sys.Id, subject string, payload []byte) ([]byte, os.Error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	rs := make([]sys.EnvelopeRecipient, len(to))
+	for i, id := range to {
+		f := c.db.GetById(id)
+		if f == nil || !f.IsComplete() {
+			return nil, os.EINVAL
+		}
+		rs[i] = sys.EnvelopeRecipient{*f.GetFingerprint(), f.GetSignatureKey()}
+	}
+	return sys.SealEnvelope(c.db.GetMe().GetSignatureKey(), rs, subject, payload)
+}
+
+// OpenEnvelope verifies and decrypts an envelope sent to us by a friend.
+// Envelopes that are stale or have been seen before are rejected.
+func (c *Core) OpenEnvelope(data []byte) (*sys.Envelope, os.Error) {
+	c.lk.Lock()
+	me := c.db.GetMe().GetSignatureKey()
+	c.lk.Unlock()
+	e, err := sys.OpenEnvelope(me, c.lookupEnvelopeKey, data)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.guard.Check(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (c *Core) lookupEnvelopeKey(fp *sys.Fingerprint) *sys.SigPubKey {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	f := c.db.GetByFingerprint(fp)
+	if f == nil || !f.IsComplete() {
+		return nil
+	}
+	return f.GetSignatureKey()
+}
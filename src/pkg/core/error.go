@@ -19,6 +19,7 @@ package core
 
 import (
 	"fmt"
+	"os"
 )
 
 // A returned Error indicates task was not completed
@@ -30,10 +31,29 @@ type Error struct {
 func (e *Error) String() string { return fmt.Sprintf("TonErr: %d, %v", e.no, e.arg) }
 
 const (
-	ErrCreate = iota
-	ErrLoad   = iota
-	ErrSave   = iota
-	ErrEncode = iota
-	ErrDecode = iota
-	ErrDup    = iota
+	ErrCreate  = iota
+	ErrLoad    = iota
+	ErrSave    = iota
+	ErrEncode  = iota
+	ErrDecode  = iota
+	ErrDup     = iota
+	ErrLocked  = iota
+	ErrPass    = iota
+	ErrCorrupt = iota
+	ErrNewer   = iota
+	ErrInUse   = iota
 )
+
+// IsPassphraseError returns true if err is due to a locked friends file or
+// to a wrong passphrase.
+func IsPassphraseError(err os.Error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.no == ErrLocked || e.no == ErrPass)
+}
+
+// IsNewerError returns true if err is due to a friends file written by a
+// newer build
+func IsNewerError(err os.Error) bool {
+	e, ok := err.(*Error)
+	return ok && e.no == ErrNewer
+}
@@ -0,0 +1,213 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"json"
+	"os"
+	"sync"
+	"tonika/sys"
+)
+
+// Events are published on the core event bus and appended, one json object
+// per line, to a log in the cache directory. When the log grows past
+// eventLogMax bytes it is moved aside to a single older file, so the log
+// never takes more than twice that. The most recent events are read back
+// at startup so the activity timeline survives restarts.
+//
+// Events are published with the bus lock, and often the core lock, held,
+// so the log is written by a goroutine of its own. Events that arrive while
+// eventQueue of them are waiting to be written are dropped from the log.
+
+const (
+	eventsKept  = 200
+	eventLogMax = 256 * 1024
+	eventQueue  = 200
+)
+
+type eventLog struct {
+	path    string
+	file    *os.File // owned by the writer goroutine
+	size    int64
+	queue   chan *sys.Event // nil once closed
+	done    chan os.Error
+	dropped int
+	lk      sync.Mutex
+}
+
+func openEventLog(p string) *eventLog {
+	l := &eventLog{path: p, queue: make(chan *sys.Event, eventQueue),
+		done: make(chan os.Error)}
+	if err := l.open(); err != nil {
+		logger.Errorf("Cannot open event log %s: %s", p, err)
+	}
+	go l.writer(l.queue)
+	return l
+}
+
+func (l *eventLog) open() os.Error {
+	f, err := os.Open(l.path, os.O_WRONLY|os.O_CREAT|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	dir, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, dir.Size
+	return nil
+}
+
+// write is called by the event bus, with the bus lock held. It only queues
+// e for the writer goroutine.
+func (l *eventLog) write(e *sys.Event) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.queue == nil {
+		return
+	}
+	if ok := l.queue <- e; !ok {
+		l.dropped++
+	}
+}
+
+// writer appends the events in q to the log until q is closed
+func (l *eventLog) writer(q chan *sys.Event) {
+	for e := range q {
+		l.appendEvent(e)
+		l.lk.Lock()
+		dropped := l.dropped
+		l.dropped = 0
+		l.lk.Unlock()
+		if dropped > 0 {
+			logger.Warnf("Event log %s fell behind, %d events not logged", l.path, dropped)
+		}
+	}
+	var err os.Error
+	if l.file != nil {
+		err = l.file.Close()
+		l.file = nil
+	}
+	l.done <- err
+}
+
+func (l *eventLog) appendEvent(e *sys.Event) {
+	if l.file == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	n, _ := l.file.Write(append0(data, '\n'))
+	l.size += int64(n)
+	if l.size < eventLogMax {
+		return
+	}
+	l.file.Close()
+	l.file = nil
+	os.Rename(l.path, l.path+".1")
+	if err = l.open(); err != nil {
+		logger.Errorf("Cannot reopen event log %s: %s", l.path, err)
+	}
+}
+
+// Close writes the events still queued and closes the log; later events
+// are not written
+func (l *eventLog) Close() os.Error {
+	l.lk.Lock()
+	q := l.queue
+	l.queue = nil
+	l.lk.Unlock()
+	if q == nil {
+		return nil
+	}
+	close(q)
+	return <-l.done
+}
+
+func append0(p []byte, b byte) []byte {
+	q := make([]byte, len(p)+1)
+	copy(q, p)
+	q[len(p)] = b
+	return q
+}
+
+// loadEvents returns the last keep events in the logs at p, oldest first
+func loadEvents(p string, keep int) []*sys.Event {
+	ring := make([]*sys.Event, keep)
+	n := 0
+	for _, name := range []string{p + ".1", p} {
+		f, err := os.Open(name, os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			e := &sys.Event{}
+			if json.Unmarshal([]byte(line), e) != nil {
+				continue
+			}
+			ring[n%keep] = e
+			n++
+		}
+		f.Close()
+	}
+	if n > keep {
+		r := make([]*sys.Event, keep)
+		for i := 0; i < keep; i++ {
+			r[i] = ring[(n+i)%keep]
+		}
+		return r
+	}
+	return ring[0:n]
+}
+
+func makeEventBus(p string) (*sys.EventBus, *eventLog) {
+	l := openEventLog(p)
+	bus := sys.MakeEventBus(eventsKept, func(e *sys.Event) { l.write(e) })
+	bus.Restore(loadEvents(p, eventsKept))
+	return bus, l
+}
+
+func (c *Core) publish(topic string, slot int, msg string) {
+	c.bus.Publish(&sys.Event{Topic: topic, Slot: slot, Msg: msg})
+}
+
+// errorLoop publishes the errors reported by the dialer and the vault
+func (c *Core) errorLoop(topic string, wait func() os.Error) {
+	for {
+		err := wait()
+		if err != nil {
+			c.publish(topic, sys.MySlot, err.String())
+		}
+	}
+}
+
+func (c *Core) Subscribe(topics []string, size int) *sys.Subscription {
+	return c.bus.Subscribe(topics, size)
+}
+
+func (c *Core) Unsubscribe(s *sys.Subscription) { c.bus.Unsubscribe(s) }
+
+func (c *Core) GetRecentEvents(n int) []*sys.Event { return c.bus.Recent(n) }
@@ -0,0 +1,53 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+func TestEventLog(t *testing.T) {
+	dir := testDir(t, "tonika-events-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "events.log")
+	bus, l := makeEventBus(p)
+	for i := 0; i < 3; i++ {
+		bus.Publish(&sys.Event{Topic: sys.EvFriendAdded, Slot: i})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	bus.Publish(&sys.Event{Topic: sys.EvShutdown})
+
+	// Queued events are written by Close, later ones are not
+	events := loadEvents(p, eventsKept)
+	if len(events) != 3 || events[2].Slot != 2 || events[2].Seq != 3 {
+		t.Fatalf("expected 3 events, got %v", events)
+	}
+
+	// Sequence numbers continue after a restart
+	bus, l = makeEventBus(p)
+	defer l.Close()
+	e := &sys.Event{Topic: sys.EvFriendOnline}
+	bus.Publish(e)
+	if e.Seq != 4 {
+		t.Errorf("sequence restarted at %d", e.Seq)
+	}
+}
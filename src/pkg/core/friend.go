@@ -23,10 +23,27 @@ import (
 
 type friend struct {
 	sys.Friend
-	online bool
+	online   bool
+	mismatch string // pinned fingerprint, if the signature key on file does not match it
+	revoked  bool   // fingerprint was revoked, though the certificate on file is missing or bad
 }
 
+// IsComplete is false for a friend whose signature key does not match their
+// pinned fingerprint, so that they are neither dialed nor introduced until
+// the key is fixed.
+func (f *friend) IsComplete() bool { return f.mismatch == "" && f.Friend.IsComplete() }
+
+// IsRevoked is also true for a friend whose fingerprint we know to be
+// revoked, whether or not we hold a good certificate for it.
+func (f *friend) IsRevoked() bool { return f.revoked || f.Friend.IsRevoked() }
+
 func (f *friend) GetStatusMsg() string {
+	if f.IsRevoked() {
+		return "Revoked! Their identity key was reported stolen, do not trust it."
+	}
+	if f.mismatch != "" {
+		return "Their signature key does not match their fingerprint. Ask them for a new invitation."
+	}
 	if f.Friend.IsComplete() {
 		return "Contact established."
 	}
@@ -34,6 +51,9 @@ func (f *friend) GetStatusMsg() string {
 }
 
 func (f *friend) GetStatusClass() string {
+	if f.IsRevoked() || f.mismatch != "" {
+		return "error"
+	}
 	if f.Friend.IsComplete() {
 		return "ok"
 	}
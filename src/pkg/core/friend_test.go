@@ -14,48 +14,50 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-
 package core
 
 import (
-	//"fmt"
+	"os"
+	"path"
 	"testing"
+	"tonika/sys"
 )
 
 func TestFriend(t *testing.T) {
-	fdb0 := MakeFriendDb("test.db")
-	if fdb0 == nil {
-		t.Fatalf("Error making\n")
-	}
-	fdb0.SetMyName("Petar")
-	fdb0.SetMyAddr("serdika.isp.nah")
-	fdb0.SetFriend(proto.Friend{
-		Id:   87598375,
-		Name: "Chris",
-		Addr: "145cpw",
-	},
-		true)
-	fdb0.SetFriend(proto.Friend{
-		Id:   122938129,
-		Name: "Jennie",
-		Addr: "nyny",
-	},
-		true)
-	err := fdb0.Save()
+	dir := testDir(t, "tonika-friend-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	db0, err := MakeFriendDb(p, nil)
 	if err != nil {
-		t.Fatalf("Error saving: %v\n", err)
+		t.Fatalf("make db: %s", err)
+	}
+	db0.me.Name = "Petar"
+	db0.me.Addr = "serdika.isp.nah"
+	if err = db0.Attach(1, &friend{Friend: sys.Friend{Name: "Chris", Addr: "145cpw"}}); err != nil {
+		t.Fatalf("attach: %s", err)
+	}
+	if err = db0.Attach(2, &friend{Friend: sys.Friend{Name: "Jennie", Addr: "nyny"}}); err != nil {
+		t.Fatalf("attach: %s", err)
+	}
+	if err = db0.Attach(2, &friend{Friend: sys.Friend{Name: "Busy"}}); err == nil {
+		t.Errorf("attached to a busy slot")
+	}
+	if err = db0.Save(); err != nil {
+		t.Fatalf("save: %s", err)
 	}
 
-	fdb := ReadFriendDb("test.db")
-	if fdb == nil {
-		t.Fatalf("Open friend db error")
+	db, err := ReadFriendDb(p, nil)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if db.me.Id != db0.me.Id || db.me.Name != "Petar" || db.me.Addr != "serdika.isp.nah" {
+		t.Errorf("bad me %v", db.me)
 	}
-	if len(fdb.GetAllFriends()) != 2 {
-		t.Errorf("Bad # of parsed friends")
+	if len(db.Enumerate()) != 2 {
+		t.Errorf("bad # of parsed friends")
 	}
-	fs := fdb.GetAllFriends()
-	jennie, present := fs[122938129]
-	if !present || jennie.Name != "Jennie" {
-		t.Errorf("Incorrect friend entries\n")
+	jennie := db.GetBySlot(2)
+	if jennie == nil || jennie.Name != "Jennie" || jennie.Addr != "nyny" {
+		t.Errorf("incorrect friend entries")
 	}
 }
@@ -0,0 +1,283 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"tonika/sys"
+)
+
+// Groups (circles) are named sets of friends, used by other subsystems to
+// grant rights to some friends and not to others. Membership is kept by slot,
+// so friends whose invitation has not completed can be grouped as well.
+
+const maxGroupName = 64
+
+type jsonGroup struct {
+	Name  string
+	Slots []string
+}
+
+func validGroupName(name string) bool {
+	if name == "" || len(name) > maxGroupName || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, c := range name {
+		if c < ' ' || c == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// GetGroups returns the names of all groups in alphabetic order
+func (db *buttress) GetGroups() []string {
+	r := make([]string, len(db.groups))
+	i := 0
+	for name, _ := range db.groups {
+		r[i] = name
+		i++
+	}
+	sort.SortStrings(r)
+	return r
+}
+
+// GetGroupMembers returns the slots of the friends in group name
+func (db *buttress) GetGroupMembers(name string) ([]int, os.Error) {
+	g, ok := db.groups[name]
+	if !ok {
+		return nil, os.EINVAL
+	}
+	r := make([]int, len(g))
+	i := 0
+	for slot, _ := range g {
+		r[i] = slot
+		i++
+	}
+	sort.SortInts(r)
+	return r, nil
+}
+
+// GetGroupsOf returns the names of the groups that slot belongs to
+func (db *buttress) GetGroupsOf(slot int) []string {
+	var n int
+	for _, g := range db.groups {
+		if g[slot] {
+			n++
+		}
+	}
+	r := make([]string, n)
+	i := 0
+	for name, g := range db.groups {
+		if g[slot] {
+			r[i] = name
+			i++
+		}
+	}
+	sort.SortStrings(r)
+	return r
+}
+
+func (db *buttress) MakeGroup(name string) os.Error {
+	if !validGroupName(name) {
+		return os.EINVAL
+	}
+	if _, present := db.groups[name]; present {
+		return &Error{ErrDup, name}
+	}
+	db.groups[name] = make(map[int]bool)
+	return nil
+}
+
+func (db *buttress) RenameGroup(old, name string) os.Error {
+	g, ok := db.groups[old]
+	if !ok || !validGroupName(name) {
+		return os.EINVAL
+	}
+	if old == name {
+		return nil
+	}
+	if _, present := db.groups[name]; present {
+		return &Error{ErrDup, name}
+	}
+	db.groups[old] = nil, false
+	db.groups[name] = g
+	return nil
+}
+
+func (db *buttress) RemoveGroup(name string) os.Error {
+	if _, ok := db.groups[name]; !ok {
+		return os.EINVAL
+	}
+	db.groups[name] = nil, false
+	return nil
+}
+
+func (db *buttress) AddToGroup(name string, slot int) os.Error {
+	g, ok := db.groups[name]
+	if !ok || db.GetBySlot(slot) == nil {
+		return os.EINVAL
+	}
+	g[slot] = true
+	return nil
+}
+
+func (db *buttress) RemoveFromGroup(name string, slot int) os.Error {
+	g, ok := db.groups[name]
+	if !ok {
+		return os.EINVAL
+	}
+	g[slot] = false, false
+	return nil
+}
+
+// InGroup returns true if the friend with fingerprint fp is a member of
+// group name. Revoked friends are members of no group.
+func (db *buttress) InGroup(fp *sys.Fingerprint, name string) bool {
+	g, ok := db.groups[name]
+	if !ok || fp == nil {
+		return false
+	}
+	f := db.GetByFingerprint(fp)
+	if f == nil || f.IsRevoked() {
+		return false
+	}
+	return g[f.Slot]
+}
+
+// forgetSlot removes slot from all groups
+func (db *buttress) forgetSlot(slot int) {
+	for _, g := range db.groups {
+		g[slot] = false, false
+	}
+}
+
+func (db *buttress) groupsToJSON() []jsonGroup {
+	names := db.GetGroups()
+	r := make([]jsonGroup, len(names))
+	for i, name := range names {
+		slots, _ := db.GetGroupMembers(name)
+		r[i].Name = name
+		r[i].Slots = make([]string, len(slots))
+		for j, s := range slots {
+			r[i].Slots[j] = strconv.Itoa(s)
+		}
+	}
+	return r
+}
+
+// parseGroups reads the groups of a friends file; members that are not
+// friends in db are dropped
+func (db *buttress) parseGroups(groups []jsonGroup) {
+	for _, jg := range groups {
+		if !validGroupName(jg.Name) {
+			logger.Warnf("db, invalid group name, skipping group")
+			continue
+		}
+		g := make(map[int]bool)
+		for _, ss := range jg.Slots {
+			s, err := strconv.Atoi(ss)
+			if err != nil || db.GetBySlot(s) == nil {
+				logger.Warnf("db, unknown member in group [%s]", jg.Name)
+				continue
+			}
+			g[s] = true
+		}
+		db.groups[jg.Name] = g
+	}
+}
+
+// Core access, see sys.Bank
+
+func (c *Core) GetGroups() []string {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.GetGroups()
+}
+
+func (c *Core) GetGroupMembers(name string) ([]int, os.Error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.GetGroupMembers(name)
+}
+
+func (c *Core) GetGroupsOf(slot int) []string {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.GetGroupsOf(slot)
+}
+
+func (c *Core) MakeGroup(name string) os.Error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.MakeGroup(name)
+}
+
+// RenameGroup renames group old, unless access is granted to it by name,
+// see groupInUse
+func (c *Core) RenameGroup(old, name string) os.Error {
+	if old != name {
+		if err := c.groupInUse(old); err != nil {
+			return err
+		}
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.RenameGroup(old, name)
+}
+
+// RemoveGroup removes group name, unless access is granted to it by name,
+// see groupInUse
+func (c *Core) RemoveGroup(name string) os.Error {
+	if err := c.groupInUse(name); err != nil {
+		return err
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.RemoveGroup(name)
+}
+
+// groupInUse returns an error naming the ACL files, or the inbox, that
+// grant access to group name. Renaming or removing the group would leave
+// them pointing at nothing, or at a group made later under the same name.
+func (c *Core) groupInUse(name string) os.Error {
+	if uses := c.vault.GroupUses(name); len(uses) > 0 {
+		return &Error{ErrInUse, strings.Join(uses, ", ")}
+	}
+	return nil
+}
+
+func (c *Core) AddToGroup(name string, slot int) os.Error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.AddToGroup(name, slot)
+}
+
+func (c *Core) RemoveFromGroup(name string, slot int) os.Error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.RemoveFromGroup(name, slot)
+}
+
+func (c *Core) InGroup(fp *sys.Fingerprint, name string) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.InGroup(fp, name)
+}
@@ -0,0 +1,99 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+func TestGroups(t *testing.T) {
+	dir := testDir(t, "tonika-group-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	db := testDb(t, p, nil)
+	bob, bk := keyedFriend("Bob")
+	carol, _ := keyedFriend("Carol")
+	bslot := db.UnusedSlot()
+	db.Attach(bslot, bob)
+	cslot := db.UnusedSlot()
+	db.Attach(cslot, carol)
+
+	if err := db.MakeGroup("close"); err != nil {
+		t.Fatalf("make group: %s", err)
+	}
+	if err := db.MakeGroup("close"); !isError(err, ErrDup) {
+		t.Errorf("duplicate group: got %v", err)
+	}
+	if db.MakeGroup("a,b") == nil || db.MakeGroup(" close") == nil {
+		t.Errorf("bad group name accepted")
+	}
+	if db.AddToGroup("close", db.UnusedSlot()) == nil || db.AddToGroup("far", bslot) == nil {
+		t.Errorf("added to a missing friend or group")
+	}
+	if err := db.AddToGroup("close", bslot); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if !db.InGroup(bob.GetFingerprint(), "close") || db.InGroup(carol.GetFingerprint(), "close") {
+		t.Errorf("wrong members")
+	}
+	if db.InGroup(bob.GetFingerprint(), "far") || db.InGroup(nil, "close") {
+		t.Errorf("member of nothing")
+	}
+
+	// Membership survives a save
+	if err := db.Save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	db, err := ReadFriendDb(p, nil)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !db.InGroup(bob.GetFingerprint(), "close") {
+		t.Errorf("membership lost")
+	}
+	if g := db.GetGroupsOf(bslot); len(g) != 1 || g[0] != "close" {
+		t.Errorf("bad groups of bob %v", g)
+	}
+
+	// A revoked friend is a member of nothing
+	rc, err := sys.MakeRevocationCert(bk, "stolen")
+	if err != nil {
+		t.Fatalf("make cert: %s", err)
+	}
+	db.GetBySlot(bslot).Revocation = rc
+	if db.InGroup(bob.GetFingerprint(), "close") {
+		t.Errorf("revoked friend still a member")
+	}
+	db.GetBySlot(bslot).Revocation = nil
+
+	if err = db.RemoveFromGroup("close", bslot); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if db.InGroup(bob.GetFingerprint(), "close") {
+		t.Errorf("removed friend still a member")
+	}
+
+	// Removing a friend takes it out of its groups
+	db.AddToGroup("close", cslot)
+	db.Remove(cslot)
+	if m, _ := db.GetGroupMembers("close"); len(m) != 0 {
+		t.Errorf("removed friend left in group %v", m)
+	}
+}
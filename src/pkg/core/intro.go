@@ -0,0 +1,394 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package core
+
+import (
+	"gob"
+	"net"
+	"os"
+	"time"
+	"tonika/sys"
+)
+
+// Introductions travel over dialer connections with this subject, sealed
+// in envelopes from the introducer. An introducer that could only deliver
+// one half of a pair withdraws the other half with an envelope whose
+// subject is introWithdrawSubject, over the same dialer subject.
+const (
+	introSubject         = "intro"
+	introWithdrawSubject = "intro.withdraw"
+)
+
+// At most this many introductions are kept waiting for an answer; the
+// oldest go first
+const maxIntros = 100
+
+type jsonIntro struct {
+	By        string // Hex encoding of the introducer's fingerprint
+	Time      int64
+	Name      string
+	Email     string
+	Addr      string
+	SigKey    string
+	DialKey   string
+	AcceptKey string
+}
+
+func (db *buttress) introsToJSON() []jsonIntro {
+	r := make([]jsonIntro, len(db.intros))
+	for i, in := range db.intros {
+		r[i] = jsonIntro{
+			By:        in.By.String(),
+			Time:      in.Time,
+			Name:      in.Name,
+			Email:     in.Email,
+			Addr:      in.Addr,
+			SigKey:    in.SigKey.String(),
+			DialKey:   in.DialKey.String(),
+			AcceptKey: in.AcceptKey.String(),
+		}
+	}
+	return r
+}
+
+func (db *buttress) parseIntros(intros []jsonIntro) {
+	db.intros = make([]*sys.Introduction, 0, len(intros))
+	for _, ji := range intros {
+		in, err := parseIntro(&ji)
+		if err != nil {
+			logger.Warnf("db, dropping bad introduction to %s: %s", ji.Name, err)
+			continue
+		}
+		n := len(db.intros)
+		db.intros = db.intros[0 : n+1]
+		db.intros[n] = in
+	}
+}
+
+func parseIntro(ji *jsonIntro) (*sys.Introduction, os.Error) {
+	by, err := sys.ParseFingerprint(ji.By)
+	if err != nil {
+		return nil, os.ErrorString("bad introducer " + ji.By)
+	}
+	sk, err := sys.ParseSigPubKey(ji.SigKey)
+	if err != nil || sk == nil {
+		return nil, os.ErrorString("bad signature key")
+	}
+	dk, err := sys.ParseDialKey(ji.DialKey)
+	if err != nil {
+		return nil, os.ErrorString("bad dial key")
+	}
+	ak, err := sys.ParseDialKey(ji.AcceptKey)
+	if err != nil {
+		return nil, os.ErrorString("bad accept key")
+	}
+	return &sys.Introduction{*by, ji.Time, ji.Name, ji.Email, ji.Addr, sk, dk, ak}, nil
+}
+
+// addIntro keeps in waiting, in place of an earlier introduction to the
+// same party by the same introducer. It returns false, and keeps the
+// earlier one, if the same party was already introduced by someone else:
+// the two introductions carry different keys, and only the one the party
+// accepts can work.
+func (db *buttress) addIntro(in *sys.Introduction) bool {
+	fp := in.Fingerprint()
+	if old := db.getIntro(&fp); old != nil {
+		if !old.By.Equal(&in.By) {
+			return false
+		}
+		db.removeIntro(&fp)
+	}
+	n := len(db.intros)
+	if n >= maxIntros {
+		n = maxIntros - 1
+	}
+	r := make([]*sys.Introduction, n+1)
+	copy(r, db.intros[len(db.intros)-n:])
+	r[n] = in
+	db.intros = r
+	return true
+}
+
+func (db *buttress) getIntro(fp *sys.Fingerprint) *sys.Introduction {
+	for _, in := range db.intros {
+		x := in.Fingerprint()
+		if x.Equal(fp) {
+			return in
+		}
+	}
+	return nil
+}
+
+func (db *buttress) removeIntro(fp *sys.Fingerprint) bool {
+	for i, in := range db.intros {
+		x := in.Fingerprint()
+		if x.Equal(fp) {
+			r := make([]*sys.Introduction, len(db.intros)-1)
+			copy(r, db.intros[0:i])
+			copy(r[i:], db.intros[i+1:])
+			db.intros = r
+			return true
+		}
+	}
+	return false
+}
+
+// Introduce introduces the friends at slots a and b to each other. Both
+// must be established contacts and online, since the introductions are
+// delivered right away.
+func (c *Core) Introduce(a, b int) os.Error {
+	c.lk.Lock()
+	fa, fb := c.db.GetBySlot(a), c.db.GetBySlot(b)
+	if fa == nil || fb == nil || a == b {
+		c.lk.Unlock()
+		return os.EINVAL
+	}
+	if !fa.IsComplete() || !fb.IsComplete() || fa.IsRevoked() || fb.IsRevoked() {
+		c.lk.Unlock()
+		return os.ErrorString("intro, both friends must be established contacts")
+	}
+	if !fa.IsOnline() || !fb.IsOnline() {
+		c.lk.Unlock()
+		return os.ErrorString("intro, both friends must be online")
+	}
+	fora, forb, err := sys.MakeIntroductions(fa, fb)
+	ida, idb := *fa.GetId(), *fb.GetId()
+	namea, nameb := fa.Name, fb.Name
+	c.lk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Reach both before telling either. If b cannot be told after all,
+	// a is asked to forget its half.
+	conna, err := c.dialIntro(ida)
+	if err != nil {
+		return err
+	}
+	defer conna.Close()
+	connb, err := c.dialIntro(idb)
+	if err != nil {
+		return err
+	}
+	defer connb.Close()
+	if err = c.sendIntro(conna, ida, introSubject, fora.Bytes()); err != nil {
+		return err
+	}
+	if err = c.sendIntro(connb, idb, introSubject, forb.Bytes()); err != nil {
+		fp := fora.Fingerprint()
+		if conn, werr := c.dialIntro(ida); werr == nil {
+			werr = c.sendIntro(conn, ida, introWithdrawSubject, fp[0:])
+			conn.Close()
+			if werr != nil {
+				c.log.Warnf("Could not withdraw the introduction sent to %s: %s", namea, werr)
+			}
+		} else {
+			c.log.Warnf("Could not withdraw the introduction sent to %s: %s", namea, werr)
+		}
+		return err
+	}
+	c.lk.Lock()
+	c.db.record(a, "admin", "Introduced to", "", nameb)
+	c.db.record(b, "admin", "Introduced to", "", namea)
+	c.db.Save()
+	c.lk.Unlock()
+	return nil
+}
+
+func (c *Core) dialIntro(id sys.Id) (net.Conn, os.Error) {
+	conn := c.dialer.Dial(id, introSubject)
+	if conn == nil {
+		return nil, os.ErrorString("intro, could not reach " + id.String())
+	}
+	return conn, nil
+}
+
+// sendIntro seals payload with subject for id and sends it over conn
+func (c *Core) sendIntro(conn net.Conn, id sys.Id, subject string, payload []byte) os.Error {
+	data, err := c.SealEnvelope([]sys.Id{id}, subject, payload)
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(conn).Encode(data)
+}
+
+func (c *Core) introLoop() {
+	c.lk.Lock()
+	d := c.dialer
+	c.lk.Unlock()
+	for {
+		from, conn := d.Accept(introSubject)
+		if conn == nil {
+			continue
+		}
+		go func() {
+			var data []byte
+			err := gob.NewDecoder(conn).Decode(&data)
+			conn.Close()
+			if err != nil {
+				return
+			}
+			c.receiveIntroduction(from, data)
+		}()
+	}
+}
+
+// receiveIntroduction keeps an introduction sent by the friend from, until
+// it is accepted or declined. Introductions to ourselves or to existing
+// contacts are dropped.
+func (c *Core) receiveIntroduction(from sys.Id, data []byte) os.Error {
+	e, err := c.OpenEnvelope(data)
+	if err != nil {
+		return err
+	}
+	if e.Subject == introWithdrawSubject {
+		return c.withdrawIntroduction(from, e)
+	}
+	if e.Subject != introSubject {
+		return os.EINVAL
+	}
+	in, err := sys.ParseIntroduction(e.Payload)
+	if err != nil {
+		return err
+	}
+	in.By = e.Sender
+	in.Time = time.Nanoseconds()
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	by := c.db.GetByFingerprint(&in.By)
+	if by == nil || by.IsRevoked() || by.GetId() == nil || *by.GetId() != from {
+		return os.EINVAL
+	}
+	fp := in.Fingerprint()
+	if fp.Equal(c.db.GetMe().GetFingerprint()) || c.db.GetByFingerprint(&fp) != nil {
+		return nil
+	}
+	if !c.db.addIntro(in) {
+		c.log.Infof("Introduction to %s by %s dropped, someone else introduced them first",
+			in.Name, by.Name)
+		return nil
+	}
+	c.db.Save()
+	c.publish(sys.EvIntroduced, by.Slot, in.Name)
+	return nil
+}
+
+// withdrawIntroduction forgets the introduction, named in e, that the
+// friend from made and could not complete
+func (c *Core) withdrawIntroduction(from sys.Id, e *sys.Envelope) os.Error {
+	if len(e.Payload) != sys.FingerprintLen {
+		return os.EINVAL
+	}
+	var fp sys.Fingerprint
+	copy(fp[0:], e.Payload)
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	by := c.db.GetByFingerprint(&e.Sender)
+	if by == nil || by.GetId() == nil || *by.GetId() != from {
+		return os.EINVAL
+	}
+	in := c.db.getIntro(&fp)
+	if in == nil || !in.By.Equal(&e.Sender) {
+		return nil
+	}
+	c.db.removeIntro(&fp)
+	c.db.Save()
+	return nil
+}
+
+// GetIntroductions returns the introductions waiting for an answer, oldest
+// first
+func (c *Core) GetIntroductions() []*sys.Introduction {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	r := make([]*sys.Introduction, len(c.db.intros))
+	for i, in := range c.db.intros {
+		x := *in
+		r[i] = &x
+	}
+	return r
+}
+
+// AcceptIntroduction makes a contact of the party introduced to us with
+// fingerprint fp. Once the other side accepts too, the two can dial each
+// other. The introducer made up the dial keys and knows them, but cannot
+// pose as either side, since connections are authenticated by the pinned
+// signature keys.
+func (c *Core) AcceptIntroduction(fp *sys.Fingerprint) (sys.View, os.Error) {
+	c.lk.Lock()
+	in := c.db.getIntro(fp)
+	if in == nil {
+		c.lk.Unlock()
+		return nil, os.EINVAL
+	}
+	by := "intro"
+	if f := c.db.GetByFingerprint(&in.By); f != nil {
+		by = "intro by " + f.Name
+	}
+
+	u := &sys.FriendUpdate{}
+	if in.Name != "" && sys.ValidName(in.Name) == nil {
+		u.SetName(in.Name)
+	}
+	if in.Email != "" && sys.ValidEmail(in.Email) == nil {
+		u.SetEmail(in.Email)
+	}
+	if in.Addr != "" && sys.ValidAddr(in.Addr) == nil {
+		u.SetAddr(in.Addr)
+	}
+	u.SetSignatureKey(in.SigKey).SetDialKey(in.DialKey).SetAcceptKey(in.AcceptKey)
+
+	// The introduction is checked in full before the friend is added, so
+	// that a refused one leaves no trace
+	slot := c.db.UnusedSlot()
+	f := &friend{Friend: sys.Friend{Slot: slot}}
+	f.Init()
+	err := c.checkUpdate(f, u)
+	if kfp := in.SigKey.Fingerprint(); err == nil && c.db.GetByFingerprint(&kfp) != nil {
+		err = &sys.UpdateError{"SignatureKey", "key belongs to another friend"}
+	}
+	if err == nil {
+		err = c.db.Attach(slot, f)
+	}
+	if err != nil {
+		c.lk.Unlock()
+		return nil, err
+	}
+	c.publish(sys.EvFriendAdded, slot, "")
+	c.applyUpdate(f, u, by)
+	c.db.removeIntro(fp)
+	c.lk.Unlock()
+
+	c.Sync(slot)
+	c.Save()
+	return f, nil
+}
+
+// DeclineIntroduction forgets the introduction to the party with
+// fingerprint fp
+func (c *Core) DeclineIntroduction(fp *sys.Fingerprint) os.Error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if !c.db.removeIntro(fp) {
+		return os.EINVAL
+	}
+	c.db.Save()
+	return nil
+}
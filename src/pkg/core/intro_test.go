@@ -0,0 +1,73 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+	"tonika/sys"
+)
+
+func TestAcceptIntroductionRefused(t *testing.T) {
+	db, err := MakeFriendDb("", nil)
+	if err != nil {
+		t.Fatalf("make db: %s", err)
+	}
+	alice, _ := keyedFriend("Alice")
+	bob, _ := keyedFriend("Bob")
+	db.Attach(db.UnusedSlot(), alice)
+	in, _, err := sys.MakeIntroductions(alice, bob)
+	if err != nil {
+		t.Fatalf("make intro: %s", err)
+	}
+	in.By = *alice.GetFingerprint()
+	db.addIntro(in)
+	fp := in.Fingerprint()
+
+	// Carol already dials with the key the introduction hands out
+	carol, _ := keyedFriend("Carol")
+	carol.DialKey = in.DialKey
+	db.Attach(db.UnusedSlot(), carol)
+
+	c := testCore(db)
+	s := c.Subscribe(nil, 10)
+	n, audit := len(db.recs), len(db.audit)
+	_, err = c.AcceptIntroduction(&fp)
+	if ue, ok := err.(*sys.UpdateError); !ok || ue.Field != "DialKey" {
+		t.Errorf("expected a DialKey error, got %v", err)
+	}
+	if len(db.recs) != n || len(db.audit) != audit {
+		t.Errorf("refused introduction left a friend or a change behind")
+	}
+	if len(s.C) != 0 {
+		e := <-s.C
+		t.Errorf("refused introduction published %s", e.Topic)
+	}
+	if db.getIntro(&fp) == nil {
+		t.Errorf("refused introduction forgotten")
+	}
+
+	// The introduced key has been revoked since
+	carol.DialKey = nil
+	db.Revoke(&fp)
+	_, err = c.AcceptIntroduction(&fp)
+	if ue, ok := err.(*sys.UpdateError); !ok || ue.Field != "SignatureKey" {
+		t.Errorf("expected a SignatureKey error, got %v", err)
+	}
+	if len(db.recs) != n || len(s.C) != 0 {
+		t.Errorf("refused introduction left a trace")
+	}
+}
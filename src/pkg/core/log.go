@@ -19,12 +19,46 @@ package core
 
 import (
 	"io/ioutil"
+	"os"
+	"path"
 	"time"
+	"tonika/slog"
 )
 
+var logger = slog.For("core")
+
+// openLog starts writing the records of sink s to the files
+// tonika.log-00001, etc., in the cache directory
+func openLog(cfg *Config, s *slog.Sink) os.Error {
+	l, err := slog.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	s.SetLevel(l)
+	return s.SetOutput(path.Join(cfg.CacheDir, "tonika.log"),
+		cfg.LogMaxSize, cfg.LogMaxAge*1e9, cfg.LogKeep)
+}
+
+// logSink returns the sink of the records of this identity. The host
+// shares its sink with the records that belong to no identity in
+// particular; each peer has one of its own.
+func (c *Core) logSink() *slog.Sink {
+	if c.sink != nil {
+		return c.sink
+	}
+	return slog.Shared()
+}
+
 func (c *Core) logLoop(name string) {
 	for {
 		time.Sleep(10e9) // every 10 seconds
-		ioutil.WriteFile(name, []byte(c.dumpProf()), 0600)
+		if c.isStopped() {
+			return
+		}
+		c.writeLog(name)
 	}
 }
+
+func (c *Core) writeLog(name string) os.Error {
+	return ioutil.WriteFile(name, []byte(c.dumpProf()), 0600)
+}
@@ -0,0 +1,173 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"tonika/sys"
+)
+
+// Friends files carry a format version. Files of older versions are brought
+// up to date by running the registered migrations in order, and files from
+// a newer build are refused, since saving them would lose what we do not
+// understand.
+//
+// To change the format: increase dbVersion, and append to dbMigrations a
+// function that upgrades a jsonDb of the previous version in place.
+
+const dbVersion = 5
+
+type dbMigration func(book *jsonDb) os.Error
+
+// dbMigrations[i] upgrades a jsonDb from version i to version i+1
+var dbMigrations = []dbMigration{
+	migrateAddFingerprints,
+	migrateAddGroups,
+	migrateAddAudit,
+	migrateAddIntros,
+	migrateAddRevoked,
+}
+
+func migrateDb(book *jsonDb) os.Error {
+	if len(dbMigrations) != dbVersion {
+		return os.ErrorString("db, missing migration")
+	}
+	if book.Version > dbVersion {
+		return &Error{ErrNewer, book.Version}
+	}
+	if book.Version < 0 {
+		return &Error{ErrDecode, book.Version}
+	}
+	for book.Version < dbVersion {
+		if err := dbMigrations[book.Version](book); err != nil {
+			return err
+		}
+		logger.Infof("db, migrated friends file from version %d to %d", 
+			book.Version, book.Version+1)
+		book.Version++
+	}
+	return nil
+}
+
+// saveMigratedDb saves db, read from the friends file src, if it had to be
+// migrated, after keeping a copy of src as it was before
+func saveMigratedDb(db *buttress, src string) os.Error {
+	if db.from >= dbVersion {
+		return nil
+	}
+	if err := backupMigratedDb(src, db.path, db.from); err != nil {
+		return err
+	}
+	if err := db.Save(); err != nil {
+		return err
+	}
+	db.from = dbVersion
+	return nil
+}
+
+// backupMigratedDb keeps a copy of the friends file src, as it was before
+// migration, next to the friends file p
+func backupMigratedDb(src, p string, from int) os.Error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return &Error{ErrLoad, err}
+	}
+	name := fmt.Sprintf("%s.v%d", p, from)
+	if err = ioutil.WriteFile(name, data, 0600); err != nil {
+		return &Error{ErrSave, err}
+	}
+	return nil
+}
+
+// Version 0 to 1: store the full key fingerprint of every friend with a
+// signature key, and of ourselves
+func migrateAddFingerprints(book *jsonDb) os.Error {
+	if book.Me.SigKey != "" {
+		pk, err := sys.ParseSigKey(book.Me.SigKey)
+		if err != nil || pk == nil {
+			return &Error{ErrDecode, book.Me.SigKey}
+		}
+		fp := pk.Fingerprint()
+		book.Me.Fingerprint = fp.String()
+	}
+	for i := 0; i < len(book.Friends); i++ {
+		f := &book.Friends[i]
+		if f.SigKey == "" || f.Fingerprint != "" {
+			continue
+		}
+		pk, err := sys.ParseSigPubKey(f.SigKey)
+		if err != nil || pk == nil {
+			continue
+		}
+		fp := pk.Fingerprint()
+		f.Fingerprint = fp.String()
+	}
+	return nil
+}
+
+// Version 1 to 2: friend groups, none to begin with
+func migrateAddGroups(book *jsonDb) os.Error {
+	if book.Groups == nil {
+		book.Groups = []jsonGroup{}
+	}
+	return nil
+}
+
+// Version 2 to 3: audit log of changes, empty to begin with
+func migrateAddAudit(book *jsonDb) os.Error {
+	if book.Audit == nil {
+		book.Audit = []jsonChange{}
+	}
+	return nil
+}
+
+// Version 3 to 4: introductions waiting for an answer, none to begin with
+func migrateAddIntros(book *jsonDb) os.Error {
+	if book.Intros == nil {
+		book.Intros = []jsonIntro{}
+	}
+	return nil
+}
+
+// Version 4 to 5: fingerprints of revoked identities, from the good
+// revocation certificates that friends carry
+func migrateAddRevoked(book *jsonDb) os.Error {
+	revoked := []string{}
+	for _, f := range book.Friends {
+		if f.Revocation == "" {
+			continue
+		}
+		pk, err := sys.ParseSigPubKey(f.SigKey)
+		if err != nil || pk == nil {
+			continue
+		}
+		rc, err := sys.ParseRevocationCert(f.Revocation)
+		if err != nil || rc.Verify(pk) != nil {
+			continue
+		}
+		revoked = appendString(revoked, rc.Fingerprint.String())
+	}
+	if book.Revoked == nil {
+		book.Revoked = revoked
+	}
+	return nil
+}
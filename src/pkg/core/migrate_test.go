@@ -0,0 +1,135 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+// writeOldDb saves db at p in the clear, as the given format version
+func writeOldDb(t *testing.T, db *buttress, p string, version int) string {
+	book := db.toJSON()
+	book.Version = version
+	data, err := json.Marshal(book)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	writeTestFile(t, p, string(data))
+	return string(data)
+}
+
+func TestMigrateDb(t *testing.T) {
+	dir := testDir(t, "tonika-migrate-test")
+	defer os.RemoveAll(dir)
+	db := testDb(t, path.Join(dir, "db"), nil)
+	bob, bk := keyedFriend("Bob")
+	rc, err := sys.MakeRevocationCert(bk, "stolen")
+	if err != nil {
+		t.Fatalf("make cert: %s", err)
+	}
+	bob.Revocation = rc
+	db.Attach(db.UnusedSlot(), bob)
+
+	// Version 0 had no fingerprints, groups, audit, intros or revocations
+	book := db.toJSON()
+	book.Version = 0
+	for i := 0; i < len(book.Friends); i++ {
+		book.Friends[i].Fingerprint = ""
+	}
+	book.Groups, book.Audit, book.Intros, book.Revoked = nil, nil, nil, nil
+	if err = migrateDb(book); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	if book.Version != dbVersion {
+		t.Errorf("migrated to version %d", book.Version)
+	}
+	if book.Groups == nil || book.Audit == nil || book.Intros == nil {
+		t.Errorf("missing sections after migration")
+	}
+	fp := bob.GetFingerprint().String()
+	found := false
+	for _, f := range book.Friends {
+		if f.Name == "Bob" {
+			found = f.Fingerprint == fp
+		}
+	}
+	if !found {
+		t.Errorf("fingerprint not restored")
+	}
+	if len(book.Revoked) != 1 || book.Revoked[0] != fp {
+		t.Errorf("expected %s revoked, got %v", fp, book.Revoked)
+	}
+
+	// Newer and nonsense versions are refused
+	book.Version = dbVersion + 1
+	if err = migrateDb(book); !IsNewerError(err) {
+		t.Errorf("newer version: got %v", err)
+	}
+	book.Version = -1
+	if err = migrateDb(book); !isError(err, ErrDecode) {
+		t.Errorf("negative version: got %v", err)
+	}
+
+	// A missing migration is an error, not a crash
+	all := dbMigrations
+	dbMigrations = dbMigrations[0 : len(dbMigrations)-1]
+	book.Version = 0
+	err = migrateDb(book)
+	dbMigrations = all
+	if err == nil {
+		t.Errorf("migrated with a missing migration")
+	}
+}
+
+func TestMigrateBackup(t *testing.T) {
+	dir := testDir(t, "tonika-migrate-backup-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	db := testDb(t, p, nil)
+	old := fmt.Sprintf("%s.v%d", p, dbVersion-1)
+
+	// Every way of opening the friends file keeps the old version
+	data := writeOldDb(t, db, p, dbVersion-1)
+	if _, err := LoadFriendDb(p, nil); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	checkTestFile(t, old, data)
+
+	os.Remove(old)
+	data = writeOldDb(t, db, p, dbVersion-1)
+	pass := []byte("pass")
+	if err := ChangeFriendDbPassphrase(p, nil, pass); err != nil {
+		t.Fatalf("change passphrase: %s", err)
+	}
+	checkTestFile(t, old, data)
+	db2, err := ReadFriendDb(p, pass)
+	if err != nil || db2.from != dbVersion {
+		t.Errorf("passphrase change did not save a migrated file (%v)", err)
+	}
+
+	os.Remove(old)
+	data = writeOldDb(t, db, p, dbVersion-1)
+	if err = WriteRevocationCert(p, nil, path.Join(dir, "cert"), "test"); err != nil {
+		t.Fatalf("write cert: %s", err)
+	}
+	checkTestFile(t, old, data)
+}
@@ -0,0 +1,132 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package core
+
+import (
+	"gob"
+	"io/ioutil"
+	"os"
+	"tonika/sys"
+)
+
+// Revocation certificates travel over dialer connections with this subject
+const revokeSubject = "revoke"
+
+func (c *Core) revokeLoop() {
+	c.lk.Lock()
+	d := c.dialer
+	c.lk.Unlock()
+	for {
+		_, conn := d.Accept(revokeSubject)
+		if conn == nil {
+			continue
+		}
+		go func() {
+			p := &sys.U_RevocationCert{}
+			err := gob.NewDecoder(conn).Decode(p)
+			conn.Close()
+			if err != nil {
+				return
+			}
+			rc, err := sys.UnprotoRevocationCert(p)
+			if err != nil {
+				return
+			}
+			c.AcceptRevocation(rc)
+		}()
+	}
+}
+
+// AcceptRevocation marks the friend named by the certificate as revoked,
+// drops all connections to them, and relays the certificate to all other
+// friends. Their fingerprint is never accepted again, even if the friend is
+// removed. Certificates for unknown identities, or not signed by the key we
+// hold, are rejected.
+func (c *Core) AcceptRevocation(rc *sys.RevocationCert) os.Error {
+	c.lk.Lock()
+	f := c.db.GetByFingerprint(&rc.Fingerprint)
+	if f == nil || f.GetSignatureKey() == nil {
+		c.lk.Unlock()
+		return os.EINVAL
+	}
+	if f.Revocation != nil {
+		c.lk.Unlock()
+		return nil
+	}
+	if err := rc.Verify(f.GetSignatureKey()); err != nil {
+		c.lk.Unlock()
+		return err
+	}
+	f.Revocation = rc
+	c.db.Revoke(&rc.Fingerprint)
+	c.log.With(*f.GetId()).Warnf("Identity of %s was revoked: %s", f.GetName(), rc.Reason)
+	c.dialer.Revoke(*f.GetId())
+	c.publish(sys.EvFriendRevoked, f.Slot, f.Name+": "+rc.Reason)
+	c.db.Save()
+	c.lk.Unlock()
+
+	go c.relayRevocation(rc)
+	return nil
+}
+
+// PublishRevocation sends a revocation certificate for our own identity
+// to all of our friends
+func (c *Core) PublishRevocation(rc *sys.RevocationCert) os.Error {
+	c.lk.Lock()
+	me := c.db.GetMe()
+	c.lk.Unlock()
+	if err := rc.Verify(me.GetSignatureKey().PubKey()); err != nil {
+		return err
+	}
+	go c.relayRevocation(rc)
+	return nil
+}
+
+func (c *Core) relayRevocation(rc *sys.RevocationCert) {
+	for _, v := range c.Enumerate() {
+		if !v.IsOnline() || v.IsRevoked() || v.GetId() == nil {
+			continue
+		}
+		conn := c.dialer.Dial(*v.GetId(), revokeSubject)
+		if conn == nil {
+			continue
+		}
+		gob.NewEncoder(conn).Encode(rc.Proto())
+		conn.Close()
+	}
+}
+
+// WriteRevocationCert makes a revocation certificate for the identity in
+// dbfile and writes it to out, so it can be kept somewhere safe and
+// published if the identity key is ever compromised.
+func WriteRevocationCert(dbfile string, pass []byte, out, reason string) os.Error {
+	db, err := LoadFriendDb(dbfile, pass)
+	if err != nil {
+		return err
+	}
+	rc, err := sys.MakeRevocationCert(db.GetMe().GetSignatureKey(), reason)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(out, []byte(rc.String()), 0600); err != nil {
+		return &Error{ErrSave, err}
+	}
+	return nil
+}
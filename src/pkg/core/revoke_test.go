@@ -0,0 +1,134 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+// keyedFriend returns a friend with a new signature key
+func keyedFriend(name string) (*friend, *sys.SigKey) {
+	k := sys.GenerateSigKey()
+	fp := k.Fingerprint()
+	id := fp.Id()
+	return &friend{Friend: sys.Friend{Name: name, Id: &id, Fingerprint: &fp,
+		SignatureKey: k.PubKey()}}, k
+}
+
+func testCore(db *buttress) *Core {
+	return &Core{db: db, bus: sys.MakeEventBus(10, nil)}
+}
+
+func TestBadRevocationKept(t *testing.T) {
+	dir := testDir(t, "tonika-revoke-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	db := testDb(t, p, nil)
+	bob, _ := keyedFriend("Bob")
+	rc, err := sys.MakeRevocationCert(sys.GenerateSigKey(), "not bob's")
+	if err != nil {
+		t.Fatalf("make cert: %s", err)
+	}
+	bob.Revocation = rc
+	db.Attach(db.UnusedSlot(), bob)
+	if err = db.Save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	db, err = ReadFriendDb(p, nil)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	f := db.GetByFingerprint(bob.GetFingerprint())
+	if f == nil {
+		t.Fatalf("friend with a bad certificate dropped")
+	}
+	if f.Revocation != nil || f.IsRevoked() {
+		t.Errorf("bad certificate kept")
+	}
+}
+
+func TestRevokedForever(t *testing.T) {
+	dir := testDir(t, "tonika-revoke-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	db := testDb(t, p, nil)
+	bob, bk := keyedFriend("Bob")
+	slot := db.UnusedSlot()
+	db.Attach(slot, bob)
+	rc, err := sys.MakeRevocationCert(bk, "stolen")
+	if err != nil {
+		t.Fatalf("make cert: %s", err)
+	}
+	bob.Revocation = rc
+	db.Revoke(&rc.Fingerprint)
+
+	// Removing the friend does not forget the revocation
+	db.Remove(slot)
+	if err = db.Save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	db, err = ReadFriendDb(p, nil)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !db.IsRevoked(bob.GetFingerprint()) {
+		t.Fatalf("revocation lost")
+	}
+	again, _ := keyedFriend("Bob again")
+	again.Fingerprint, again.SignatureKey = bob.Fingerprint, bob.SignatureKey
+	if db.Attach(db.UnusedSlot(), again) == nil {
+		t.Errorf("revoked fingerprint attached")
+	}
+
+	c := testCore(db)
+	slot = db.UnusedSlot()
+	db.Attach(slot, &friend{Friend: sys.Friend{Name: "New"}})
+	_, err = c.Update(slot, (&sys.FriendUpdate{}).SetSignatureKey(bk.PubKey()), "test")
+	if ue, ok := err.(*sys.UpdateError); !ok || ue.Field != "SignatureKey" {
+		t.Errorf("revoked key accepted by update: %v", err)
+	}
+}
+
+func TestUpdateClearsRevocation(t *testing.T) {
+	db, err := MakeFriendDb("", nil)
+	if err != nil {
+		t.Fatalf("make db: %s", err)
+	}
+	bob, bk := keyedFriend("Bob")
+	slot := db.UnusedSlot()
+	db.Attach(slot, bob)
+	rc, _ := sys.MakeRevocationCert(bk, "stolen")
+	bob.Revocation = rc
+	db.Revoke(&rc.Fingerprint)
+
+	// Bob comes back with a new key
+	c := testCore(db)
+	nk := sys.GenerateSigKey()
+	v, err := c.Update(slot, (&sys.FriendUpdate{}).SetSignatureKey(nk.PubKey()), "test")
+	if err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if v.IsRevoked() || bob.Revocation != nil {
+		t.Errorf("new key still revoked")
+	}
+	if !db.IsRevoked(&rc.Fingerprint) {
+		t.Errorf("old key no longer revoked")
+	}
+}
@@ -0,0 +1,256 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The friends file is never rewritten in place. A new version is written
+// to a temporary file, synced to disk and renamed over the old one, after
+// the old one has been copied to a timestamped backup (at most once every
+// dbBackupEvery, so that a burst of saves does not push out all older
+// backups). Each file ends in a checksum line, so that a truncated or
+// damaged file is detected at load time and the newest good backup is used
+// instead.
+
+const (
+	dbBackups     = 5          // Number of backups to keep
+	dbBackupEvery = 3600 * 1e9 // Minimum time between backups, in nanoseconds
+	dbSumPrefix   = "\ntonika-sum sha256 "
+)
+
+func dbChecksum(data []byte) string {
+	h := sha256.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum())
+}
+
+// readDbFile reads the friends file at p and verifies its checksum.
+// Files written before checksums were introduced are accepted as is.
+func readDbFile(p string) ([]byte, os.Error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, &Error{ErrLoad, err}
+	}
+	k := bytes.LastIndex(data, []byte(dbSumPrefix))
+	if k < 0 {
+		return data, nil
+	}
+	sum := strings.TrimSpace(string(data[k+len(dbSumPrefix):]))
+	data = data[0:k]
+	if sum != dbChecksum(data) {
+		return nil, &Error{ErrCorrupt, p}
+	}
+	return data, nil
+}
+
+// writeDbFile atomically replaces the friends file at p with data
+func writeDbFile(p string, data []byte) os.Error {
+	tmp := p + ".tmp"
+	file, err := os.Open(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		logger.Errorf("Cannot open friends file \"%s\"", tmp)
+		return &Error{ErrSave, err}
+	}
+	sum := dbSumPrefix + dbChecksum(data) + "\n"
+	if _, err = file.Write(data); err == nil {
+		_, err = file.Write([]byte(sum))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return &Error{ErrSave, err}
+	}
+	backupDbFile(p)
+	if err = os.Rename(tmp, p); err != nil {
+		return &Error{ErrSave, err}
+	}
+	if err = syncDir(p); err != nil {
+		return &Error{ErrSave, err}
+	}
+	return nil
+}
+
+// syncDir flushes the directory holding p to disk, so that a rename into it
+// survives a crash
+func syncDir(p string) os.Error {
+	dir, _ := path.Split(p)
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// backupTime returns when the backup b was made, from its name
+func backupTime(b string) int64 {
+	k := strings.LastIndex(b, ".bak.")
+	if k < 0 {
+		return 0
+	}
+	t, err := strconv.Atoi64(b[k+len(".bak."):])
+	if err != nil {
+		return 0
+	}
+	return t
+}
+
+// backupDbFile copies a good friends file at p to a new timestamped backup,
+// unless the newest backup is less than dbBackupEvery old
+func backupDbFile(p string) {
+	now := time.Nanoseconds()
+	if bb := listDbBackups(p); len(bb) > 0 && now-backupTime(bb[0]) < dbBackupEvery {
+		return
+	}
+	if _, err := readDbFile(p); err != nil {
+		return
+	}
+	if _, err := copyDbBackup(p); err != nil {
+		logger.Warnf("Cannot back up friends file \"%s\": %s", p, err)
+	}
+}
+
+// copyDbBackup copies the friends file at p, as it is, to a new timestamped
+// backup whose name it returns, and removes all but the newest dbBackups
+// backups
+func copyDbBackup(p string) (string, os.Error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s.bak.%020d", p, time.Nanoseconds())
+	if err = ioutil.WriteFile(name, data, 0600); err != nil {
+		return "", err
+	}
+	bb := listDbBackups(p)
+	for i := dbBackups; i < len(bb); i++ {
+		os.Remove(bb[i])
+	}
+	return name, nil
+}
+
+// listDbBackups returns the backups of the friends file at p, newest first
+func listDbBackups(p string) []string {
+	dir, file := path.Split(p)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	pfx := file + ".bak."
+	names := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name, pfx) && fi.IsRegular() {
+			names = names[0 : len(names)+1]
+			names[len(names)-1] = path.Join(dir, fi.Name)
+		}
+	}
+	sort.SortStrings(names)
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return names
+}
+
+// LoadFriendDb reads the friends file at p. If it is damaged or missing,
+// the newest backup that reads correctly is restored in its place. The
+// returned error is ErrCorrupt if a damaged file or backups are present
+// but nothing could be recovered, in which case a new identity must not be
+// made over them, or ErrPass if some backup could be recovered with another
+// passphrase.
+func LoadFriendDb(p string, pass []byte) (*buttress, os.Error) {
+	db, err := ReadFriendDb(p, pass)
+	if err == nil {
+		if err = saveMigratedDb(db, p); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	if IsPassphraseError(err) || IsNewerError(err) {
+		return nil, err
+	}
+	backups := listDbBackups(p)
+	if !isFile(p) && len(backups) == 0 {
+		return nil, err
+	}
+	logger.Warnf("Friends file \"%s\" is missing or damaged (%s), looking for a backup", p, err)
+	locked := 0
+	for _, b := range backups {
+		bdb, berr := ReadFriendDb(b, pass)
+		if IsPassphraseError(berr) {
+			locked++
+			continue
+		}
+		if berr != nil {
+			continue
+		}
+		logger.Warnf("Recovering friends file from backup \"%s\"", b)
+		if isFile(p) {
+			// Keep every damaged file, in case one can be recovered by hand
+			damaged := fmt.Sprintf("%s.damaged.%020d", p, time.Nanoseconds())
+			if err := os.Rename(p, damaged); err != nil {
+				return nil, &Error{ErrSave, err}
+			}
+			logger.Warnf("Damaged friends file moved to \"%s\"", damaged)
+		}
+		bdb.path = p
+		if bdb.from < dbVersion {
+			berr = saveMigratedDb(bdb, b)
+		} else {
+			berr = bdb.Save()
+		}
+		if berr != nil {
+			return nil, berr
+		}
+		return bdb, nil
+	}
+	if locked > 0 {
+		logger.Errorf("%d backups of friends file \"%s\" are locked with another passphrase",
+			locked, p)
+		return nil, &Error{ErrPass, p}
+	}
+	logger.Errorf("No good backup of friends file \"%s\" was found", p)
+	return nil, &Error{ErrCorrupt, p}
+}
@@ -0,0 +1,201 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func isError(err os.Error, no int) bool {
+	e, ok := err.(*Error)
+	return ok && e.no == no
+}
+
+// damageTestFile flips a byte in the middle of the file at p
+func damageTestFile(t *testing.T, p string) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil || len(data) == 0 {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	data[len(data)/2] ^= 0x20
+	if err = ioutil.WriteFile(p, data, 0600); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+}
+
+// countTestFiles returns how many files in dir have a name containing s
+func countTestFiles(t *testing.T, dir, s string) int {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("readdir: %s", err)
+	}
+	n := 0
+	for _, fi := range infos {
+		if strings.Index(fi.Name, s) >= 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDbFile(t *testing.T) {
+	dir := testDir(t, "tonika-dbfile-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+
+	if err := writeDbFile(p, []byte("first")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if data, err := readDbFile(p); err != nil || string(data) != "first" {
+		t.Errorf("read back %q (%v)", data, err)
+	}
+	if n := countTestFiles(t, dir, ".tmp"); n != 0 {
+		t.Errorf("%d temporary files left", n)
+	}
+
+	// A damaged file fails its checksum
+	damageTestFile(t, p)
+	if _, err := readDbFile(p); !isError(err, ErrCorrupt) {
+		t.Errorf("damaged file: expected ErrCorrupt, got %v", err)
+	}
+
+	// A file from before checksums is read as it is
+	writeTestFile(t, p, "legacy")
+	if data, err := readDbFile(p); err != nil || string(data) != "legacy" {
+		t.Errorf("legacy file: read %q (%v)", data, err)
+	}
+}
+
+func TestDbBackupEvery(t *testing.T) {
+	dir := testDir(t, "tonika-dbbackup-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+
+	// Nothing to back up on the first write, one backup on the second,
+	// and none on the third, which comes too soon after it
+	for i := 0; i < 3; i++ {
+		if err := writeDbFile(p, []byte("data")); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+	bb := listDbBackups(p)
+	if len(bb) != 1 {
+		t.Fatalf("expected 1 backup, got %d", len(bb))
+	}
+	if data, err := readDbFile(bb[0]); err != nil || string(data) != "data" {
+		t.Errorf("backup reads %q (%v)", data, err)
+	}
+
+	// Old backups are pruned
+	for i := 0; i < dbBackups+2; i++ {
+		if _, err := copyDbBackup(p); err != nil {
+			t.Fatalf("backup: %s", err)
+		}
+	}
+	if n := len(listDbBackups(p)); n != dbBackups {
+		t.Errorf("expected %d backups, got %d", dbBackups, n)
+	}
+}
+
+func TestLoadRecover(t *testing.T) {
+	dir := testDir(t, "tonika-recover-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	pass := []byte("pass")
+	db0 := testDb(t, p, pass)
+	if _, err := copyDbBackup(p); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+	damageTestFile(t, p)
+
+	db, err := LoadFriendDb(p, pass)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if db.me.Id != db0.me.Id || len(db.recs) != 1 {
+		t.Errorf("recovered the wrong db")
+	}
+	if n := countTestFiles(t, dir, ".damaged."); n != 1 {
+		t.Errorf("expected the damaged file to be kept, found %d", n)
+	}
+	if _, err = ReadFriendDb(p, pass); err != nil {
+		t.Errorf("recovered file does not read: %s", err)
+	}
+
+	// Nothing good left to recover from
+	for _, b := range listDbBackups(p) {
+		damageTestFile(t, b)
+	}
+	damageTestFile(t, p)
+	if _, err = LoadFriendDb(p, pass); !isError(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+
+	// No file and no backups is not an error of its own
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0700)
+	if _, err = LoadFriendDb(p, pass); !isError(err, ErrLoad) {
+		t.Errorf("expected ErrLoad, got %v", err)
+	}
+}
+
+func TestLoadRecoverPass(t *testing.T) {
+	dir := testDir(t, "tonika-recover-pass-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	testDb(t, p, []byte("pass"))
+	if _, err := copyDbBackup(p); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+	damageTestFile(t, p)
+
+	// The backup is good, but needs the right passphrase
+	if _, err := LoadFriendDb(p, []byte("wrong")); !isError(err, ErrPass) {
+		t.Errorf("expected ErrPass, got %v", err)
+	}
+	if n := countTestFiles(t, dir, ".damaged."); n != 0 {
+		t.Errorf("damaged file moved without recovering")
+	}
+	if _, err := LoadFriendDb(p, []byte("pass")); err != nil {
+		t.Errorf("load: %s", err)
+	}
+}
+
+func TestLoadRecoverMigrated(t *testing.T) {
+	dir := testDir(t, "tonika-recover-migrate-test")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "db")
+	db0 := testDb(t, p, nil)
+
+	// A backup written by the previous version
+	data := writeOldDb(t, db0, p+".bak.00000000000000000001", dbVersion-1)
+	damageTestFile(t, p)
+
+	db, err := LoadFriendDb(p, nil)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if db.me.Id != db0.me.Id || db.from != dbVersion {
+		t.Errorf("recovered the wrong db")
+	}
+	checkTestFile(t, fmt.Sprintf("%s.v%d", p, dbVersion-1), data)
+}
@@ -0,0 +1,261 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"os"
+	"strconv"
+	"time"
+	"tonika/sys"
+)
+
+// Every change made through Update and UpdateMy is recorded in an audit log,
+// kept in the friends file so that it is encrypted along with it. Only the
+// most recent maxAudit changes are kept.
+
+const maxAudit = 1000
+
+type jsonChange struct {
+	Time  int64
+	Slot  string
+	By    string
+	Field string
+	Old   string
+	New   string
+}
+
+func (db *buttress) record(slot int, by, field, from, to string) {
+	ch := &sys.Change{time.Nanoseconds(), slot, by, field, from, to}
+	n := len(db.audit)
+	if n >= maxAudit {
+		n = maxAudit - 1
+	}
+	a := make([]*sys.Change, n+1)
+	copy(a, db.audit[len(db.audit)-n:])
+	a[n] = ch
+	db.audit = a
+}
+
+// GetHistory returns the changes made to slot, oldest first
+func (db *buttress) GetHistory(slot int) []*sys.Change {
+	var n int
+	for _, ch := range db.audit {
+		if ch.Slot == slot {
+			n++
+		}
+	}
+	r := make([]*sys.Change, n)
+	i := 0
+	for _, ch := range db.audit {
+		if ch.Slot == slot {
+			c := *ch
+			r[i] = &c
+			i++
+		}
+	}
+	return r
+}
+
+func (db *buttress) auditToJSON() []jsonChange {
+	r := make([]jsonChange, len(db.audit))
+	for i, ch := range db.audit {
+		r[i] = jsonChange{ch.Time, strconv.Itoa(ch.Slot), ch.By, ch.Field, ch.Old, ch.New}
+	}
+	return r
+}
+
+func (db *buttress) parseAudit(audit []jsonChange) {
+	if len(audit) > maxAudit {
+		audit = audit[len(audit)-maxAudit:]
+	}
+	db.audit = make([]*sys.Change, 0, len(audit))
+	for _, jc := range audit {
+		slot, err := strconv.Atoi(jc.Slot)
+		if err != nil {
+			continue
+		}
+		n := len(db.audit)
+		db.audit = db.audit[0 : n+1]
+		db.audit[n] = &sys.Change{jc.Time, slot, jc.By, jc.Field, jc.Old, jc.New}
+	}
+}
+
+// Update applies u to the friend at slot, on behalf of by. Either all
+// fields of u are applied, or none is and a *sys.UpdateError is returned.
+func (c *Core) Update(slot int, u *sys.FriendUpdate, by string) (sys.View, os.Error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	f := c.db.GetBySlot(slot)
+	if f == nil {
+		return nil, &sys.UpdateError{"", "no such friend"}
+	}
+	if err := c.checkUpdate(f, u); err != nil {
+		return nil, err
+	}
+	c.applyUpdate(f, u, by)
+	return f, nil
+}
+
+// checkUpdate returns a *sys.UpdateError if u cannot be applied to f, which
+// need not be attached yet. c.lk must be held.
+func (c *Core) checkUpdate(f *friend, u *sys.FriendUpdate) os.Error {
+	if u.Name != nil {
+		if err := sys.ValidName(*u.Name); err != nil {
+			return &sys.UpdateError{"Name", err.String()}
+		}
+	}
+	if u.Email != nil {
+		if err := sys.ValidEmail(*u.Email); err != nil {
+			return &sys.UpdateError{"Email", err.String()}
+		}
+	}
+	if u.Addr != nil {
+		if err := sys.ValidAddr(*u.Addr); err != nil {
+			return &sys.UpdateError{"Addr", err.String()}
+		}
+	}
+	if u.SignatureKey != nil {
+		fp := u.SignatureKey.Fingerprint()
+		if c.db.IsRevoked(&fp) {
+			return &sys.UpdateError{"SignatureKey", "key has been revoked"}
+		}
+		if c.db.CheckCollision(f, &fp) != nil {
+			return &sys.UpdateError{"SignatureKey", "key belongs to another friend"}
+		}
+	}
+	if u.DialKey != nil {
+		g := c.db.GetByDialKey(u.DialKey)
+		if g != nil && g != f {
+			return &sys.UpdateError{"DialKey", "key belongs to another friend"}
+		}
+	}
+	if u.AcceptKey != nil {
+		g := c.db.GetByAcceptKey(u.AcceptKey)
+		if g != nil && g != f {
+			return &sys.UpdateError{"AcceptKey", "key belongs to another friend"}
+		}
+	}
+	return nil
+}
+
+// applyUpdate applies u, checked by checkUpdate, to the friend f at slot
+// f.Slot, on behalf of by. c.lk must be held.
+func (c *Core) applyUpdate(f *friend, u *sys.FriendUpdate, by string) {
+	slot := f.Slot
+	var fp sys.Fingerprint
+	if u.SignatureKey != nil {
+		fp = u.SignatureKey.Fingerprint()
+	}
+	complete := f.IsComplete()
+	if u.Name != nil && *u.Name != f.Name {
+		c.db.record(slot, by, "Name", f.Name, *u.Name)
+		f.Name = *u.Name
+	}
+	if u.Email != nil && *u.Email != f.Email {
+		c.db.record(slot, by, "Email", f.Email, *u.Email)
+		f.Email = *u.Email
+	}
+	if u.Addr != nil && *u.Addr != f.Addr {
+		c.db.record(slot, by, "Addr", f.Addr, *u.Addr)
+		f.Addr = *u.Addr
+	}
+	if u.SignatureKey != nil && f.mismatch != "" && f.Fingerprint != nil && f.Fingerprint.Equal(&fp) {
+		// A key that matches the pinned fingerprint again
+		c.db.record(slot, by, "SignatureKey", "", "(matches fingerprint)")
+		f.SignatureKey = u.SignatureKey
+		f.mismatch = ""
+		if f.Revocation != nil && f.Revocation.Verify(f.SignatureKey) != nil {
+			f.Revocation = nil
+		}
+	}
+	if u.SignatureKey != nil && (f.Fingerprint == nil || !f.Fingerprint.Equal(&fp)) {
+		// The audit log shows fingerprints rather than whole keys
+		old := ""
+		if f.Fingerprint != nil {
+			old = f.Fingerprint.String()
+		}
+		c.db.record(slot, by, "Fingerprint", old, fp.String())
+		if old != "" {
+			c.publish(sys.EvKeyChanged, slot, f.Name+": "+fp.String())
+		}
+		f.SignatureKey = u.SignatureKey
+		f.Fingerprint = &fp
+		f.mismatch = ""
+		id := fp.Id()
+		f.Id = &id
+		// A certificate revokes the old key, not this one, which is not
+		// revoked as checked above
+		if f.IsRevoked() {
+			c.db.record(slot, by, "Revocation", "revoked", "")
+		}
+		f.Revocation = nil
+		f.revoked = false
+	}
+	if u.DialKey != nil && (f.DialKey == nil || !f.DialKey.Equal(*u.DialKey)) {
+		// Dial keys are shared secrets, so their values are not logged
+		c.db.record(slot, by, "DialKey", "", "(new key)")
+		f.DialKey = u.DialKey
+	}
+	if u.AcceptKey != nil && (f.AcceptKey == nil || !f.AcceptKey.Equal(*u.AcceptKey)) {
+		c.db.record(slot, by, "AcceptKey", "", "(new key)")
+		f.AcceptKey = u.AcceptKey
+	}
+	if !complete && f.IsComplete() {
+		c.publish(sys.EvInviteAccepted, slot, f.Name)
+	}
+}
+
+// UpdateMy applies u to our own details, on behalf of by
+func (c *Core) UpdateMy(u *sys.MyUpdate, by string) os.Error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	me := c.db.GetMe()
+	if u.Name != nil {
+		if err := sys.ValidName(*u.Name); err != nil {
+			return &sys.UpdateError{"Name", err.String()}
+		}
+	}
+	if u.Email != nil {
+		if err := sys.ValidEmail(*u.Email); err != nil {
+			return &sys.UpdateError{"Email", err.String()}
+		}
+	}
+	if u.ExtAddr != nil {
+		if err := sys.ValidAddr(*u.ExtAddr); err != nil {
+			return &sys.UpdateError{"ExtAddr", err.String()}
+		}
+	}
+	if u.Name != nil && *u.Name != me.Name {
+		c.db.record(sys.MySlot, by, "Name", me.Name, *u.Name)
+		me.Name = *u.Name
+	}
+	if u.Email != nil && *u.Email != me.Email {
+		c.db.record(sys.MySlot, by, "Email", me.Email, *u.Email)
+		me.Email = *u.Email
+	}
+	if u.ExtAddr != nil && *u.ExtAddr != me.ExtAddr {
+		c.db.record(sys.MySlot, by, "ExtAddr", me.ExtAddr, *u.ExtAddr)
+		me.ExtAddr = *u.ExtAddr
+	}
+	return nil
+}
+
+func (c *Core) GetHistory(slot int) []*sys.Change {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.db.GetHistory(slot)
+}
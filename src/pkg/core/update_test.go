@@ -0,0 +1,72 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+	"tonika/sys"
+)
+
+func TestUpdateAllOrNothing(t *testing.T) {
+	db, err := MakeFriendDb("", nil)
+	if err != nil {
+		t.Fatalf("make db: %s", err)
+	}
+	bob, _ := keyedFriend("Bob")
+	bob.Addr = "bob.org:80"
+	slot := db.UnusedSlot()
+	db.Attach(slot, bob)
+	carol, _ := keyedFriend("Carol")
+	db.Attach(db.UnusedSlot(), carol)
+	c := testCore(db)
+	n := len(db.audit)
+
+	tests := []struct {
+		u     *sys.FriendUpdate
+		field string
+	}{
+		{(&sys.FriendUpdate{}).SetName("Robert").SetAddr("nowhere"), "Addr"},
+		{(&sys.FriendUpdate{}).SetName("Robert").SetEmail("bob"), "Email"},
+		{(&sys.FriendUpdate{}).SetAddr("bob.net:80").SetName("a\nb"), "Name"},
+		{(&sys.FriendUpdate{}).SetName("Robert").SetSignatureKey(carol.GetSignatureKey()),
+			"SignatureKey"},
+	}
+	for i, tt := range tests {
+		_, err := c.Update(slot, tt.u, "test")
+		ue, ok := err.(*sys.UpdateError)
+		if !ok || ue.Field != tt.field {
+			t.Errorf("%d: expected an error in %s, got %v", i, tt.field, err)
+		}
+		if bob.Name != "Bob" || bob.Addr != "bob.org:80" || bob.Email != "" {
+			t.Errorf("%d: partly applied", i)
+		}
+	}
+	if len(db.audit) != n {
+		t.Errorf("refused updates recorded")
+	}
+
+	if _, err = c.Update(db.UnusedSlot(), (&sys.FriendUpdate{}).SetName("x"), "test"); err == nil {
+		t.Errorf("updated a missing friend")
+	}
+	_, err = c.Update(slot, (&sys.FriendUpdate{}).SetName("Robert").SetAddr("bob.net:80"), "test")
+	if err != nil || bob.Name != "Robert" || bob.Addr != "bob.net:80" {
+		t.Errorf("good update not applied (%v)", err)
+	}
+	if len(db.audit) != n+2 {
+		t.Errorf("expected 2 changes recorded, got %d", len(db.audit)-n)
+	}
+}
@@ -0,0 +1,209 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package crypto
+
+import (
+	"crypto/sha256"
+	"hash"
+	"os"
+)
+
+// Scrypt derives a keyLen-byte key from password and salt, following
+// Percival's "Stronger key derivation via sequential memory-hard functions".
+// N must be a power of 2 greater than 1.
+func Scrypt(password, salt []byte, N, r, p, keyLen int) ([]byte, os.Error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, os.ErrorString("scrypt, N must be a power of 2")
+	}
+	if r <= 0 || p <= 0 || keyLen <= 0 {
+		return nil, os.ErrorString("scrypt, bad parameters")
+	}
+	b := PBKDF2SHA256(password, salt, 1, p*128*r)
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*N*r)
+	for i := 0; i < p; i++ {
+		smix(b[i*128*r:], r, N, v, xy)
+	}
+	return PBKDF2SHA256(password, b, 1, keyLen), nil
+}
+
+// PBKDF2SHA256 implements PBKDF2 (RFC 2898) with HMAC-SHA256 as the PRF.
+func PBKDF2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	const hlen = 32
+	nblocks := (keyLen + hlen - 1) / hlen
+	dk := make([]byte, nblocks*hlen)
+	buf := make([]byte, 4)
+	for block := 1; block <= nblocks; block++ {
+		buf[0] = byte(block >> 24)
+		buf[1] = byte(block >> 16)
+		buf[2] = byte(block >> 8)
+		buf[3] = byte(block)
+		u := HMACSHA256(password, salt, buf)
+		t := make([]byte, len(u))
+		copy(t, u)
+		for n := 1; n < iter; n++ {
+			u = HMACSHA256(password, u)
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		copy(dk[(block-1)*hlen:], t)
+	}
+	return dk[0:keyLen]
+}
+
+// HMACSHA256 computes the HMAC-SHA256 of the concatenation of msgs under key.
+func HMACSHA256(key []byte, msgs ...[]byte) []byte {
+	h := newHMACSHA256(key)
+	for _, m := range msgs {
+		h.Write(m)
+	}
+	return h.Sum()
+}
+
+// hmacSHA256 computes the HMAC-SHA256 of what is written to it
+type hmacSHA256 struct {
+	inner, outer hash.Hash
+}
+
+func newHMACSHA256(key []byte) *hmacSHA256 {
+	const blocksize = 64
+	if len(key) > blocksize {
+		h := sha256.New()
+		h.Write(key)
+		key = h.Sum()
+	}
+	ipad := make([]byte, blocksize)
+	opad := make([]byte, blocksize)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := 0; i < blocksize; i++ {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+	h := &hmacSHA256{sha256.New(), sha256.New()}
+	h.inner.Write(ipad)
+	h.outer.Write(opad)
+	return h
+}
+
+func (h *hmacSHA256) Write(p []byte) (int, os.Error) { return h.inner.Write(p) }
+
+// Sum returns the HMAC. It may be called only once.
+func (h *hmacSHA256) Sum() []byte {
+	h.outer.Write(h.inner.Sum())
+	return h.outer.Sum()
+}
+
+func smix(b []byte, r, N int, v, xy []uint32) {
+	x := xy[0 : 32*r]
+	y := xy[32*r:]
+
+	j := 0
+	for i := 0; i < 32*r; i++ {
+		x[i] = uint32(b[j]) | uint32(b[j+1])<<8 | uint32(b[j+2])<<16 | uint32(b[j+3])<<24
+		j += 4
+	}
+	for i := 0; i < N; i++ {
+		copy(v[i*32*r:], x)
+		blockMix(x, y, r)
+	}
+	for i := 0; i < N; i++ {
+		k := int(x[(2*r-1)*16] & uint32(N-1))
+		for n := 0; n < 32*r; n++ {
+			x[n] ^= v[k*32*r+n]
+		}
+		blockMix(x, y, r)
+	}
+	j = 0
+	for _, w := range x {
+		b[j] = byte(w)
+		b[j+1] = byte(w >> 8)
+		b[j+2] = byte(w >> 16)
+		b[j+3] = byte(w >> 24)
+		j += 4
+	}
+}
+
+// blockMix computes BlockMix_salsa20/8 of b in place, using y as scratch space
+func blockMix(b, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[0:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := 0; k < 16; k++ {
+			x[k] ^= b[i*16+k]
+		}
+		salsa208(&x)
+		copy(y[i*16:], x[0:])
+	}
+	// Even blocks go to the first half, odd blocks to the second
+	for i := 0; i < r; i++ {
+		copy(b[i*16:], y[(2*i)*16:(2*i+1)*16])
+		copy(b[(r+i)*16:], y[(2*i+1)*16:(2*i+2)*16])
+	}
+}
+
+func rotl(a uint32, n uint) uint32 { return a<<n | a>>(32-n) }
+
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= rotl(x[0]+x[12], 7)
+		x[8] ^= rotl(x[4]+x[0], 9)
+		x[12] ^= rotl(x[8]+x[4], 13)
+		x[0] ^= rotl(x[12]+x[8], 18)
+
+		x[9] ^= rotl(x[5]+x[1], 7)
+		x[13] ^= rotl(x[9]+x[5], 9)
+		x[1] ^= rotl(x[13]+x[9], 13)
+		x[5] ^= rotl(x[1]+x[13], 18)
+
+		x[14] ^= rotl(x[10]+x[6], 7)
+		x[2] ^= rotl(x[14]+x[10], 9)
+		x[6] ^= rotl(x[2]+x[14], 13)
+		x[10] ^= rotl(x[6]+x[2], 18)
+
+		x[3] ^= rotl(x[15]+x[11], 7)
+		x[7] ^= rotl(x[3]+x[15], 9)
+		x[11] ^= rotl(x[7]+x[3], 13)
+		x[15] ^= rotl(x[11]+x[7], 18)
+
+		x[1] ^= rotl(x[0]+x[3], 7)
+		x[2] ^= rotl(x[1]+x[0], 9)
+		x[3] ^= rotl(x[2]+x[1], 13)
+		x[0] ^= rotl(x[3]+x[2], 18)
+
+		x[6] ^= rotl(x[5]+x[4], 7)
+		x[7] ^= rotl(x[6]+x[5], 9)
+		x[4] ^= rotl(x[7]+x[6], 13)
+		x[5] ^= rotl(x[4]+x[7], 18)
+
+		x[11] ^= rotl(x[10]+x[9], 7)
+		x[8] ^= rotl(x[11]+x[10], 9)
+		x[9] ^= rotl(x[8]+x[11], 13)
+		x[10] ^= rotl(x[9]+x[8], 18)
+
+		x[12] ^= rotl(x[15]+x[14], 7)
+		x[13] ^= rotl(x[12]+x[15], 9)
+		x[14] ^= rotl(x[13]+x[12], 13)
+		x[15] ^= rotl(x[14]+x[13], 18)
+	}
+	for i := 0; i < 16; i++ {
+		b[i] += x[i]
+	}
+}
@@ -0,0 +1,129 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"json"
+	"testing"
+)
+
+func TestScrypt(t *testing.T) {
+	k, err := Scrypt([]byte("password"), []byte("NaCl"), 1024, 8, 16, 64)
+	if err != nil {
+		t.Fatalf("scrypt: %s\n", err)
+	}
+	const want = "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+		"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"
+	if hex.EncodeToString(k) != want {
+		t.Fatalf("scrypt mismatch")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	plain := []byte("{\"Me\":{\"Name\":\"Petar\"}}")
+	sealed, err := SealWithPassphrase(plain, []byte("open sesame"))
+	if err != nil {
+		t.Fatalf("seal: %s\n", err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatalf("not recognized as sealed")
+	}
+	if IsSealed(plain) {
+		t.Fatalf("plain recognized as sealed")
+	}
+	if _, err = OpenWithPassphrase(sealed, []byte("open sesam")); err != ErrPassphrase {
+		t.Fatalf("wrong passphrase accepted")
+	}
+	plain2, err := OpenWithPassphrase(sealed, []byte("open sesame"))
+	if err != nil {
+		t.Fatalf("open: %s\n", err)
+	}
+	if string(plain2) != string(plain) {
+		t.Fatalf("mismatch")
+	}
+}
+
+func TestSealBounds(t *testing.T) {
+	sealed, err := SealWithPassphrase([]byte("text"), []byte("pass"))
+	if err != nil {
+		t.Fatalf("seal: %s\n", err)
+	}
+	s := jsonSealed{}
+	if err = json.Unmarshal(sealed, &s); err != nil {
+		t.Fatalf("unmarshal: %s\n", err)
+	}
+	bad := [][3]int{
+		[3]int{1 << 30, 8, 1},
+		[3]int{1 << 14, 1024, 1},
+		[3]int{1 << 14, 8, 1 << 20},
+		[3]int{1000, 8, 1},
+		[3]int{0, 8, 1},
+	}
+	for _, b := range bad {
+		s.N, s.R, s.P = b[0], b[1], b[2]
+		data, _ := json.Marshal(&s)
+		if _, err = OpenWithPassphrase(data, []byte("pass")); err == nil || err == ErrPassphrase {
+			t.Errorf("parameters %v not rejected", b)
+		}
+	}
+}
+
+func TestSealStream(t *testing.T) {
+	plain := make([]byte, 100000)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	var buf bytes.Buffer
+	w, err := NewSealWriter(&buf, []byte("pass"))
+	if err != nil {
+		t.Fatalf("writer: %s\n", err)
+	}
+	w.Write(plain[0:10])
+	w.Write(plain[10:])
+	if err = w.Close(); err != nil {
+		t.Fatalf("close: %s\n", err)
+	}
+	sealed := buf.Bytes()
+
+	r, err := NewSealReader(bytes.NewBuffer(sealed), []byte("pass"))
+	if err != nil {
+		t.Fatalf("reader: %s\n", err)
+	}
+	plain2, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(plain, plain2) {
+		t.Fatalf("mismatch: %v", err)
+	}
+
+	// A flipped bit is caught at the end
+	sealed[len(sealed)/2] ^= 1
+	r, err = NewSealReader(bytes.NewBuffer(sealed), []byte("pass"))
+	if err != nil {
+		t.Fatalf("reader: %s\n", err)
+	}
+	if _, err = ioutil.ReadAll(r); err != ErrPassphrase {
+		t.Fatalf("tampering not detected")
+	}
+
+	// A wrong passphrase is caught at once
+	if _, err = NewSealReader(bytes.NewBuffer(sealed), []byte("wrong")); err != ErrPassphrase {
+		t.Fatalf("wrong passphrase not detected")
+	}
+}
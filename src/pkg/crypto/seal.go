@@ -0,0 +1,239 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package crypto
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"json"
+	"os"
+)
+
+// Sealed blobs are JSON objects carrying the scrypt parameters and salt
+// next to the AES-256-CTR encrypted text and its HMAC-SHA256.
+type jsonSealed struct {
+	Sealed string
+	N      int
+	R      int
+	P      int
+	Salt   string // Base64 encoding
+	MAC    string // Base64 encoding
+	Text   string // Base64 encoding
+}
+
+const (
+	sealFormat   = "tonika-scrypt-aes-ctr"
+	sealSaltLen  = 16
+	sealKeyLen   = 32
+	SealDefaultN = 1 << 14
+	SealDefaultR = 8
+	SealDefaultP = 1
+)
+
+// Bounds on the scrypt parameters of a sealed blob, so that a crafted blob
+// cannot make us allocate 128*N*r bytes or loop N*r*p times without end.
+// The defaults take 16MB.
+const (
+	sealMaxN   = 1 << 20
+	sealMaxR   = 32
+	sealMaxP   = 16
+	sealMaxMem = 256 << 20 // bytes, 128*N*r
+	sealMaxCPU = 1 << 24   // N*r*p
+)
+
+var ErrPassphrase = os.ErrorString("crypto, wrong passphrase or corrupt data")
+
+// IsSealed returns true if data looks like the output of SealWithPassphrase
+func IsSealed(data []byte) bool {
+	s := jsonSealed{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return false
+	}
+	return s.Sealed == sealFormat
+}
+
+// SealWithPassphrase encrypts and authenticates plaintext under a key
+// derived from passphrase with scrypt.
+func SealWithPassphrase(plaintext, passphrase []byte) ([]byte, os.Error) {
+	urand := NewTimedRand()
+	salt := make([]byte, sealSaltLen)
+	n, _ := urand.Read(salt)
+	if n != len(salt) {
+		panic("crypto, gen salt")
+	}
+	s := &jsonSealed{
+		Sealed: sealFormat,
+		N:      SealDefaultN,
+		R:      SealDefaultR,
+		P:      SealDefaultP,
+		Salt:   EncodeBase64(salt),
+	}
+	ekey, mkey, err := sealKeys(passphrase, salt, s.N, s.R, s.P)
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, len(plaintext))
+	copy(text, plaintext)
+	if err = XORCTR(ekey, text); err != nil {
+		return nil, err
+	}
+	s.Text = EncodeBase64(text)
+	s.MAC = EncodeBase64(HMACSHA256(mkey, salt, text))
+	return json.Marshal(s)
+}
+
+// OpenWithPassphrase reverses SealWithPassphrase. It returns ErrPassphrase
+// if the passphrase is wrong or the data has been tampered with.
+func OpenWithPassphrase(sealed, passphrase []byte) ([]byte, os.Error) {
+	s := jsonSealed{}
+	if err := json.Unmarshal(sealed, &s); err != nil {
+		return nil, err
+	}
+	if s.Sealed != sealFormat {
+		return nil, os.ErrorString("crypto, unknown seal format")
+	}
+	if err := checkSealParams(s.N, s.R, s.P); err != nil {
+		return nil, err
+	}
+	salt, err := DecodeBase64(s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) != sealSaltLen {
+		return nil, os.ErrorString("crypto, bad salt")
+	}
+	mac, err := DecodeBase64(s.MAC)
+	if err != nil {
+		return nil, err
+	}
+	text, err := DecodeBase64(s.Text)
+	if err != nil {
+		return nil, err
+	}
+	ekey, mkey, err := sealKeys(passphrase, salt, s.N, s.R, s.P)
+	if err != nil {
+		return nil, err
+	}
+	if !equalBytes(mac, HMACSHA256(mkey, salt, text)) {
+		return nil, ErrPassphrase
+	}
+	if err = XORCTR(ekey, text); err != nil {
+		return nil, err
+	}
+	return text, nil
+}
+
+func sealKeys(passphrase, salt []byte, N, r, p int) (ekey, mkey []byte, err os.Error) {
+	dk, err := Scrypt(passphrase, salt, N, r, p, 2*sealKeyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk[0:sealKeyLen], dk[sealKeyLen:], nil
+}
+
+// checkSealParams rejects scrypt parameters outside the bounds above
+func checkSealParams(N, r, p int) os.Error {
+	if N <= 1 || N > sealMaxN || N&(N-1) != 0 ||
+		r <= 0 || r > sealMaxR || p <= 0 || p > sealMaxP ||
+		int64(128*N)*int64(r) > sealMaxMem || int64(N*r)*int64(p) > sealMaxCPU {
+		return os.ErrorString("crypto, scrypt parameters out of bounds")
+	}
+	return nil
+}
+
+// XORCTR encrypts or decrypts text in place with AES in counter mode,
+// starting the counter at zero. A key must therefore never be used for
+// more than one text.
+func XORCTR(key, text []byte) os.Error {
+	c, err := newCTR(key)
+	if err != nil {
+		return err
+	}
+	c.XOR(text)
+	return nil
+}
+
+// ctr is the AES-256 key stream in counter mode. The counter starts at
+// zero, which is safe because every key is derived from a fresh salt and
+// used for a single text.
+type ctr struct {
+	c   *aes.Cipher
+	ctr []byte
+	pad []byte
+	off int // bytes of pad used
+}
+
+func newCTR(key []byte) (*ctr, os.Error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ctr{c, make([]byte, aes.BlockSize), make([]byte, aes.BlockSize), aes.BlockSize}, nil
+}
+
+// XOR encrypts or decrypts p in place, continuing the key stream
+func (s *ctr) XOR(p []byte) {
+	for i := range p {
+		if s.off == len(s.pad) {
+			// Encrypt(dst, src) encrypts the block src into dst, which
+			// may be the same slice
+			copy(s.pad, s.ctr)
+			s.c.Encrypt(s.pad, s.pad)
+			for j := len(s.ctr) - 1; j >= 0; j-- {
+				s.ctr[j]++
+				if s.ctr[j] != 0 {
+					break
+				}
+			}
+			s.off = 0
+		}
+		p[i] ^= s.pad[s.off]
+		s.off++
+	}
+}
+
+// equalBytes compares in time independent of where a and b differ
+func equalBytes(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var v byte
+	for i := 0; i < len(a); i++ {
+		v |= a[i] ^ b[i]
+	}
+	return v == 0
+}
+
+// EncodeBase64 returns the standard base64 encoding of p
+func EncodeBase64(p []byte) string {
+	enc := base64.StdEncoding
+	buf := make([]byte, enc.EncodedLen(len(p)))
+	enc.Encode(buf, p)
+	return string(buf)
+}
+
+// DecodeBase64 reverses EncodeBase64
+func DecodeBase64(s string) ([]byte, os.Error) {
+	enc := base64.StdEncoding
+	buf := make([]byte, enc.DecodedLen(len(s)))
+	n, err := enc.Decode(buf, []byte(s))
+	if err != nil {
+		return nil, err
+	}
+	return buf[0:n], nil
+}
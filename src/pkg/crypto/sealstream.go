@@ -0,0 +1,206 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bufio"
+	"io"
+	"json"
+	"os"
+)
+
+// A sealed stream is like a sealed blob, for data too large to hold in
+// memory: a JSON header line with the scrypt parameters, the salt and a key
+// check (so a wrong passphrase is caught before anything is decrypted), the
+// AES-256-CTR encrypted text, and the HMAC-SHA256 of salt and text in the
+// last 32 bytes.
+
+const (
+	sealStreamFormat = "tonika-scrypt-aes-ctr-stream"
+	sealMACLen       = 32
+	maxSealHeader    = 1024
+	sealKeyCheck     = "tonika-seal-key-check"
+)
+
+// keyCheck authenticates a constant, to tell a wrong passphrase early
+func keyCheck(mkey []byte) []byte {
+	h := newHMACSHA256(mkey)
+	h.Write([]byte(sealKeyCheck))
+	return h.Sum()
+}
+
+// SealWriter encrypts what is written to it onto an underlying writer
+type SealWriter struct {
+	w   io.Writer
+	ctr *ctr
+	mac *hmacSHA256
+	buf []byte
+}
+
+// NewSealWriter writes the header of a sealed stream to w and returns a
+// writer for the text. Close must be called to write the HMAC.
+func NewSealWriter(w io.Writer, passphrase []byte) (*SealWriter, os.Error) {
+	urand := NewTimedRand()
+	salt := make([]byte, sealSaltLen)
+	n, _ := urand.Read(salt)
+	if n != len(salt) {
+		panic("crypto, gen salt")
+	}
+	h := &jsonSealed{
+		Sealed: sealStreamFormat,
+		N:      SealDefaultN,
+		R:      SealDefaultR,
+		P:      SealDefaultP,
+		Salt:   EncodeBase64(salt),
+	}
+	ekey, mkey, err := sealKeys(passphrase, salt, h.N, h.R, h.P)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCTR(ekey)
+	if err != nil {
+		return nil, err
+	}
+	h.MAC = EncodeBase64(keyCheck(mkey))
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write([]byte{'\n'}); err != nil {
+		return nil, err
+	}
+	s := &SealWriter{w: w, ctr: c, mac: newHMACSHA256(mkey), buf: make([]byte, 32*1024)}
+	s.mac.Write(salt)
+	return s, nil
+}
+
+func (s *SealWriter) Write(p []byte) (int, os.Error) {
+	n := 0
+	for len(p) > 0 {
+		k := copy(s.buf, p)
+		s.ctr.XOR(s.buf[0:k])
+		s.mac.Write(s.buf[0:k])
+		if _, err := s.w.Write(s.buf[0:k]); err != nil {
+			return n, err
+		}
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close writes the HMAC. It does not close the underlying writer.
+func (s *SealWriter) Close() os.Error {
+	_, err := s.w.Write(s.mac.Sum())
+	return err
+}
+
+// SealReader decrypts a sealed stream. The text it returns is only
+// authenticated once Read has returned os.EOF; if the stream was tampered
+// with or the passphrase is wrong, the last Read returns ErrPassphrase
+// instead, and whatever was read must be thrown away.
+type SealReader struct {
+	r    *bufio.Reader
+	ctr  *ctr
+	mac  *hmacSHA256
+	tail []byte // the last sealMACLen bytes read, which may be the HMAC
+	err  os.Error
+}
+
+// NewSealReader reads the header of a sealed stream from r and derives the
+// key from passphrase
+func NewSealReader(r io.Reader, passphrase []byte) (*SealReader, os.Error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil || len(line) > maxSealHeader {
+		return nil, os.ErrorString("crypto, not a sealed stream")
+	}
+	h := jsonSealed{}
+	if err = json.Unmarshal(line, &h); err != nil || h.Sealed != sealStreamFormat {
+		return nil, os.ErrorString("crypto, not a sealed stream")
+	}
+	if err = checkSealParams(h.N, h.R, h.P); err != nil {
+		return nil, err
+	}
+	salt, err := DecodeBase64(h.Salt)
+	if err != nil || len(salt) != sealSaltLen {
+		return nil, os.ErrorString("crypto, bad salt")
+	}
+	ekey, mkey, err := sealKeys(passphrase, salt, h.N, h.R, h.P)
+	if err != nil {
+		return nil, err
+	}
+	check, err := DecodeBase64(h.MAC)
+	if err != nil || !equalBytes(check, keyCheck(mkey)) {
+		return nil, ErrPassphrase
+	}
+	c, err := newCTR(ekey)
+	if err != nil {
+		return nil, err
+	}
+	s := &SealReader{r: br, ctr: c, mac: newHMACSHA256(mkey)}
+	s.mac.Write(salt)
+	s.tail = make([]byte, sealMACLen)
+	if _, err = io.ReadFull(br, s.tail); err != nil {
+		return nil, ErrPassphrase
+	}
+	return s, nil
+}
+
+func (s *SealReader) Read(p []byte) (int, os.Error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Read past the tail, and pass on the bytes that are not the last
+	// sealMACLen of the stream
+	buf := make([]byte, sealMACLen+len(p))
+	copy(buf, s.tail)
+	n, err := s.r.Read(buf[sealMACLen:])
+	if n == 0 && err == nil {
+		return 0, nil
+	}
+	if n > 0 {
+		copy(p, buf[0:n])
+		copy(s.tail, buf[n:n+sealMACLen])
+		s.mac.Write(p[0:n])
+		s.ctr.XOR(p[0:n])
+	}
+	if err == os.EOF {
+		if equalBytes(s.tail, s.mac.Sum()) {
+			s.err = os.EOF
+		} else {
+			s.err = ErrPassphrase
+		}
+		if n == 0 {
+			return 0, s.err
+		}
+		if s.err != os.EOF {
+			return 0, s.err
+		}
+		return n, nil
+	}
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
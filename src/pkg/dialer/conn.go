@@ -170,8 +170,7 @@ func (y *Conn) Connect(addr string, fdlim *http.FDLimiter) (err os.Error) {
 			if err == nil {
 				//fmt.Printf(term.FgGreen+"d·conn[%#p] —— connected\n"+term.Reset, y)
 				if err := conn.(*net.TCPConn).SetKeepAlive(true); err != nil {
-					//log.Stderrf("%#p d·conn —— cannot set tcp keepalive: %s", y, err)
-					fmt.Fprintf(os.Stderr, "tonika: warn: cannot set tcp keepalive\n")
+					logger.Warnf("cannot set tcp keepalive: %s", err)
 				}
 				conn = http.NewConnRunOnClose(conn, func() { fdlim.Unlock() })
 				if err = y.Attach(conn); err != nil {
@@ -21,7 +21,6 @@
 package dialer
 
 import (
-	"fmt"
 	"io"
 	//"log"
 	"net"
@@ -31,10 +30,14 @@ import (
 	"tonika/sys"
 	"tonika/http"
 	"tonika/prof"
+	"tonika/slog"
+	"tonika/util/alarm"
 	"tonika/util/tube"
 	//"tonika/util/term"
 )
 
+var logger = slog.For("dialer")
+
 type Dialer interface {
 	Dial(id sys.Id, subject string) net.Conn
 	Accept(subject string) (sys.Id, net.Conn)
@@ -45,7 +48,8 @@ type Dialer0 struct {
 	auth sys.AuthLocal
 
 	ltcp    net.Listener
-	tels    map[sys.Id]*telephone
+	tels    map[sys.Fingerprint]*telephone
+	ids     map[sys.Id]sys.Fingerprint // the fingerprint behind each short Id
 	dials   map[sys.DialKey]*telephone
 	unauthd map[*Conn]int
 	listens map[string]chan *dialerRing
@@ -56,6 +60,8 @@ type Dialer0 struct {
 
 	arrivech chan sys.Id
 	statusch chan *StatusUpdate
+	errch    chan os.Error
+	log      *slog.Logger
 }
 
 type dialerRing struct {
@@ -70,12 +76,15 @@ type StatusUpdate struct {
 
 func MakeDialer0(auth sys.AuthLocal, addr string, fdlim int) (d *Dialer0, err os.Error) {
 	d = &Dialer0{
-		tels:     make(map[sys.Id]*telephone),
+		tels:     make(map[sys.Fingerprint]*telephone),
+		ids:      make(map[sys.Id]sys.Fingerprint),
 		dials:    make(map[sys.DialKey]*telephone),
 		unauthd:  make(map[*Conn]int),
 		listens:  make(map[string]chan *dialerRing),
 		arrivech: make(chan sys.Id, 5),
 		statusch: make(chan *StatusUpdate, 5),
+		errch:    make(chan os.Error, 5),
+		log:      logger.Local(*auth.GetId()),
 	}
 	d.fdlim.Init(fdlim)
 	if err := d.Bind(auth, addr); err != nil {
@@ -85,6 +94,45 @@ func MakeDialer0(auth sys.AuthLocal, addr string, fdlim int) (d *Dialer0, err os
 	return d, nil
 }
 
+// Shutdown stops accepting connections and hangs up on all friends, so they
+// see us go offline right away rather than after a timeout. It returns
+// os.EAGAIN if hanging up takes longer than ns nanoseconds.
+func (d *Dialer0) Shutdown(ns int64) os.Error {
+	d.lk.Lock()
+	l := d.ltcp
+	d.ltcp = nil
+	tels := make([]*telephone, len(d.tels))
+	i := 0
+	for fp, t := range d.tels {
+		tels[i] = t
+		i++
+		d.tels[fp] = nil, false
+	}
+	d.ids = make(map[sys.Id]sys.Fingerprint)
+	d.dials = make(map[sys.DialKey]*telephone)
+	d.lk.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	done := make(chan int, 1)
+	go func() {
+		for _, t := range tels {
+			t.kill()
+		}
+		done <- 1
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-alarm.Ignite(ns):
+	}
+	return os.EAGAIN
+}
+
+// SetFDLimit changes the number of file descriptors used for accepted
+// connections
+func (d *Dialer0) SetFDLimit(fdlim int) { d.fdlim.SetLimit(fdlim) }
+
 func (d *Dialer0) getLocalAuth() sys.AuthLocal {
 	d.lk.Lock()
 	defer d.lk.Unlock()
@@ -141,8 +189,7 @@ func (d *Dialer0) listen() os.Error {
 			go d.accept(rwc)
 			continue
 		}
-		//log.Stderrf("%#p d —— fd starvation", d)
-		fmt.Fprintf(os.Stderr, "tonika: warn: file descriptor starvation\n")
+		d.log.Warnf("file descriptor starvation")
 	}
 	panic("unreach")
 }
@@ -160,6 +207,7 @@ func (d *Dialer0) accept(rwc io.ReadWriteCloser) {
 
 	var err os.Error
 	var remoteId sys.Id
+	var remoteAuth sys.AuthRemote
 	_, _, err = conn.Greet()
 
 	if err == nil {
@@ -171,19 +219,18 @@ func (d *Dialer0) accept(rwc io.ReadWriteCloser) {
 				return sys.AuthAccept(
 					localAuth, 
 					func(key *sys.DialKey) sys.AuthRemote { 
-						return d.lookupTelAuth(key) 
+						remoteAuth = d.lookupTelAuth(key)
+						return remoteAuth
 					}, 
 					tube)
 			})
 	}
 
-	/*
 	if err == nil {
-		fmt.Printf(term.FgYellow+"accept--> authenticated\n"+term.Reset)
+		d.log.With(remoteId).Debugf("accept, authenticated")
 	} else {
-		fmt.Printf(term.FgYellow+"accept--> auth err: %s\n"+term.Reset, err)
+		d.log.Infof("accept, auth failed: %s", err)
 	}
-	*/
 
 	d.lk.Lock()
 	d.unauthd[conn] = 0,false
@@ -195,8 +242,11 @@ func (d *Dialer0) accept(rwc io.ReadWriteCloser) {
 
 	// TODO: Small. If tel changes (revoke+add) during authentication, we'd be
 	// inserting a conn with stale authentication.
-	t := d.getTel(remoteId)
-	if t == nil {
+	// The tel is the one whose full fingerprint the peer authenticated
+	// against.
+	t := d.getTelByFingerprint(remoteAuth.GetFingerprint())
+	if t == nil || t.GetAuth() != remoteAuth {
+		conn.Close()
 		return
 	}
 	t.register(conn)
@@ -255,9 +305,20 @@ func (d *Dialer0) WaitForStatus() *StatusUpdate {
 }
 
 func (d *Dialer0) announceOnline(id sys.Id, v bool) {
+	if v {
+		d.log.With(id).Infof("online")
+	} else {
+		d.log.With(id).Infof("offline")
+	}
 	_ = d.statusch <- &StatusUpdate{id,v}
 }
 
+// WaitForError returns the next error that stopped the dialer from
+// accepting connections
+func (d *Dialer0) WaitForError() os.Error {
+	return <-d.errch
+}
+
 func (d *Dialer0) Error() os.Error {
 	d.lk.Lock()
 	defer d.lk.Unlock()
@@ -268,4 +329,5 @@ func (d *Dialer0) setError(err os.Error) {
 	d.lk.Lock()
 	defer d.lk.Unlock()
 	d.err = err
+	_ = d.errch <- err
 }
@@ -238,13 +238,11 @@ func (t *telephone) connect() {
 			})
 	}
 
-	/*
 	if err == nil {
-		fmt.Printf(term.FgYellow+"connect--> authenticated\n"+term.Reset)
+		d.log.With(*auth.GetId()).Debugf("connect, authenticated")
 	} else {
-		fmt.Printf(term.FgYellow+"connect--> auth err: %s\n"+term.Reset, err)
+		d.log.With(*auth.GetId()).Infof("connect, auth failed: %s", err)
 	}
-	*/
 
 	t.lk.Lock()
 	t.authing[conn] = 0, false
@@ -270,10 +268,26 @@ func (t *telephone) kill() {
 
 // Dialer methods about telephones
 
+// Telephones are kept by the full fingerprint of the friend. The short Id,
+// which the Dialer interface uses, leads to the fingerprint.
+
 func (d *Dialer0) getTel(id sys.Id) *telephone {
 	d.lk.Lock()
-	t, ok := d.tels[id]
-	d.lk.Unlock()
+	defer d.lk.Unlock()
+	fp, ok := d.ids[id]
+	if !ok {
+		return nil
+	}
+	return d.tels[fp]
+}
+
+func (d *Dialer0) getTelByFingerprint(fp *sys.Fingerprint) *telephone {
+	if fp == nil {
+		return nil
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	t, ok := d.tels[*fp]
 	if !ok {
 		return nil
 	}
@@ -281,15 +295,26 @@ func (d *Dialer0) getTel(id sys.Id) *telephone {
 }
 
 func (d *Dialer0) Add(auth sys.AuthRemote, addr string) {
+	fp := auth.GetFingerprint()
+	if fp == nil {
+		d.log.With(*auth.GetId()).Warnf("add, no fingerprint")
+		return
+	}
 	d.lk.Lock()
-	_, present := d.tels[*auth.GetId()]
+	_, present := d.tels[*fp]
+	fp0, taken := d.ids[*auth.GetId()]
 	d.lk.Unlock()
 	if present {
 		return
 	}
+	if taken && fp0 != *fp {
+		d.log.With(*auth.GetId()).Warnf("add, Id taken by another fingerprint")
+		return
+	}
 	t := makeTel(d, auth, addr)
 	d.lk.Lock()
-	d.tels[*auth.GetId()] = t
+	d.tels[*fp] = t
+	d.ids[*auth.GetId()] = *fp
 	d.dials[*auth.GetAcceptKey()] = t
 	d.lk.Unlock()
 	t.rebalance()
@@ -319,9 +344,12 @@ func (d *Dialer0) Update(id sys.Id, addr string) {
 
 func (d *Dialer0) Revoke(id sys.Id) {
 	d.lk.Lock()
-	t, present := d.tels[id]
-	d.tels[id] = nil, false
+	fp, present := d.ids[id]
+	var t *telephone
 	if present {
+		t = d.tels[fp]
+		d.tels[fp] = nil, false
+		d.ids[id] = fp, false
 		d.dials[*t.GetAuth().GetAcceptKey()] = nil, false
 	}
 	d.lk.Unlock()
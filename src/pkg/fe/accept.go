@@ -34,7 +34,7 @@ type acceptData struct {
 	AdminURL string
 }
 
-func (fe *FrontEnd) replyAdminAccept(req *http.Request) *http.Response {
+func (fe *identity) replyAdminAccept(req *http.Request) *http.Response {
 	args, err := http.ParseQuery(req.URL.RawQuery)
 	if err != nil {
 		return buildResp("Invalid accept link")
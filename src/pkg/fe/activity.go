@@ -0,0 +1,84 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package fe
+
+import (
+	"bytes"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+)
+
+type activityData struct {
+	Events []*eventData
+}
+
+type eventData struct {
+	When  string
+	Topic string
+	Who   string
+	Msg   string
+	Class string
+}
+
+const activityCount = 100
+
+func (fe *identity) replyAdminActivity(req *http.Request) *http.Response {
+	events := fe.bank.GetRecentEvents(activityCount)
+	data := activityData{Events: make([]*eventData, len(events))}
+	for i, e := range events {
+		ed := &eventData{
+			When:  time.SecondsToLocalTime(e.Time / 1e9).Format(time.RFC1123),
+			Topic: e.Topic,
+			Msg:   e.Msg,
+			Class: "ok",
+		}
+		if v, err := fe.bank.GetBySlot(e.Slot); err == nil {
+			ed.Who = v.GetName()
+		}
+		switch e.Topic {
+		case sys.EvFriendRevoked, sys.EvVaultError, sys.EvDialerError:
+			ed.Class = "error"
+		case sys.EvKeyChanged, sys.EvFriendRemoved:
+			ed.Class = "warn"
+		}
+		data.Events[i] = ed
+	}
+
+	// prepare content of page
+	var w bytes.Buffer
+	err := fe.tmplActivity.Execute(&data, &w)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+
+	// wrap into a page frame
+	pdata := pageData {
+		Title: sys.Name+" &mdash; Activity",
+		CSSLinks: []string{"monitor.css"},
+		JSLinks: []string{"activity.js"},
+		GridLayout: "",
+		Content: w.String(),
+	}
+	var w2 bytes.Buffer
+	err = fe.tmplPage.Execute(&pdata, &w2)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(w2.String())
+}
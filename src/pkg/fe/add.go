@@ -27,7 +27,7 @@ type addData struct {
 	AdminURL  string
 }
 
-func (fe *FrontEnd) replyAdminAdd(req *http.Request) *http.Response {
+func (fe *identity) replyAdminAdd(req *http.Request) *http.Response {
 	// prepare content of page
 	data := addData{ 
 		AdminURL: fe.adminURL, 
@@ -20,6 +20,8 @@ package fe
 import (
 	"bytes"
 	"strconv"
+	"strings"
+	"time"
 	"tonika/http"
 	"tonika/sys"
 )
@@ -39,16 +41,18 @@ type friendData struct {
 	Email       string
 	StatusMsg   string
 	StatusClass string
+	Groups      string
 	AdminURL    string
 }
 
-func friendToJSON(a sys.View, adminURL string) *friendData {
+func friendToJSON(a sys.View, groups []string, adminURL string) *friendData {
 	r := &friendData{
 		Slot:        strconv.Itoa(a.GetSlot()),
 		Name:        a.GetName(),
 		Email:       a.GetEmail(),
 		StatusMsg:   a.GetStatusMsg(),
 		StatusClass: a.GetStatusClass(),
+		Groups:      strings.Join(groups, ", "),
 		AdminURL:    adminURL,
 	}
 	if a.GetId() != nil {
@@ -57,34 +61,84 @@ func friendToJSON(a sys.View, adminURL string) *friendData {
 	return r
 }
 
-func friendsToJSON(friends []sys.View, adminURL string) []*friendData {
+func (fe *identity) friendsToJSON(friends []sys.View) []*friendData {
 	r := make([]*friendData, len(friends))
 	for i := 0; i < len(friends); i++ {
-		r[i] = friendToJSON(friends[i], adminURL)
+		groups := fe.bank.GetGroupsOf(friends[i].GetSlot())
+		r[i] = friendToJSON(friends[i], groups, fe.adminURL)
+	}
+	return r
+}
+
+type groupData struct {
+	Name     string
+	Size     int
+	AdminURL string
+}
+
+func (fe *identity) groupsToJSON() []*groupData {
+	names := fe.bank.GetGroups()
+	r := make([]*groupData, len(names))
+	for i, name := range names {
+		members, _ := fe.bank.GetGroupMembers(name)
+		r[i] = &groupData{Name: name, Size: len(members), AdminURL: fe.adminURL}
+	}
+	return r
+}
+
+type introData struct {
+	Name        string
+	Email       string
+	By          string
+	When        string
+	Fingerprint string
+}
+
+func (fe *identity) introsToJSON() []*introData {
+	intros := fe.bank.GetIntroductions()
+	r := make([]*introData, len(intros))
+	for i, in := range intros {
+		fp := in.Fingerprint()
+		r[i] = &introData{
+			Name:        in.Name,
+			Email:       in.Email,
+			By:          "a contact",
+			When:        time.SecondsToLocalTime(in.Time / 1e9).Format(time.RFC1123),
+			Fingerprint: fp.String(),
+		}
+		if v, err := fe.bank.GetByFingerprint(&in.By); err == nil {
+			r[i].By = v.GetName()
+		}
 	}
 	return r
 }
 
 type adminData struct {
 	MyId      string
+	MyFingerprint string
 	MyName    string
 	MyEmail   string
 	MyAddr    string
 	MyExtAddr string
 	AdminURL  string
 	Friends   []*friendData
+	Groups    []*groupData
+	Intros    []*introData
 }
 
-func (fe *FrontEnd) replyAdminMain() *http.Response {
+func (fe *identity) replyAdminMain() *http.Response {
 	// prepare content of page
 	adata := adminData{ 
 		MyId: fe.bank.GetMyId().Eye(),
+		MyFingerprint: fe.bank.GetMyFingerprint().String(),
 		MyName: fe.bank.GetMyName(),
 		MyEmail: fe.bank.GetMyEmail(),
 		MyAddr: fe.bank.GetMyAddr(),
 		MyExtAddr: fe.bank.GetMyExtAddr(),
 		AdminURL: fe.adminURL,
-		Friends: friendsToJSON(fe.bank.Enumerate(), fe.adminURL), 
+		Friends: fe.friendsToJSON(fe.bank.Enumerate()), 
+		Groups: fe.groupsToJSON(),
+		Intros: fe.introsToJSON(),
 	}
 	var w bytes.Buffer
 	err := fe.tmplAdmin.Execute(&adata, &w)
@@ -19,17 +19,49 @@ package fe
 
 import (
 	"json"
+	"os"
 	"strconv"
 	"tonika/http"
 	"tonika/sys"
 )
 
 type apiAcceptResult struct {
-	InviteMsg string "InviteMsg"
-	ErrMsg    string "ErrMsg"
+	InviteMsg string          "InviteMsg"
+	ErrMsg    string          "ErrMsg"
+	FieldErrs []apiFieldError "FieldErrs"
 }
 
-func (fe *FrontEnd) replyAPIAccept(args map[string][]string) *http.Response {
+// apiFieldError reports a field of the invitation that was not accepted
+type apiFieldError struct {
+	Field  string "Field"
+	Reason string "Reason"
+}
+
+func (r *apiAcceptResult) addFieldErr(field string, err os.Error) {
+	l := make([]apiFieldError, len(r.FieldErrs)+1)
+	copy(l, r.FieldErrs)
+	l[len(r.FieldErrs)] = apiFieldError{field, err.String()}
+	r.FieldErrs = l
+}
+
+// acceptErrMsg explains why accepting an invitation failed
+func acceptErrMsg(err os.Error) string {
+	ue, ok := err.(*sys.UpdateError)
+	if !ok {
+		return "This invitation could not be accepted: " + err.String()
+	}
+	switch ue.Field {
+	case "":
+		return "This friend no longer exists."
+	case "SignatureKey":
+		return "This invitation comes from an identity that belongs to another of your friends."
+	case "DialKey":
+		return "This invitation has already been accepted for another friend."
+	}
+	return "This invitation has a bad " + ue.Field + ": " + ue.Reason
+}
+
+func (fe *identity) replyAPIAccept(args map[string][]string) *http.Response {
 	// name and email args
 	na, ok := args["na"]
 	if !ok || na == nil || len(na) != 1 {
@@ -92,22 +124,35 @@ func (fe *FrontEnd) replyAPIAccept(args map[string][]string) *http.Response {
 		adding = true
 	}
 
+	// Bad details are left out and reported, the keys are what matter
+	u := &sys.FriendUpdate{}
 	if na[0] != "" {
-		fe.bank.Write(s, "Name", na[0])
+		if err = sys.ValidName(na[0]); err != nil {
+			result.addFieldErr("Name", err)
+		} else {
+			u.SetName(na[0])
+		}
 	}
 	if em[0] != "" {
-		fe.bank.Write(s, "Email", em[0])
+		if err = sys.ValidEmail(em[0]); err != nil {
+			result.addFieldErr("Email", err)
+		} else {
+			u.SetEmail(em[0])
+		}
 	}
 	if ad[0] != "" {
-		fe.bank.Write(s, "Addr", ad[0])
-	}
-	_, err = fe.bank.Write(s, "SignatureKey", sigkey)
-	if err != nil {
-		result.ErrMsg = "This friend's invite has already been accepted."
+		if err = sys.ValidAddr(ad[0]); err != nil {
+			result.addFieldErr("Addr", err)
+		} else {
+			u.SetAddr(ad[0])
+		}
 	}
-	_, err = fe.bank.Write(s, "DialKey", dialkey)
+	u.SetSignatureKey(sigkey).SetDialKey(dialkey)
+	_, err = fe.bank.Update(s, u, "invite")
 	if err != nil {
-		result.ErrMsg = "This friend's invite has already been accepted."
+		result.ErrMsg = acceptErrMsg(err)
+	} else if len(result.FieldErrs) > 0 {
+		result.ErrMsg = "The invitation was accepted, but some of its details were not."
 	}
 	if adding {
 		result.InviteMsg = fe.makeInvite(v)
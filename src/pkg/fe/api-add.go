@@ -29,7 +29,7 @@ type apiAddResult struct {
 	Msg string "Msg"
 }
 
-func (fe *FrontEnd) makeInvite(v sys.View) string {
+func (fe *identity) makeInvite(v sys.View) string {
 	return "Hello " + v.GetName() + ",\n\n" +
 		"I want to invite you in my "+sys.Name+" circle of friends.\n\n" +
 		"Here's what you need to do:\n\n" +
@@ -42,7 +42,7 @@ func (fe *FrontEnd) makeInvite(v sys.View) string {
 		"We hope you enjoy "+sys.Name+".\n--Team "+sys.Name+"\n"
 }
 
-func (fe *FrontEnd) makeInviteLink(v sys.View) string {
+func (fe *identity) makeInviteLink(v sys.View) string {
 	// The variable names in the link are from the point of view of the receiver
 	akopt := ""
 	if v.GetDialKey() != nil {
@@ -58,7 +58,7 @@ func (fe *FrontEnd) makeInviteLink(v sys.View) string {
 	return link
 }
 
-func (fe *FrontEnd) replyAPIAdd(args map[string][]string) *http.Response {
+func (fe *identity) replyAPIAdd(args map[string][]string) *http.Response {
 	name, ok := args["n"]
 	if !ok {
 		return newRespBadRequest()
@@ -78,9 +78,17 @@ func (fe *FrontEnd) replyAPIAdd(args map[string][]string) *http.Response {
 		e = email[0]
 	}
 
-	v := fe.bank.Reserve()
-	fe.bank.Write(v.GetSlot(), "Name", n)
-	fe.bank.Write(v.GetSlot(), "Email", e)
+	if sys.ValidName(n) != nil || sys.ValidEmail(e) != nil {
+		return newRespBadRequest()
+	}
+	slot := fe.bank.Reserve().GetSlot()
+	u := &sys.FriendUpdate{}
+	u.SetName(n).SetEmail(e)
+	v, err := fe.bank.Update(slot, u, "admin")
+	if err != nil {
+		fe.bank.Revoke(slot)
+		return newRespBadRequest()
+	}
 	fe.bank.Save()
 
 	j := &apiAddResult{ fe.makeInvite(v) }
@@ -0,0 +1,71 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package fe
+
+import (
+	"os"
+	"strconv"
+	"tonika/http"
+)
+
+// replyAPIDownload handles the download manager. The operation is in
+// argument "op":
+//   add    u=url    start downloading a file from a friend's vault, and
+//                   from other friends holding parts of it if swarm=1
+//   pause  d=id     pause a running download
+//   resume d=id     resume a paused or failed download
+//   remove d=id     forget a download that is not running
+// The reply is "OK", or the reason the operation failed.
+func (fe *identity) replyAPIDownload(args map[string][]string) *http.Response {
+	op, ok := getArg(args, "op")
+	if !ok {
+		return newRespBadRequest()
+	}
+	var err os.Error
+	if op == "add" {
+		u, ok := getArg(args, "u")
+		if !ok {
+			return newRespBadRequest()
+		}
+		swarm, _ := getArg(args, "swarm")
+		err = fe.StartDownload(u, swarm == "1")
+	} else {
+		s, ok := getArg(args, "d")
+		if !ok {
+			return newRespBadRequest()
+		}
+		id, err2 := strconv.Atoi(s)
+		if err2 != nil {
+			return newRespBadRequest()
+		}
+		switch op {
+		case "pause":
+			err = fe.PauseDownload(id)
+		case "resume":
+			err = fe.ResumeDownload(id)
+		case "remove":
+			err = fe.RemoveDownload(id)
+		default:
+			return newRespBadRequest()
+		}
+	}
+	if err != nil {
+		return buildResp(err.String())
+	}
+	return buildResp("OK")
+}
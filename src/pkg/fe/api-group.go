@@ -0,0 +1,92 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fe
+
+import (
+	"os"
+	"strconv"
+	"tonika/http"
+	//"tonika/sys"
+)
+
+// replyAPIGroup manages groups. The operation is in argument "op":
+//   make   g=name          create a group
+//   rename g=name n=new    rename a group
+//   remove g=name          delete a group
+//   join   g=name s=slot   add a friend to a group
+//   leave  g=name s=slot   remove a friend from a group
+func (fe *identity) replyAPIGroup(args map[string][]string) *http.Response {
+	op, ok := getArg(args, "op")
+	if !ok {
+		return newRespBadRequest()
+	}
+	g, ok := getArg(args, "g")
+	if !ok {
+		return newRespBadRequest()
+	}
+	var err os.Error
+	switch op {
+	case "make":
+		err = fe.bank.MakeGroup(g)
+	case "rename":
+		n, ok := getArg(args, "n")
+		if !ok {
+			return newRespBadRequest()
+		}
+		err = fe.bank.RenameGroup(g, n)
+	case "remove":
+		err = fe.bank.RemoveGroup(g)
+	case "join", "leave":
+		ss, ok := getArg(args, "s")
+		if !ok {
+			return newRespBadRequest()
+		}
+		s, err2 := strconv.Atoi(ss)
+		if err2 != nil {
+			return newRespBadRequest()
+		}
+		if op == "join" {
+			err = fe.bank.AddToGroup(g, s)
+		} else {
+			err = fe.bank.RemoveFromGroup(g, s)
+		}
+	default:
+		return newRespBadRequest()
+	}
+	if err != nil {
+		return buildEditResp(err, groupErrMsg(g, err))
+	}
+	fe.bank.Save()
+	return buildEditResp(nil, "")
+}
+
+// groupErrMsg explains why a change to group g failed
+func groupErrMsg(g string, err os.Error) string {
+	if err == os.EINVAL {
+		return "There is no group " + g + ", or no such friend, or the name is not valid."
+	}
+	return "Group " + g + " could not be changed: " + err.String()
+}
+
+// getArg returns the single value of argument name
+func getArg(args map[string][]string, name string) (string, bool) {
+	v, ok := args[name]
+	if !ok || v == nil || len(v) != 1 {
+		return "", false
+	}
+	return v[0], true
+}
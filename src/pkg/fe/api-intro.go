@@ -0,0 +1,71 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fe
+
+import (
+	"os"
+	"strconv"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// replyAPIIntro handles introductions. The operation is in argument "op":
+//   introduce a=slot b=slot   introduce two friends to each other
+//   accept    fp=fingerprint  make a contact of someone we were introduced to
+//   decline   fp=fingerprint  forget an introduction
+// The reply is "OK", or the reason the operation failed.
+func (fe *identity) replyAPIIntro(args map[string][]string) *http.Response {
+	op, ok := getArg(args, "op")
+	if !ok {
+		return newRespBadRequest()
+	}
+	var err os.Error
+	switch op {
+	case "introduce":
+		sa, ok1 := getArg(args, "a")
+		sb, ok2 := getArg(args, "b")
+		if !ok1 || !ok2 {
+			return newRespBadRequest()
+		}
+		a, err1 := strconv.Atoi(sa)
+		b, err2 := strconv.Atoi(sb)
+		if err1 != nil || err2 != nil {
+			return newRespBadRequest()
+		}
+		err = fe.bank.Introduce(a, b)
+	case "accept", "decline":
+		s, ok := getArg(args, "fp")
+		if !ok {
+			return newRespBadRequest()
+		}
+		fp, err2 := sys.ParseFingerprint(s)
+		if err2 != nil {
+			return newRespBadRequest()
+		}
+		if op == "accept" {
+			_, err = fe.bank.AcceptIntroduction(fp)
+		} else {
+			err = fe.bank.DeclineIntroduction(fp)
+		}
+	default:
+		return newRespBadRequest()
+	}
+	if err != nil {
+		return buildResp(err.String())
+	}
+	return buildResp("OK")
+}
@@ -29,14 +29,14 @@ type apiLiveResult struct {
 	Links string "Links"
 }
 
-func (fe *FrontEnd) replyAPILive(args map[string][]string) *http.Response {
+func (fe *identity) replyAPILive(args map[string][]string) *http.Response {
 	var w bytes.Buffer
 	fmt.Fprintf(&w, "<ul>")
 	friends := fe.bank.Enumerate()
 	for _,f := range friends {
 		if f.IsOnline() {
 			fmt.Fprintf(&w, "<li><div class=\"ok\"><a href=\"" + 
-				sys.MakeURL("", *f.GetId(), "") + 
+				sys.MakeViaURL(*f.GetId(), fe.id, "") + 
 				"\">" + f.GetName() + "</a></div></li>")
 		} else {
 			fmt.Fprintf(&w, "<li><div class=\"nop\">" + f.GetName() + "</div></li>")
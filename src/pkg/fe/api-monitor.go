@@ -22,6 +22,6 @@ import (
 	//"tonika/sys"
 )
 
-func (fe *FrontEnd) replyAPIMonitor(args map[string][]string) *http.Response {
+func (fe *identity) replyAPIMonitor(args map[string][]string) *http.Response {
 	return buildResp(fe.bank.String())
 }
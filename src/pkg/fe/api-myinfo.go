@@ -19,10 +19,10 @@ package fe
 
 import (
 	"tonika/http"
-	//"tonika/sys"
+	"tonika/sys"
 )
 
-func (fe *FrontEnd) replyAPIMyInfo(args map[string][]string) *http.Response {
+func (fe *identity) replyAPIMyInfo(args map[string][]string) *http.Response {
 	name, ok := args["n"]
 	if !ok {
 		return newRespBadRequest()
@@ -49,10 +49,11 @@ func (fe *FrontEnd) replyAPIMyInfo(args map[string][]string) *http.Response {
 		a = addr[0]
 	}
 
-	fe.bank.SetMy("Name", n)
-	fe.bank.SetMy("Email", e)
-	fe.bank.SetMy("ExtAddr", a)
-
+	u := &sys.MyUpdate{}
+	u.SetName(n).SetEmail(e).SetExtAddr(a)
+	if err := fe.bank.UpdateMy(u, "admin"); err != nil {
+		return newRespBadRequest()
+	}
 	fe.bank.Save()
 
 	return buildResp("OK")
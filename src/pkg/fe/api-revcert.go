@@ -0,0 +1,47 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package fe
+
+import (
+	"tonika/http"
+	"tonika/sys"
+)
+
+// Accepts a pasted revocation certificate. If it is for our own identity it
+// is published to our friends, otherwise it revokes the friend it names.
+func (fe *identity) replyAPIRevCert(args map[string][]string) *http.Response {
+	cc, ok := args["c"]
+	if !ok || cc == nil || len(cc) != 1 {
+		return newRespBadRequest()
+	}
+	rc, err := sys.ParseRevocationCert(cc[0])
+	if err != nil {
+		return newRespBadRequest()
+	}
+	if rc.Fingerprint.Equal(fe.bank.GetMyFingerprint()) {
+		err = fe.bank.PublishRevocation(rc)
+	} else {
+		err = fe.bank.AcceptRevocation(rc)
+	}
+	if err != nil {
+		return newRespBadRequest()
+	}
+	return buildResp("OK")
+}
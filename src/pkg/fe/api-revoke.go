@@ -23,7 +23,7 @@ import (
 	//"tonika/sys"
 )
 
-func (fe *FrontEnd) replyAPIRevoke(args map[string][]string) *http.Response {
+func (fe *identity) replyAPIRevoke(args map[string][]string) *http.Response {
 	ss, ok := args["s"]
 	if !ok || ss == nil || len(ss) != 1 {
 		return newRespBadRequest()
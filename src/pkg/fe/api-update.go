@@ -18,12 +18,51 @@
 package fe
 
 import (
+	"json"
+	"os"
 	"strconv"
 	"tonika/http"
-	//"tonika/sys"
+	"tonika/sys"
 )
 
-func (fe *FrontEnd) replyAPIUpdate(args map[string][]string) *http.Response {
+// apiEditResult is the reply of the update and group APIs. ErrMsg is empty
+// if the change was made. Otherwise, as with api-accept, FieldErrs names the
+// field that was refused, if there is one.
+type apiEditResult struct {
+	ErrMsg    string          "ErrMsg"
+	FieldErrs []apiFieldError "FieldErrs"
+}
+
+// buildEditResp replies with the outcome of a change; err is nil on success
+// and msg explains it otherwise
+func buildEditResp(err os.Error, msg string) *http.Response {
+	result := &apiEditResult{}
+	if err != nil {
+		result.ErrMsg = msg
+		if ue, ok := err.(*sys.UpdateError); ok && ue.Field != "" {
+			result.FieldErrs = []apiFieldError{apiFieldError{ue.Field, ue.Reason}}
+		}
+	}
+	jb, err := json.Marshal(result)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(string(jb))
+}
+
+// updateErrMsg explains why an update of a friend failed
+func updateErrMsg(err os.Error) string {
+	ue, ok := err.(*sys.UpdateError)
+	if !ok {
+		return "The changes could not be made: " + err.String()
+	}
+	if ue.Field == "" {
+		return "This friend no longer exists."
+	}
+	return "Nothing was changed, because of a bad " + ue.Field + ": " + ue.Reason
+}
+
+func (fe *identity) replyAPIUpdate(args map[string][]string) *http.Response {
 	// name and email args
 	name, ok := args["n"]
 	if !ok {
@@ -60,12 +99,13 @@ func (fe *FrontEnd) replyAPIUpdate(args map[string][]string) *http.Response {
 		return newRespBadRequest()
 	}
 
-	fe.bank.Write(s, "Name", n)
-	fe.bank.Write(s, "Email", e)
-	fe.bank.Write(s, "Addr", a)
-
+	u := &sys.FriendUpdate{}
+	u.SetName(n).SetEmail(e).SetAddr(a)
+	if _, err = fe.bank.Update(s, u, "admin"); err != nil {
+		return buildEditResp(err, updateErrMsg(err))
+	}
 	fe.bank.Save()
 	fe.bank.SyncAddr(s)
 
-	return buildResp("OK")
+	return buildEditResp(nil, "")
 }
@@ -27,14 +27,16 @@ type bugData struct {
 	Email  string
 	Build  string
 	MaskId string
+	AdminURL string
 }
 
-func (fe *FrontEnd) replyAdminBug(req *http.Request) *http.Response {
+func (fe *identity) replyAdminBug(req *http.Request) *http.Response {
 
 	data := bugData{ 
 		Email: "petar@"+sys.Host,
 		Build: fe.bank.GetBuild(),
 		MaskId: fe.bank.GetMyId().Eye(),
+		AdminURL: fe.adminURL,
 	}
 
 	// prepare content of page
@@ -0,0 +1,415 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"sync"
+	"tonika/http"
+	"tonika/sys"
+	"tonika/vault"
+)
+
+// States of a download
+const (
+	dlRunning = "running"
+	dlPaused  = "paused"
+	dlDone    = "done"
+	dlFailed  = "failed"
+)
+
+// download is a file fetched from a friend's vault into the download
+// directory. A download that is paused, fails or is cut short by a restart
+// resumes where it stopped, by asking the vault only for the missing bytes.
+// Files are checked against the manifest signed by their owner as they
+// arrive (see vault.ServeVerified). Swarm downloads also fetch chunks from
+// friends holding them (see vault.ServeSwarm).
+type download struct {
+	Id        int
+	URL       string
+	File      string // name in the download directory
+	Size      int64  // -1 while unknown
+	Have      int64
+	State     string
+	Err       string
+	Validator string // ETag or Last-Modified of the file, sent back in If-Range
+	Swarm     bool
+	Sources   map[string]int64 // bytes fetched from each source, by Id
+	pause     bool
+}
+
+// downloads is the download manager of the Front End
+type downloads struct {
+	dir  string
+	list []*download
+	next int
+	lk   sync.Mutex
+}
+
+const downloadsFile = "downloads.json"
+
+// SetDownloadDir keeps downloaded files, and the list of downloads, in dir.
+// Downloads that were running when the list was last saved are resumed.
+func (fe *FrontEnd) SetDownloadDir(dir string) os.Error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dl := &fe.dl
+	dl.lk.Lock()
+	dl.dir = dir
+	dl.list = nil
+	data, err := ioutil.ReadFile(path.Join(dir, downloadsFile))
+	if err == nil {
+		err = json.Unmarshal(data, &dl.list)
+	}
+	for _, d := range dl.list {
+		if d.Id >= dl.next {
+			dl.next = d.Id + 1
+		}
+	}
+	var resume []*download
+	for _, d := range dl.list {
+		if d.State == dlRunning {
+			resume = appendDownload(resume, d)
+		}
+	}
+	dl.lk.Unlock()
+	for _, d := range resume {
+		go fe.fetch(d)
+	}
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func appendDownload(l []*download, d *download) []*download {
+	r := make([]*download, len(l)+1)
+	copy(r, l)
+	r[len(l)] = d
+	return r
+}
+
+func isNotExist(err os.Error) bool {
+	perr, ok := err.(*os.PathError)
+	return ok && perr.Error == os.ENOENT
+}
+
+// save writes the list of downloads. The caller holds dl.lk.
+func (dl *downloads) save() {
+	if dl.dir == "" {
+		return
+	}
+	data, err := json.Marshal(dl.list)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(dl.dir, downloadsFile), data, 0600)
+	}
+	if err != nil {
+		logger.Warnf("Cannot save downloads: %s", err)
+	}
+}
+
+// getDownloads returns copies of all downloads, oldest first
+func (fe *FrontEnd) getDownloads() []download {
+	dl := &fe.dl
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	r := make([]download, len(dl.list))
+	for i, d := range dl.list {
+		r[i] = *d
+	}
+	return r
+}
+
+func (fe *FrontEnd) getDownload(id int) *download {
+	for _, d := range fe.dl.list {
+		if d.Id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// StartDownload begins fetching url, which must be a file at a friend's
+// vault, like http://<id>.5ttt.org/some/file. If swarm is true, parts of
+// the file are fetched from other friends holding them too.
+func (fe *FrontEnd) StartDownload(url string, swarm bool) os.Error {
+	u, err := http.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	if t, _ := getRequestType(&http.Request{Host: u.Host}); t != feTonikaReq {
+		return os.ErrorString("not a " + sys.Name + " address")
+	}
+	name := path.Base(u.Path)
+	if name == "" || name == "/" || name == "." || name == downloadsFile {
+		return os.ErrorString("not a file")
+	}
+	dl := &fe.dl
+	dl.lk.Lock()
+	if dl.dir == "" {
+		dl.lk.Unlock()
+		return os.ErrorString("no download directory")
+	}
+	// don't overwrite other downloads
+	file := name
+	for i := 1; dl.fileTaken(file); i++ {
+		file = fmt.Sprintf("%d-%s", i, name)
+	}
+	d := &download{Id: dl.next, URL: url, File: file, Size: -1, State: dlRunning, Swarm: swarm}
+	dl.next++
+	dl.list = appendDownload(dl.list, d)
+	dl.save()
+	dl.lk.Unlock()
+	go fe.fetch(d)
+	return nil
+}
+
+// fileTaken returns true if file is used by a download. The caller holds
+// dl.lk.
+func (dl *downloads) fileTaken(file string) bool {
+	for _, d := range dl.list {
+		if d.File == file {
+			return true
+		}
+	}
+	_, err := os.Lstat(path.Join(dl.dir, file))
+	return err == nil
+}
+
+// PauseDownload stops download id, which can be resumed later
+func (fe *FrontEnd) PauseDownload(id int) os.Error {
+	fe.dl.lk.Lock()
+	defer fe.dl.lk.Unlock()
+	d := fe.getDownload(id)
+	if d == nil {
+		return os.EINVAL
+	}
+	if d.State == dlRunning {
+		d.pause = true
+	}
+	return nil
+}
+
+// ResumeDownload continues a paused or failed download id
+func (fe *FrontEnd) ResumeDownload(id int) os.Error {
+	fe.dl.lk.Lock()
+	d := fe.getDownload(id)
+	if d == nil {
+		fe.dl.lk.Unlock()
+		return os.EINVAL
+	}
+	if d.State != dlPaused && d.State != dlFailed {
+		fe.dl.lk.Unlock()
+		return nil
+	}
+	d.State, d.Err, d.pause = dlRunning, "", false
+	fe.dl.save()
+	fe.dl.lk.Unlock()
+	go fe.fetch(d)
+	return nil
+}
+
+// RemoveDownload forgets download id, which must not be running. The file
+// is removed too, unless the download is done.
+func (fe *FrontEnd) RemoveDownload(id int) os.Error {
+	dl := &fe.dl
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	for i, d := range dl.list {
+		if d.Id != id {
+			continue
+		}
+		if d.State == dlRunning {
+			return os.ErrorString("pause the download first")
+		}
+		if d.State != dlDone {
+			os.Remove(path.Join(dl.dir, d.File))
+		}
+		l := make([]*download, len(dl.list)-1)
+		copy(l, dl.list[0:i])
+		copy(l[i:], dl.list[i+1:])
+		dl.list = l
+		dl.save()
+		return nil
+	}
+	return os.EINVAL
+}
+
+// finish sets the final state of a fetch of d
+func (fe *FrontEnd) finish(d *download, state string, err os.Error) {
+	fe.dl.lk.Lock()
+	defer fe.dl.lk.Unlock()
+	d.State, d.pause = state, false
+	if err != nil {
+		d.Err = err.String()
+		logger.Infof("Download of %s failed: %s", d.URL, err)
+	}
+	fe.dl.save()
+}
+
+// fetch runs download d until it is done, fails or is paused
+func (fe *FrontEnd) fetch(d *download) {
+	fe.dl.lk.Lock()
+	url, full, validator, swarm := d.URL, path.Join(fe.dl.dir, d.File), d.Validator, d.Swarm
+	fe.dl.lk.Unlock()
+
+	u, err := http.ParseURL(url)
+	if err != nil {
+		fe.finish(d, dlFailed, err)
+		return
+	}
+	_, tid := getRequestType(&http.Request{Host: u.Host})
+	i := fe.getVaultIdentity(&http.Request{Host: u.Host}, tid)
+	if i == nil {
+		fe.finish(d, dlFailed, os.ErrorString("no identity, or several, for "+u.Host))
+		return
+	}
+	f, err := os.Open(full, os.O_WRONLY|os.O_CREAT, 0600)
+	if err != nil {
+		fe.finish(d, dlFailed, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		fe.finish(d, dlFailed, err)
+		return
+	}
+	have := fi.Size
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Host:       sys.MakeHost("", tid), // the vault only knows the plain host
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(map[string]string),
+		UserAgent:  sys.Name + "-Downloader",
+	}
+	if have > 0 {
+		req.Header["Range"] = fmt.Sprintf("bytes=%d-", have)
+		if validator != "" {
+			req.Header["If-Range"] = validator
+		}
+	}
+	var resp *http.Response
+	if swarm {
+		resp, err = i.vault.ServeSwarm(req, func(src sys.Id, n int64) {
+			fe.dl.lk.Lock()
+			if d.Sources == nil {
+				d.Sources = make(map[string]int64)
+			}
+			d.Sources[src.String()] += n
+			fe.dl.lk.Unlock()
+		})
+	} else {
+		resp, err = i.vault.ServeVerified(req)
+	}
+	if err != nil {
+		fe.finish(d, dlFailed, err)
+		return
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	size := int64(-1)
+	switch resp.StatusCode {
+	case 200:
+		// whole file, maybe because it changed since the last attempt
+		have = 0
+		if err = f.Truncate(0); err != nil {
+			fe.finish(d, dlFailed, err)
+			return
+		}
+		size = resp.ContentLength
+	case 206:
+		start, total, ok := vault.ParseContentRange(resp.Header["Content-Range"])
+		if !ok || start != have {
+			fe.finish(d, dlFailed, os.ErrorString("bad Content-Range"))
+			return
+		}
+		size = total
+	case 416:
+		// nothing left to fetch
+		fe.dl.lk.Lock()
+		done := d.Size == have
+		fe.dl.lk.Unlock()
+		if done {
+			fe.finish(d, dlDone, nil)
+		} else {
+			fe.finish(d, dlFailed, os.ErrorString(resp.Status))
+		}
+		return
+	default:
+		fe.finish(d, dlFailed, os.ErrorString(resp.Status))
+		return
+	}
+	if _, err = f.Seek(have, 0); err != nil {
+		fe.finish(d, dlFailed, err)
+		return
+	}
+	fe.dl.lk.Lock()
+	validator = resp.Header["Etag"]
+	if validator == "" {
+		validator = resp.Header["Last-Modified"]
+	}
+	d.Size, d.Have, d.Validator = size, have, validator
+	fe.dl.save()
+	fe.dl.lk.Unlock()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[0:n]); werr != nil {
+				fe.finish(d, dlFailed, werr)
+				return
+			}
+		}
+		fe.dl.lk.Lock()
+		d.Have += int64(n)
+		pause := d.pause
+		fe.dl.lk.Unlock()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			fe.finish(d, dlFailed, err)
+			return
+		}
+		if pause {
+			fe.finish(d, dlPaused, nil)
+			return
+		}
+	}
+	// A body cut short ends like a whole one. Such a download fails, and
+	// can be resumed from where it stopped.
+	fe.dl.lk.Lock()
+	got := d.Have
+	fe.dl.lk.Unlock()
+	if size >= 0 && got != size {
+		fe.finish(d, dlFailed, os.ErrorString(fmt.Sprintf("got %d of %d bytes", got, size)))
+		return
+	}
+	fe.finish(d, dlDone, nil)
+}
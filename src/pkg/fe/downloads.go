@@ -0,0 +1,126 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package fe
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"tonika/http"
+	"tonika/sys"
+)
+
+type downloadsData struct {
+	Downloads []*downloadData
+	Refresh   string // non-empty while a download is running
+}
+
+type downloadData struct {
+	Id       int
+	URL      string
+	File     string
+	Progress string
+	State    string
+	Err      string
+	Action   string // "pause", "resume" or empty
+	Sources  string // bytes fetched from each source, for swarm downloads
+}
+
+func (fe *identity) replyAdminDownloads(req *http.Request) *http.Response {
+	list := fe.getDownloads()
+	data := downloadsData{Downloads: make([]*downloadData, len(list))}
+	// newest first
+	for i, d := range list {
+		dd := &downloadData{
+			Id:       d.Id,
+			URL:      d.URL,
+			File:     d.File,
+			State:    d.State,
+			Err:      d.Err,
+		}
+		switch d.State {
+		case dlRunning:
+			dd.Action = "pause"
+		case dlPaused, dlFailed:
+			dd.Action = "resume"
+		}
+		if d.Size >= 0 {
+			pct := int64(100)
+			if d.Size > 0 {
+				pct = 100 * d.Have / d.Size
+			}
+			dd.Progress = fmt.Sprintf("%d of %d bytes (%d%%)", d.Have, d.Size, pct)
+		} else {
+			dd.Progress = fmt.Sprintf("%d bytes", d.Have)
+		}
+		if d.Swarm {
+			dd.Sources = fe.describeSources(d.Sources)
+		}
+		if d.State == dlRunning {
+			data.Refresh = "refresh"
+		}
+		data.Downloads[len(list)-1-i] = dd
+	}
+
+	// prepare content of page
+	var w bytes.Buffer
+	err := fe.tmplDownloads.Execute(&data, &w)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+
+	// wrap into a page frame
+	pdata := pageData {
+		Title: sys.Name+" &mdash; Downloads",
+		CSSLinks: []string{"monitor.css"},
+		JSLinks: []string{"downloads.js"},
+		GridLayout: "",
+		Content: w.String(),
+	}
+	var w2 bytes.Buffer
+	err = fe.tmplPage.Execute(&pdata, &w2)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(w2.String())
+}
+
+// describeSources lists the sources of a swarm download by name, with the
+// bytes fetched from each
+func (fe *identity) describeSources(sources map[string]int64) string {
+	if len(sources) == 0 {
+		return ""
+	}
+	l := make([]string, 0, len(sources))
+	for s, n := range sources {
+		name := s
+		if id, err := sys.ParseId(s); err == nil {
+			name = id.Eye()
+			if id == fe.bank.GetMyId() {
+				name = "my cache"
+			} else if v, err := fe.bank.GetById(id); err == nil {
+				name = v.GetName()
+			}
+		}
+		l = l[0 : len(l)+1]
+		l[len(l)-1] = fmt.Sprintf("%s: %d bytes", name, n)
+	}
+	sort.SortStrings(l)
+	return "from " + strings.Join(l, ", ")
+}
@@ -20,8 +20,8 @@ package fe
 import (
 	"bytes"
 	"strconv"
+	"time"
 	"tonika/http"
-	//"tonika/sys"
 )
 
 type editData struct {
@@ -31,13 +31,39 @@ type editData struct {
 	Addr  string
 
 	Id    string
+	Fingerprint string
 	DialKey   string
 	AcceptKey string
 	SigKey    string
 	HelloKey  string
+
+	Groups    []*memberData
+	Others    []*otherData
+	History   []*changeData
+	AdminURL  string
+}
+
+type changeData struct {
+	When  string
+	By    string
+	Field string
+	Old   string
+	New   string
+}
+
+// otherData is a contact that the friend being edited can be introduced to
+type otherData struct {
+	Slot int
+	Name string
+}
+
+// memberData says whether the friend being edited is in a group
+type memberData struct {
+	Name    string
+	Checked string
 }
 
-func (fe *FrontEnd) replyAdminEdit(req *http.Request) *http.Response {
+func (fe *identity) replyAdminEdit(req *http.Request) *http.Response {
 
 	args, err := http.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -61,10 +87,14 @@ func (fe *FrontEnd) replyAdminEdit(req *http.Request) *http.Response {
 		Name:  v.GetName(),
 		Email: v.GetEmail(),
 		Addr: v.GetAddr(),
+		AdminURL: fe.adminURL,
 	}
 	if v.GetId() != nil {
 		data.Id = v.GetId().Eye()
 	}
+	if v.GetFingerprint() != nil {
+		data.Fingerprint = v.GetFingerprint().String()
+	}
 	if v.GetDialKey() != nil {
 		data.DialKey = v.GetDialKey().String()
 	}
@@ -77,6 +107,44 @@ func (fe *FrontEnd) replyAdminEdit(req *http.Request) *http.Response {
 	if v.GetSignatureKey() != nil {
 		data.SigKey = v.GetSignatureKey().String()
 	}
+	in := make(map[string]bool)
+	for _, g := range fe.bank.GetGroupsOf(sn) {
+		in[g] = true
+	}
+	groups := fe.bank.GetGroups()
+	data.Groups = make([]*memberData, len(groups))
+	for i, g := range groups {
+		data.Groups[i] = &memberData{Name: g}
+		if in[g] {
+			data.Groups[i].Checked = "checked"
+		}
+	}
+	if v.IsComplete() && !v.IsRevoked() {
+		all := fe.bank.Enumerate()
+		n := 0
+		for _, w := range all {
+			if w.GetSlot() != sn && w.IsComplete() && !w.IsRevoked() {
+				all[n] = w
+				n++
+			}
+		}
+		data.Others = make([]*otherData, n)
+		for i, w := range all[0:n] {
+			data.Others[i] = &otherData{Slot: w.GetSlot(), Name: w.GetName()}
+		}
+	}
+	hist := fe.bank.GetHistory(sn)
+	data.History = make([]*changeData, len(hist))
+	for i, ch := range hist {
+		// newest first
+		data.History[len(hist)-1-i] = &changeData{
+			When:  time.SecondsToLocalTime(ch.Time / 1e9).Format(time.RFC1123),
+			By:    ch.By,
+			Field: ch.Field,
+			Old:   ch.Old,
+			New:   ch.New,
+		}
+	}
 
 	// prepare content of page
 	var w bytes.Buffer
@@ -29,21 +29,21 @@ import (
 	"sync"
 	"template"
 	"tonika/http"
+	"tonika/slog"
 	"tonika/sys"
-	"tonika/vault"
 	"tonika/util/misc"
 )
 
+var logger = slog.For("fe")
+
 type FrontEnd struct {
 	server      *http.AsyncServer
 	wwwclient   *http.AsyncClient
 	tdir, sdir  string
-	bank        sys.Bank
-	vault       vault.Vault
-	adminURL    string
-	myURL       string
+	ids         []*identity // the first one is the default
 
 	tmplPage     *template.Template
+	tmplActivity *template.Template
 	tmplAdmin    *template.Template
 	tmplAdd      *template.Template
 	tmplEdit     *template.Template
@@ -52,6 +52,13 @@ type FrontEnd struct {
 	tmplReinvite *template.Template
 	tmplRoot     *template.Template
 	tmplMonitor  *template.Template
+	tmplPicker   *template.Template
+	tmplLogs     *template.Template
+	tmplDownloads *template.Template
+	tmplInbox    *template.Template
+	tmplSearch   *template.Template
+
+	dl        downloads
 
 	useragent string
 	lk        sync.Mutex
@@ -59,21 +66,16 @@ type FrontEnd struct {
 
 // tdir = fe templates dir
 // sdir = fe static files dir
+// Identities to serve are added with AddIdentity.
 func MakeFrontEnd(
 	tdir,sdir string, 
 	addr string, 
 	allow string,
-	bank sys.Bank, 
-	vault vault.Vault,
-	myid sys.Id) (*FrontEnd, os.Error) {
+	serverfd, clientfd int) (*FrontEnd, os.Error) {
 
 	fe := &FrontEnd{
 		tdir:     tdir,
 		sdir:     sdir,
-		bank:     bank,
-		vault:    vault,
-		adminURL: "http://a."+sys.Host,
-		myURL:    sys.MakeURL("", myid, ""),
 	}
 	err := fe.loadTmpls()
 	if err != nil {
@@ -83,13 +85,37 @@ func MakeFrontEnd(
 	if err != nil {
 		return nil, err
 	}
-	fe.wwwclient = http.NewAsyncClient(30e9, 2, 3, 60)
-	fe.server = http.NewAsyncServer(l, 20e9, 100)
+	fe.wwwclient = http.NewAsyncClient(30e9, 2, 3, clientfd)
+	fe.server = http.NewAsyncServer(l, 20e9, serverfd)
 	fe.server.SetAllowHosts(http.MakeAllowHosts(allow))
 	go fe.serveLoop()
 	return fe, nil
 }
 
+// Rebind moves the Front End proxy to addr
+func (fe *FrontEnd) Rebind(addr string) os.Error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Warnf("Cannot move Front End to %s: %s", addr, err)
+		return err
+	}
+	logger.Infof("Front End moved to %s", addr)
+	return fe.server.Rebind(l)
+}
+
+// SetAllow changes the comma-separated list of hosts allowed to use the
+// Front End
+func (fe *FrontEnd) SetAllow(allow string) {
+	fe.server.SetAllowHosts(http.MakeAllowHosts(allow))
+}
+
+// SetFDLimits changes the number of file descriptors used by the proxy
+// server and by its outgoing web client
+func (fe *FrontEnd) SetFDLimits(server, client int) {
+	fe.server.GetFDLimiter().SetLimit(server)
+	fe.wwwclient.GetFDLimiter().SetLimit(client)
+}
+
 func (fe *FrontEnd) String() string {
 	fe.lk.Lock()
 	defer fe.lk.Unlock()
@@ -118,6 +144,10 @@ func (fe *FrontEnd) loadTmpls() (err os.Error) {
 	if err != nil {
 		return err
 	}
+	fe.tmplActivity,err = loadTmpl(fe.tdir, "activity.tmpl")
+	if err != nil {
+		return err
+	}
 	fe.tmplAdmin,err = loadTmpl(fe.tdir, "admin.tmpl")
 	if err != nil {
 		return err
@@ -146,6 +176,26 @@ func (fe *FrontEnd) loadTmpls() (err os.Error) {
 	if err != nil {
 		return err
 	}
+	fe.tmplPicker,err = loadTmpl(fe.tdir, "picker.tmpl")
+	if err != nil {
+		return err
+	}
+	fe.tmplLogs,err = loadTmpl(fe.tdir, "logs.tmpl")
+	if err != nil {
+		return err
+	}
+	fe.tmplDownloads,err = loadTmpl(fe.tdir, "downloads.tmpl")
+	if err != nil {
+		return err
+	}
+	fe.tmplInbox,err = loadTmpl(fe.tdir, "inbox.tmpl")
+	if err != nil {
+		return err
+	}
+	fe.tmplSearch,err = loadTmpl(fe.tdir, "search.tmpl")
+	if err != nil {
+		return err
+	}
 	fe.tmplRoot,err = loadTmpl(fe.tdir, "root.tmpl")
 	return err
 }
@@ -153,12 +203,22 @@ func (fe *FrontEnd) loadTmpls() (err os.Error) {
 func (fe *FrontEnd) serveLoop() {
 	for {
 		q,err := fe.server.Read()
+		if err == os.EBADF {
+			return // shut down
+		}
 		if err == nil {
 			go fe.serve(q)
+		} else {
+			logger.Debugf("Front End read: %s", err)
 		}
 	}
 }
 
+// Shutdown stops the Front End proxy and closes its connections
+func (fe *FrontEnd) Shutdown() os.Error {
+	return fe.server.Shutdown()
+}
+
 func (fe *FrontEnd) serve(q *http.Query) {
 	req := q.GetRequest()
 	//fmt.Printf("Request: %v·%v·%v·%v\n", 
@@ -168,14 +228,22 @@ func (fe *FrontEnd) serve(q *http.Query) {
 	fe.useragent = req.UserAgent
 	fe.lk.Unlock()
 
-	rtype, _ := getRequestType(req)
+	rtype, id := getRequestType(req)
 	switch {
 	case rtype == feWWWReq:
 		fe.serveWWW(q)
 	case rtype == feAdminReq:
-		fe.serveAdmin(q)
-	case rtype == feTonikaReq:
-		fe.serveViaVault(q)
+		fe.serveAdmin(q, id)
+	case rtype == feTonikaReq && len(fe.getIdentities()) > 0:
+		i := fe.getVaultIdentity(req, id)
+		if i == nil {
+			serveUserMsg("This "+sys.Name+" address is not known to any of your identities, "+
+				"or is known to several. Open it from the pages of one of them.", q)
+			return
+		}
+		// The vault only knows the plain host of the node
+		req.Host = sys.MakeHost("", id)
+		i.serveViaVault(q)
 	default:
 		q.Continue()
 		if req.Body != nil {
@@ -245,7 +313,7 @@ func (fe *FrontEnd) wwwConnect(q *http.Query) {
 	http.MakeBridge(conn1, r1, conn2, nil)
 }
 
-func (fe *FrontEnd) serveAdmin(q *http.Query) {
+func (fe *FrontEnd) serveAdmin(q *http.Query, id sys.Id) {
 	req := q.GetRequest()
 	q.Continue()
 
@@ -266,36 +334,58 @@ func (fe *FrontEnd) serveAdmin(q *http.Query) {
 		return
 	}
 
+	i := fe.getAdminIdentity(id)
+	if i == nil {
+		if id == 0 && path == "/" {
+			q.Write(fe.replyPicker())
+		} else {
+			q.Write(newRespNotFound())
+		}
+		return
+	}
+	q.Write(i.replyAdmin(req, path))
+}
+
+func (fe *identity) replyAdmin(req *http.Request, path string) *http.Response {
 	var resp *http.Response
 	switch {
 	case strings.HasPrefix(path, "/api/"):
 		resp = fe.replyAPI(req)
 	case strings.HasPrefix(path, "/accept"):
 		resp = fe.replyAdminAccept(req)
+	case strings.HasPrefix(path, "/activity"):
+		resp = fe.replyAdminActivity(req)
 	case strings.HasPrefix(path, "/add"):
 		resp = fe.replyAdminAdd(req)
 	case strings.HasPrefix(path, "/bug"):
 		resp = fe.replyAdminBug(req)
+	case strings.HasPrefix(path, "/downloads"):
+		resp = fe.replyAdminDownloads(req)
 	case strings.HasPrefix(path, "/edit"):
 		resp = fe.replyAdminEdit(req)
+	case strings.HasPrefix(path, "/inbox"):
+		resp = fe.replyAdminInbox(req)
+	case strings.HasPrefix(path, "/logs"):
+		resp = fe.replyAdminLogs(req)
 	case strings.HasPrefix(path, "/monitor"):
 		resp = fe.replyAdminMonitor(req)
 	case strings.HasPrefix(path, "/neighbors"):
 		resp = fe.replyRoot()
 	case strings.HasPrefix(path, "/reinvite"):
 		resp = fe.replyAdminReinvite(req)
+	case strings.HasPrefix(path, "/search"):
+		resp = fe.replyAdminSearch(req)
 	case strings.HasPrefix(path, "/"):
 		resp = fe.replyAdminMain()
 	default:
-		q.Write(newRespNotFound())
-		return
+		resp = newRespNotFound()
 	}
 	//dresp, _ := http.DumpResponse(resp, false)
 	//fmt.Printf("RESP:\n%s\n", string(dresp))
-	q.Write(resp)
+	return resp
 }
 
-func (fe *FrontEnd) replyAPI(req *http.Request) *http.Response { 
+func (fe *identity) replyAPI(req *http.Request) *http.Response { 
 	p := req.URL.Path
 	p = p[len("/api/"):]
 	path := strings.Split(p, "/", -1)
@@ -315,14 +405,24 @@ func (fe *FrontEnd) replyAPI(req *http.Request) *http.Response {
 		return fe.replyAPIAccept(args)
 	case "add":
 		return fe.replyAPIAdd(args)
+	case "download":
+		return fe.replyAPIDownload(args)
+	case "group":
+		return fe.replyAPIGroup(args)
+	case "intro":
+		return fe.replyAPIIntro(args)
 	case "live":
 		return fe.replyAPILive(args)
 	case "monitor":
 		return fe.replyAPIMonitor(args)
+	case "revcert":
+		return fe.replyAPIRevCert(args)
 	case "revoke":
 		return fe.replyAPIRevoke(args)
 	case "update":
 		return fe.replyAPIUpdate(args)
+	case "reload":
+		return fe.replyAPIReload(args)
 	case "myinfo":
 		return fe.replyAPIMyInfo(args)
 	default:
@@ -14,28 +14,17 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-
 package fe
 
 import (
-	"os"
-	"os/signal"
 	"testing"
 )
 
-func sigh() {
-	for {
-		<-signal.Incoming
-		os.Exit(0)
-		//panic()
-	}
-}
-
 func TestFe(t *testing.T) {
-	go sigh()
-	_,err := NewFrontEnd("./tmpl/", "./static")
+	fe, err := MakeFrontEnd("../BUNDLE/fe/tmpl/", "../BUNDLE/fe/static",
+		"127.0.0.1:0", "127.0.0.1", 10, 10)
 	if err != nil {
 		t.Fatalf("err new: %s", err)
 	}
-	<-make(chan int)
+	fe.Shutdown()
 }
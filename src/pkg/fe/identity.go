@@ -0,0 +1,162 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package fe
+
+import (
+	"bytes"
+	"tonika/http"
+	"tonika/sys"
+	"tonika/vault"
+)
+
+// identity is one of the identities served by the Front End. The admin
+// pages and APIs are methods of identity, so each of them only ever sees
+// the bank and the vault of the identity it was addressed to.
+type identity struct {
+	*FrontEnd
+	id       sys.Id
+	bank     sys.Bank
+	vault    vault.Vault
+	adminURL string
+	myURL    string
+}
+
+// AddIdentity makes the Front End serve the identity behind bank, whose
+// files are served by vault. Its admin pages live at a.<id>.5ttt.org. The
+// first identity added is the default one.
+func (fe *FrontEnd) AddIdentity(bank sys.Bank, vault vault.Vault) {
+	id := bank.GetMyId()
+	fe.lk.Lock()
+	defer fe.lk.Unlock()
+	ids := make([]*identity, len(fe.ids)+1)
+	copy(ids, fe.ids)
+	ids[len(fe.ids)] = &identity{
+		FrontEnd: fe,
+		id:       id,
+		bank:     bank,
+		vault:    vault,
+		adminURL: sys.MakeURL("a", id, ""),
+		myURL:    sys.MakeURL("", id, ""),
+	}
+	fe.ids = ids
+}
+
+func (fe *FrontEnd) getIdentities() []*identity {
+	fe.lk.Lock()
+	defer fe.lk.Unlock()
+	return fe.ids
+}
+
+// getAdminIdentity returns the identity whose admin pages are at
+// a.<id>.5ttt.org. For a.5ttt.org it returns the only identity, or nil
+// if there are several to pick from.
+func (fe *FrontEnd) getAdminIdentity(id sys.Id) *identity {
+	ids := fe.getIdentities()
+	if id == 0 {
+		if len(ids) == 1 {
+			return ids[0]
+		}
+		return nil
+	}
+	for _, i := range ids {
+		if i.id == id {
+			return i
+		}
+	}
+	return nil
+}
+
+// getVaultIdentity picks the identity whose vault should fetch req from the
+// node id: the identity named in the host (id.via.5ttt.org), else the
+// identity itself or the only identity that has id as a friend. If several
+// identities are served, it returns nil rather than guess when id is shared
+// by some of them or known to none. The Referer is not looked at, since any
+// page can make the browser send requests on behalf of another identity;
+// the pages of an identity link to friends through it, with via URLs.
+func (fe *FrontEnd) getVaultIdentity(req *http.Request, id sys.Id) *identity {
+	ids := fe.getIdentities()
+	if len(ids) == 0 {
+		return nil
+	}
+	if via := getViaId(req.Host); via != 0 {
+		return fe.getAdminIdentity(via)
+	}
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	var found *identity
+	for _, i := range ids {
+		if i.id == id {
+			return i
+		}
+		if _, err := i.bank.GetById(id); err == nil {
+			if found != nil {
+				return nil
+			}
+			found = i
+		}
+	}
+	return found
+}
+
+type pickerData struct {
+	Identities []*pickerItem
+}
+
+type pickerItem struct {
+	Id       string
+	Name     string
+	Friends  int
+	AdminURL string
+}
+
+// replyPicker lists the identities served, for the user to choose one
+func (fe *FrontEnd) replyPicker() *http.Response {
+	ids := fe.getIdentities()
+	data := pickerData{Identities: make([]*pickerItem, len(ids))}
+	for k, i := range ids {
+		data.Identities[k] = &pickerItem{
+			Id:       i.id.Eye(),
+			Name:     i.bank.GetMyName(),
+			Friends:  len(i.bank.Enumerate()),
+			AdminURL: i.adminURL,
+		}
+	}
+
+	// prepare content of page
+	var w bytes.Buffer
+	err := fe.tmplPicker.Execute(&data, &w)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+
+	// wrap into a page frame
+	pdata := pageData{
+		Title:      sys.Name + " &mdash; Pick an identity",
+		CSSLinks:   []string{"admin.css"},
+		JSLinks:    []string{},
+		GridLayout: "",
+		Content:    w.String(),
+	}
+	var w2 bytes.Buffer
+	err = fe.tmplPage.Execute(&pdata, &w2)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(w2.String())
+}
@@ -0,0 +1,108 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fe
+
+import (
+	"os"
+	"testing"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// testBank is an identity with some friends; other Bank methods are not
+// used here
+type testBank struct {
+	sys.Bank
+	me      sys.Id
+	friends []sys.Id
+}
+
+func (b *testBank) GetMyId() sys.Id { return b.me }
+
+func (b *testBank) GetById(id sys.Id) (sys.View, os.Error) {
+	for _, f := range b.friends {
+		if f == id {
+			return nil, nil
+		}
+	}
+	return nil, os.EINVAL
+}
+
+func TestGetViaId(t *testing.T) {
+	x, via := sys.Id(1234567), sys.Id(7654321)
+	if id := getViaId(sys.MakeHost(x.String(), via)); id != via {
+		t.Errorf("via host: got %v", id)
+	}
+	for _, host := range []string{
+		sys.MakeHost("", x),
+		sys.MakeHost("a", via),
+		"a.b." + sys.Host,
+		x.String() + "." + via.String() + ".example.org",
+		"www.google.com",
+	} {
+		if id := getViaId(host); id != 0 {
+			t.Errorf("%s: got %v", host, id)
+		}
+	}
+}
+
+func TestGetVaultIdentity(t *testing.T) {
+	alice, bob := sys.Id(1111111), sys.Id(2222222)
+	carol, dave, eve := sys.Id(3333333), sys.Id(4444444), sys.Id(5555555)
+	fe := &FrontEnd{}
+	if fe.getVaultIdentity(&http.Request{Host: sys.MakeHost("", carol)}, carol) != nil {
+		t.Errorf("identity picked with none served")
+	}
+	fe.AddIdentity(&testBank{me: alice, friends: []sys.Id{carol, dave}}, nil)
+	pick := func(host string, id sys.Id) sys.Id {
+		i := fe.getVaultIdentity(&http.Request{Host: host}, id)
+		if i == nil {
+			return 0
+		}
+		return i.id
+	}
+	if pick(sys.MakeHost("", eve), eve) != alice {
+		t.Errorf("the only identity not picked")
+	}
+
+	fe.AddIdentity(&testBank{me: bob, friends: []sys.Id{dave}}, nil)
+	tests := []struct {
+		host string
+		id   sys.Id
+		want sys.Id
+	}{
+		{sys.MakeHost("", carol), carol, alice},
+		{sys.MakeHost("", bob), bob, bob},
+		{sys.MakeHost("", dave), dave, 0},
+		{sys.MakeHost("", eve), eve, 0},
+		{sys.MakeHost(dave.String(), bob), dave, bob},
+		{sys.MakeHost(carol.String(), bob), carol, bob},
+		{sys.MakeHost(dave.String(), eve), dave, 0},
+	}
+	for i, tt := range tests {
+		if got := pick(tt.host, tt.id); got != tt.want {
+			t.Errorf("%d: %s: expected %v, got %v", i, tt.host, tt.want, got)
+		}
+	}
+
+	// The Referer does not choose the identity
+	req := &http.Request{Host: sys.MakeHost("", dave),
+		Referer: sys.MakeURL("a", alice, "")}
+	if fe.getVaultIdentity(req, dave) != nil {
+		t.Errorf("identity picked from the Referer")
+	}
+}
@@ -0,0 +1,89 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fe
+
+import (
+	"bytes"
+	"sort"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+	"tonika/vault"
+)
+
+type inboxData struct {
+	Files []*inboxFileData
+}
+
+type inboxFileData struct {
+	Sender string
+	Name   string
+	URL    string
+	Size   int64
+	When   string
+}
+
+// inboxSorter orders received files newest first
+type inboxSorter []*vault.InboxFile
+
+func (s inboxSorter) Len() int           { return len(s) }
+func (s inboxSorter) Less(i, j int) bool { return s[i].Mtime > s[j].Mtime }
+func (s inboxSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (fe *identity) replyAdminInbox(req *http.Request) *http.Response {
+	files, err := fe.vault.Inbox()
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	sort.Sort(inboxSorter(files))
+	data := inboxData{Files: make([]*inboxFileData, len(files))}
+	for i, f := range files {
+		sender := f.Sender.Eye()
+		if v, err := fe.bank.GetById(f.Sender); err == nil {
+			sender = v.GetName()
+		}
+		data.Files[i] = &inboxFileData{
+			Sender: sender,
+			Name:   f.Name,
+			URL:    fe.myURL + "/" + http.URLPathEscape(f.Path),
+			Size:   f.Size,
+			When:   time.SecondsToLocalTime(f.Mtime).Format(time.RFC1123),
+		}
+	}
+
+	// prepare content of page
+	var w bytes.Buffer
+	err = fe.tmplInbox.Execute(&data, &w)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+
+	// wrap into a page frame
+	pdata := pageData {
+		Title: sys.Name+" &mdash; Inbox",
+		CSSLinks: []string{"monitor.css"},
+		JSLinks: []string{},
+		GridLayout: "",
+		Content: w.String(),
+	}
+	var w2 bytes.Buffer
+	err = fe.tmplPage.Execute(&pdata, &w2)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(w2.String())
+}
@@ -0,0 +1,146 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package fe
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"tonika/http"
+	"tonika/slog"
+	"tonika/sys"
+)
+
+type logsData struct {
+	Levels  []*optionData
+	Systems []*optionData
+	Friends []*optionData
+	Text    string
+	Records []*recordData
+}
+
+// optionData is one choice of a filter drop-down
+type optionData struct {
+	Value    string
+	Name     string
+	Selected string
+}
+
+type recordData struct {
+	When  string
+	Level string
+	Sys   string
+	Who   string
+	Msg   string
+}
+
+var logSystems = []string{"core", "dialer", "compass", "vault", "fe"}
+
+const logsCount = 500
+
+// replyAdminLogs shows the most recent log records of this identity. The
+// query arguments lv, sys, id and q narrow them down by least level,
+// subsystem, friend Id and text in the message.
+func (fe *identity) replyAdminLogs(req *http.Request) *http.Response {
+	args, err := http.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return newRespBadRequest()
+	}
+	arg := func(k string) string {
+		if v, ok := args[k]; ok && len(v) == 1 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	f := &slog.Filter{Level: slog.Info, Sys: arg("sys"), Id: arg("id"), Text: arg("q")}
+	if lv := arg("lv"); lv != "" {
+		if f.Level, err = slog.ParseLevel(lv); err != nil {
+			return newRespBadRequest()
+		}
+	}
+
+	data := logsData{Text: f.Text}
+	data.Levels = make([]*optionData, slog.Error+1)
+	for l := slog.Debug; l <= slog.Error; l++ {
+		data.Levels[l] = makeOption(l.String(), l.String(), l == f.Level)
+	}
+	data.Systems = make([]*optionData, len(logSystems)+1)
+	data.Systems[0] = makeOption("", "all", f.Sys == "")
+	for i, s := range logSystems {
+		data.Systems[i+1] = makeOption(s, s, s == f.Sys)
+	}
+	names := make(map[string]string)
+	views := fe.bank.Enumerate()
+	data.Friends = make([]*optionData, 1, len(views)+1)
+	data.Friends[0] = makeOption("", "all", f.Id == "")
+	for _, v := range views {
+		if v.GetId() == nil {
+			continue
+		}
+		id := v.GetId().Eye()
+		names[id] = v.GetName()
+		data.Friends = data.Friends[0 : len(data.Friends)+1]
+		data.Friends[len(data.Friends)-1] = makeOption(id, v.GetName(), id == f.Id)
+	}
+
+	recs := slog.Of(fe.bank.GetMyId()).Recent(logsCount, f)
+	data.Records = make([]*recordData, len(recs))
+	for i, r := range recs {
+		rd := &recordData{
+			When:  time.SecondsToLocalTime(r.Time / 1e9).Format(time.RFC1123),
+			Level: r.Level.String(),
+			Sys:   r.Sys,
+			Who:   r.Id,
+			Msg:   r.Msg,
+		}
+		if n, ok := names[r.Id]; ok {
+			rd.Who = n
+		}
+		data.Records[i] = rd
+	}
+
+	// prepare content of page
+	var w bytes.Buffer
+	err = fe.tmplLogs.Execute(&data, &w)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+
+	// wrap into a page frame
+	pdata := pageData {
+		Title: sys.Name+" &mdash; Logs",
+		CSSLinks: []string{"monitor.css"},
+		JSLinks: []string{"logs.js"},
+		GridLayout: "",
+		Content: w.String(),
+	}
+	var w2 bytes.Buffer
+	err = fe.tmplPage.Execute(&pdata, &w2)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(w2.String())
+}
+
+func makeOption(value, name string, selected bool) *optionData {
+	o := &optionData{Value: value, Name: name}
+	if selected {
+		o.Selected = "selected"
+	}
+	return o
+}
@@ -27,7 +27,7 @@ type monitorData struct {
 	Text  string
 }
 
-func (fe *FrontEnd) replyAdminMonitor(req *http.Request) *http.Response {
+func (fe *identity) replyAdminMonitor(req *http.Request) *http.Response {
 
 	data := monitorData{ Text: fe.bank.String() }
 
@@ -28,7 +28,7 @@ type reinviteData struct {
 	Invite string
 }
 
-func (fe *FrontEnd) replyAdminReinvite(req *http.Request) *http.Response {
+func (fe *identity) replyAdminReinvite(req *http.Request) *http.Response {
 
 	args, err := http.ParseQuery(req.URL.RawQuery)
 	s, ok := args["s"]
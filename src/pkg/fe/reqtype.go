@@ -59,5 +59,27 @@ func getRequestType(req *http.Request) (int, sys.Id) {
 	if hostparts[0] == "a" { // a.xxxxxxxxx.5ttt.org
 		return feAdminReq, id 
 	}
+	if len(hostparts) == 1 { // yyyyyyyyy.xxxxxxxxx.5ttt.org, y reached via x
+		if fid, err := sys.ParseId(hostparts[0]); err == nil {
+			return feTonikaReq, fid
+		}
+	}
 	return feBadReq, 0
 }
+
+// getViaId returns the local identity x in a host of the form
+// y.x.5ttt.org, or 0
+func getViaId(host string) sys.Id {
+	hostparts := misc.ReverseHost(strings.Split(host, ".", -1))
+	if len(hostparts) != 4 || hostparts[0] != sys.Host0 || hostparts[1] != sys.Host1 {
+		return 0
+	}
+	if _, err := sys.ParseId(hostparts[3]); err != nil {
+		return 0
+	}
+	via, err := sys.ParseId(hostparts[2])
+	if err != nil {
+		return 0
+	}
+	return via
+}
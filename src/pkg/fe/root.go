@@ -32,7 +32,7 @@ type rootData struct {
 	Links     string
 }
 
-func (fe *FrontEnd) replyRoot() *http.Response {
+func (fe *identity) replyRoot() *http.Response {
 	friends := fe.bank.Enumerate()
 	var u bytes.Buffer
 	u.WriteString("<ul>")
@@ -40,7 +40,7 @@ func (fe *FrontEnd) replyRoot() *http.Response {
 	for _,f := range friends {
 		if f.IsOnline() {
 			u.WriteString("<li><div class=\"ok\"><a href=\"" + 
-				sys.MakeURL("", *f.GetId(), "") + "\">" + f.GetName() +
+				sys.MakeViaURL(*f.GetId(), fe.id, "") + "\">" + f.GetName() +
 				"</a></div></li>")
 		} else {
 			u.WriteString("<li><div class=\"nop\">" + f.GetName() + "</div></li>")
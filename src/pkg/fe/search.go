@@ -0,0 +1,128 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fe
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+	"tonika/vault"
+)
+
+type searchData struct {
+	Text    string
+	Hops    []*optionData
+	Done    string // non-empty once a search was made
+	Err     string
+	Results []*resultData
+}
+
+type resultData struct {
+	Name  string
+	URL   string
+	Owner string
+	Size  int64
+	When  string
+}
+
+// replyAdminSearch looks for files in my vault and those of my friends.
+// The query argument q holds the words to look for, and hops how far
+// into the friend graph the search goes.
+func (fe *identity) replyAdminSearch(req *http.Request) *http.Response {
+	args, err := http.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return newRespBadRequest()
+	}
+	arg := func(k string) string {
+		if v, ok := args[k]; ok && len(v) == 1 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	hops := 1
+	if h := arg("hops"); h != "" {
+		if hops, err = strconv.Atoi(h); err != nil {
+			return newRespBadRequest()
+		}
+	}
+	data := searchData{Text: arg("q")}
+	data.Hops = make([]*optionData, vault.MaxSearchHops+1)
+	for h := 0; h <= vault.MaxSearchHops; h++ {
+		name := fmt.Sprintf("%d hops", h)
+		switch h {
+		case 0:
+			name = "my vault"
+		case 1:
+			name = "friends"
+		case 2:
+			name = "friends of friends"
+		}
+		data.Hops[h] = makeOption(strconv.Itoa(h), name, h == hops)
+	}
+
+	if data.Text != "" {
+		hits, err := fe.vault.Search(data.Text, hops)
+		data.Done = "done"
+		if err != nil {
+			data.Err = err.String()
+		}
+		data.Results = make([]*resultData, len(hits))
+		for i, h := range hits {
+			owner := h.Owner
+			if id, err := sys.ParseId(h.Owner); err == nil {
+				if id == fe.bank.GetMyId() {
+					owner = "me"
+				} else if v, err := fe.bank.GetById(id); err == nil {
+					owner = v.GetName()
+				}
+			}
+			data.Results[i] = &resultData{
+				Name:  h.Path,
+				URL:   h.URL(fe.bank.GetMyId()),
+				Owner: owner,
+				Size:  h.Size,
+				When:  time.SecondsToLocalTime(h.Mtime).Format(time.RFC1123),
+			}
+		}
+	}
+
+	// prepare content of page
+	var w bytes.Buffer
+	err = fe.tmplSearch.Execute(&data, &w)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+
+	// wrap into a page frame
+	pdata := pageData {
+		Title: sys.Name+" &mdash; Search",
+		CSSLinks: []string{"monitor.css"},
+		JSLinks: []string{"search.js"},
+		GridLayout: "",
+		Content: w.String(),
+	}
+	var w2 bytes.Buffer
+	err = fe.tmplPage.Execute(&pdata, &w2)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	return buildResp(w2.String())
+}
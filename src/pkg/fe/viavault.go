@@ -22,7 +22,7 @@ import (
 	"tonika/sys"
 )
 
-func (fe *FrontEnd) serveViaVault(q *http.Query) {
+func (fe *identity) serveViaVault(q *http.Query) {
 	req := q.GetRequest()
 	resp, err := fe.vault.Serve(req)
 	if err != nil {
@@ -133,6 +133,33 @@ func (as *AsyncServer) SetAllowHosts(ah *AllowHosts) {
 	as.allow = ah
 }
 
+// Rebind makes the server accept connections on l instead of its current
+// listener, which is closed. Connections accepted so far are unaffected.
+func (as *AsyncServer) Rebind(l net.Listener) os.Error {
+	as.lk.Lock()
+	old := as.listen
+	if old == nil {
+		as.lk.Unlock()
+		return os.EINVAL
+	}
+	as.listen = l
+	as.lk.Unlock()
+	return old.Close()
+}
+
+func (as *AsyncServer) isShutdown() bool {
+	as.lk.Lock()
+	defer as.lk.Unlock()
+	return as.listen == nil
+}
+
+// rebound returns true if l is no longer the listener of the server
+func (as *AsyncServer) rebound(l net.Listener) bool {
+	as.lk.Lock()
+	defer as.lk.Unlock()
+	return as.listen != nil && as.listen != l
+}
+
 func (as *AsyncServer) isAllowed(c net.Conn) bool {
 	as.lk.Lock()
 	defer as.lk.Unlock()
@@ -151,7 +178,7 @@ func (as *AsyncServer) acceptLoop() {
 			return
 		}
 		as.fdl.Lock()
-		c, err := as.listen.Accept()
+		c, err := l.Accept()
 		if err != nil || !as.isAllowed(c) {
 			if err == nil {
 				err = os.EPERM
@@ -160,6 +187,12 @@ func (as *AsyncServer) acceptLoop() {
 				c.Close()
 			}
 			as.fdl.Unlock()
+			if err != os.EPERM && as.rebound(l) {
+				continue // the old listener was closed by Rebind
+			}
+			if as.isShutdown() {
+				return
+			}
 			as.qch <- &Query{err:err}
 			continue
 		}
@@ -31,13 +31,36 @@ func (fdl *FDLimiter) Init(fdlim int) {
 	fdl.lk.Unlock()
 }
 
+// SetLimit changes the limit. Descriptors that are already allocated stay
+// allocated, even if they exceed a lowered limit.
+func (fdl *FDLimiter) SetLimit(fdlim int) {
+	if fdlim <= 0 {
+		panic("FDLimiter, bad limit")
+	}
+	fdl.lk.Lock()
+	raised := fdlim > fdl.limit
+	fdl.limit = fdlim
+	if raised && fdl.count < fdl.limit {
+		// Several descriptors may have become available, so wake up all
+		// waiters by closing the channel they wait on, and let later
+		// waiters wait on a new one.
+		close(fdl.ch)
+		fdl.ch = make(chan int, 1)
+	}
+	fdl.lk.Unlock()
+}
+
 func (fdl *FDLimiter) LockCount() int {
 	fdl.lk.Lock()
 	defer fdl.lk.Unlock()
 	return fdl.count
 }
 
-func (fdl *FDLimiter) Limit() int { return fdl.limit }
+func (fdl *FDLimiter) Limit() int {
+	fdl.lk.Lock()
+	defer fdl.lk.Unlock()
+	return fdl.limit
+}
 
 // Lock blocks until it can allocate one fd without violating the limit.
 func (fdl *FDLimiter) Lock() {
@@ -48,8 +71,9 @@ func (fdl *FDLimiter) Lock() {
 			fdl.lk.Unlock()
 			return
 		}
+		ch := fdl.ch // SetLimit may replace it
 		fdl.lk.Unlock()
-		<-fdl.ch
+		<-ch
 	}
 	panic("FDLimiter, unreachable")
 }
@@ -66,6 +90,7 @@ func (fdl *FDLimiter) LockOrTimeout(ns int64) os.Error {
 			fdl.lk.Unlock()
 			return nil
 		}
+		ch := fdl.ch
 		fdl.lk.Unlock()
 
 		// Or, wait for an fd or timeout
@@ -76,7 +101,7 @@ func (fdl *FDLimiter) LockOrTimeout(ns int64) os.Error {
 		alrm := alarmOnce(ns - waitsofar)
 		select {
 		case <-alrm:
-		case <-fdl.ch:
+		case <-ch:
 		}
 		waitsofar += time.Nanoseconds() - t0
 	}
@@ -91,12 +116,13 @@ func (fdl *FDLimiter) LockOrChan(ch <-chan interface{}) (msg interface{}, err os
 			fdl.lk.Unlock()
 			return nil, nil
 		}
+		fdlch := fdl.ch
 		fdl.lk.Unlock()
 
 		select {
 		case msg = <-ch:
 			return msg, os.EAGAIN
-		case <-fdl.ch:
+		case <-fdlch:
 		}
 	}
 	panic("FDLimiter, unreachable")
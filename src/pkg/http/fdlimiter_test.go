@@ -0,0 +1,35 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFDLimiterRaise(t *testing.T) {
+	fdl := &FDLimiter{}
+	fdl.Init(1)
+	fdl.Lock()
+	got := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			fdl.Lock()
+			got <- 1
+		}()
+	}
+	time.Sleep(50e6)
+	fdl.SetLimit(4) // room for all three waiters
+	for i := 0; i < 3; i++ {
+		select {
+		case <-got:
+		case <-alarmOnce(2e9):
+			t.Fatalf("only %d of 3 waiters woke up", i)
+		}
+	}
+	if fdl.LockCount() != 4 {
+		t.Fatalf("count is %d", fdl.LockCount())
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// MultipartReader reads the parts of a multipart/form-data body, as sent by
+// browsers for file uploads, one after the other. Parts are streamed, so
+// that large files are never held in memory.
+type MultipartReader struct {
+	r     io.Reader
+	buf   []byte // unread input
+	delim []byte // "\r\n--" + boundary
+	eof   bool   // r is exhausted
+	done  bool   // the closing delimiter has been read
+	part  *Part  // the part being read
+}
+
+// Part is one part of a multipart body. Its Read returns os.EOF at the end
+// of the part.
+type Part struct {
+	Header map[string]string
+	mr     *MultipartReader
+	end    bool
+}
+
+const multipartBufSize = 32 * 1024
+
+var crlf = []byte{'\r', '\n'}
+
+// MultipartBoundary returns the boundary given in the Content-Type ct of
+// a multipart/form-data body, or "" if ct is of another type.
+func MultipartBoundary(ct string) string {
+	params := strings.Split(ct, ";", -1)
+	if strings.ToLower(strings.TrimSpace(params[0])) != "multipart/form-data" {
+		return ""
+	}
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(strings.ToLower(p), "boundary=") {
+			return strings.Trim(p[len("boundary="):], "\"")
+		}
+	}
+	return ""
+}
+
+func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+	mr := &MultipartReader{
+		r:     r,
+		buf:   make([]byte, 2, multipartBufSize),
+		delim: []byte("\r\n--" + boundary),
+	}
+	// The first delimiter need not follow a line break. Pretend it does,
+	// and treat whatever comes before it as a part to skip.
+	copy(mr.buf, crlf)
+	mr.part = &Part{mr: mr}
+	return mr
+}
+
+// fill reads more input into the buffer
+func (mr *MultipartReader) fill() os.Error {
+	if mr.eof {
+		return io.ErrUnexpectedEOF
+	}
+	if len(mr.buf) == cap(mr.buf) {
+		return os.ErrorString("multipart: header line too long")
+	}
+	n, err := mr.r.Read(mr.buf[len(mr.buf):cap(mr.buf)])
+	mr.buf = mr.buf[0 : len(mr.buf)+n]
+	if err == os.EOF {
+		mr.eof = true
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// consume drops the first n bytes of the buffer
+func (mr *MultipartReader) consume(n int) {
+	copy(mr.buf, mr.buf[n:])
+	mr.buf = mr.buf[0 : len(mr.buf)-n]
+}
+
+func (mr *MultipartReader) readLine() (string, os.Error) {
+	for {
+		if i := bytes.Index(mr.buf, crlf); i >= 0 {
+			line := string(mr.buf[0:i])
+			mr.consume(i + 2)
+			return line, nil
+		}
+		if err := mr.fill(); err != nil {
+			return "", err
+		}
+	}
+	panic("unreach")
+}
+
+// NextPart skips what is left of the current part and returns the next one.
+// After the last part, it returns os.EOF.
+func (mr *MultipartReader) NextPart() (*Part, os.Error) {
+	if mr.part != nil {
+		var junk [512]byte
+		for {
+			_, err := mr.part.Read(junk[0:])
+			if err == os.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		mr.part = nil
+	}
+	if mr.done {
+		return nil, os.EOF
+	}
+
+	// The delimiter is followed by "--" after the last part, and otherwise
+	// by optional white space up to the end of the line
+	for len(mr.buf) < 2 {
+		if err := mr.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if mr.buf[0] == '-' && mr.buf[1] == '-' {
+		mr.done = true
+		return nil, os.EOF
+	}
+	if _, err := mr.readLine(); err != nil {
+		return nil, err
+	}
+
+	header := make(map[string]string)
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, &badStringError{"malformed part header", line}
+		}
+		header[CanonicalHeaderKey(strings.TrimSpace(line[0:i]))] = strings.TrimSpace(line[i+1:])
+	}
+	mr.part = &Part{Header: header, mr: mr}
+	return mr.part, nil
+}
+
+func (p *Part) Read(d []byte) (int, os.Error) {
+	if p.end {
+		return 0, os.EOF
+	}
+	mr := p.mr
+	for {
+		if i := bytes.Index(mr.buf, mr.delim); i >= 0 {
+			if i == 0 {
+				mr.consume(len(mr.delim))
+				p.end = true
+				return 0, os.EOF
+			}
+			n := copy(d, mr.buf[0:i])
+			mr.consume(n)
+			return n, nil
+		}
+		// Bytes that cannot be the start of a delimiter are part data
+		if safe := len(mr.buf) - len(mr.delim) + 1; safe > 0 {
+			n := copy(d, mr.buf[0:safe])
+			mr.consume(n)
+			return n, nil
+		}
+		if err := mr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	panic("unreach")
+}
+
+// FormName returns the name of the form field the part holds
+func (p *Part) FormName() string { return p.disposition("name") }
+
+// FileName returns the name of the uploaded file the part holds, or "" if
+// the part is not a file
+func (p *Part) FileName() string { return p.disposition("filename") }
+
+func (p *Part) disposition(key string) string {
+	params := strings.Split(p.Header["Content-Disposition"], ";", -1)
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		i := strings.Index(param, "=")
+		if i < 0 || strings.ToLower(param[0:i]) != key {
+			continue
+		}
+		return strings.Trim(param[i+1:], "\"")
+	}
+	return ""
+}
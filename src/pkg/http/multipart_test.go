@@ -0,0 +1,77 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMultipartBoundary(t *testing.T) {
+	if b := MultipartBoundary("multipart/form-data; boundary=\"xyz\""); b != "xyz" {
+		t.Errorf("got %q", b)
+	}
+	if b := MultipartBoundary("text/plain; boundary=xyz"); b != "" {
+		t.Errorf("got %q for text/plain", b)
+	}
+}
+
+func TestMultipartReader(t *testing.T) {
+	big := strings.Repeat("0123456789\r\n--", 10000)
+	body := "preamble\r\n" +
+		"--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"note\"\r\n\r\n" +
+		"hello\r\n" +
+		"--XyZ  \r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		big + "\r\n" +
+		"--XyZ--\r\nepilogue"
+	mr := NewMultipartReader(iotest.HalfReader(strings.NewReader(body)), "XyZ")
+
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("first part: %s", err)
+	}
+	if p.FormName() != "note" || p.FileName() != "" {
+		t.Errorf("first part is %q %q", p.FormName(), p.FileName())
+	}
+	// leave the first part unread
+
+	p, err = mr.NextPart()
+	if err != nil {
+		t.Fatalf("second part: %s", err)
+	}
+	if p.FileName() != "a.txt" || p.Header["Content-Type"] != "text/plain" {
+		t.Errorf("second part has header %v", p.Header)
+	}
+	data, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatalf("reading second part: %s", err)
+	}
+	if !bytes.Equal(data, []byte(big)) {
+		t.Errorf("second part has %d bytes, want %d", len(data), len(big))
+	}
+
+	if _, err = mr.NextPart(); err != os.EOF {
+		t.Errorf("expected os.EOF after the last part, got %v", err)
+	}
+}
+
+func TestMultipartTruncated(t *testing.T) {
+	body := "--XyZ\r\nContent-Disposition: form-data; name=\"f\"\r\n\r\nunfinished"
+	mr := NewMultipartReader(strings.NewReader(body), "XyZ")
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart: %s", err)
+	}
+	if _, err = ioutil.ReadAll(p); err == nil {
+		t.Errorf("expected an error for a truncated body")
+	}
+}
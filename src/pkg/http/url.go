@@ -190,6 +190,10 @@ func urlUnescape(s string, doPlus bool) (string, os.Error) {
 // URLEscape converts a string into URL-encoded form.
 func URLEscape(s string) string { return urlEscape(s, true) }
 
+// URLPathEscape is like URLEscape, but for the path part of a URL, where a
+// space is escaped as %20 rather than +.
+func URLPathEscape(s string) string { return urlEscape(s, false) }
+
 func urlEscape(s string, doPlus bool) string {
 	spaceCount, hexCount := 0, 0
 	for i := 0; i < len(s); i++ {
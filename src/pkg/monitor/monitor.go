@@ -22,29 +22,72 @@ import (
 	"fmt"
 	"json"
 	"net"
-	"time"
+	"os"
+	"sync"
 	"tonika/crypto"
 	"tonika/http"
 	"tonika/sys"
+	"tonika/util/alarm"
 )
 
 type Monitor struct {
 	dumper json.Marshaler
 	key    *crypto.CipherMsgPubKey
+	url    *http.URL // nil if reports are off
+	every  int64
+	stop   chan int // closed by Stop
+	lk     sync.Mutex
 }
 
-func MakeMonitor(dumper json.Marshaler, reportURL string, every int64) *Monitor {
+// MakeMonitor starts reporting to reportURL every so many nanoseconds.
+// An empty reportURL turns reports off.
+func MakeMonitor(dumper json.Marshaler, reportURL string, every int64) (*Monitor, os.Error) {
 	key,err := crypto.ParseCipherMsgPubKey(sys.MonitorPubKey)
 	if err != nil {
 		panic("invalid monitor key")
 	}
-	mon := &Monitor{dumper, key}
-	url,err := http.ParseURL(reportURL)
-	if err != nil {
-		panic("mon, bad report URL")
+	mon := &Monitor{dumper: dumper, key: key, stop: make(chan int)}
+	if err = mon.SetReport(reportURL, every); err != nil {
+		return nil, err
+	}
+	go mon.report(mon.stop)
+	return mon, nil
+}
+
+// SetReport changes where and how often reports are sent, taking effect
+// after the next report. An empty reportURL turns reports off.
+func (mon *Monitor) SetReport(reportURL string, every int64) os.Error {
+	var url *http.URL
+	if reportURL != "" {
+		u, err := http.ParseURL(reportURL)
+		if err != nil {
+			return err
+		}
+		url = u
 	}
-	go mon.report(url, every)
-	return mon
+	if every <= 0 {
+		return os.EINVAL
+	}
+	mon.lk.Lock()
+	mon.url, mon.every = url, every
+	mon.lk.Unlock()
+	return nil
+}
+
+// Stop ends the reports. A report being sent is not interrupted.
+func (mon *Monitor) Stop() {
+	mon.lk.Lock()
+	defer mon.lk.Unlock()
+	if mon.stop != nil {
+		close(mon.stop)
+		mon.stop = nil
+	}
+}
+
+func (mon *Monitor) getReport() (*http.URL, int64) {
+	mon.lk.Lock()
+	defer mon.lk.Unlock()
+	return mon.url, mon.every
 }
 
 func printJSON(j []byte) {
@@ -57,14 +100,24 @@ func printJSON(j []byte) {
 	fmt.Printf("MON:\n%s\n", w.String())
 }
 
-func (mon *Monitor) report(url *http.URL, every int64) {
+// report sends reports until stop is closed
+func (mon *Monitor) report(stop chan int) {
 	i := 0
 	for {
 		// Sleep between updates
+		url, every := mon.getReport()
 		if i > 0 {
-			time.Sleep(every)
+			select {
+			case <-alarm.Ignite(every):
+			case <-stop:
+				return
+			}
+			url, _ = mon.getReport()
 		}
 		i++
+		if url == nil {
+			continue
+		}
 
 		// Prepare HTTP request
 		jj,err := mon.dumper.MarshalJSON()
@@ -0,0 +1,64 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countDumper counts the reports that were prepared
+type countDumper struct {
+	n  int
+	lk sync.Mutex
+}
+
+func (d *countDumper) MarshalJSON() ([]byte, os.Error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.n++
+	return []byte("{}"), nil
+}
+
+func (d *countDumper) count() int {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.n
+}
+
+func TestStop(t *testing.T) {
+	d := &countDumper{}
+	// Nothing listens on port 1, so reports fail fast
+	mon, err := MakeMonitor(d, "http://127.0.0.1:1/", 1e7)
+	if err != nil {
+		t.Fatalf("make: %s", err)
+	}
+	time.Sleep(2e8)
+	mon.Stop()
+	n := d.count()
+	if n == 0 {
+		t.Fatalf("no reports made")
+	}
+	time.Sleep(2e8)
+	// A report already under way may still finish
+	if m := d.count(); m > n+1 {
+		t.Errorf("%d reports made after Stop", m-n)
+	}
+	mon.Stop()
+}
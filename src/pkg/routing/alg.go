@@ -24,6 +24,16 @@ import (
 	. "tonika/sys"
 )
 
+// MakeAlgorithm returns a fresh instance of the routing algorithm with the
+// given name, for the local node id
+func MakeAlgorithm(name string, id Id) (Algorithm, os.Error) {
+	switch name {
+	case "onehop":
+		return MakeOneHopRouting(id), nil
+	}
+	return nil, os.ErrorString("routing, unknown algorithm " + name)
+}
+
 // A Algorithm is an abstract algorithm that can exchange 
 // messages with neighbors (friends) and answer next-hop queries 
 // for given source-destination pairs.
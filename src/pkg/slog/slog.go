@@ -0,0 +1,315 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+// Package slog is a leveled, structured log shared by all subsystems. Each
+// record is tagged with the subsystem that made it and, where there is one,
+// the Id of the friend concerned. Records are kept in memory for the Front
+// End, echoed to stderr, and written as json lines to a series of rotated
+// files. Local identities hosted in the same process can keep their
+// records apart, each in a sink of its own.
+package slog
+
+import (
+	"bytes"
+	"fmt"
+	"json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"tonika/sys"
+	"tonika/util/filewriter"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel accepts the level names "debug", "info", "warn" and "error"
+func ParseLevel(s string) (Level, os.Error) {
+	for i, n := range levelNames {
+		if n == strings.ToLower(s) {
+			return Level(i), nil
+		}
+	}
+	return Info, os.ErrorString("log, unknown level " + s)
+}
+
+// Record is one entry in the log
+type Record struct {
+	Seq   int64  // increasing, unique within a run
+	Time  int64  // nanoseconds since epoch
+	Level Level
+	Sys   string // subsystem, like "dialer"
+	Id    string // friend concerned, or empty
+	Msg   string
+}
+
+func (r *Record) String() string {
+	id := r.Id
+	if id == "" {
+		id = "-"
+	}
+	return fmt.Sprintf("%s %-5s %-7s %s %s",
+		time.SecondsToLocalTime(r.Time/1e9).Format(time.RFC3339),
+		r.Level.String(), r.Sys, id, r.Msg)
+}
+
+// Filter selects records. Empty fields match everything.
+type Filter struct {
+	Level Level  // at least this level
+	Sys   string
+	Id    string
+	Text  string // contained in the message
+}
+
+func (f *Filter) Match(r *Record) bool {
+	if f == nil {
+		return true
+	}
+	return r.Level >= f.Level &&
+		(f.Sys == "" || f.Sys == r.Sys) &&
+		(f.Id == "" || f.Id == r.Id) &&
+		(f.Text == "" || strings.Index(r.Msg, f.Text) >= 0)
+}
+
+// The log keeps this many recent records in memory
+const keepRecent = 2000
+
+// Sink keeps records in memory and writes them out. Records of local
+// identities that have a sink of their own, see Open, go there; all others
+// go to the shared sink, which the package functions SetLevel, SetOutput,
+// etc. act on.
+type Sink struct {
+	me     string // local identity, empty for the shared sink
+	level  Level
+	seq    int64
+	recent []*Record // ring buffer
+	next   int
+	out    *filewriter.FileWriter
+	lk     sync.Mutex
+}
+
+var std = makeSink("", Info)
+
+var (
+	sinks   = make(map[string]*Sink) // by local identity
+	sinkslk sync.Mutex
+)
+
+func makeSink(me string, level Level) *Sink {
+	return &Sink{me: me, level: level, recent: make([]*Record, keepRecent)}
+}
+
+// Shared returns the sink of records not kept apart by Open
+func Shared() *Sink { return std }
+
+// Open keeps the records of the local identity me apart from those of the
+// others, in a sink of its own, from now until the sink is closed. The new
+// sink starts at the level of the shared one and writes to no files.
+func Open(me sys.Id) *Sink {
+	s := makeSink(me.String(), GetLevel())
+	sinkslk.Lock()
+	defer sinkslk.Unlock()
+	sinks[s.me] = s
+	return s
+}
+
+// Of returns the sink that keeps the records of the local identity me
+func Of(me sys.Id) *Sink { return sinkOf(me.String()) }
+
+func sinkOf(me string) *Sink {
+	if me == "" {
+		return std
+	}
+	sinkslk.Lock()
+	defer sinkslk.Unlock()
+	if s, ok := sinks[me]; ok {
+		return s
+	}
+	return std
+}
+
+// SetLevel drops records below l from now on
+func SetLevel(l Level) { std.SetLevel(l) }
+
+func GetLevel() Level { return std.GetLevel() }
+
+// SetOutput sets the output of the shared sink, see Sink.SetOutput
+func SetOutput(prefix string, maxSize, maxAge int64, keep int) os.Error {
+	return std.SetOutput(prefix, maxSize, maxAge, keep)
+}
+
+// SetRotation changes the rotation of the shared output, see SetOutput
+func SetRotation(maxSize, maxAge int64, keep int) { std.SetRotation(maxSize, maxAge, keep) }
+
+// Close stops writing the shared sink to its output files
+func Close() os.Error { return std.Close() }
+
+// Recent returns up to n of the most recent records in the shared sink
+// that match f, newest first
+func Recent(n int, f *Filter) []*Record { return std.Recent(n, f) }
+
+// SetLevel drops records below l from now on
+func (s *Sink) SetLevel(l Level) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.level = l
+}
+
+func (s *Sink) GetLevel() Level {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.level
+}
+
+// SetOutput writes records to the files prefix-00001, prefix-00002, etc.
+// A new file is started when the current one is larger than maxSize bytes
+// or older than maxAge nanoseconds, and only the newest keep files stay.
+func (s *Sink) SetOutput(prefix string, maxSize, maxAge int64, keep int) os.Error {
+	w, err := filewriter.MakeFileWriter(prefix)
+	if err != nil {
+		return err
+	}
+	w.SetRotation(maxSize, maxAge, keep)
+	s.lk.Lock()
+	old := s.out
+	s.out = w
+	s.lk.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// SetRotation changes the rotation of the current output, see SetOutput
+func (s *Sink) SetRotation(maxSize, maxAge int64, keep int) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.out != nil {
+		s.out.SetRotation(maxSize, maxAge, keep)
+	}
+}
+
+// Close stops writing to the output files. A sink made by Open stops
+// taking records too; they go to the shared sink again.
+func (s *Sink) Close() os.Error {
+	if s != std {
+		sinkslk.Lock()
+		if sinks[s.me] == s {
+			sinks[s.me] = nil, false
+		}
+		sinkslk.Unlock()
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.out == nil {
+		return nil
+	}
+	err := s.out.Close()
+	s.out = nil
+	return err
+}
+
+// Recent returns up to n of the most recent records that match f, newest
+// first
+func (s *Sink) Recent(n int, f *Filter) []*Record {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	r := make([]*Record, 0, n)
+	for i := 1; i <= keepRecent && len(r) < n; i++ {
+		rec := s.recent[(s.next-i+keepRecent)%keepRecent]
+		if rec == nil {
+			break
+		}
+		if f.Match(rec) {
+			r = r[0 : len(r)+1]
+			r[len(r)-1] = rec
+		}
+	}
+	return r
+}
+
+func (s *Sink) log(level Level, subsys, id, msg string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if level < s.level {
+		return
+	}
+	s.seq++
+	r := &Record{s.seq, time.Nanoseconds(), level, subsys, id, msg}
+	s.recent[s.next] = r
+	s.next = (s.next + 1) % keepRecent
+	fmt.Fprintf(os.Stderr, "%s\n", r.String())
+	if s.out != nil {
+		data, err := json.Marshal(r)
+		if err == nil {
+			var w bytes.Buffer
+			w.Write(data)
+			w.WriteByte('\n')
+			s.out.Write(w.Bytes())
+		}
+	}
+}
+
+// Logger makes records on behalf of a subsystem, and optionally a local
+// identity and a friend
+type Logger struct {
+	sys string
+	me  string
+	id  string
+}
+
+// For returns the logger of subsystem subsys
+func For(subsys string) *Logger { return &Logger{sys: subsys} }
+
+// Local returns a logger whose records go to the sink of the local
+// identity me, see Open
+func (l *Logger) Local(me sys.Id) *Logger { return &Logger{l.sys, me.String(), l.id} }
+
+// With returns a logger that tags records with the friend id
+func (l *Logger) With(id sys.Id) *Logger { return &Logger{l.sys, l.me, id.Eye()} }
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	sinkOf(l.me).log(Debug, l.sys, l.id, fmt.Sprintf(format, v))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	sinkOf(l.me).log(Info, l.sys, l.id, fmt.Sprintf(format, v))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	sinkOf(l.me).log(Warn, l.sys, l.id, fmt.Sprintf(format, v))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	sinkOf(l.me).log(Error, l.sys, l.id, fmt.Sprintf(format, v))
+}
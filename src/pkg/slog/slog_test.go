@@ -0,0 +1,87 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package slog
+
+import (
+	"testing"
+	"tonika/sys"
+)
+
+func TestRecent(t *testing.T) {
+	SetLevel(Info)
+	a := For("a")
+	b := For("b")
+	a.Debugf("dropped")
+	a.Infof("one %d", 1)
+	b.Warnf("two")
+	a.Errorf("three")
+
+	r := Recent(10, &Filter{Level: Info, Sys: "a"})
+	if len(r) != 2 || r[0].Msg != "three" || r[1].Msg != "one 1" {
+		t.Fatalf("sys filter: %v", r)
+	}
+	r = Recent(10, &Filter{Level: Warn})
+	if len(r) != 2 || r[0].Msg != "three" || r[1].Msg != "two" {
+		t.Fatalf("level filter: %v", r)
+	}
+	r = Recent(1, &Filter{Text: "one"})
+	if len(r) != 1 || r[0].Level != Info {
+		t.Fatalf("text filter: %v", r)
+	}
+	if len(Recent(10, &Filter{Text: "dropped"})) != 0 {
+		t.Fatalf("debug record kept")
+	}
+}
+
+func TestSinks(t *testing.T) {
+	SetLevel(Info)
+	me, other := sys.Id(1), sys.Id(2)
+	s := Open(me)
+	l := For("x")
+	l.Local(me).Infof("mine")
+	l.Local(other).Infof("other")
+	l.Infof("shared")
+
+	r := s.Recent(10, nil)
+	if len(r) != 1 || r[0].Msg != "mine" || Of(me) != s {
+		t.Fatalf("own sink: %v", r)
+	}
+	r = Recent(10, &Filter{Sys: "x"})
+	if len(r) != 2 || r[0].Msg != "shared" || r[1].Msg != "other" {
+		t.Fatalf("shared sink: %v", r)
+	}
+	s.Close()
+	if Of(me) != Shared() {
+		t.Fatalf("closed sink still open")
+	}
+	l.Local(me).Infof("after")
+	if len(s.Recent(10, nil)) != 1 || len(Recent(1, &Filter{Text: "after"})) != 1 {
+		t.Fatalf("records after close")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for l := Debug; l <= Error; l++ {
+		if p, err := ParseLevel(l.String()); err != nil || p != l {
+			t.Fatalf("level %s", l)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatalf("bad level accepted")
+	}
+}
@@ -28,10 +28,12 @@ type U_AuthAcc_M1 struct {
 }
 
 type U_AuthConn_M2 struct {
+	SigKey    string // Base64 encoding of the signature public key
 	Resp      []byte
 }
 
 type U_AuthAcc_M2 struct {
 	DialKey U_DialKey
+	SigKey  string // Base64 encoding of the signature public key
 	Resp    []byte
 }
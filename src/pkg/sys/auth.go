@@ -36,6 +36,11 @@ type AuthLookupFunc func(key *DialKey) AuthRemote
 
 func AuthConnect(local AuthLocal, remote AuthRemote, tube tube.TubedConn) (Id, tube.TubedConn, os.Error) {
 	
+	if remote.IsRevoked() {
+		return 0, nil, os.NewError("Remote identity is revoked")
+	}
+
+
 	// Establish symmetric encryption
 	xtube, err := authHello(tube)
 	if err != nil {
@@ -64,12 +69,16 @@ func AuthConnect(local AuthLocal, remote AuthRemote, tube tube.TubedConn) (Id, t
 	if err != nil {
 		return 0, nil, err
 	}
-	m2 := &U_AuthConn_M2{sign}
+	m2 := &U_AuthConn_M2{
+		SigKey: local.GetSignatureKey().PubKey().String(),
+		Resp:   sign,
+	}
 	if err := xtube.Encode(m2); err != nil {
 		return 0, nil, err
 	}
 
-	// Verify their dialkey (against our accept key) and their challange response
+	// Verify their dialkey (against our accept key), the signature key they
+	// present (against the pinned fingerprint) and their challange response
 	m2_remote := &U_AuthAcc_M2{}
 	if err := xtube.Decode(m2_remote); err != nil {
 		return 0, nil, err
@@ -81,11 +90,15 @@ func AuthConnect(local AuthLocal, remote AuthRemote, tube tube.TubedConn) (Id, t
 	if *dk != *remote.GetAcceptKey() {
 		return 0, nil, os.NewError("DialKey does not match AcceptKey")
 	}
-	if err := remote.GetSignatureKey().Verify(ch, m2_remote.Resp); err != nil {
+	sk, err := presentedKey(remote, m2_remote.SigKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := sk.Verify(ch, m2_remote.Resp); err != nil {
 		return 0, nil, err
 	}
 	
-	return remote.GetSignatureKey().Id(), xtube, nil
+	return sk.Id(), xtube, nil
 }
 
 func AuthAccept(local AuthLocal, lookup AuthLookupFunc, tube tube.TubedConn) (Id, tube.TubedConn, os.Error) {
@@ -121,6 +134,9 @@ func AuthAccept(local AuthLocal, lookup AuthLookupFunc, tube tube.TubedConn) (Id
 	if rauth == nil {
 		return 0, nil, os.NewError("No remote auth")
 	}
+	if rauth.IsRevoked() {
+		return 0, nil, os.NewError("Remote identity is revoked")
+	}
 	
 	// Send dial key and challange response
 	sign,err := local.GetSignatureKey().Sign(m1_remote.Challange)
@@ -129,25 +145,57 @@ func AuthAccept(local AuthLocal, lookup AuthLookupFunc, tube tube.TubedConn) (Id
 	}
 	m2 := &U_AuthAcc_M2{
 		DialKey: *rauth.GetDialKey().Proto(),
+		SigKey:  local.GetSignatureKey().PubKey().String(),
 		Resp:    sign,
 	}
 	if err := xtube.Encode(m2); err != nil {
 		return 0, nil, err
 	}
 
-	// Receive their challange response and verify correct
+	// Receive the signature key they present and their challange response,
+	// and verify both
 	m2_remote := &U_AuthConn_M2{}
 	if err := xtube.Decode(m2_remote); err != nil {
 		return 0, nil, err
 	}
-	if err := rauth.GetSignatureKey().Verify(ch, m2_remote.Resp); err != nil {
+	sk, err := presentedKey(rauth, m2_remote.SigKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := sk.Verify(ch, m2_remote.Resp); err != nil {
 		return 0, nil, err
 	}
 
-	return rauth.GetSignatureKey().Id(), xtube, nil
+	return sk.Id(), xtube, nil
+}
+
+// presentedKey parses the signature key that the remote presented during
+// the handshake, and checks that its full fingerprint is the one we pinned
+// for them. The short Id alone could be matched by another key. Older
+// peers present no key, in which case the key we hold for them is checked
+// and their response is verified against it.
+func presentedKey(remote AuthRemote, s string) (*SigPubKey, os.Error) {
+	var sk *SigPubKey
+	if s == "" {
+		if sk = remote.GetSignatureKey(); sk == nil {
+			return nil, os.NewError("No signature key presented or known")
+		}
+	} else {
+		var err os.Error
+		if sk, err = ParseSigPubKey(s); err != nil {
+			return nil, err
+		}
+	}
+	pinned := remote.GetFingerprint()
+	fp := sk.Fingerprint()
+	if pinned == nil || !pinned.Equal(&fp) {
+		return nil, os.NewError("Signature key does not match Fingerprint")
+	}
+	return sk, nil
 }
 
 // authHello establishes a symmetrically encrypted channel over t
+
 func authHello(t tube.TubedConn) (tube.TubedConn, os.Error) {
 
 	// Make my hello private key
@@ -0,0 +1,68 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sys
+
+import (
+	"testing"
+)
+
+func TestPresentedKey(t *testing.T) {
+	k := GenerateSigKey()
+	fp := k.Fingerprint()
+	id := fp.Id()
+	f := &Friend{Name: "alice", Id: &id, Fingerprint: &fp, SignatureKey: k.PubKey()}
+
+	sk, err := presentedKey(f, k.PubKey().String())
+	if err != nil || sk.Id() != id {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+
+	// Another key is refused, even if the friend's record carries it
+	other := GenerateSigKey()
+	f.SignatureKey = other.PubKey()
+	if _, err = presentedKey(f, other.PubKey().String()); err == nil {
+		t.Fatalf("key that does not match the fingerprint accepted")
+	}
+	f.Fingerprint = nil
+	if _, err = presentedKey(f, k.PubKey().String()); err == nil {
+		t.Fatalf("key accepted without a pinned fingerprint")
+	}
+	if _, err = presentedKey(f, "garbage"); err == nil {
+		t.Fatalf("garbage accepted")
+	}
+}
+
+func TestPresentedKeyMissing(t *testing.T) {
+	k := GenerateSigKey()
+	fp := k.Fingerprint()
+	id := fp.Id()
+	f := &Friend{Name: "alice", Id: &id, Fingerprint: &fp, SignatureKey: k.PubKey()}
+
+	// Older peers present no key, and the one we hold is used
+	sk, err := presentedKey(f, "")
+	if err != nil || sk.Id() != id {
+		t.Fatalf("peer without a key rejected: %v", err)
+	}
+	f.SignatureKey = GenerateSigKey().PubKey()
+	if _, err = presentedKey(f, ""); err == nil {
+		t.Fatalf("held key that does not match the fingerprint accepted")
+	}
+	f.SignatureKey = nil
+	if _, err = presentedKey(f, ""); err == nil {
+		t.Fatalf("no key at all accepted")
+	}
+}
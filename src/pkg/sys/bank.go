@@ -31,19 +31,52 @@ type Bank interface {
 	GetMyAddr() string
 	GetMyExtAddr() string
 	GetMySignatureKey() *SigPubKey
+	GetMyFingerprint() *Fingerprint
 
-	SetMy(key string, v interface{})
+	UpdateMy(u *MyUpdate, by string) os.Error
 
 	GetBySlot(slot int) (View, os.Error)
 	GetById(id Id) (View, os.Error)
+	GetByFingerprint(fp *Fingerprint) (View, os.Error)
 	GetByAcceptKey(ak *DialKey) (View, os.Error)
 	GetByDialKey(dk *DialKey) (View, os.Error)
 
 	Reserve() View
 	Revoke(slot int)
+	AcceptRevocation(rc *RevocationCert) os.Error
+	PublishRevocation(rc *RevocationCert) os.Error
 	Enumerate() []View
-	Write(slot int, key string, v interface{}) (View, os.Error)
+	Update(slot int, u *FriendUpdate, by string) (View, os.Error)
+	GetHistory(slot int) []*Change
 	Sync(slot int)
 	SyncAddr(slot int)
 	Save()
+	ReloadConfig() os.Error
+
+	GetGroups() []string
+	GetGroupMembers(group string) ([]int, os.Error)
+	GetGroupsOf(slot int) []string
+	MakeGroup(group string) os.Error
+	RenameGroup(old, group string) os.Error
+	RemoveGroup(group string) os.Error
+	AddToGroup(group string, slot int) os.Error
+	RemoveFromGroup(group string, slot int) os.Error
+	InGroup(fp *Fingerprint, group string) bool
+
+	Subscribe(topics []string, size int) *Subscription
+	Unsubscribe(s *Subscription)
+	GetRecentEvents(n int) []*Event
+
+	Introduce(a, b int) os.Error
+	GetIntroductions() []*Introduction
+	AcceptIntroduction(fp *Fingerprint) (View, os.Error)
+	DeclineIntroduction(fp *Fingerprint) os.Error
+
+	SealEnvelope(to []Id, subject string, payload []byte) ([]byte, os.Error)
+	OpenEnvelope(data []byte) (*Envelope, os.Error)
+}
+
+// Groups is the part of Bank that subsystems use to enforce group policy
+type Groups interface {
+	InGroup(fp *Fingerprint, group string) bool
 }
@@ -38,6 +38,12 @@ const (
 	//TangraServerURL  = "http://localhost:37373/green" // for testing
 )
 
+// MakeViaURL returns the URL of path on the node id, as reached by the
+// local identity via: http://id.via.5ttt.org/path
+func MakeViaURL(id, via Id, path string) string {
+	return MakeURL(id.String(), via, path)
+}
+
 // hostPrefix --> hostPrefix.5ttt.org
 func MakeHost(hostPrefix string, id Id) string {
 	if hostPrefix != "" {
@@ -0,0 +1,338 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package sys
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"gob"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	"tonika/crypto"
+	ubytes "tonika/util/bytes"
+)
+
+// An envelope carries a payload from one identity to one or more friends.
+// It is signed with the sender's SigKey, and its text is encrypted with
+// AES-256-CTR under a key derived from a fresh random seed. The seed is
+// encrypted for each recipient with RSA-OAEP under their signature public
+// key, with a label of its own, so that only they can open it. Dial keys,
+// which travel in invitations and introductions, play no part. The body
+// carries a timestamp and a random replay id, which receivers check with an
+// EnvelopeGuard.
+
+const (
+	EnvelopeVersion = 3
+	EnvelopeMaxSkew = 10 * 60 * 1e9 // 10 mins, in nanoseconds
+
+	envelopeSeedLen  = 20 // fits in OAEP under a SignatureModulusLen key
+	envelopeNonceLen = 16
+)
+
+var (
+	envelopeSeedLabel = []byte("envelope-seed")
+	envelopeTextLabel = []byte("envelope-text")
+)
+
+// EnvelopeRecipient names a recipient of an envelope and their signature
+// public key
+type EnvelopeRecipient struct {
+	Fingerprint Fingerprint
+	Key         *SigPubKey
+}
+
+type U_Envelope struct {
+	Version    int
+	Sender     []byte          // Fingerprint of sender
+	Recipients []U_EnvelopeKey
+	Text       []byte          // U_EnvelopeBody, encrypted with a key derived from Seed
+	Sign       []byte          // Sender's signature of all fields above
+}
+
+type U_EnvelopeKey struct {
+	Recipient []byte // Fingerprint of recipient
+	Seed      []byte // encrypted with the recipient's signature public key
+}
+
+type U_EnvelopeBody struct {
+	Time    int64  // nanoseconds since epoch
+	Nonce   []byte // replay id
+	Subject string
+	Payload []byte
+}
+
+// Envelope is the verified and decrypted content of an envelope
+type Envelope struct {
+	Sender  Fingerprint
+	Time    int64
+	Nonce   []byte
+	Subject string
+	Payload []byte
+}
+
+func (e *Envelope) ReplayId() string { return hex.EncodeToString(e.Nonce) }
+
+// SealEnvelope signs subject and payload with from and encrypts them so that
+// any of the recipients in to can open them.
+func SealEnvelope(from *SigKey, to []EnvelopeRecipient, subject string, payload []byte) ([]byte, os.Error) {
+	if len(to) == 0 {
+		return nil, os.ErrorString("envelope, no recipients")
+	}
+	urand := crypto.NewTimedRand()
+	seed := make([]byte, envelopeSeedLen)
+	nonce := make([]byte, envelopeNonceLen)
+	if n, _ := urand.Read(seed); n != len(seed) {
+		panic("envelope, gen seed")
+	}
+	if n, _ := urand.Read(nonce); n != len(nonce) {
+		panic("envelope, gen nonce")
+	}
+
+	// Encrypt body
+	body := &U_EnvelopeBody{
+		Time:    time.Nanoseconds(),
+		Nonce:   nonce,
+		Subject: subject,
+		Payload: payload,
+	}
+	var w bytes.Buffer
+	if err := gob.NewEncoder(&w).Encode(body); err != nil {
+		return nil, err
+	}
+	text := w.Bytes()
+	if err := envelopeXOR(seed, text); err != nil {
+		return nil, err
+	}
+
+	// Address to recipients
+	fp := from.Fingerprint()
+	env := &U_Envelope{
+		Version:    EnvelopeVersion,
+		Sender:     fp[0:],
+		Recipients: make([]U_EnvelopeKey, len(to)),
+		Text:       text,
+	}
+	for i, r := range to {
+		if r.Key == nil || !VerifyKeyAndFingerprint(&r.Fingerprint, *r.Key.RsaPubKey()) {
+			return nil, os.ErrorString("envelope, recipient key mismatch")
+		}
+		wseed, err := crypto.EncryptShortMsg(r.Key.RsaPubKey(), seed, envelopeSeedLabel)
+		if err != nil {
+			return nil, err
+		}
+		rfp := r.Fingerprint
+		env.Recipients[i] = U_EnvelopeKey{rfp[0:], wseed}
+	}
+
+	// Sign
+	sign, err := from.Sign(envelopeSignBytes(env))
+	if err != nil {
+		return nil, err
+	}
+	env.Sign = sign
+
+	var v bytes.Buffer
+	if err := gob.NewEncoder(&v).Encode(env); err != nil {
+		return nil, err
+	}
+	return v.Bytes(), nil
+}
+
+// OpenEnvelope decrypts an envelope addressed to me and verifies its
+// signature. The sender's signature key is obtained from lookup, which
+// returns nil for unknown senders.
+func OpenEnvelope(me *SigKey, lookup func(fp *Fingerprint) *SigPubKey,
+	data []byte) (*Envelope, os.Error) {
+	env := &U_Envelope{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(env); err != nil {
+		return nil, err
+	}
+	if env.Version != EnvelopeVersion {
+		return nil, os.ErrorString("envelope, unsupported version")
+	}
+	if len(env.Sender) != FingerprintLen {
+		return nil, os.ErrorString("envelope, bad sender")
+	}
+	e := &Envelope{}
+	copy(e.Sender[0:], env.Sender)
+
+	// Verify sender
+	pk := lookup(&e.Sender)
+	if pk == nil {
+		return nil, os.ErrorString("envelope, unknown sender")
+	}
+	if !VerifyKeyAndFingerprint(&e.Sender, *pk.RsaPubKey()) {
+		return nil, os.ErrorString("envelope, sender key mismatch")
+	}
+	if err := pk.Verify(envelopeSignBytes(env), env.Sign); err != nil {
+		return nil, err
+	}
+
+	// Find our seed
+	var seed []byte
+	myfp := me.Fingerprint()
+	for _, r := range env.Recipients {
+		if bytes.Equal(r.Recipient, myfp[0:]) {
+			var err os.Error
+			seed, err = crypto.DecryptShortMsg(me.RsaPrivKey(), r.Seed, envelopeSeedLabel)
+			if err != nil || len(seed) != envelopeSeedLen {
+				return nil, os.ErrorString("envelope, bad seed")
+			}
+			break
+		}
+	}
+	if seed == nil {
+		return nil, os.ErrorString("envelope, not a recipient")
+	}
+
+	// Decrypt body
+	if err := envelopeXOR(seed, env.Text); err != nil {
+		return nil, err
+	}
+	body := &U_EnvelopeBody{}
+	if err := gob.NewDecoder(bytes.NewBuffer(env.Text)).Decode(body); err != nil {
+		return nil, err
+	}
+	e.Time = body.Time
+	e.Nonce = body.Nonce
+	e.Subject = body.Subject
+	e.Payload = body.Payload
+	return e, nil
+}
+
+// envelopeSignBytes serializes the signed fields of env unambiguously
+func envelopeSignBytes(env *U_Envelope) []byte {
+	var w bytes.Buffer
+	put := func(p []byte) {
+		w.Write(ubytes.Int64ToBytes(int64(len(p))))
+		w.Write(p)
+	}
+	w.Write(ubytes.Int64ToBytes(int64(env.Version)))
+	put(env.Sender)
+	w.Write(ubytes.Int64ToBytes(int64(len(env.Recipients))))
+	for _, r := range env.Recipients {
+		put(r.Recipient)
+		put(r.Seed)
+	}
+	put(env.Text)
+	return w.Bytes()
+}
+
+// envelopeXOR encrypts or decrypts text in place under seed. Each seed is
+// fresh, so the counter may start at zero.
+func envelopeXOR(seed, text []byte) os.Error {
+	return crypto.XORCTR(crypto.HMACSHA256(seed, envelopeTextLabel), text)
+}
+
+// EnvelopeGuard rejects envelopes that are too old, from the future or
+// that have been seen before. If it has a file, the envelopes it has seen
+// are appended to it, so that they are not accepted again after a restart.
+// The file is rewritten without the forgotten entries when they are pruned.
+type EnvelopeGuard struct {
+	path   string
+	seen   map[string]int64 // replay id -> envelope time
+	pruned int64            // when seen was last pruned
+	lk     sync.Mutex
+}
+
+// MakeEnvelopeGuard returns a guard that remembers what it has seen in the
+// file at path, or only in memory if path is empty.
+func MakeEnvelopeGuard(path string) *EnvelopeGuard {
+	g := &EnvelopeGuard{path: path, seen: make(map[string]int64), pruned: time.Nanoseconds()}
+	if path == "" {
+		return g
+	}
+	f, err := os.Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		return g
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		var rid string
+		var t int64
+		if _, err := fmt.Fscanf(r, "%s %d\n", &rid, &t); err != nil {
+			break
+		}
+		g.seen[rid] = t
+	}
+	return g
+}
+
+func (g *EnvelopeGuard) Check(e *Envelope) os.Error {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	now := time.Nanoseconds()
+	if e.Time < now-EnvelopeMaxSkew || e.Time > now+EnvelopeMaxSkew {
+		return os.ErrorString("envelope, stale timestamp")
+	}
+	rid := e.Sender.String() + "/" + e.ReplayId()
+	if _, ok := g.seen[rid]; ok {
+		return os.ErrorString("envelope, replayed")
+	}
+	g.seen[rid] = e.Time
+	// Entries older than the skew are turned down by their timestamp
+	// anyway, so they are forgotten once in a while rather than on every
+	// check.
+	if now-g.pruned > EnvelopeMaxSkew {
+		for id, t := range g.seen {
+			if t < now-EnvelopeMaxSkew {
+				g.seen[id] = 0, false
+			}
+		}
+		g.pruned = now
+		return g.rewrite()
+	}
+	return g.append(rid, e.Time)
+}
+
+// append adds one seen envelope to the file
+func (g *EnvelopeGuard) append(rid string, t int64) os.Error {
+	if g.path == "" {
+		return nil
+	}
+	f, err := os.Open(g.path, os.O_WRONLY|os.O_APPEND|os.O_CREAT, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %d\n", rid, t)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rewrite replaces the file with what is remembered
+func (g *EnvelopeGuard) rewrite() os.Error {
+	if g.path == "" {
+		return nil
+	}
+	var w bytes.Buffer
+	for rid, t := range g.seen {
+		fmt.Fprintf(&w, "%s %d\n", rid, t)
+	}
+	tmp := g.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, w.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.path)
+}
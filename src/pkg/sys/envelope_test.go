@@ -0,0 +1,113 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package sys
+
+import (
+	"bytes"
+	"gob"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	alice := GenerateSigKey()
+	bob := GenerateSigKey()
+	carol := GenerateSigKey()
+	lookup := func(fp *Fingerprint) *SigPubKey {
+		if VerifyKeyAndFingerprint(fp, *alice.RsaPubKey()) {
+			return alice.PubKey()
+		}
+		return nil
+	}
+
+	to := []EnvelopeRecipient{EnvelopeRecipient{bob.Fingerprint(), bob.PubKey()}}
+	data, err := SealEnvelope(alice, to, "hello", []byte("hi bob"))
+	if err != nil {
+		t.Fatalf("seal: %s\n", err)
+	}
+	e, err := OpenEnvelope(bob, lookup, data)
+	if err != nil {
+		t.Fatalf("open: %s\n", err)
+	}
+	if e.Subject != "hello" || string(e.Payload) != "hi bob" {
+		t.Fatalf("mismatch")
+	}
+	if _, err = OpenEnvelope(carol, lookup, data); err == nil {
+		t.Fatalf("opened by non-recipient")
+	}
+
+	// Whoever knows bob's fingerprint but not his private key cannot open
+	// it, even by claiming to be bob
+	env := &U_Envelope{}
+	if err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(env); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	cfp := carol.Fingerprint()
+	env.Recipients[0].Recipient = cfp[0:]
+	var w bytes.Buffer
+	gob.NewEncoder(&w).Encode(env)
+	if e2, err := OpenEnvelope(carol, lookup, w.Bytes()); err == nil && string(e2.Payload) == "hi bob" {
+		t.Fatalf("opened without the recipient's key")
+	}
+	mixed := []EnvelopeRecipient{EnvelopeRecipient{bob.Fingerprint(), carol.PubKey()}}
+	if _, err = SealEnvelope(alice, mixed, "x", nil); err == nil {
+		t.Fatalf("sealed to a key that does not match the fingerprint")
+	}
+
+	g := MakeEnvelopeGuard("")
+	if err = g.Check(e); err != nil {
+		t.Fatalf("guard: %s\n", err)
+	}
+	if err = g.Check(e); err == nil {
+		t.Fatalf("replay not detected")
+	}
+}
+
+func TestEnvelopeGuardFile(t *testing.T) {
+	p := os.TempDir() + "/tonika-envelope-guard"
+	os.Remove(p)
+	defer os.Remove(p)
+	e := &Envelope{Time: time.Nanoseconds(), Nonce: []byte("nonce")}
+	if err := MakeEnvelopeGuard(p).Check(e); err != nil {
+		t.Fatalf("guard: %s\n", err)
+	}
+	// A new guard, as after a restart, remembers the envelope
+	if err := MakeEnvelopeGuard(p).Check(e); err == nil {
+		t.Fatalf("replay after restart not detected")
+	}
+	e.Nonce = []byte("other")
+	if err := MakeEnvelopeGuard(p).Check(e); err != nil {
+		t.Fatalf("guard: %s\n", err)
+	}
+	// Both were appended to the file, which a prune rewrites
+	g := MakeEnvelopeGuard(p)
+	if len(g.seen) != 2 {
+		t.Fatalf("expected 2 envelopes in the file, got %d", len(g.seen))
+	}
+	g.pruned = 0
+	old := &Envelope{Time: time.Nanoseconds() - EnvelopeMaxSkew + 1e9, Nonce: []byte("old")}
+	if err := g.Check(old); err != nil {
+		t.Fatalf("guard: %s\n", err)
+	}
+	if n := len(MakeEnvelopeGuard(p).seen); n != 3 {
+		t.Fatalf("expected 3 envelopes after the rewrite, got %d", n)
+	}
+}
@@ -0,0 +1,185 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package sys
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event topics. Topics are dot-separated; subscribing to a prefix ending in
+// a dot, like "friend.", receives all topics under it.
+const (
+	EvFriendAdded    = "friend.added"      // a new contact was made
+	EvInviteAccepted = "friend.accepted"   // a contact's invitation completed
+	EvKeyChanged     = "friend.key"        // a contact's signature key changed
+	EvFriendRevoked  = "friend.revoked"    // a contact's identity was revoked
+	EvFriendRemoved  = "friend.removed"    // a contact was removed
+	EvIntroduced     = "friend.introduced" // a contact introduced us to someone
+	EvFriendOnline   = "friend.online"
+	EvFriendOffline  = "friend.offline"
+	EvVaultError     = "vault.error"
+	EvDialerError    = "dialer.error"
+	EvConfigReloaded = "system.config"
+	EvShutdown       = "system.shutdown"
+)
+
+// Event is something that happened in the system
+type Event struct {
+	Seq   int64 // increasing, and continued across runs by Restore
+	Time  int64 // nanoseconds since epoch
+	Topic string
+	Slot  int // the friend concerned, or MySlot
+	Msg   string
+}
+
+// Subscription receives the events on the topics it was made for. Events
+// that arrive while its queue is full are dropped and counted.
+type Subscription struct {
+	C       chan *Event
+	topics  []string
+	dropped int64
+}
+
+func (s *Subscription) matches(topic string) bool {
+	if len(s.topics) == 0 {
+		return true
+	}
+	for _, t := range s.topics {
+		if t == topic || (strings.HasSuffix(t, ".") && strings.HasPrefix(topic, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBus delivers published events to subscribers, and remembers the
+// most recent ones
+type EventBus struct {
+	seq    int64
+	subs   map[*Subscription]int
+	recent []*Event // ring buffer
+	next   int
+	sink   func(*Event)
+	lk     sync.Mutex
+}
+
+// MakeEventBus makes a bus that remembers the last keep events. If sink is
+// not nil, it is called with every event, in order, e.g. to persist them.
+func MakeEventBus(keep int, sink func(*Event)) *EventBus {
+	return &EventBus{
+		subs:   make(map[*Subscription]int),
+		recent: make([]*Event, keep),
+		sink:   sink,
+	}
+}
+
+// Subscribe returns a subscription to topics, with a queue of size events.
+// No topics means all topics.
+func (b *EventBus) Subscribe(topics []string, size int) *Subscription {
+	s := &Subscription{C: make(chan *Event, size), topics: topics}
+	b.lk.Lock()
+	b.subs[s] = 1
+	b.lk.Unlock()
+	return s
+}
+
+// Unsubscribe stops delivery to s and closes its channel
+func (b *EventBus) Unsubscribe(s *Subscription) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if _, ok := b.subs[s]; ok {
+		b.subs[s] = 0, false
+		close(s.C)
+	}
+}
+
+// Dropped returns the number of events s missed because its queue was full
+func (b *EventBus) Dropped(s *Subscription) int64 {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return s.dropped
+}
+
+// Publish stamps e with the next sequence number, and with the time if it
+// has none, and delivers it. Publish never blocks on subscribers.
+func (b *EventBus) Publish(e *Event) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	if e.Time == 0 {
+		e.Time = time.Nanoseconds()
+	}
+	b.remember(e)
+	if b.sink != nil {
+		b.sink(e)
+	}
+	for s, _ := range b.subs {
+		if !s.matches(e.Topic) {
+			continue
+		}
+		if ok := s.C <- e; !ok {
+			s.dropped++
+		}
+	}
+}
+
+// Restore adds events from an earlier run to the recent events, without
+// delivering them. Later events are numbered after the restored ones, so
+// that sequence numbers do not start over after a restart.
+func (b *EventBus) Restore(events []*Event) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	for _, e := range events {
+		b.remember(e)
+		if e.Seq > b.seq {
+			b.seq = e.Seq
+		}
+	}
+}
+
+func (b *EventBus) remember(e *Event) {
+	if len(b.recent) == 0 {
+		return
+	}
+	b.recent[b.next] = e
+	b.next = (b.next + 1) % len(b.recent)
+}
+
+// Recent returns up to n of the most recent events, newest first
+func (b *EventBus) Recent(n int) []*Event {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	k := len(b.recent)
+	if n > k {
+		n = k
+	}
+	r := make([]*Event, n)
+	m := 0
+	for i := 1; i <= k && m < n; i++ {
+		e := b.recent[(b.next-i+k)%k]
+		if e == nil {
+			break
+		}
+		r[m] = e
+		m++
+	}
+	return r[0:m]
+}
@@ -0,0 +1,66 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package sys
+
+import (
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	var sunk int
+	b := MakeEventBus(3, func(e *Event) { sunk++ })
+	friends := b.Subscribe([]string{"friend."}, 1)
+	vault := b.Subscribe([]string{EvVaultError}, 5)
+
+	b.Publish(&Event{Topic: EvFriendAdded})
+	b.Publish(&Event{Topic: EvFriendOnline})
+	b.Publish(&Event{Topic: EvVaultError})
+	b.Publish(&Event{Topic: EvDialerError})
+
+	if e := <-friends.C; e.Topic != EvFriendAdded || e.Seq != 1 {
+		t.Fatalf("friend subscriber got %v", e)
+	}
+	if b.Dropped(friends) != 1 {
+		t.Fatalf("expecting one dropped event")
+	}
+	if e := <-vault.C; e.Topic != EvVaultError {
+		t.Fatalf("vault subscriber got %v", e)
+	}
+	if sunk != 4 {
+		t.Fatalf("sink saw %d events", sunk)
+	}
+	r := b.Recent(10)
+	if len(r) != 3 || r[0].Topic != EvDialerError || r[2].Topic != EvFriendOnline {
+		t.Fatalf("bad recent events")
+	}
+	b.Unsubscribe(vault)
+	b.Publish(&Event{Topic: EvVaultError})
+	if e := <-vault.C; e != nil || !closed(vault.C) {
+		t.Fatalf("unsubscribed channel still open")
+	}
+}
+
+func TestEventBusRestore(t *testing.T) {
+	b := MakeEventBus(3, nil)
+	b.Restore([]*Event{&Event{Seq: 7, Topic: EvFriendAdded}, &Event{Seq: 9, Topic: EvFriendOnline}})
+	e := &Event{Topic: EvShutdown}
+	b.Publish(e)
+	if e.Seq != 10 {
+		t.Fatalf("sequence restarted at %d after restore", e.Seq)
+	}
+}
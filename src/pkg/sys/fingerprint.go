@@ -0,0 +1,101 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package sys
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"tonika/util/bytes"
+	"tonika/util/misc"
+	"tonika/util/rsa64"
+)
+
+// A Fingerprint is the full 256-bit SHA256 hash of a signature public key.
+// It is what authentication and the friends file rely on. The 64-bit Id is
+// derived from it by folding, and is only used for display, hostnames and
+// routing.
+type Fingerprint [FingerprintLen]byte
+
+const FingerprintLen = 32
+
+func FingerprintForKey(pk rsa.PublicKey) Fingerprint {
+	// Write the Rsa64 representation of public key into Sha256
+	pk64 := []byte(rsa64.PubToBase64(&pk))
+	sha256 := sha256.New()
+	for {
+		n,err := sha256.Write(pk64)
+		if err != nil {
+			panic("sha256 malfunction")
+		}
+		if n == len(pk64) {
+			break
+		}
+		pk64 = pk64[n:]
+	}
+	h := sha256.Sum()
+	if len(h) != FingerprintLen {
+		panic("expecting 32 bytes")
+	}
+	var fp Fingerprint
+	copy(fp[0:], h)
+	return fp
+}
+
+func ParseFingerprint(s string) (*Fingerprint, os.Error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != FingerprintLen {
+		return nil, os.ErrorString("fingerprint, bad length")
+	}
+	fp := &Fingerprint{}
+	copy(fp[0:], b)
+	return fp, nil
+}
+
+// Id folds the fingerprint into the short 64-bit Id
+func (fp *Fingerprint) Id() Id {
+	var h [FingerprintLen]byte
+	copy(h[0:], fp[0:])
+	for i := 1; i < 4; i++ {
+		for j := 0; j < 8; j++ {
+			h[j] ^= h[8*i+j]
+		}
+	}
+	id64,err := bytes.BytesToInt64(h[0:8])
+	if err != nil {
+		panic("logic")
+	}
+	return Id(id64)
+}
+
+func (fp *Fingerprint) Equal(x *Fingerprint) bool { return *fp == *x }
+
+func (fp *Fingerprint) String() string { return hex.EncodeToString(fp[0:]) }
+
+func (fp *Fingerprint) ToJSON() string { return misc.JSONQuote(fp.String()) }
+
+func (fp *Fingerprint) MarshalJSON() ([]byte, os.Error) { return []byte(fp.ToJSON()), nil }
+
+// Verifies that the fingerprint corresponds to the public key
+func VerifyKeyAndFingerprint(fp *Fingerprint, pubkey rsa.PublicKey) bool {
+	return *fp == FingerprintForKey(pubkey)
+}
@@ -0,0 +1,132 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package sys
+
+import (
+	"bytes"
+	"gob"
+	"os"
+)
+
+// An introduction vouches for a friend of a friend. The introducer makes a
+// pair, one for each of the two friends being introduced, and sends each
+// sealed in an envelope, so its recipient knows who vouches for it. Each
+// carries the other party's signature key and address, and a pair of fresh
+// dial keys made up by the introducer, so the two can dial each other as
+// soon as both have accepted. The introducer knows those dial keys too,
+// which is why an introduction is only as good as the friend who made it.
+type Introduction struct {
+	By        Fingerprint // the introducer, taken from the envelope
+	Time      int64       // nanoseconds since epoch, when it was received
+	Name      string      // the introduced party, as the introducer knows them
+	Email     string
+	Addr      string
+	SigKey    *SigPubKey
+	DialKey   *DialKey // we dial the introduced party with this
+	AcceptKey *DialKey // the introduced party dials us with this
+}
+
+type U_Introduction struct {
+	Name      string
+	Email     string
+	Addr      string
+	SigKey    string
+	DialKey   int64
+	AcceptKey int64
+}
+
+// MakeIntroductions introduces a and b to each other. The first result is
+// for a and the second for b.
+func MakeIntroductions(a, b Info) (*Introduction, *Introduction, os.Error) {
+	if a.GetSignatureKey() == nil || b.GetSignatureKey() == nil {
+		return nil, nil, os.ErrorString("intro, friend has no signature key")
+	}
+	if a.GetFingerprint().Equal(b.GetFingerprint()) {
+		return nil, nil, os.ErrorString("intro, cannot introduce a friend to themselves")
+	}
+	ab, ba := GenerateDialKey(), GenerateDialKey()
+	fora := &Introduction{
+		Name:      b.GetName(),
+		Email:     b.GetEmail(),
+		Addr:      b.GetAddr(),
+		SigKey:    b.GetSignatureKey(),
+		DialKey:   ab,
+		AcceptKey: ba,
+	}
+	forb := &Introduction{
+		Name:      a.GetName(),
+		Email:     a.GetEmail(),
+		Addr:      a.GetAddr(),
+		SigKey:    a.GetSignatureKey(),
+		DialKey:   ba,
+		AcceptKey: ab,
+	}
+	return fora, forb, nil
+}
+
+// Fingerprint returns the fingerprint of the introduced party
+func (in *Introduction) Fingerprint() Fingerprint { return in.SigKey.Fingerprint() }
+
+func (in *Introduction) Proto() *U_Introduction {
+	return &U_Introduction{
+		Name:      in.Name,
+		Email:     in.Email,
+		Addr:      in.Addr,
+		SigKey:    in.SigKey.String(),
+		DialKey:   in.DialKey.Int64(),
+		AcceptKey: in.AcceptKey.Int64(),
+	}
+}
+
+func UnprotoIntroduction(p *U_Introduction) (*Introduction, os.Error) {
+	sk, err := ParseSigPubKey(p.SigKey)
+	if err != nil {
+		return nil, err
+	}
+	if p.DialKey == p.AcceptKey {
+		return nil, os.ErrorString("intro, dial and accept keys are the same")
+	}
+	dk, ak := DialKey(p.DialKey), DialKey(p.AcceptKey)
+	return &Introduction{
+		Name:      p.Name,
+		Email:     p.Email,
+		Addr:      p.Addr,
+		SigKey:    sk,
+		DialKey:   &dk,
+		AcceptKey: &ak,
+	}, nil
+}
+
+// Bytes encodes the introduction as the payload of an envelope
+func (in *Introduction) Bytes() []byte {
+	var w bytes.Buffer
+	if err := gob.NewEncoder(&w).Encode(in.Proto()); err != nil {
+		panic("intro, encode")
+	}
+	return w.Bytes()
+}
+
+// ParseIntroduction decodes an envelope payload made by Bytes. The By and
+// Time fields are left for the receiver to fill.
+func ParseIntroduction(payload []byte) (*Introduction, os.Error) {
+	p := &U_Introduction{}
+	if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(p); err != nil {
+		return nil, err
+	}
+	return UnprotoIntroduction(p)
+}
@@ -0,0 +1,55 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package sys
+
+import (
+	"testing"
+)
+
+func makeTestFriend(name string) *Friend {
+	k := GenerateSigKey()
+	fp := k.Fingerprint()
+	id := fp.Id()
+	return &Friend{Name: name, Addr: name + ".org:80", Id: &id, Fingerprint: &fp,
+		SignatureKey: k.PubKey()}
+}
+
+func TestIntroduction(t *testing.T) {
+	alice, bob := makeTestFriend("alice"), makeTestFriend("bob")
+	fora, forb, err := MakeIntroductions(alice, bob)
+	if err != nil {
+		t.Fatalf("make: %s\n", err)
+	}
+	if !fora.DialKey.Equal(*forb.AcceptKey) || !forb.DialKey.Equal(*fora.AcceptKey) {
+		t.Fatalf("dial keys do not pair up")
+	}
+	in, err := ParseIntroduction(fora.Bytes())
+	if err != nil {
+		t.Fatalf("parse: %s\n", err)
+	}
+	fp := in.Fingerprint()
+	if in.Name != "bob" || in.Addr != "bob.org:80" || !fp.Equal(bob.GetFingerprint()) ||
+		!in.DialKey.Equal(*fora.DialKey) || !in.AcceptKey.Equal(*fora.AcceptKey) {
+		t.Fatalf("mismatch")
+	}
+	if _, _, err = MakeIntroductions(alice, alice); err == nil {
+		t.Fatalf("introduced a friend to themselves")
+	}
+}
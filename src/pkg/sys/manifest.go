@@ -0,0 +1,159 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sys
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"gob"
+	"io"
+	"os"
+	"time"
+	ubytes "tonika/util/bytes"
+)
+
+// A Manifest lists the SHA1 hashes of the chunks of a file published in a
+// vault, and is signed by the owner of the vault. It carries the owner's
+// public key, which the receiver checks against the fingerprint of the
+// friend it asked, so that a file relayed by untrusted vaults can be
+// verified chunk by chunk as it arrives. The time it was signed lets the
+// receiver refuse an older manifest of a file, replayed by a relay to pass
+// off an older version as the current one.
+type Manifest struct {
+	Key       string // SigPubKey of the owner
+	Path      string // of the file, relative to the owner's home directory
+	Size      int64
+	Mtime     int64  // modification time of the file, in nanoseconds
+	Signed    int64  // when the manifest was made, in nanoseconds
+	ChunkSize int64
+	Chunks    []byte // the hashes of all chunks, one after the other
+	Sign      []byte
+}
+
+const (
+	ChunkHashLen = 20 // SHA1
+	MaxChunkSize = 4 * 1024 * 1024
+)
+
+// HashChunk returns the hash of a chunk as listed in a manifest
+func HashChunk(data []byte) []byte {
+	h := sha1.New()
+	h.Write(data)
+	return h.Sum()
+}
+
+// MakeManifest reads the file of size bytes from r in chunks of chunkSize
+// bytes, and returns its manifest signed with key
+func MakeManifest(key *SigKey, path string, size, mtime, chunkSize int64,
+	r io.Reader) (*Manifest, os.Error) {
+
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return nil, os.ErrorString("manifest, bad chunk size")
+	}
+	m := &Manifest{
+		Key:       key.PubKey().String(),
+		Path:      path,
+		Size:      size,
+		Mtime:     mtime,
+		Signed:    time.Nanoseconds(),
+		ChunkSize: chunkSize,
+	}
+	n := m.NumChunks()
+	m.Chunks = make([]byte, n*ChunkHashLen)
+	buf := make([]byte, chunkSize)
+	for i := 0; i < n; i++ {
+		_, k := m.ChunkSpan(i)
+		if _, err := io.ReadFull(r, buf[0:k]); err != nil {
+			return nil, err
+		}
+		copy(m.Chunks[i*ChunkHashLen:], HashChunk(buf[0:k]))
+	}
+	sign, err := key.Sign(m.signBytes())
+	if err != nil {
+		return nil, err
+	}
+	m.Sign = sign
+	return m, nil
+}
+
+func (m *Manifest) signBytes() []byte {
+	var w bytes.Buffer
+	w.WriteString("manifest")
+	w.WriteString(m.Key)
+	w.WriteString(m.Path)
+	w.WriteByte(0)
+	w.Write(ubytes.Int64ToBytes(m.Size))
+	w.Write(ubytes.Int64ToBytes(m.Mtime))
+	w.Write(ubytes.Int64ToBytes(m.Signed))
+	w.Write(ubytes.Int64ToBytes(m.ChunkSize))
+	w.Write(m.Chunks)
+	return w.Bytes()
+}
+
+// NumChunks returns the number of chunks of the file
+func (m *Manifest) NumChunks() int {
+	return int((m.Size + m.ChunkSize - 1) / m.ChunkSize)
+}
+
+// ChunkSpan returns the offset and length of the i-th chunk
+func (m *Manifest) ChunkSpan(i int) (off, n int64) {
+	off = int64(i) * m.ChunkSize
+	n = m.ChunkSize
+	if off+n > m.Size {
+		n = m.Size - off
+	}
+	return off, n
+}
+
+// ChunkHash returns the hash of the i-th chunk
+func (m *Manifest) ChunkHash(i int) []byte {
+	return m.Chunks[i*ChunkHashLen : (i+1)*ChunkHashLen]
+}
+
+// Verify checks that the manifest is well-formed and was signed by the
+// owner of the vault, whose fingerprint is given
+func (m *Manifest) Verify(owner *Fingerprint) os.Error {
+	if m.Size < 0 || m.ChunkSize <= 0 || m.ChunkSize > MaxChunkSize ||
+		len(m.Chunks) != m.NumChunks()*ChunkHashLen {
+		return os.ErrorString("manifest, malformed")
+	}
+	pk, err := ParseSigPubKey(m.Key)
+	if err != nil {
+		return err
+	}
+	if !VerifyKeyAndFingerprint(owner, *pk.RsaPubKey()) {
+		return os.ErrorString("manifest, key does not match owner")
+	}
+	return pk.Verify(m.signBytes(), m.Sign)
+}
+
+// Bytes returns the encoding of the manifest sent by vaults
+func (m *Manifest) Bytes() []byte {
+	var w bytes.Buffer
+	if err := gob.NewEncoder(&w).Encode(m); err != nil {
+		panic("manifest, encode")
+	}
+	return w.Bytes()
+}
+
+func ParseManifest(data []byte) (*Manifest, os.Error) {
+	m := &Manifest{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
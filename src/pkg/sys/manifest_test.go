@@ -0,0 +1,76 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sys
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	alice := GenerateSigKey()
+	bob := GenerateSigKey()
+	data := strings.Repeat("0123456789", 25)
+	m, err := MakeManifest(alice, "music/song.ogg", int64(len(data)), 7, 100,
+		strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("make: %s", err)
+	}
+	if m.NumChunks() != 3 {
+		t.Fatalf("%d chunks, want 3", m.NumChunks())
+	}
+	if off, n := m.ChunkSpan(2); off != 200 || n != 50 {
+		t.Errorf("last chunk at %d, %d bytes", off, n)
+	}
+	if !bytes.Equal(m.ChunkHash(1), HashChunk([]byte(data[100:200]))) {
+		t.Errorf("chunk hash mismatch")
+	}
+
+	m, err = ParseManifest(m.Bytes())
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	afp, bfp := alice.Fingerprint(), bob.Fingerprint()
+	if err = m.Verify(&afp); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if m.Verify(&bfp) == nil {
+		t.Errorf("verified against the wrong owner")
+	}
+	// a key with the same Id, but another fingerprint, is not the owner
+	same := afp
+	same[0] ^= 1
+	same[8] ^= 1
+	if same.Id() != afp.Id() || m.Verify(&same) == nil {
+		t.Errorf("verified against the Id alone")
+	}
+	m.Chunks[0] ^= 1
+	if m.Verify(&afp) == nil {
+		t.Errorf("verified a tampered manifest")
+	}
+	m.Chunks[0] ^= 1
+	m.Signed++
+	if m.Verify(&afp) == nil {
+		t.Errorf("verified a manifest with another signing time")
+	}
+	m.Signed--
+	m.Path = "music/other.ogg"
+	if m.Verify(&afp) == nil {
+		t.Errorf("verified a manifest moved to another path")
+	}
+}
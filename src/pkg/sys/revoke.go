@@ -0,0 +1,128 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+
+package sys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"gob"
+	"os"
+	"time"
+	ubytes "tonika/util/bytes"
+)
+
+// A revocation certificate declares an identity compromised. It is signed
+// by the identity's own SigKey, so it can be generated ahead of time, kept
+// offline, and relayed by anyone: friends verify it against the key they
+// already hold for that identity.
+type RevocationCert struct {
+	Fingerprint Fingerprint
+	Time        int64 // nanoseconds since epoch
+	Reason      string
+	Sign        []byte
+}
+
+type U_RevocationCert struct {
+	Fingerprint []byte
+	Time        int64
+	Reason      string
+	Sign        []byte
+}
+
+func MakeRevocationCert(key *SigKey, reason string) (*RevocationCert, os.Error) {
+	rc := &RevocationCert{
+		Fingerprint: key.Fingerprint(),
+		Time:        time.Nanoseconds(),
+		Reason:      reason,
+	}
+	sign, err := key.Sign(rc.signBytes())
+	if err != nil {
+		return nil, err
+	}
+	rc.Sign = sign
+	return rc, nil
+}
+
+func (rc *RevocationCert) signBytes() []byte {
+	var w bytes.Buffer
+	w.WriteString("revoke")
+	w.Write(rc.Fingerprint[0:])
+	w.Write(ubytes.Int64ToBytes(rc.Time))
+	w.WriteString(rc.Reason)
+	return w.Bytes()
+}
+
+// Verify checks that the certificate was signed by pk, and that pk is the
+// key of the revoked identity
+func (rc *RevocationCert) Verify(pk *SigPubKey) os.Error {
+	if !VerifyKeyAndFingerprint(&rc.Fingerprint, *pk.RsaPubKey()) {
+		return os.ErrorString("revocation, key does not match fingerprint")
+	}
+	return pk.Verify(rc.signBytes(), rc.Sign)
+}
+
+func (rc *RevocationCert) Proto() *U_RevocationCert {
+	return &U_RevocationCert{
+		Fingerprint: rc.Fingerprint[0:],
+		Time:        rc.Time,
+		Reason:      rc.Reason,
+		Sign:        rc.Sign,
+	}
+}
+
+func UnprotoRevocationCert(p *U_RevocationCert) (*RevocationCert, os.Error) {
+	if len(p.Fingerprint) != FingerprintLen {
+		return nil, os.ErrorString("revocation, bad fingerprint")
+	}
+	rc := &RevocationCert{
+		Time:   p.Time,
+		Reason: p.Reason,
+		Sign:   p.Sign,
+	}
+	copy(rc.Fingerprint[0:], p.Fingerprint)
+	return rc, nil
+}
+
+// String returns a Base64 encoding of the certificate, suitable for
+// storing in a file or pasting into the Front End
+func (rc *RevocationCert) String() string {
+	var w bytes.Buffer
+	if err := gob.NewEncoder(&w).Encode(rc.Proto()); err != nil {
+		panic("revocation, encode")
+	}
+	enc := base64.StdEncoding
+	buf := make([]byte, enc.EncodedLen(w.Len()))
+	enc.Encode(buf, w.Bytes())
+	return string(buf)
+}
+
+func ParseRevocationCert(s string) (*RevocationCert, os.Error) {
+	enc := base64.StdEncoding
+	buf := make([]byte, enc.DecodedLen(len(s)))
+	n, err := enc.Decode(buf, []byte(s))
+	if err != nil {
+		return nil, err
+	}
+	p := &U_RevocationCert{}
+	if err = gob.NewDecoder(bytes.NewBuffer(buf[0:n])).Decode(p); err != nil {
+		return nil, err
+	}
+	return UnprotoRevocationCert(p)
+}
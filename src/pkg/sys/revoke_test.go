@@ -0,0 +1,49 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sys
+
+import (
+	"testing"
+)
+
+func TestRevocationCert(t *testing.T) {
+	k, other := GenerateSigKey(), GenerateSigKey()
+	rc, err := MakeRevocationCert(k, "key stolen")
+	if err != nil {
+		t.Fatalf("make: %s", err)
+	}
+	if err = rc.Verify(k.PubKey()); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if rc.Verify(other.PubKey()) == nil {
+		t.Errorf("verified with another key")
+	}
+	rc2, err := ParseRevocationCert(rc.String())
+	if err != nil || rc2.Verify(k.PubKey()) != nil || rc2.Reason != rc.Reason {
+		t.Fatalf("round trip: %v", err)
+	}
+	rc2.Reason = "just kidding"
+	if rc2.Verify(k.PubKey()) == nil {
+		t.Errorf("changed reason verified")
+	}
+	if _, err = ParseRevocationCert("garbage"); err == nil {
+		t.Errorf("garbage parsed")
+	}
+	if _, err = UnprotoRevocationCert(&U_RevocationCert{Fingerprint: []byte{1, 2}}); err == nil {
+		t.Errorf("short fingerprint accepted")
+	}
+}
@@ -80,6 +80,10 @@ func (sk *SigKey) Id() Id {
 	return IdForKey(sk.rsa.PublicKey)
 }
 
+func (sk *SigKey) Fingerprint() Fingerprint {
+	return FingerprintForKey(sk.rsa.PublicKey)
+}
+
 func (sk *SigKey) Sign(msg []byte) ([]byte, os.Error) {
 	// Hash the message
 	hash := sha1.New()
@@ -123,6 +127,10 @@ func (sk *SigPubKey) Id() Id {
 	return IdForKey(*sk.rsa)
 }
 
+func (sk *SigPubKey) Fingerprint() Fingerprint {
+	return FingerprintForKey(*sk.rsa)
+}
+
 func (sk *SigPubKey) Verify(msg, sign []byte) os.Error {
 	// Hash message
 	hash := sha1.New()
@@ -35,10 +35,12 @@ type AuthLocal interface {
 
 type AuthRemote interface {
 	GetId() *Id
+	GetFingerprint() *Fingerprint
 	GetSignatureKey() *SigPubKey
 	GetDialKey() *DialKey
 	GetAcceptKey() *DialKey
 	GetHelloKey() *HelloKey
+	IsRevoked() bool
 }
 
 type Identity interface {
@@ -48,6 +50,7 @@ type Identity interface {
 }
 
 type Health interface {
+	IsComplete() bool // both sides of the invitation are done
 	GetSlot() int
 	GetStatusMsg() string
 	GetStatusClass() string
@@ -89,17 +92,24 @@ func (m *Me) GetName() string { return m.Name }
 func (m *Me) GetEmail() string { return m.Email }
 func (m *Me) GetSignatureKey() *SigKey { return m.SignatureKey }
 
+func (m *Me) GetFingerprint() *Fingerprint {
+	fp := m.SignatureKey.Fingerprint()
+	return &fp
+}
+
 // Friend
 type Friend struct {
 	Slot int                     // we generate
 	Name string                  // we choose
 	Email string                 // we choose
 	Id *Id                       // they provide
+	Fingerprint *Fingerprint     // they provide
 	SignatureKey *SigPubKey      // they provide
 	DialKey *DialKey             // they provide
 	Addr string	             // they provide
 	AcceptKey *DialKey           // we generate
 	HelloKey *HelloKey           // we generate
+	Revocation *RevocationCert   // anyone relays, nil unless revoked
 	Rest map[string]string
 }
 
@@ -110,10 +120,13 @@ func (f *Friend) GetEmail() string { return f.Email }
 func (f *Friend) GetAddr() string { return f.Addr }
 
 func (f *Friend) GetId() *Id { return f.Id }
+func (f *Friend) GetFingerprint() *Fingerprint { return f.Fingerprint }
 func (f *Friend) GetSignatureKey() *SigPubKey { return f.SignatureKey }
 func (f *Friend) GetDialKey() *DialKey { return f.DialKey }
 func (f *Friend) GetAcceptKey() *DialKey { return f.AcceptKey }
 func (f *Friend) GetHelloKey() *HelloKey { return f.HelloKey }
+func (f *Friend) GetRevocation() *RevocationCert { return f.Revocation }
+func (f *Friend) IsRevoked() bool { return f.Revocation != nil }
 
 func (f *Friend) Init() {
 	f.AcceptKey = GenerateDialKey()
@@ -122,6 +135,7 @@ func (f *Friend) Init() {
 
 func (f *Friend) IsComplete() bool {
 	return f.Id != nil && 
+		f.Fingerprint != nil && 
 		f.SignatureKey != nil && 
 		f.HelloKey != nil && 
 		f.DialKey != nil && 
@@ -0,0 +1,160 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package sys
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Updates to friends and to ourselves are made in batches: every field that
+// is set in an update is validated before any of them is applied, so an
+// update either happens in full or not at all.
+
+// FriendUpdate is a batch of changes to a friend. Nil fields are unchanged.
+type FriendUpdate struct {
+	Name         *string
+	Email        *string
+	Addr         *string
+	SignatureKey *SigPubKey
+	DialKey      *DialKey
+	AcceptKey    *DialKey
+}
+
+func (u *FriendUpdate) SetName(s string) *FriendUpdate  { u.Name = &s; return u }
+func (u *FriendUpdate) SetEmail(s string) *FriendUpdate { u.Email = &s; return u }
+func (u *FriendUpdate) SetAddr(s string) *FriendUpdate  { u.Addr = &s; return u }
+
+func (u *FriendUpdate) SetSignatureKey(k *SigPubKey) *FriendUpdate {
+	u.SignatureKey = k
+	return u
+}
+
+func (u *FriendUpdate) SetDialKey(k *DialKey) *FriendUpdate {
+	u.DialKey = k
+	return u
+}
+
+func (u *FriendUpdate) SetAcceptKey(k *DialKey) *FriendUpdate {
+	u.AcceptKey = k
+	return u
+}
+
+// MyUpdate is a batch of changes to our own details. Nil fields are unchanged.
+type MyUpdate struct {
+	Name    *string
+	Email   *string
+	ExtAddr *string
+}
+
+func (u *MyUpdate) SetName(s string) *MyUpdate    { u.Name = &s; return u }
+func (u *MyUpdate) SetEmail(s string) *MyUpdate   { u.Email = &s; return u }
+func (u *MyUpdate) SetExtAddr(s string) *MyUpdate { u.ExtAddr = &s; return u }
+
+// UpdateError is returned when an update is refused. Field names the
+// offending field, or is empty if the update as a whole was refused.
+type UpdateError struct {
+	Field  string
+	Reason string
+}
+
+func (e *UpdateError) String() string {
+	if e.Field == "" {
+		return "update: " + e.Reason
+	}
+	return "update " + e.Field + ": " + e.Reason
+}
+
+// Change records one field change in the audit log
+type Change struct {
+	Time  int64  // nanoseconds since epoch
+	Slot  int    // MySlot for changes to ourselves
+	By    string // who made the change, e.g. "admin" or "invite"
+	Field string
+	Old   string
+	New   string
+}
+
+// MySlot is the slot under which changes to ourselves are recorded
+const MySlot = -1
+
+// Validation
+
+const maxFieldLen = 100
+
+// ValidName checks names of friends and of ourselves
+func ValidName(s string) os.Error {
+	if len(s) > maxFieldLen {
+		return os.ErrorString("too long")
+	}
+	for _, c := range s {
+		if c < ' ' {
+			return os.ErrorString("control characters not allowed")
+		}
+	}
+	return nil
+}
+
+// ValidEmail checks email addresses. The empty address is valid.
+func ValidEmail(s string) os.Error {
+	if s == "" {
+		return nil
+	}
+	if err := ValidName(s); err != nil {
+		return err
+	}
+	at := strings.Index(s, "@")
+	if at <= 0 || at == len(s)-1 || strings.Count(s, "@") != 1 || strings.Index(s, " ") >= 0 {
+		return os.ErrorString("not an email address")
+	}
+	return nil
+}
+
+// ValidAddr checks addresses of the form host:port, where host may be an
+// IPv6 address in brackets. The empty address is valid.
+func ValidAddr(s string) os.Error {
+	if s == "" {
+		return nil
+	}
+	if len(s) > maxFieldLen {
+		return os.ErrorString("too long")
+	}
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return os.ErrorString("expecting host:port")
+	}
+	host, port := s[0:i], s[i+1:]
+	if host[0] == '[' {
+		if host[len(host)-1] != ']' || len(host) < 3 {
+			return os.ErrorString("bad IPv6 address")
+		}
+	} else if strings.Index(host, ":") >= 0 {
+		return os.ErrorString("IPv6 addresses must be in brackets")
+	}
+	for _, c := range host {
+		if c <= ' ' || c == '/' {
+			return os.ErrorString("bad host")
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return os.ErrorString("bad port")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sys
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	long := strings.Repeat("x", maxFieldLen+1)
+	tests := []struct {
+		valid func(string) os.Error
+		s     string
+		ok    bool
+	}{
+		{ValidName, "", true},
+		{ValidName, "Petar M.", true},
+		{ValidName, "a\nb", false},
+		{ValidName, long, false},
+		{ValidEmail, "", true},
+		{ValidEmail, "petar@5ttt.org", true},
+		{ValidEmail, "petar", false},
+		{ValidEmail, "@5ttt.org", false},
+		{ValidEmail, "petar@", false},
+		{ValidEmail, "a@b@c", false},
+		{ValidEmail, "pe tar@5ttt.org", false},
+		{ValidEmail, long + "@x", false},
+		{ValidAddr, "", true},
+		{ValidAddr, "5ttt.org:80", true},
+		{ValidAddr, "[::1]:80", true},
+		{ValidAddr, "5ttt.org", false},
+		{ValidAddr, ":80", false},
+		{ValidAddr, "::1:80", false},
+		{ValidAddr, "[]:80", false},
+		{ValidAddr, "[::1:80", false},
+		{ValidAddr, "5ttt.org:0", false},
+		{ValidAddr, "5ttt.org:65536", false},
+		{ValidAddr, "5ttt.org:http", false},
+		{ValidAddr, "a/b:80", false},
+		{ValidAddr, long + ":80", false},
+	}
+	for i, tt := range tests {
+		if err := tt.valid(tt.s); (err == nil) != tt.ok {
+			t.Errorf("%d: %q: expected ok=%v, got %v", i, tt.s, tt.ok, err)
+		}
+	}
+}
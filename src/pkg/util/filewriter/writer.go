@@ -26,20 +26,31 @@ import (
 	"path"
 	"strconv"
 	"sync"
+	"time"
 	"tonika/util/varint"
 )
 
-// FileWriter
+// FileWriter writes to a numbered series of files, prefix-00001,
+// prefix-00002, etc., starting a new one when the current one gets too big
+// or too old. Optionally, only the newest few files are kept.
 type FileWriter struct {
 	prefix  string
 	file    *os.File
 	written int64
+	opened  int64 // when the current file was started, in ns
+	maxSize int64 // bytes
+	maxAge  int64 // ns, 0 for no limit
+	keep    int   // files, 0 to keep all
 	lk,glk  sync.Mutex
 	enc     *gob.Encoder
 }
 
+// DefaultMaxSize is the size at which a new file is started, unless changed
+// with SetRotation
+const DefaultMaxSize = 1024*1024*100 // 100MB
+
 func MakeFileWriter(fileprefix string) (*FileWriter, os.Error) {
-	w := &FileWriter{ prefix: fileprefix }
+	w := &FileWriter{ prefix: fileprefix, maxSize: DefaultMaxSize }
 	err := w.recycle()
 	if err != nil {
 		return nil, err
@@ -81,6 +92,19 @@ func generateName(prefix string) (string, os.Error) {
 	return path.Join(dir, w.String()), nil
 }
 
+// SetRotation makes the writer start a new file once the current one has
+// more than maxSize bytes, or is older than maxAge nanoseconds (0 for no age
+// limit), and remove the oldest files so that at most keep are left (0 to
+// keep all).
+func (w *FileWriter) SetRotation(maxSize, maxAge int64, keep int) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	w.maxSize, w.maxAge, w.keep = maxSize, maxAge, keep
+}
+
 func (w *FileWriter) recycle() os.Error {
 	if w.file != nil {
 		w.file.Close()
@@ -96,6 +120,32 @@ func (w *FileWriter) recycle() os.Error {
 		return err
 	}
 	w.file = file
+	w.opened = time.Nanoseconds()
+	return w.prune()
+}
+
+// prune removes all but the newest w.keep files
+func (w *FileWriter) prune() os.Error {
+	if w.keep <= 0 {
+		return nil
+	}
+	dir, pre := path.Split(w.prefix)
+	if dir == "" {
+		dir = "."
+	}
+	d,err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	files,err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	files = filterAndSort(files, pre)
+	for i := 0; i < len(files)-w.keep; i++ {
+		os.Remove(path.Join(dir, files[i]))
+	}
 	return nil
 }
 
@@ -111,7 +161,8 @@ func (w *FileWriter) Write(p []byte) (int, os.Error) {
 		panic("filewriter, write")
 	}
 	w.written += int64(n)
-	if w.written > 1024*1024*100 {  // If > 100MB, start a new file
+	if w.written > w.maxSize || 
+		(w.maxAge > 0 && time.Nanoseconds()-w.opened > w.maxAge) {
 		return n, w.recycle()
 	}
 	return n, nil
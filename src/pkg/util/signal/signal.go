@@ -34,3 +34,23 @@ func InstallCtrlCPanic() {
 		}
 	}()
 }
+
+// What a daemon does about an incoming signal, see Next
+const (
+	Ignore = iota
+	Reload // SIGHUP
+	Stop   // SIGINT or SIGTERM
+)
+
+// Next waits for the next incoming signal, and returns it along with what
+// a daemon should do about it
+func Next() (signal.Signal, int) {
+	s := <-signal.Incoming
+	switch s {
+	case signal.Signal(signal.SIGHUP):
+		return s, Reload
+	case signal.Signal(signal.SIGINT), signal.Signal(signal.SIGTERM):
+		return s, Stop
+	}
+	return s, Ignore
+}
@@ -0,0 +1,236 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"tonika/sys"
+	"tonika/util/eye64"
+)
+
+// Read access to the home directory is controlled by ACL files. An ACL file
+// applies to the directory it is in and everything below it, unless a
+// deeper ACL file overrides it. Directories with no ACL file above them are
+// readable by everyone. Each line of an ACL file grants access:
+//
+//	everyone
+//	friend <id>
+//	group <name>
+//
+// Empty lines and lines starting with # are ignored. ACL files themselves
+// are never served.
+const aclFile = ".tonika-acl"
+
+// groups looks up the members of a group by their short Id
+type groups interface {
+	InGroup(id sys.Id, group string) bool
+}
+
+type acl struct {
+	everyone bool
+	ids      map[sys.Id]bool
+	groups   []string
+}
+
+func parseACL(data string) (*acl, os.Error) {
+	a := &acl{ids: make(map[sys.Id]bool)}
+	for _, line := range strings.Split(data, "\n", -1) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kind, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			kind, arg = line[0:i], strings.TrimSpace(line[i+1:])
+		}
+		switch {
+		case kind == "everyone" && arg == "":
+			a.everyone = true
+		case kind == "friend" && arg != "":
+			u64, err := eye64.EyeToU64(arg)
+			if err != nil {
+				return nil, os.ErrorString("acl, bad friend id " + arg)
+			}
+			a.ids[sys.Id(u64)] = true
+		case kind == "group" && arg != "":
+			n := len(a.groups)
+			if n == cap(a.groups) {
+				g := make([]string, n, 2*n+1)
+				copy(g, a.groups)
+				a.groups = g
+			}
+			a.groups = a.groups[0 : n+1]
+			a.groups[n] = arg
+		default:
+			return nil, os.ErrorString("acl, bad line: " + line)
+		}
+	}
+	return a, nil
+}
+
+// allows returns true if the acl grants access to friend id. Groups are
+// looked up in g, which can be nil.
+func (a *acl) allows(id sys.Id, g groups) bool {
+	if a.everyone || a.ids[id] {
+		return true
+	}
+	if g == nil {
+		return false
+	}
+	for _, name := range a.groups {
+		if g.InGroup(id, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findACL returns the ACL file that governs fpath, a file path relative to
+// hdir, or nil if there is none. An ACL file that cannot be read or parsed
+// denies access to everyone.
+func findACL(hdir, fpath string) *acl {
+	dir, _ := path.Split(path.Clean("/" + fpath))
+	for {
+		full := path.Join(hdir, dir, aclFile)
+		if isFile(full) {
+			data, err := ioutil.ReadFile(full)
+			var a *acl
+			if err == nil {
+				a, err = parseACL(string(data))
+			}
+			if err != nil {
+				logger.Warnf("%s: %s", full, err)
+				return &acl{ids: make(map[sys.Id]bool)}
+			}
+			return a
+		}
+		if dir == "/" {
+			return nil
+		}
+		dir, _ = path.Split(dir[0 : len(dir)-1])
+	}
+	panic("unreach")
+}
+
+// isPublic returns true if everyone may read fpath
+func (v *Vault0) isPublic(fpath string) bool {
+	if _, ok := v.inInbox(fpath); ok {
+		return false
+	}
+	a := findACL(v.getHomeDir(), fpath)
+	return a == nil || a.everyone
+}
+
+// canRead returns true if the request for fpath, made by origin and handed
+// to us by the neighbor peer, may be served. When the request was forwarded,
+// the origin cannot be verified, so the peer must be allowed as well;
+// this way nobody learns more than the forwarding friend could read anyway.
+func (v *Vault0) canRead(fpath string, origin, peer sys.Id) bool {
+	return v.canReadCached(fpath, origin, peer, nil)
+}
+
+// aclCache keeps the ACL found for each directory, nil included, while one
+// request looks at many files
+type aclCache map[string]*acl
+
+// canReadCached is canRead, looking up ACLs in c first if it is not nil.
+// c must only be used for one home directory.
+func (v *Vault0) canReadCached(fpath string, origin, peer sys.Id, c aclCache) bool {
+	if path.Base(fpath) == aclFile || isHidden(fpath) {
+		return false
+	}
+	if origin == v.id && peer == v.id {
+		return true
+	}
+	// The inbox is mine alone, see inbox.go
+	if _, ok := v.inInbox(fpath); ok {
+		return false
+	}
+	var a *acl
+	dir, _ := path.Split(path.Clean("/" + fpath))
+	if ca, ok := c[dir]; ok {
+		a = ca
+	} else {
+		a = findACL(v.getHomeDir(), fpath)
+		if c != nil {
+			c[dir] = a
+		}
+	}
+	if a == nil {
+		return true
+	}
+	g := v.getGroups()
+	return a.allows(origin, g) && (peer == origin || a.allows(peer, g))
+}
+
+// maxACLDirs bounds the directories looked at by GroupUses
+const maxACLDirs = 10000
+
+// GroupUses returns the ACL files, as paths relative to the home
+// directory, that grant access to group, followed by the inbox directory
+// if uploads are granted to it. A group should not be renamed or removed
+// while it is in use, or access would silently change.
+func (v *Vault0) GroupUses(group string) []string {
+	n := 0
+	r := aclsNaming(v.getHomeDir(), "/", group, &n, nil)
+	if in := v.getInbox(); in.dir != "" && in.group == group {
+		l := make([]string, len(r)+1)
+		copy(l, r)
+		l[len(r)] = path.Join("/", in.dir)
+		r = l
+	}
+	return r
+}
+
+func aclsNaming(hdir, dir, group string, n *int, r []string) []string {
+	if *n >= maxACLDirs {
+		return r
+	}
+	*n++
+	full := path.Join(hdir, dir)
+	if data, err := ioutil.ReadFile(path.Join(full, aclFile)); err == nil {
+		if a, err := parseACL(string(data)); err == nil && a.names(group) {
+			l := make([]string, len(r)+1)
+			copy(l, r)
+			l[len(r)] = path.Join(dir, aclFile)
+			r = l
+		}
+	}
+	fis, err := ioutil.ReadDir(full)
+	if err != nil {
+		return r
+	}
+	for _, fi := range fis {
+		if fi.IsDirectory() && !strings.HasPrefix(fi.Name, ".") {
+			r = aclsNaming(hdir, path.Join(dir, fi.Name), group, n, r)
+		}
+	}
+	return r
+}
+
+func (a *acl) names(group string) bool {
+	for _, g := range a.groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+type testGroups map[string]sys.Id
+
+func (g testGroups) InGroup(id sys.Id, name string) bool { return g[name] == id }
+
+// testFpGroups has one member, by fingerprint, in each group, see sys.Groups
+type testFpGroups map[string]*sys.Fingerprint
+
+func (g testFpGroups) InGroup(fp *sys.Fingerprint, name string) bool {
+	return g[name] != nil && g[name].Equal(fp)
+}
+
+type testFriend struct {
+	*sys.Friend
+}
+
+func (f testFriend) GetStatusMsg() string   { return "" }
+func (f testFriend) GetStatusClass() string { return "" }
+func (f testFriend) IsOnline() bool         { return true }
+
+type testNeighbors []sys.View
+
+func (n testNeighbors) Enumerate() []sys.View { return n }
+
+// makeTestFriend returns a friend with a new signature key
+func makeTestFriend(name string) testFriend {
+	k := sys.GenerateSigKey()
+	fp := k.Fingerprint()
+	id := fp.Id()
+	return testFriend{&sys.Friend{Name: name, Id: &id, Fingerprint: &fp,
+		SignatureKey: k.PubKey()}}
+}
+
+func TestACL(t *testing.T) {
+	alice, bob, carol := sys.Id(1), sys.Id(2), sys.Id(3)
+	a, err := parseACL("# family only\n\nfriend " + alice.Eye() + "\ngroup close family\n")
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	g := testGroups{"close family": bob}
+	if !a.allows(alice, nil) || !a.allows(bob, g) {
+		t.Fatalf("grant missing")
+	}
+	if a.allows(bob, nil) || a.allows(carol, g) {
+		t.Fatalf("bad grant")
+	}
+	a, err = parseACL("everyone\n")
+	if err != nil || !a.allows(carol, nil) {
+		t.Fatalf("everyone")
+	}
+	if _, err = parseACL("friends all\n"); err == nil {
+		t.Fatalf("bad line accepted")
+	}
+}
+
+// makeACLHome makes a home directory where a/ is for alice and the group
+// close, and a/b/ for bob alone. Nothing else has an ACL.
+func makeACLHome(t *testing.T, alice, bob sys.Id) string {
+	dir := path.Join(os.TempDir(), "tonika-acl-test")
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(path.Join(dir, "a/b/c"), 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	os.MkdirAll(path.Join(dir, "open"), 0700)
+	ioutil.WriteFile(path.Join(dir, "a", aclFile),
+		[]byte("friend "+alice.Eye()+"\ngroup close\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, "a/b", aclFile), []byte("friend "+bob.Eye()+"\n"), 0600)
+	return dir
+}
+
+func TestFindACL(t *testing.T) {
+	alice, bob := sys.Id(2), sys.Id(3)
+	dir := makeACLHome(t, alice, bob)
+	defer os.RemoveAll(dir)
+
+	if findACL(dir, "open/x") != nil || findACL(dir, "x") != nil {
+		t.Errorf("ACL found where there is none")
+	}
+	a := findACL(dir, "a/x")
+	if a == nil || !a.allows(alice, nil) || a.allows(bob, nil) {
+		t.Errorf("a/x not governed by a/%s", aclFile)
+	}
+	// the deepest ACL file wins, also further down
+	for _, p := range []string{"a/b/x", "a/b/c/x", "/a/b/c/"} {
+		a = findACL(dir, p)
+		if a == nil || !a.allows(bob, nil) || a.allows(alice, nil) {
+			t.Errorf("%s not governed by a/b/%s", p, aclFile)
+		}
+	}
+	ioutil.WriteFile(path.Join(dir, "open", aclFile), []byte("friends all\n"), 0600)
+	if a = findACL(dir, "open/x"); a == nil || a.allows(alice, nil) || a.everyone {
+		t.Errorf("bad ACL file does not deny")
+	}
+}
+
+func TestCanRead(t *testing.T) {
+	me, alice, bob, carol := sys.Id(1), sys.Id(2), sys.Id(3), sys.Id(4)
+	dir := makeACLHome(t, alice, bob)
+	defer os.RemoveAll(dir)
+	v := &Vault0{id: me, hdir: dir}
+	v.SetGroups(testGroups{"close": carol})
+
+	if !v.canRead("open/x", carol, carol) || !v.canRead("a/x", me, me) {
+		t.Errorf("open file or own request denied")
+	}
+	if !v.canRead("a/x", alice, alice) || !v.canRead("a/x", carol, carol) {
+		t.Errorf("direct request denied")
+	}
+	if v.canRead("a/x", bob, bob) || v.canRead("a/b/x", alice, alice) {
+		t.Errorf("direct request allowed")
+	}
+	// forwarded requests need both the origin and the peer
+	if !v.canRead("a/x", alice, carol) || !v.canRead("a/x", carol, alice) {
+		t.Errorf("forwarded request denied")
+	}
+	if v.canRead("a/x", alice, bob) || v.canRead("a/x", bob, alice) {
+		t.Errorf("forwarded request allowed")
+	}
+	if !v.canRead("open/x", alice, bob) {
+		t.Errorf("forwarded request for an open file denied")
+	}
+}
+
+func TestACLNotServed(t *testing.T) {
+	me, alice, bob := sys.Id(1), sys.Id(2), sys.Id(3)
+	dir := makeACLHome(t, alice, bob)
+	defer os.RemoveAll(dir)
+	v := &Vault0{id: me, hdir: dir}
+	ioutil.WriteFile(path.Join(dir, "open", aclFile), []byte("everyone\n"), 0600)
+
+	for _, p := range []string{aclFile, "a/" + aclFile, "a/b/" + aclFile, "open/" + aclFile} {
+		if v.canRead(p, me, me) || v.canRead(p, alice, alice) || v.canRead(p, bob, bob) {
+			t.Errorf("%s can be read", p)
+		}
+	}
+}
+
+func TestGroupUses(t *testing.T) {
+	alice, bob := sys.Id(2), sys.Id(3)
+	dir := makeACLHome(t, alice, bob)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "open/.hidden"), 0700)
+	ioutil.WriteFile(path.Join(dir, "open", aclFile), []byte("group close\ngroup far\n"), 0600)
+	v := &Vault0{id: 1, hdir: dir}
+
+	uses := v.GroupUses("close")
+	if len(uses) != 2 || uses[0] != "/a/"+aclFile || uses[1] != "/open/"+aclFile {
+		t.Errorf("uses of close: %v", uses)
+	}
+	if uses = v.GroupUses("nobody"); len(uses) != 0 {
+		t.Errorf("uses of an unused group: %v", uses)
+	}
+	v.SetInbox("open", "far", 10)
+	uses = v.GroupUses("far")
+	if len(uses) != 2 || uses[0] != "/open/"+aclFile || uses[1] != "/open" {
+		t.Errorf("uses of the inbox group: %v", uses)
+	}
+}
@@ -0,0 +1,490 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// The vault keeps copies of responses from friends' vaults in the cache
+// directory, for requests made by me as well as for requests forwarded on
+// behalf of others. Copies are used while they are fresh, following the
+// Cache-Control max-age, Expires and Last-Modified of the response, then
+// revalidated with a conditional request. When the friend cannot be reached,
+// a stale copy is served unless the response said must-revalidate. Responses
+// marked private are only kept for, and only served to, my own requests.
+// The least recently used copies are evicted to keep the cache under its
+// size limit.
+
+// DefaultCacheSize is the size limit of the cache, unless changed with
+// SetCacheSize
+const DefaultCacheSize = 100 * 1024 * 1024
+
+// Copies are considered fresh for at most this long without explicit
+// expiration information
+const maxHeuristicAge = 24 * 3600 * 1e9
+
+type cacheEntry struct {
+	Key     string
+	Header  map[string]string // as allowed by respAllowHeader
+	Size    int64
+	Stored  int64 // when fetched or last revalidated, in ns
+	Used    int64 // when last served, in ns
+	Private bool
+}
+
+type cache struct {
+	dir     string
+	max     int64
+	size    int64
+	entries map[string]*cacheEntry
+	lk      sync.Mutex
+}
+
+// makeCache opens the cache in dir, creating it if needed, and loads the
+// entries left by a previous run
+func makeCache(dir string) (*cache, os.Error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &cache{dir: dir, max: DefaultCacheSize, entries: make(map[string]*cacheEntry)}
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		e := &cacheEntry{}
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err == nil {
+			err = json.Unmarshal(data, e)
+		}
+		if err != nil || e.Key == "" || !isFile(c.bodyFile(e.Key)) {
+			os.Remove(path.Join(dir, name))
+			continue
+		}
+		c.entries[e.Key] = e
+		c.size += e.Size
+	}
+	c.evict()
+	return c, nil
+}
+
+func cacheKey(tid sys.Id, fpath, query string) string {
+	if query == "" {
+		return tid.Eye() + fpath
+	}
+	return tid.Eye() + fpath + "?" + query
+}
+
+func (c *cache) fileName(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	return path.Join(c.dir, hex.EncodeToString(h.Sum()))
+}
+
+func (c *cache) bodyFile(key string) string { return c.fileName(key) }
+func (c *cache) metaFile(key string) string { return c.fileName(key) + ".meta" }
+
+// setMax changes the size limit of the cache. Zero turns caching off.
+func (c *cache) setMax(max int64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.max = max
+	c.evict()
+}
+
+// get returns a copy of the entry for key, or nil if there is none that
+// may be served to me (if my is set) or to others
+func (c *cache) get(key string, my bool) *cacheEntry {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	e, ok := c.entries[key]
+	if !ok || (e.Private && !my) {
+		return nil
+	}
+	e.Used = time.Nanoseconds()
+	r := *e
+	return &r
+}
+
+// remove drops the entry for key. The caller holds c.lk.
+func (c *cache) remove(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.entries[key] = nil, false
+	c.size -= e.Size
+	os.Remove(c.bodyFile(key))
+	os.Remove(c.metaFile(key))
+}
+
+// evict drops the least recently used entries until the cache is within
+// its size limit. The caller holds c.lk.
+func (c *cache) evict() {
+	for c.size > c.max {
+		var lru *cacheEntry
+		for _, e := range c.entries {
+			if lru == nil || e.Used < lru.Used {
+				lru = e
+			}
+		}
+		if lru == nil {
+			return
+		}
+		c.remove(lru.Key)
+	}
+}
+
+// saveMeta writes the metadata of e. The caller holds c.lk.
+func (c *cache) saveMeta(e *cacheEntry) os.Error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.metaFile(e.Key), data, 0600)
+}
+
+// refresh records that the entry for key was revalidated, with the headers
+// of the 304 response
+func (c *cache) refresh(key string, header map[string]string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	for k, v := range header {
+		if respAllowHeader[k] && k != "Age" && k != "Warning" {
+			e.Header[k] = v
+		}
+	}
+	e.Stored = time.Nanoseconds()
+	c.saveMeta(e)
+}
+
+// commit adds the body in the file tmp as the entry for key
+func (c *cache) commit(key, tmp string, header map[string]string, size int64, private bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if size > c.max {
+		os.Remove(tmp)
+		return
+	}
+	c.remove(key)
+	now := time.Nanoseconds()
+	e := &cacheEntry{Key: key, Header: header, Size: size, Stored: now, Used: now, Private: private}
+	if err := os.Rename(tmp, c.bodyFile(key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err := c.saveMeta(e); err != nil {
+		os.Remove(c.bodyFile(key))
+		return
+	}
+	c.entries[key] = e
+	c.size += size
+	c.evict()
+}
+
+// cacheControl parses a Cache-Control header into its directives
+func cacheControl(s string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(s, ",", -1) {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if i := strings.Index(d, "="); i >= 0 {
+			cc[strings.ToLower(d[0:i])] = strings.Trim(d[i+1:], "\" ")
+		} else {
+			cc[strings.ToLower(d)] = ""
+		}
+	}
+	return cc
+}
+
+// lifetime returns how long, in ns, the entry is fresh after it was stored
+func (e *cacheEntry) lifetime() int64 {
+	cc := cacheControl(e.Header["Cache-Control"])
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if ma, ok := cc["max-age"]; ok {
+		n, err := strconv.Atoi64(ma)
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n * 1e9
+	}
+	if exp, ok := e.Header["Expires"]; ok {
+		t, err := time.Parse(httpTime, strings.TrimSpace(exp))
+		if err != nil {
+			return 0
+		}
+		return t.Seconds()*1e9 - e.Stored
+	}
+	if lm, ok := e.Header["Last-Modified"]; ok {
+		t, err := time.Parse(httpTime, strings.TrimSpace(lm))
+		if err != nil {
+			return 0
+		}
+		// a tenth of the time since it last changed
+		h := (e.Stored - t.Seconds()*1e9) / 10
+		if h > maxHeuristicAge {
+			h = maxHeuristicAge
+		}
+		return h
+	}
+	return 0
+}
+
+func (e *cacheEntry) fresh() bool {
+	return time.Nanoseconds()-e.Stored < e.lifetime()
+}
+
+func (e *cacheEntry) mustRevalidate() bool {
+	_, ok := cacheControl(e.Header["Cache-Control"])["must-revalidate"]
+	return ok
+}
+
+func (e *cacheEntry) mtime() int64 {
+	t, err := time.Parse(httpTime, strings.TrimSpace(e.Header["Last-Modified"]))
+	if err != nil {
+		return -1
+	}
+	return t.Seconds()
+}
+
+// cacheableReq returns true if req can be answered from the cache
+func cacheableReq(req *http.Request) bool {
+	if req.Method != "" && req.Method != "GET" {
+		return false
+	}
+	_, rng := req.Header["Range"]
+	cc := cacheControl(req.Header["Cache-Control"])
+	_, nostore := cc["no-store"]
+	return !rng && !nostore
+}
+
+// storable returns true if resp may be kept in the cache, for me if my is
+// set, or for everyone
+func storable(resp *http.Response, my bool) bool {
+	if resp.StatusCode != 200 {
+		return false
+	}
+	cc := cacheControl(resp.Header["Cache-Control"])
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok && !my {
+		return false
+	}
+	return true
+}
+
+// filler copies a response body into a temporary file as it is read, and
+// adds the file to the cache when the whole body has been read
+type filler struct {
+	body    io.ReadCloser
+	c       *cache
+	key     string
+	tmp     *os.File
+	header  map[string]string
+	private bool
+	n, want int64
+}
+
+func (f *filler) Read(p []byte) (int, os.Error) {
+	n, err := f.body.Read(p)
+	if f.tmp != nil && n > 0 {
+		if _, werr := f.tmp.Write(p[0:n]); werr != nil {
+			f.abort()
+		}
+		f.n += int64(n)
+	}
+	if err == os.EOF && f.tmp != nil {
+		name := f.tmp.Name()
+		f.tmp.Close()
+		f.tmp = nil
+		if f.want < 0 || f.n == f.want {
+			f.c.commit(f.key, name, f.header, f.n, f.private)
+		} else {
+			os.Remove(name)
+		}
+	}
+	return n, err
+}
+
+func (f *filler) abort() {
+	if f.tmp != nil {
+		f.tmp.Close()
+		os.Remove(f.tmp.Name())
+		f.tmp = nil
+	}
+}
+
+func (f *filler) Close() os.Error {
+	f.abort()
+	return f.body.Close()
+}
+
+// fill makes resp, fetched for key, be added to the cache as its body is
+// read
+func (c *cache) fill(key string, resp *http.Response, my bool) {
+	if resp.Body == nil {
+		return
+	}
+	c.lk.Lock()
+	max := c.max
+	c.lk.Unlock()
+	if max <= 0 || resp.ContentLength > max {
+		return
+	}
+	tmp, err := ioutil.TempFile(c.dir, "fill-")
+	if err != nil {
+		return
+	}
+	header := make(map[string]string)
+	for k, v := range resp.Header {
+		if respAllowHeader[k] && k != "Age" && k != "Warning" {
+			header[k] = v
+		}
+	}
+	_, private := cacheControl(resp.Header["Cache-Control"])["private"]
+	want := resp.ContentLength
+	if len(resp.TransferEncoding) > 0 {
+		want = -1
+	}
+	resp.Body = &filler{resp.Body, c, key, tmp, header, private, 0, want}
+}
+
+// serveCached answers req, which is for the vault of tid, from the cache if
+// it can, and otherwise forwards it, caching the response on the way back
+func (v *Vault0) serveCached(req *http.Request, my bool, tid sys.Id, fpath, query string) (*http.Response, os.Error) {
+	c := v.cache
+	if c == nil || !cacheableReq(req) {
+		return v.forward(req, my, tid)
+	}
+	key := cacheKey(tid, fpath, query)
+	e := c.get(key, my)
+	if e != nil && e.fresh() {
+		if resp := v.respondCached(req, e, ""); resp != nil {
+			return resp, nil
+		}
+		e = nil
+	}
+
+	// Revalidate a stale copy. The requester's own conditions are checked
+	// against the copy afterwards.
+	var inm, ims string
+	var hasInm, hasIms bool
+	if e != nil {
+		if req.Header == nil {
+			req.Header = make(map[string]string)
+		}
+		inm, hasInm = req.Header["If-None-Match"]
+		ims, hasIms = req.Header["If-Modified-Since"]
+		req.Header["If-None-Match"] = "", false
+		req.Header["If-Modified-Since"] = "", false
+		if etag, ok := e.Header["Etag"]; ok {
+			req.Header["If-None-Match"] = etag
+		}
+		if lm, ok := e.Header["Last-Modified"]; ok {
+			req.Header["If-Modified-Since"] = lm
+		}
+	}
+	resp, err := v.forward(req, my, tid)
+	if e != nil {
+		req.Header["If-None-Match"] = inm, hasInm
+		req.Header["If-Modified-Since"] = ims, hasIms
+		switch {
+		case err == nil && resp.StatusCode == 304:
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			c.refresh(key, resp.Header)
+			if r := v.respondCached(req, e, ""); r != nil {
+				return r, nil
+			}
+			return newRespServiceUnavailable(), os.ErrorString("service unavailable")
+		case (err != nil || resp.StatusCode == 503) && !e.mustRevalidate():
+			if r := v.respondCached(req, e, "110 - \"Response is stale\""); r != nil {
+				if resp != nil && resp.Body != nil {
+					resp.Body.Close()
+				}
+				return r, nil
+			}
+		}
+	}
+	if err == nil && storable(resp, my) {
+		c.fill(key, resp, my)
+	}
+	return resp, err
+}
+
+// respondCached builds a response from the cache entry e, or returns nil if
+// its body is gone. A non-empty warning is added as a Warning header.
+func (v *Vault0) respondCached(req *http.Request, e *cacheEntry, warning string) *http.Response {
+	var resp *http.Response
+	if notModified(req, e.Header["Etag"], e.mtime()) {
+		resp = newRespNotModified()
+	} else {
+		if v.fdlim.LockOrTimeout(10e9) != nil {
+			return nil
+		}
+		file, err := os.Open(v.cache.bodyFile(e.Key), os.O_RDONLY, 0)
+		if err != nil {
+			v.fdlim.Unlock()
+			return nil
+		}
+		body := http.NewRunOnClose(&fileBody{file, file}, func() { v.fdlim.Unlock() })
+		resp = buildRespFromBody(body, e.Size)
+		resp.Header = make(map[string]string)
+	}
+	for k, h := range e.Header {
+		resp.Header[k] = h
+	}
+	resp.Header["Age"] = strconv.Itoa64((time.Nanoseconds() - e.Stored) / 1e9)
+	if warning != "" {
+		resp.Header["Warning"] = warning
+	}
+	setRespVersion(resp)
+	setRespHop(resp, 0)
+	return resp
+}
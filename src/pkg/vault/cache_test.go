@@ -0,0 +1,149 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+)
+
+func TestLifetime(t *testing.T) {
+	now := time.Nanoseconds()
+	at := func(sec int64) string { return time.SecondsToUTC(sec).Format(httpTime) }
+	entry := func(k, v string) *cacheEntry {
+		return &cacheEntry{Header: map[string]string{k: v}, Stored: now}
+	}
+	if l := entry("Cache-Control", "public, max-age=60").lifetime(); l != 60e9 {
+		t.Errorf("max-age, got %d", l)
+	}
+	if l := entry("Cache-Control", "max-age=60, no-cache").lifetime(); l != 0 {
+		t.Errorf("no-cache, got %d", l)
+	}
+	if l := entry("Cache-Control", "max-age=x").lifetime(); l != 0 {
+		t.Errorf("bad max-age, got %d", l)
+	}
+	if !entry("Cache-Control", "max-age=60").fresh() {
+		t.Errorf("entry with max-age should be fresh")
+	}
+	if entry("Expires", at(now/1e9-10)).fresh() {
+		t.Errorf("entry past Expires should be stale")
+	}
+	if !entry("Expires", at(now/1e9+100)).fresh() {
+		t.Errorf("entry before Expires should be fresh")
+	}
+	l := entry("Last-Modified", at(now/1e9-1000)).lifetime()
+	if l < 99e9 || l > 101e9 {
+		t.Errorf("heuristic lifetime, got %d", l)
+	}
+	l = entry("Last-Modified", at(now/1e9-365*24*3600)).lifetime()
+	if l != maxHeuristicAge {
+		t.Errorf("heuristic lifetime is capped, got %d", l)
+	}
+	if entry("Etag", "\"1-2\"").fresh() {
+		t.Errorf("entry without expiration information should be stale")
+	}
+	if !entry("Cache-Control", "must-revalidate").mustRevalidate() {
+		t.Errorf("must-revalidate")
+	}
+}
+
+func TestStorable(t *testing.T) {
+	resp := func(code int, cc string) *http.Response {
+		return &http.Response{StatusCode: code, Header: map[string]string{"Cache-Control": cc}}
+	}
+	if !storable(resp(200, ""), false) {
+		t.Errorf("plain 200 is storable")
+	}
+	if storable(resp(206, ""), true) {
+		t.Errorf("206 is not storable")
+	}
+	if storable(resp(200, "no-store"), true) {
+		t.Errorf("no-store is not storable")
+	}
+	if !storable(resp(200, "private"), true) || storable(resp(200, "private"), false) {
+		t.Errorf("private is storable only for me")
+	}
+}
+
+// A listing of a public directory still leaves out what the requester may
+// not read, so no one else may be served a cached copy
+func TestListingNotStorable(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-listing-cache-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(path.Join(dir, "alice"), 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	ioutil.WriteFile(path.Join(dir, "alice", aclFile), []byte("friend "+sys.Id(2).Eye()+"\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, "public.txt"), []byte("x"), 0600)
+	v := &Vault0{id: 1, hdir: dir}
+
+	for _, q := range []string{"", "format=json"} {
+		resp, err := v.serveLocal(&http.Request{Method: "GET"}, "/", q, 2, 2)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("listing %q: %v", q, err)
+		}
+		if storable(resp, false) || !storable(resp, true) {
+			t.Errorf("listing %q is storable for everyone", q)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-cache-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	c, err := makeCache(dir)
+	if err != nil {
+		t.Fatalf("makeCache: %s", err)
+	}
+	c.setMax(25)
+	put := func(key string, private bool) {
+		tmp := path.Join(dir, "tmp")
+		if err := ioutil.WriteFile(tmp, []byte("0123456789"), 0600); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		c.commit(key, tmp, map[string]string{}, 10, private)
+	}
+	put("a", false)
+	put("b", true)
+	if c.get("b", false) != nil {
+		t.Errorf("private entry served to others")
+	}
+	if c.get("b", true) == nil {
+		t.Errorf("private entry not served to me")
+	}
+	c.get("a", false)
+	put("c", false) // evicts b, the least recently used
+	if c.get("b", true) != nil || c.get("a", false) == nil || c.get("c", false) == nil {
+		t.Errorf("wrong entry evicted")
+	}
+
+	// Entries survive a restart
+	c, err = makeCache(dir)
+	if err != nil {
+		t.Fatalf("makeCache: %s", err)
+	}
+	if c.get("a", false) == nil || c.size != 20 {
+		t.Errorf("entries lost on reload")
+	}
+}
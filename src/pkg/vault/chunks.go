@@ -0,0 +1,193 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"tonika/sys"
+)
+
+// The chunk store keeps the verified chunks of files fetched with
+// ServeVerified and ServeSwarm in the cache directory, named by their hash.
+// Identical chunks, whichever file or friend they came from, are kept and
+// fetched only once. Chunks of files that everyone may read are shared
+// with friends who ask for them (see swarm.go); the others, marked with
+// privateSuffix, are not. The least recently used chunks are evicted to
+// keep the store under its size limit, which is the same as the cache's.
+
+const privateSuffix = ".p"
+
+type chunkStore struct {
+	dir  string
+	max  int64
+	size int64
+	used map[string]int64 // file name -> last use, in ns
+	lk   sync.Mutex
+}
+
+func makeChunkStore(dir string) (*chunkStore, os.Error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &chunkStore{dir: dir, max: DefaultCacheSize, used: make(map[string]int64)}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !fi.IsRegular() {
+			continue
+		}
+		name := fi.Name
+		if strings.HasSuffix(name, privateSuffix) {
+			name = name[0 : len(name)-len(privateSuffix)]
+		}
+		if _, err := hex.DecodeString(name); err != nil {
+			// left over from an interrupted put
+			os.Remove(path.Join(dir, fi.Name))
+			continue
+		}
+		s.used[fi.Name] = fi.Mtime_ns
+		s.size += fi.Size
+	}
+	s.evict()
+	return s, nil
+}
+
+func (s *chunkStore) setMax(max int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.max = max
+	s.evict()
+}
+
+// chunkNames returns the file names a chunk may be stored under, the shared
+// one first
+func chunkNames(sum []byte, sharedOnly bool) []string {
+	name := hex.EncodeToString(sum)
+	if sharedOnly {
+		return []string{name}
+	}
+	return []string{name, name + privateSuffix}
+}
+
+// get returns the chunk with the given hash, or nil if it is not stored.
+// If sharedOnly is set, only a chunk that may be shared is returned.
+func (s *chunkStore) get(sum []byte, sharedOnly bool) []byte {
+	for _, name := range chunkNames(sum, sharedOnly) {
+		s.lk.Lock()
+		_, ok := s.used[name]
+		s.lk.Unlock()
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(s.dir, name))
+		s.lk.Lock()
+		if err != nil || !bytes.Equal(sys.HashChunk(data), sum) {
+			s.remove(name)
+			s.lk.Unlock()
+			continue
+		}
+		if _, ok := s.used[name]; ok {
+			s.used[name] = time.Nanoseconds()
+		}
+		s.lk.Unlock()
+		return data
+	}
+	return nil
+}
+
+// has returns true if the chunk with the given hash is stored. If
+// sharedOnly is set, only chunks that may be shared count.
+func (s *chunkStore) has(sum []byte, sharedOnly bool) bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, name := range chunkNames(sum, sharedOnly) {
+		if _, ok := s.used[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// put stores data, which has been verified to have the given hash. Once a
+// chunk is stored as shared, it stays shared.
+func (s *chunkStore) put(sum, data []byte, shared bool) {
+	names := chunkNames(sum, false)
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, ok := s.used[names[0]]; ok || int64(len(data)) > s.max {
+		return
+	}
+	if _, ok := s.used[names[1]]; ok {
+		if !shared {
+			return
+		}
+		s.remove(names[1])
+	}
+	name := names[0]
+	if !shared {
+		name = names[1]
+	}
+	tmp := path.Join(s.dir, "put-"+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, path.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	s.used[name] = time.Nanoseconds()
+	s.size += int64(len(data))
+	s.evict()
+}
+
+// remove drops a chunk. The caller holds s.lk.
+func (s *chunkStore) remove(name string) {
+	if _, ok := s.used[name]; !ok {
+		return
+	}
+	full := path.Join(s.dir, name)
+	if fi, err := os.Stat(full); err == nil {
+		s.size -= fi.Size
+	}
+	os.Remove(full)
+	s.used[name] = 0, false
+}
+
+// evict drops the least recently used chunks until the store is within its
+// size limit. The caller holds s.lk.
+func (s *chunkStore) evict() {
+	for s.size > s.max && len(s.used) > 0 {
+		var lru string
+		var at int64
+		for name, t := range s.used {
+			if lru == "" || t < at {
+				lru, at = name, t
+			}
+		}
+		s.remove(lru)
+	}
+}
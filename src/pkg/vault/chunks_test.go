@@ -0,0 +1,79 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+func TestChunkStore(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-chunks-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	s, err := makeChunkStore(dir)
+	if err != nil {
+		t.Fatalf("makeChunkStore: %s", err)
+	}
+	s.setMax(25)
+	a, b, c := []byte("aaaaaaaaaa"), []byte("bbbbbbbbbb"), []byte("cccccccccc")
+	ha, hb, hc := sys.HashChunk(a), sys.HashChunk(b), sys.HashChunk(c)
+	s.put(ha, a, true)
+	s.put(hb, b, true)
+	if !bytes.Equal(s.get(ha, false), a) {
+		t.Errorf("chunk a not stored")
+	}
+	s.put(hc, c, true) // evicts b, the least recently used
+	if s.has(hb, false) || !s.has(ha, false) || !s.has(hc, false) {
+		t.Errorf("wrong chunk evicted")
+	}
+
+	// A damaged chunk is dropped
+	if err := ioutil.WriteFile(path.Join(s.dir, hex.EncodeToString(hc)), []byte("damaged"), 0600); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if s.get(hc, false) != nil || s.has(hc, false) {
+		t.Errorf("damaged chunk served")
+	}
+
+	// Private chunks are not shared, until stored as shared
+	s.setMax(100)
+	p := []byte("pppppppppp")
+	hp := sys.HashChunk(p)
+	s.put(hp, p, false)
+	if !s.has(hp, false) || s.has(hp, true) || s.get(hp, true) != nil {
+		t.Errorf("private chunk shared")
+	}
+	s.put(hp, p, true)
+	if !bytes.Equal(s.get(hp, true), p) {
+		t.Errorf("chunk not shared")
+	}
+
+	// Chunks survive a restart
+	s, err = makeChunkStore(dir)
+	if err != nil {
+		t.Fatalf("makeChunkStore: %s", err)
+	}
+	if !bytes.Equal(s.get(ha, false), a) {
+		t.Errorf("chunk a lost on reload")
+	}
+}
@@ -0,0 +1,55 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"tonika/http"
+)
+
+// fileETag returns a strong entity tag for the file fi. It changes whenever
+// the file's size or modification time does.
+func fileETag(fi *os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", fi.Size, fi.Mtime_ns)
+}
+
+// notModified returns true if the conditional headers of req say that the
+// requester's copy, with entity tag etag and modified at mtime seconds, is
+// current. If-None-Match takes precedence over If-Modified-Since.
+func notModified(req *http.Request, etag string, mtime int64) bool {
+	if inm, ok := req.Header["If-None-Match"]; ok {
+		for _, t := range strings.Split(inm, ",", -1) {
+			t = strings.TrimSpace(t)
+			if strings.HasPrefix(t, "W/") {
+				t = t[2:]
+			}
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, ok := req.Header["If-Modified-Since"]; ok {
+		t, err := time.Parse(httpTime, strings.TrimSpace(ims))
+		return err == nil && mtime <= t.Seconds()
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"testing"
+	"time"
+	"tonika/http"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := "\"10-abc\""
+	mtime := int64(1280000000)
+	at := func(sec int64) string { return time.SecondsToUTC(sec).Format(httpTime) }
+	req := func(k, v string) *http.Request {
+		return &http.Request{Header: map[string]string{k: v}}
+	}
+	if !notModified(req("If-None-Match", "\"x\", "+etag), etag, mtime) {
+		t.Errorf("If-None-Match with matching tag")
+	}
+	if !notModified(req("If-None-Match", "W/"+etag), etag, mtime) {
+		t.Errorf("If-None-Match with weak tag")
+	}
+	if notModified(req("If-None-Match", "\"x\""), etag, mtime) {
+		t.Errorf("If-None-Match with other tag")
+	}
+	if !notModified(req("If-Modified-Since", at(mtime)), etag, mtime) {
+		t.Errorf("If-Modified-Since at mtime")
+	}
+	if notModified(req("If-Modified-Since", at(mtime-1)), etag, mtime) {
+		t.Errorf("If-Modified-Since before mtime")
+	}
+	if notModified(&http.Request{}, etag, mtime) {
+		t.Errorf("unconditional request")
+	}
+}
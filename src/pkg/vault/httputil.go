@@ -56,14 +56,48 @@ func parseURL(req *http.Request) (tid sys.Id, path, query string, err os.Error)
 
 // Sanitize
 
+// Headers of vault responses that are passed on to the browser. The rest,
+// including the Vault-* headers, are dropped.
+var respAllowHeader = map[string]bool{
+	"Accept-Ranges":    true,
+	"Age":              true,
+	"Cache-Control":    true,
+	"Content-Encoding": true,
+	"Content-Range":    true,
+	"Content-Type":     true,
+	"Date":             true,
+	"Etag":             true,
+	"Expires":          true,
+	"Last-Modified":    true,
+	"Warning":          true,
+}
+
+// setPrivate marks resp as meant for one requester only, which keeps it out
+// of the caches of the vaults that forward it
+func setPrivate(resp *http.Response) {
+	if resp.Header == nil {
+		resp.Header = make(map[string]string)
+	}
+	resp.Header["Cache-Control"] = "private"
+}
+
 func sanitizeResp(resp *http.Response) {
 	if resp.Header == nil {
 		return
 	}
-	resp.Header["Vault-Build"] = "", false
-	resp.Header["Vault-Proto"] = "", false
-	resp.Header["Vault-Hop"] = "", false
-	resp.Header["Vault-Origin"] = "", false
+	for k, _ := range resp.Header {
+		if !respAllowHeader[k] {
+			resp.Header[k] = "", false
+		}
+	}
+}
+
+// discardBody closes the body of req, if any
+func discardBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+		req.Body = nil
+	}
 }
 
 // Version
@@ -160,6 +194,24 @@ func loadTmpl(tdir, name string) (tmpl *template.Template, err os.Error) {
 }
 
 var (
+	// Bad gateway
+	htmlErrBadGateway = "<html>" +
+		"<head><title>502 Bad Gateway</title></head>\n" +
+		"<body bgcolor=\"white\">\n" +
+		"<center><h1>502 Bad Gateway</h1></center>\n" +
+		"<hr><center>"+sys.Name+" Front End</center>\n" +
+		"</body></html>"
+	respErrBadGateway = &http.Response{
+		Status: "Bad Gateway",
+		StatusCode: 502,
+		Proto: "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		RequestMethod: "GET",
+		Body: http.StringToBody(htmlErrBadGateway),
+		ContentLength: int64(len(htmlErrBadGateway)),
+		Close: false,
+	}
 	// Service unavailable
 	htmlErrServiceUnavailable = "<html>" +
 		"<head><title>503 Service Unavailable</title></head>\n" +
@@ -196,6 +248,42 @@ var (
 		ContentLength: int64(len(htmlErrNotFound)),
 		Close: false,
 	}
+	// Forbidden
+	htmlErrForbidden = "<html>" +
+		"<head><title>403 Forbidden</title></head>\n" +
+		"<body bgcolor=\"white\">\n" +
+		"<center><h1>403 Forbidden</h1></center>\n" +
+		"<hr><center>"+sys.Name+" Front End</center>\n" +
+		"</body></html>"
+	respErrForbidden = &http.Response{
+		Status:        "Forbidden",
+		StatusCode:    403,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		RequestMethod: "GET",
+		Body:          http.StringToBody(htmlErrForbidden),
+		ContentLength: int64(len(htmlErrForbidden)),
+		Close:         false,
+	}
+	// Range not satisfiable
+	htmlErrRangeNotSatisfiable = "<html>" +
+		"<head><title>416 Requested Range Not Satisfiable</title></head>\n" +
+		"<body bgcolor=\"white\">\n" +
+		"<center><h1>416 Requested Range Not Satisfiable</h1></center>\n" +
+		"<hr><center>"+sys.Name+" Front End</center>\n" +
+		"</body></html>"
+	respErrRangeNotSatisfiable = &http.Response{
+		Status:        "Requested Range Not Satisfiable",
+		StatusCode:    416,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		RequestMethod: "GET",
+		Body:          http.StringToBody(htmlErrRangeNotSatisfiable),
+		ContentLength: int64(len(htmlErrRangeNotSatisfiable)),
+		Close:         false,
+	}
 	// Bad request
 	htmlErrBadRequest = "<html>" +
 		"<head><title>400 Bad Request</title></head>\n" +
@@ -214,6 +302,53 @@ var (
 		ContentLength: int64(len(htmlErrBadRequest)),
 		Close:         false,
 	}
+	// Method not allowed
+	htmlErrMethodNotAllowed = "<html>" +
+		"<head><title>405 Method Not Allowed</title></head>\n" +
+		"<body bgcolor=\"white\">\n" +
+		"<center><h1>405 Method Not Allowed</h1></center>\n" +
+		"<hr><center>"+sys.Name+" Front End</center>\n" +
+		"</body></html>"
+	respErrMethodNotAllowed = &http.Response{
+		Status:        "Method Not Allowed",
+		StatusCode:    405,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		RequestMethod: "GET",
+		Body:          http.StringToBody(htmlErrMethodNotAllowed),
+		ContentLength: int64(len(htmlErrMethodNotAllowed)),
+		Close:         false,
+	}
+	// Request entity too large
+	htmlErrTooLarge = "<html>" +
+		"<head><title>413 Request Entity Too Large</title></head>\n" +
+		"<body bgcolor=\"white\">\n" +
+		"<center><h1>413 Request Entity Too Large</h1></center>\n" +
+		"<hr><center>"+sys.Name+" Front End</center>\n" +
+		"</body></html>"
+	respErrTooLarge = &http.Response{
+		Status:        "Request Entity Too Large",
+		StatusCode:    413,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		RequestMethod: "GET",
+		Body:          http.StringToBody(htmlErrTooLarge),
+		ContentLength: int64(len(htmlErrTooLarge)),
+		Close:         false,
+	}
+	// Not modified
+	respNotModified = &http.Response{
+		Status:        "Not Modified",
+		StatusCode:    304,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		RequestMethod: "GET",
+		ContentLength: 0,
+		Close:         false,
+	}
 	// OK
 	respOK = &http.Response{
 		Status: "OK",
@@ -229,7 +364,7 @@ var (
 
 func statusCodeSupported(code int) bool {
 	switch code {
-	case 200,400,404,503:
+	case 200,201,206,304,400,403,404,405,413,416,503:
 		return true
 	default:
 		return false
@@ -237,6 +372,16 @@ func statusCodeSupported(code int) bool {
 	panic("unreach")
 }
 
+func newRespBadGateway() *http.Response {
+	blk.Lock()
+	defer blk.Unlock()
+	r, err := http.DupResp(respErrBadGateway)
+	if err != nil {
+		panic("v")
+	}
+	return r
+}
+
 func newRespServiceUnavailable() *http.Response {
 	blk.Lock()
 	defer blk.Unlock()
@@ -257,6 +402,57 @@ func newRespBadRequest() *http.Response {
 	return r
 }
 
+func newRespForbidden() *http.Response {
+	blk.Lock()
+	defer blk.Unlock()
+	r, err := http.DupResp(respErrForbidden)
+	if err != nil {
+		panic("v")
+	}
+	return r
+}
+
+func newRespMethodNotAllowed() *http.Response {
+	blk.Lock()
+	defer blk.Unlock()
+	r, err := http.DupResp(respErrMethodNotAllowed)
+	if err != nil {
+		panic("v")
+	}
+	return r
+}
+
+func newRespTooLarge() *http.Response {
+	blk.Lock()
+	defer blk.Unlock()
+	r, err := http.DupResp(respErrTooLarge)
+	if err != nil {
+		panic("v")
+	}
+	return r
+}
+
+func newRespNotModified() *http.Response {
+	blk.Lock()
+	defer blk.Unlock()
+	r, err := http.DupResp(respNotModified)
+	if err != nil {
+		panic("v")
+	}
+	r.Header = make(map[string]string)
+	return r
+}
+
+func newRespRangeNotSatisfiable() *http.Response {
+	blk.Lock()
+	defer blk.Unlock()
+	r, err := http.DupResp(respErrRangeNotSatisfiable)
+	if err != nil {
+		panic("v")
+	}
+	return r
+}
+
 func newRespNotFound() *http.Response {
 	blk.Lock()
 	defer blk.Unlock()
@@ -296,6 +492,26 @@ func buildRespFromBody(body io.ReadCloser, bodylen int64) *http.Response {
 	return resp
 }
 
+// buildPartialResp is like buildRespFromBody, but with status 206 Partial
+// Content
+func buildPartialResp(body io.ReadCloser, bodylen int64) *http.Response {
+	resp := buildRespFromBody(body, bodylen)
+	resp.Status = "Partial Content"
+	resp.StatusCode = 206
+	if resp.Header == nil {
+		resp.Header = make(map[string]string)
+	}
+	return resp
+}
+
+// buildCreatedResp is like buildResp, but with status 201 Created
+func buildCreatedResp(html string) *http.Response {
+	resp := buildResp(html)
+	resp.Status = "Created"
+	resp.StatusCode = 201
+	return resp
+}
+
 func newRespUnsupported() *http.Response {
 	return buildResp("Your friend uses a newer (unsupported) software. Please update.")
 }
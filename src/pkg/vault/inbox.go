@@ -0,0 +1,408 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"template"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// Friends in the group set with SetInbox may upload files into the inbox, a
+// folder of the home directory. A file is either PUT to /<inbox>/<name>,
+// or POSTed as multipart/form-data to /<inbox>/, which is what the upload
+// form served there does. Uploads are streamed through the vaults along the
+// way. Each sender gets a folder, named after their Id, inside the inbox,
+// and the files in it may not add up to more than the quota. Nobody but me
+// can read the inbox.
+
+// DefaultInboxQuota is the number of bytes each friend may upload, unless
+// changed with SetInbox
+const DefaultInboxQuota = 100 * 1024 * 1024
+
+// Files are received under a name with this prefix, and renamed when
+// complete
+const inboxPartPrefix = ".part-"
+
+const maxInboxName = 128
+
+var errTooLarge = os.ErrorString("upload exceeds quota")
+
+type inboxConfig struct {
+	dir   string // relative to the home directory, empty if uploads are off
+	group string
+	quota int64
+}
+
+// InboxFile is a file received into the inbox
+type InboxFile struct {
+	Sender sys.Id
+	Name   string
+	Path   string // relative to the home directory
+	Size   int64
+	Mtime  int64 // in seconds
+}
+
+// SetInbox lets the members of group upload into dir, a folder of the home
+// directory, up to quota bytes each. An empty dir or group turns uploads
+// off.
+func (v *Vault0) SetInbox(dir, group string, quota int64) os.Error {
+	if dir != "" {
+		dir = path.Clean(dir)
+		if dir == "." || dir[0] == '/' || dir == ".." || strings.HasPrefix(dir, "../") {
+			return os.ErrorString("Bad inbox directory")
+		}
+	}
+	if quota < 0 {
+		return os.ErrorString("Bad inbox quota")
+	}
+	v.lk.Lock()
+	v.inbox = inboxConfig{dir, group, quota}
+	v.lk.Unlock()
+	return nil
+}
+
+func (v *Vault0) getInbox() inboxConfig {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	return v.inbox
+}
+
+// inInbox returns true if fpath, relative to the home directory, is inside
+// the inbox, along with the rest of fpath below the inbox
+func (v *Vault0) inInbox(fpath string) (rest string, ok bool) {
+	in := v.getInbox()
+	if in.dir == "" {
+		return "", false
+	}
+	fpath = path.Clean(fpath)
+	if len(fpath) > 0 && fpath[0] == '/' {
+		fpath = fpath[1:]
+	}
+	if fpath == in.dir {
+		return "", true
+	}
+	if strings.HasPrefix(fpath, in.dir+"/") {
+		return fpath[len(in.dir)+1:], true
+	}
+	return "", false
+}
+
+// mayUpload returns true if origin may upload, with the request handed to
+// us by peer. As with reading (see canRead), a forwarding peer must be
+// allowed as well.
+func (v *Vault0) mayUpload(origin, peer sys.Id) bool {
+	in := v.getInbox()
+	g := v.getGroups()
+	if in.group == "" || g == nil || origin == v.id {
+		return false
+	}
+	return g.InGroup(origin, in.group) && (peer == origin || g.InGroup(peer, in.group))
+}
+
+// sanitizeName turns the name of an uploaded file into one that is safe to
+// use in the inbox, or returns "" if nothing is left of it
+func sanitizeName(name string) string {
+	// Some browsers send the full path of the file
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	r := []int(strings.TrimSpace(name))
+	for i, c := range r {
+		if c < ' ' || c == 0x7f || strings.IndexRune("/\\:*?\"<>|", c) >= 0 {
+			r[i] = '_'
+		}
+	}
+	// No hidden files, which also rules out "." and ".."
+	for len(r) > 0 && r[0] == '.' {
+		r = r[1:]
+	}
+	if len(r) > maxInboxName {
+		r = r[0:maxInboxName]
+	}
+	return string(r)
+}
+
+// uniqueName returns name, or name with a number added before its
+// extension, so that it does not name an existing file in dir
+func uniqueName(dir, name string) string {
+	if _, err := os.Lstat(path.Join(dir, name)); err != nil {
+		return name
+	}
+	ext := path.Ext(name)
+	base := name[0 : len(name)-len(ext)]
+	for i := 1; ; i++ {
+		n := base + "-" + strconv.Itoa(i) + ext
+		if _, err := os.Lstat(path.Join(dir, n)); err != nil {
+			return n
+		}
+	}
+	panic("unreach")
+}
+
+// usage returns the total size of the files in dir
+func usage(dir string) int64 {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var n int64
+	for _, fi := range fis {
+		if fi.IsRegular() {
+			n += fi.Size
+		}
+	}
+	return n
+}
+
+// receive saves the file read from r as name in dir, unless it is longer
+// than room bytes. It returns the name the file was saved under.
+func (v *Vault0) receive(dir, name string, r io.Reader, room int64) (string, int64, os.Error) {
+	if v.fdlim.LockOrTimeout(10e9) != nil {
+		v.reportError(os.ErrorString("file descriptor starvation"))
+		return "", 0, os.ErrorString("service unavailable")
+	}
+	defer v.fdlim.Unlock()
+	f, err := ioutil.TempFile(dir, inboxPartPrefix)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.Copyn(f, r, room+1)
+	f.Close()
+	if err == os.EOF {
+		err = nil
+	}
+	if err == nil && n > room {
+		err = errTooLarge
+	}
+	if err == nil {
+		name = uniqueName(dir, name)
+		err = os.Rename(f.Name(), path.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", n, err
+	}
+	return name, n, nil
+}
+
+// serveInbox answers the request of origin for rest, a path inside the
+// inbox. Requests for the inbox itself get the upload form, PUTs of a file
+// name and POSTs to the inbox itself upload.
+func (v *Vault0) serveInbox(req *http.Request, rest string, origin, peer sys.Id) (*http.Response, os.Error) {
+	defer discardBody(req)
+	if !v.mayUpload(origin, peer) {
+		v.log().With(origin).Infof("Denied upload (via %s)", peer.Eye())
+		return newRespForbidden(), os.ErrorString("forbidden")
+	}
+	in := v.getInbox()
+	dir := path.Join(v.getHomeDir(), in.dir, origin.Eye())
+
+	switch req.Method {
+	case "", "GET", "HEAD":
+		if rest != "" {
+			return newRespForbidden(), os.ErrorString("forbidden")
+		}
+		resp := buildResp(inboxForm(dir, in.quota))
+		setPrivate(resp)
+		return resp, nil
+	case "PUT", "POST":
+	default:
+		return newRespMethodNotAllowed(), os.ErrorString("method not allowed")
+	}
+
+	// One upload at a time per sender, so that the quota holds
+	v.lk.Lock()
+	if v.uploading[origin] {
+		v.lk.Unlock()
+		return newRespServiceUnavailable(), os.ErrorString("upload in progress")
+	}
+	v.uploading[origin] = true
+	v.lk.Unlock()
+	defer func() {
+		v.lk.Lock()
+		v.uploading[origin] = false, false
+		v.lk.Unlock()
+	}()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		v.reportError(err)
+		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
+	}
+	room := in.quota - usage(dir)
+	if req.ContentLength > room {
+		return newRespTooLarge(), errTooLarge
+	}
+	body := req.Body
+	if body == nil {
+		body = http.StringToBody("")
+	}
+
+	var got bytes.Buffer
+	var err os.Error
+	if req.Method == "PUT" {
+		name := sanitizeName(rest)
+		if name == "" || strings.Index(rest, "/") >= 0 {
+			return newRespBadRequest(), os.ErrorString("bad file name")
+		}
+		name, _, err = v.receiveLogged(dir, name, body, room, origin, &got)
+	} else {
+		boundary := http.MultipartBoundary(req.Header["Content-Type"])
+		if rest != "" || boundary == "" {
+			return newRespBadRequest(), os.ErrorString("bad request")
+		}
+		mr := http.NewMultipartReader(body, boundary)
+		for {
+			p, perr := mr.NextPart()
+			if perr == os.EOF {
+				break
+			}
+			if perr != nil {
+				err = perr
+				break
+			}
+			name := sanitizeName(p.FileName())
+			if name == "" {
+				continue
+			}
+			var n int64
+			_, n, err = v.receiveLogged(dir, name, p, room, origin, &got)
+			if err != nil {
+				break
+			}
+			room -= n
+		}
+	}
+	switch {
+	case err == errTooLarge:
+		return newRespTooLarge(), err
+	case err != nil:
+		return newRespBadRequest(), err
+	}
+	return buildCreatedResp(inboxReceived(got.String())), nil
+}
+
+// receiveLogged is receive, which also logs the file and adds it to the
+// list of received files in got
+func (v *Vault0) receiveLogged(dir, name string, r io.Reader, room int64,
+	origin sys.Id, got *bytes.Buffer) (string, int64, os.Error) {
+
+	saved, n, err := v.receive(dir, name, r, room)
+	if err != nil {
+		v.log().With(origin).Warnf("Upload of %s failed: %s", name, err)
+		return saved, n, err
+	}
+	v.log().With(origin).Infof("Received %s, %d bytes", saved, n)
+	got.WriteString("<li>")
+	template.HTMLEscape(got, []byte(saved))
+	fmt.Fprintf(got, " (%d bytes)</li>\n", n)
+	return saved, n, nil
+}
+
+// inboxForm returns the upload form, with the files already received in
+// dir and what is left of the quota
+func inboxForm(dir string, quota int64) string {
+	var w bytes.Buffer
+	w.WriteString("<html>\n<head><title>Upload</title></head>\n<body bgcolor=\"white\">\n")
+	w.WriteString("<h1>Upload</h1>\n")
+	fmt.Fprintf(&w, "<p>You have sent %d of %d bytes.</p>\n", usage(dir), quota)
+	fis, _ := ioutil.ReadDir(dir)
+	if len(fis) > 0 {
+		w.WriteString("<ul>\n")
+		for _, fi := range fis {
+			if !fi.IsRegular() || strings.HasPrefix(fi.Name, ".") {
+				continue
+			}
+			w.WriteString("<li>")
+			template.HTMLEscape(&w, []byte(fi.Name))
+			fmt.Fprintf(&w, " (%d bytes)</li>\n", fi.Size)
+		}
+		w.WriteString("</ul>\n")
+	}
+	w.WriteString("<form method=\"post\" action=\"\" enctype=\"multipart/form-data\">\n" +
+		"<input type=\"file\" name=\"file\" multiple />\n" +
+		"<input type=\"submit\" value=\"Upload\" />\n</form>\n")
+	w.WriteString("<hr><center>" + sys.Name + " Vault</center>\n</body></html>")
+	return w.String()
+}
+
+func inboxReceived(list string) string {
+	return "<html>\n<head><title>Upload</title></head>\n<body bgcolor=\"white\">\n" +
+		"<h1>Received</h1>\n<ul>\n" + list + "</ul>\n" +
+		"<p><a href=\"\">Upload more</a></p>\n" +
+		"<hr><center>" + sys.Name + " Vault</center>\n</body></html>"
+}
+
+// Inbox returns the files received into the inbox, by sender
+func (v *Vault0) Inbox() ([]*InboxFile, os.Error) {
+	in := v.getInbox()
+	if in.dir == "" {
+		return nil, nil
+	}
+	root := path.Join(v.getHomeDir(), in.dir)
+	if !isDirectory(root) {
+		return nil, nil
+	}
+	senders, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*InboxFile, 0, 16)
+	for _, sfi := range senders {
+		if !sfi.IsDirectory() {
+			continue
+		}
+		sender, err := sys.ParseId(sfi.Name)
+		if err != nil {
+			continue
+		}
+		fis, err := ioutil.ReadDir(path.Join(root, sfi.Name))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !fi.IsRegular() || strings.HasPrefix(fi.Name, ".") {
+				continue
+			}
+			if len(r) == cap(r) {
+				r1 := make([]*InboxFile, len(r), 2*cap(r))
+				copy(r1, r)
+				r = r1
+			}
+			r = r[0 : len(r)+1]
+			r[len(r)-1] = &InboxFile{
+				Sender: sender,
+				Name:   fi.Name,
+				Path:   path.Join(in.dir, sfi.Name, fi.Name),
+				Size:   fi.Size,
+				Mtime:  fi.Mtime_ns / 1e9,
+			}
+		}
+	}
+	return r, nil
+}
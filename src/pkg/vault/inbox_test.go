@@ -0,0 +1,107 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"tonika/sys"
+)
+
+type nameTest struct {
+	in, out string
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []nameTest{
+		nameTest{"photo.jpg", "photo.jpg"},
+		nameTest{"C:\\Users\\me\\photo.jpg", "photo.jpg"},
+		nameTest{"../../etc/passwd", "passwd"},
+		nameTest{"..", ""},
+		nameTest{".hidden", "hidden"},
+		nameTest{" a:b*c?.txt ", "a_b_c_.txt"},
+		nameTest{"tab\there", "tab_here"},
+		nameTest{"", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeName(tt.in); got != tt.out {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+	if got := sanitizeName(strings.Repeat("x", 500)); len(got) != maxInboxName {
+		t.Errorf("long name kept %d characters", len(got))
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-inbox-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if n := uniqueName(dir, "a.txt"); n != "a.txt" {
+		t.Errorf("got %q for a new name", n)
+	}
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("1"), 0600)
+	ioutil.WriteFile(path.Join(dir, "a-1.txt"), []byte("22"), 0600)
+	if n := uniqueName(dir, "a.txt"); n != "a-2.txt" {
+		t.Errorf("got %q for a taken name", n)
+	}
+	if n := usage(dir); n != 3 {
+		t.Errorf("usage is %d, want 3", n)
+	}
+}
+
+func TestInInbox(t *testing.T) {
+	v := &Vault0{id: sys.Id(1)}
+	if _, ok := v.inInbox("inbox/x"); ok {
+		t.Errorf("uploads are off without an inbox")
+	}
+	if err := v.SetInbox("../up", "upload", 10); err == nil {
+		t.Errorf("inbox outside the home directory accepted")
+	}
+	v.SetInbox("inbox", "upload", 10)
+	if rest, ok := v.inInbox("/inbox"); !ok || rest != "" {
+		t.Errorf("inbox itself: %q %v", rest, ok)
+	}
+	if rest, ok := v.inInbox("inbox/x/y"); !ok || rest != "x/y" {
+		t.Errorf("inside the inbox: %q %v", rest, ok)
+	}
+	if _, ok := v.inInbox("inboxes/x"); ok {
+		t.Errorf("inboxes is not the inbox")
+	}
+
+	a, b := makeTestFriend("Alice"), makeTestFriend("Bob")
+	alice, bob := *a.GetId(), *b.GetId()
+	v.SetNeighbors(testNeighbors{a, b})
+	v.SetGroups(testFpGroups{"upload": a.GetFingerprint()})
+	if !v.mayUpload(alice, alice) || v.mayUpload(bob, bob) || v.mayUpload(alice, bob) {
+		t.Errorf("wrong upload rights")
+	}
+
+	// Membership goes with the key, not the short Id
+	c := makeTestFriend("Carol")
+	c.Id = &alice
+	v.SetNeighbors(testNeighbors{c, b})
+	if v.mayUpload(alice, alice) {
+		t.Errorf("upload allowed to another key with the same Id")
+	}
+}
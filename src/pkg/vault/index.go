@@ -0,0 +1,336 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tonika/http"
+	"unicode"
+)
+
+// The index lists the files of the home directory by the words in their
+// names and, for text files, in their content. It is rebuilt every
+// indexRefresh, re-reading only the files that changed. Hidden files, the
+// inbox and folders holding a ".tonika-nolist" file are left out, so that
+// searches reveal no more than listings do. Scans take their file
+// descriptors from the vault's limit, like requests do.
+
+const (
+	indexRefresh = 5 * 60e9 // ns between scans of the home directory
+	maxIndexText = 1 << 20  // bytes of a file read for words
+	maxIndexDocs = 100000   // files indexed
+	maxWordLen   = 40
+	nameWeight   = 10   // a word in the name counts as much as ten in the text
+	textSniff    = 1024 // bytes looked at to tell text from binary
+	maxPrefixed  = 1000 // words of the index matched by one word of a search
+)
+
+type indexDoc struct {
+	path  string
+	size  int64
+	mtime int64          // ns
+	words map[string]int // weighted count of each word
+}
+
+type index struct {
+	docs  map[string]*indexDoc  // by path
+	words map[string][]*indexDoc // docs holding each word
+	fdlim *http.FDLimiter
+	lk    sync.Mutex
+}
+
+func makeIndex(fdlim *http.FDLimiter) *index {
+	return &index{
+		docs:  make(map[string]*indexDoc),
+		words: make(map[string][]*indexDoc),
+		fdlim: fdlim,
+	}
+}
+
+// indexLoop keeps the index of the home directory up to date
+func (v *Vault0) indexLoop() {
+	for v.isHealthy() != nil {
+		v.index.scan(v.getHomeDir(), v.indexable)
+		time.Sleep(indexRefresh)
+	}
+}
+
+// indexable returns true if fpath, relative to the home directory, may be
+// indexed. The inbox is mine alone.
+func (v *Vault0) indexable(fpath string) bool {
+	_, ok := v.inInbox(fpath)
+	return !ok
+}
+
+// scan rebuilds the index from the files under hdir, for which include
+// returns true
+func (x *index) scan(hdir string, include func(fpath string) bool) {
+	x.lk.Lock()
+	old := x.docs
+	x.lk.Unlock()
+	docs := make(map[string]*indexDoc)
+	x.scanDir(hdir, ".", include, old, docs)
+	words := make(map[string][]*indexDoc)
+	for _, d := range docs {
+		for w, _ := range d.words {
+			words[w] = appendDoc(words[w], d)
+		}
+	}
+	x.lk.Lock()
+	x.docs, x.words = docs, words
+	x.lk.Unlock()
+}
+
+func appendDoc(l []*indexDoc, d *indexDoc) []*indexDoc {
+	if len(l) == cap(l) {
+		l1 := make([]*indexDoc, len(l), 2*cap(l)+1)
+		copy(l1, l)
+		l = l1
+	}
+	l = l[0 : len(l)+1]
+	l[len(l)-1] = d
+	return l
+}
+
+func (x *index) scanDir(hdir, dir string, include func(string) bool, old, docs map[string]*indexDoc) {
+	full := path.Join(hdir, dir)
+	if isFile(path.Join(full, noListFile)) {
+		return
+	}
+	x.fdlim.Lock()
+	d, err := os.Open(full, os.O_RDONLY, 0)
+	if err != nil {
+		x.fdlim.Unlock()
+		return
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	x.fdlim.Unlock()
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if len(docs) >= maxIndexDocs {
+			return
+		}
+		fpath := path.Join(dir, fi.Name)
+		if strings.HasPrefix(fi.Name, ".") || !include(fpath) {
+			continue
+		}
+		switch {
+		case fi.IsDirectory():
+			x.scanDir(hdir, fpath, include, old, docs)
+		case fi.IsRegular():
+			if o, ok := old[fpath]; ok && o.size == fi.Size && o.mtime == fi.Mtime_ns {
+				docs[fpath] = o
+				continue
+			}
+			x.fdlim.Lock()
+			docs[fpath] = indexFile(path.Join(hdir, fpath), fpath, fi)
+			x.fdlim.Unlock()
+		}
+	}
+}
+
+// indexFile reads the words of the file full. Only the start of a file is
+// read, unless it looks like text.
+func indexFile(full, fpath string, fi *os.FileInfo) *indexDoc {
+	d := &indexDoc{path: fpath, size: fi.Size, mtime: fi.Mtime_ns, words: make(map[string]int)}
+	for _, w := range splitWords(path.Base(fpath)) {
+		d.words[w] += nameWeight
+	}
+	f, err := os.Open(full, os.O_RDONLY, 0)
+	if err != nil {
+		return d
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	_, err = io.Copyn(&buf, f, textSniff)
+	if err == nil && isText(buf.Bytes()) {
+		_, err = io.Copyn(&buf, f, maxIndexText-textSniff)
+	}
+	if err != nil && err != os.EOF {
+		return d
+	}
+	text := buf.Bytes()
+	if !isText(text) {
+		return d
+	}
+	ext := strings.ToLower(path.Ext(fpath))
+	if ext == ".html" || ext == ".htm" {
+		text = stripTags(text)
+	}
+	for _, w := range splitWords(string(text)) {
+		d.words[w]++
+	}
+	return d
+}
+
+// isText returns false if the start of data looks binary
+func isText(data []byte) bool {
+	if len(data) > textSniff {
+		data = data[0:textSniff]
+	}
+	return bytes.IndexByte(data, 0) < 0
+}
+
+// stripTags drops the HTML tags from text
+func stripTags(text []byte) []byte {
+	r := make([]byte, 0, len(text))
+	in := false
+	for _, c := range text {
+		switch {
+		case c == '<':
+			in = true
+		case c == '>' && in:
+			in = false
+			c = ' '
+			fallthrough
+		case !in:
+			r = r[0 : len(r)+1]
+			r[len(r)-1] = c
+		}
+	}
+	return r
+}
+
+// splitWords returns the lower-case words of s, made of letters and digits.
+// Single letters and words longer than maxWordLen are left out.
+func splitWords(s string) []string {
+	var r []string
+	word := make([]int, 0, maxWordLen)
+	long := false
+	flush := func() {
+		if len(word) > 1 && !long {
+			if len(r) == cap(r) {
+				r1 := make([]string, len(r), 2*cap(r)+8)
+				copy(r1, r)
+				r = r1
+			}
+			r = r[0 : len(r)+1]
+			r[len(r)-1] = string(word)
+		}
+		word, long = word[0:0], false
+	}
+	for _, c := range s {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			flush()
+			continue
+		}
+		if len(word) == maxWordLen {
+			long = true
+			continue
+		}
+		word = word[0 : len(word)+1]
+		word[len(word)-1] = unicode.ToLower(c)
+	}
+	flush()
+	return r
+}
+
+// indexHit is a file matching all the words of a search
+type indexHit struct {
+	path  string
+	size  int64
+	mtime int64 // ns
+	score int
+}
+
+type hitSorter []*indexHit
+
+func (s hitSorter) Len() int           { return len(s) }
+func (s hitSorter) Less(i, j int) bool { return s[i].score > s[j].score }
+func (s hitSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// search returns up to max files holding all of words, for which keep
+// returns true, best first. A word also matches the longer words it
+// begins, up to maxPrefixed of them. The search stops at the first max
+// files kept, so these are the best of those, not of all the matches.
+func (x *index) search(words []string, keep func(fpath string) bool, max int) []*indexHit {
+	found := x.match(words)
+	hits := make([]*indexHit, 0, max)
+	for _, h := range found {
+		if len(hits) == max {
+			break
+		}
+		if keep(h.path) {
+			hits = hits[0 : len(hits)+1]
+			hits[len(hits)-1] = h
+		}
+	}
+	sort.Sort(hitSorter(hits))
+	return hits
+}
+
+// match returns the files holding all of words, in no order
+func (x *index) match(words []string) []*indexHit {
+	x.lk.Lock()
+	defer x.lk.Unlock()
+	found := make(map[*indexDoc]int)
+	for i, w := range words {
+		next := make(map[*indexDoc]int)
+		for _, iw := range x.prefixed(w) {
+			for _, d := range x.words[iw] {
+				if _, ok := found[d]; i == 0 || ok {
+					next[d] += d.words[iw]
+				}
+			}
+		}
+		for d, n := range next {
+			next[d] = n + found[d]
+		}
+		found = next
+		if len(found) == 0 {
+			return nil
+		}
+	}
+	hits := make([]*indexHit, 0, len(found))
+	for d, score := range found {
+		hits = hits[0 : len(hits)+1]
+		hits[len(hits)-1] = &indexHit{d.path, d.size, d.mtime, score}
+	}
+	return hits
+}
+
+// prefixed returns w, if it is in the index, and up to maxPrefixed longer
+// words of the index that begin with w
+func (x *index) prefixed(w string) []string {
+	r := make([]string, 0, maxPrefixed+1)
+	if _, ok := x.words[w]; ok {
+		r = r[0:1]
+		r[0] = w
+	}
+	n := 0
+	for iw := range x.words {
+		if n == maxPrefixed {
+			break
+		}
+		if iw != w && strings.HasPrefix(iw, w) {
+			r = r[0 : len(r)+1]
+			r[len(r)-1] = iw
+			n++
+		}
+	}
+	return r
+}
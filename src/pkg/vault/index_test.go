@@ -0,0 +1,127 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	words := splitWords("Hello, World-2010! a b cd ÉTÉ")
+	expect := []string{"hello", "world", "2010", "cd", "été"}
+	if len(words) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, words)
+	}
+	for i, w := range words {
+		if w != expect[i] {
+			t.Errorf("word %d: expected %s, got %s", i, expect[i], w)
+		}
+	}
+	long := "x"
+	for len(long) <= maxWordLen {
+		long += long
+	}
+	if l := splitWords(long + " ok"); len(l) != 1 || l[0] != "ok" {
+		t.Errorf("long word kept: %v", l)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-index-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"music/blue-moon.ogg":    "\x00binary data moon",
+		"notes/moon.txt":         "the moon is blue tonight",
+		"notes/page.html":        "<p class=\"moonlight\">sunny</p>",
+		"notes/.hidden.txt":      "blue moon",
+		"secret/.tonika-nolist":  "",
+		"secret/blue.txt":        "blue moon",
+		"inbox/alice/blue.txt":   "blue moon",
+	}
+	for name, text := range files {
+		full := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(full), 0700); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(text), 0600); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+	v := &Vault0{id: 1, hdir: dir}
+	v.SetInbox("inbox", "upload", 10)
+	v.fdlim.Init(1) // scans hold one descriptor at a time
+	x := makeIndex(&v.fdlim)
+	x.scan(dir, v.indexable)
+
+	all := func(string) bool { return true }
+	found := func(words ...string) []string {
+		hits := x.search(words, all, maxSearchHits)
+		r := make([]string, len(hits))
+		for i, h := range hits {
+			r[i] = h.path
+		}
+		return r
+	}
+	// The name weighs more than the text; binary content is not read
+	if r := found("blue", "moon"); len(r) != 2 || r[0] != "music/blue-moon.ogg" || r[1] != "notes/moon.txt" {
+		t.Errorf("blue moon: got %v", r)
+	}
+	if r := found("binary"); len(r) != 0 {
+		t.Errorf("binary content indexed: %v", r)
+	}
+	// Tags are not words, and words match by prefix
+	if r := found("moonl"); len(r) != 0 {
+		t.Errorf("tag attribute indexed: %v", r)
+	}
+	if r := found("sun"); len(r) != 1 || r[0] != "notes/page.html" {
+		t.Errorf("sun: got %v", r)
+	}
+	if r := found("tonight", "sunny"); len(r) != 0 {
+		t.Errorf("words of different files matched: %v", r)
+	}
+	// Hits are kept and counted before they are sorted
+	notMoon := func(fpath string) bool { return fpath != "notes/moon.txt" }
+	if h := x.search([]string{"moon"}, notMoon, 1); len(h) != 1 || h[0].path == "notes/moon.txt" {
+		t.Errorf("kept hits: %v", h)
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	x := makeIndex(nil)
+	x.words["a"] = nil
+	for i := 0; i < 2*maxPrefixed; i++ {
+		x.words["a"+strconv.Itoa(i)] = nil
+	}
+	r := x.prefixed("a")
+	if len(r) != maxPrefixed+1 || r[0] != "a" {
+		t.Errorf("expected %d words starting with a, got %d", maxPrefixed+1, len(r))
+	}
+}
+
+func TestMergeHits(t *testing.T) {
+	a := []*SearchHit{&SearchHit{"1", "a", 0, 0, 5}, &SearchHit{"1", "b", 0, 0, 1}}
+	b := []*SearchHit{&SearchHit{"1", "a", 0, 0, 5}, &SearchHit{"2", "a", 0, 0, 3}}
+	r := mergeHits(a, b)
+	if len(r) != 3 || r[0].Score != 5 || r[1].Score != 3 || r[2].Score != 1 {
+		t.Errorf("bad merge: %v", r)
+	}
+}
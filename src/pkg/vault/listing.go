@@ -0,0 +1,201 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"json"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"template"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// When a directory has no index.html, the vault generates a listing of it,
+// unless the directory holds a noListFile. The query arguments are
+//
+//	sort=name|size|time	(default name)
+//	order=asc|desc		(default asc)
+//	format=html|json	(default html)
+//
+// Hidden files, whose names start with a dot, and entries the requester may
+// not read are left out. Hidden files are not served either, see canRead.
+const noListFile = ".tonika-nolist"
+
+type listEntry struct {
+	Name    string
+	Type    string // "file" or "dir"
+	Size    int64  // bytes, 0 for directories
+	ModTime int64  // seconds since epoch
+}
+
+type listing struct {
+	Path    string
+	Entries []*listEntry
+}
+
+type listSorter struct {
+	e    []*listEntry
+	by   string
+	desc bool
+}
+
+func (s *listSorter) Len() int      { return len(s.e) }
+func (s *listSorter) Swap(i, j int) { s.e[i], s.e[j] = s.e[j], s.e[i] }
+
+func (s *listSorter) Less(i, j int) bool {
+	a, b := s.e[i], s.e[j]
+	if s.desc {
+		a, b = b, a
+	}
+	switch s.by {
+	case "size":
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case "time":
+		if a.ModTime != b.ModTime {
+			return a.ModTime < b.ModTime
+		}
+	}
+	if a.Type != b.Type {
+		return a.Type == "dir"
+	}
+	return a.Name < b.Name
+}
+
+// serveListing answers a request for the directory dir, relative to the
+// home directory, which has no index.html
+func (v *Vault0) serveListing(dir, query string, origin, peer sys.Id) (*http.Response, os.Error) {
+	full := path.Join(v.getHomeDir(), dir)
+	if isFile(path.Join(full, noListFile)) {
+		if dir == "." {
+			return newRespNoIndexHTML(), nil
+		}
+		return newRespNotFound(), os.ErrorString("not found")
+	}
+	args, err := http.ParseQuery(query)
+	if err != nil {
+		return newRespBadRequest(), os.ErrorString("bad request")
+	}
+	arg := func(k, def string) string {
+		if a, ok := args[k]; ok && len(a) == 1 {
+			return a[0]
+		}
+		return def
+	}
+	by, order, format := arg("sort", "name"), arg("order", "asc"), arg("format", "html")
+	if (by != "name" && by != "size" && by != "time") ||
+		(order != "asc" && order != "desc") ||
+		(format != "html" && format != "json") {
+		return newRespBadRequest(), os.ErrorString("bad request")
+	}
+
+	d, err := os.Open(full, os.O_RDONLY, 0)
+	if err != nil {
+		return newRespNotFound(), os.ErrorString("not found")
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		v.reportError(err)
+		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
+	}
+	l := &listing{Path: "/" + dir, Entries: make([]*listEntry, 0, len(fis))}
+	if dir == "." {
+		l.Path = "/"
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name, ".") {
+			continue
+		}
+		e := &listEntry{Name: fi.Name, Type: "file", Size: fi.Size, ModTime: fi.Mtime_ns / 1e9}
+		// the ACL of a subdirectory is the one its index.html would have
+		probe := path.Join(dir, fi.Name)
+		if fi.IsDirectory() {
+			e.Type, e.Size = "dir", 0
+			probe = path.Join(probe, "index.html")
+		}
+		if !v.canRead(probe, origin, peer) {
+			continue
+		}
+		l.Entries = l.Entries[0 : len(l.Entries)+1]
+		l.Entries[len(l.Entries)-1] = e
+	}
+	sort.Sort(&listSorter{l.Entries, by, order == "desc"})
+
+	if format == "json" {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return newRespServiceUnavailable(), os.ErrorString("service unavailable")
+		}
+		resp := buildResp(string(data))
+		resp.Header = map[string]string{"Content-Type": "application/json"}
+		return resp, nil
+	}
+	resp := buildResp(l.html(by, order))
+	resp.Header = map[string]string{"Content-Type": "text/html; charset=utf-8"}
+	return resp, nil
+}
+
+func (l *listing) html(by, order string) string {
+	var w bytes.Buffer
+	esc := func(s string) { template.HTMLEscape(&w, []byte(s)) }
+	w.WriteString("<html>\n<head><title>Index of ")
+	esc(l.Path)
+	w.WriteString("</title></head>\n<body bgcolor=\"white\">\n<h1>Index of ")
+	esc(l.Path)
+	w.WriteString("</h1>\n<table>\n<tr>")
+	for _, col := range []string{"name", "size", "time"} {
+		o := "asc"
+		if col == by && order == "asc" {
+			o = "desc"
+		}
+		fmt.Fprintf(&w, "<th><a href=\"?sort=%s&amp;order=%s\">%s</a></th>", col, o, col)
+	}
+	w.WriteString("</tr>\n")
+	if l.Path != "/" {
+		parent, _ := path.Split(l.Path)
+		w.WriteString("<tr><td><a href=\"")
+		esc(http.URLPathEscape(parent))
+		w.WriteString("\">..</a></td><td></td><td></td></tr>\n")
+	}
+	base := http.URLPathEscape(l.Path)
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	for _, e := range l.Entries {
+		name, size := e.Name, fmt.Sprintf("%d", e.Size)
+		if e.Type == "dir" {
+			name, size = name+"/", "-"
+		}
+		w.WriteString("<tr><td><a href=\"")
+		esc(base + http.URLPathEscape(name))
+		w.WriteString("\">")
+		esc(name)
+		fmt.Fprintf(&w, "</a></td><td align=\"right\">%s</td><td>%s</td></tr>\n",
+			size, time.SecondsToUTC(e.ModTime).Format(time.RFC1123))
+	}
+	w.WriteString("</table>\n<hr><center>" + sys.Name + " Vault</center>\n</body></html>")
+	return w.String()
+}
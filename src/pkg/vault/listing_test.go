@@ -0,0 +1,104 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestListSorter(t *testing.T) {
+	e := []*listEntry{
+		&listEntry{Name: "b", Type: "file", Size: 1, ModTime: 30},
+		&listEntry{Name: "z", Type: "dir", ModTime: 10},
+		&listEntry{Name: "a", Type: "file", Size: 3, ModTime: 20},
+	}
+	check := func(by string, desc bool, want string) {
+		sort.Sort(&listSorter{e, by, desc})
+		got := ""
+		for _, x := range e {
+			got += x.Name
+		}
+		if got != want {
+			t.Errorf("sort=%s desc=%v: got %s, want %s", by, desc, got, want)
+		}
+	}
+	check("name", false, "zab")
+	check("name", true, "baz")
+	check("size", false, "zba")
+	check("time", true, "baz")
+}
+
+func TestHidden(t *testing.T) {
+	v := &Vault0{id: 1, hdir: os.TempDir()}
+	for _, p := range []string{".secret", "a/.git/config", ".git/index.html", "a/.b/c"} {
+		if !isHidden(p) || v.canRead(p, 1, 1) || v.canRead(p, 2, 2) {
+			t.Errorf("%s is not hidden", p)
+		}
+	}
+	for _, p := range []string{"a/b.c", "index.html", "./a", "a."} {
+		if isHidden(p) || !v.canRead(p, 2, 2) {
+			t.Errorf("%s is hidden", p)
+		}
+	}
+}
+
+func TestServeListing(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-listing-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(path.Join(dir, "sub/quiet"), 0700); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	ioutil.WriteFile(path.Join(dir, "sub/a.txt"), []byte("aaa"), 0600)
+	ioutil.WriteFile(path.Join(dir, "sub/.hidden"), []byte("h"), 0600)
+	ioutil.WriteFile(path.Join(dir, "sub/quiet", noListFile), []byte{}, 0600)
+	v := &Vault0{id: 1, hdir: dir}
+
+	resp, err := v.serveListing("sub", "format=json", 2, 2)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("json listing: %v", err)
+	}
+	if resp.Header["Content-Type"] != "application/json" {
+		t.Errorf("json listing served as %q", resp.Header["Content-Type"])
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	var l listing
+	if err = json.Unmarshal(data, &l); err != nil {
+		t.Fatalf("json listing: %s", err)
+	}
+	if l.Path != "/sub" || len(l.Entries) != 2 ||
+		l.Entries[0].Name != "quiet" || l.Entries[0].Type != "dir" ||
+		l.Entries[1].Name != "a.txt" || l.Entries[1].Size != 3 {
+		t.Errorf("json listing: %s", data)
+	}
+
+	if resp, _ = v.serveListing("sub", "", 2, 2); resp.Header["Content-Type"] == "application/json" {
+		t.Errorf("html listing served as json")
+	}
+	if resp, _ = v.serveListing("sub/quiet", "", 2, 2); resp.StatusCode != 404 {
+		t.Errorf("listing of a nolist directory: %d", resp.StatusCode)
+	}
+	if resp, _ = v.serveListing("sub", "format=xml", 2, 2); resp.StatusCode != 400 {
+		t.Errorf("bad format: %d", resp.StatusCode)
+	}
+}
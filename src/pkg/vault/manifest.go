@@ -0,0 +1,114 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"os"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// For files in the home directory, the vault publishes a manifest signed
+// with my signature key (see sys.Manifest), in answer to a request for the
+// file with the query "manifest". Manifests are kept in memory until the
+// file changes.
+
+// Files are cut into chunks of this many bytes
+const chunkSize = 256 * 1024
+
+// How many manifests are kept in memory
+const maxManifests = 256
+
+// Content-Type of manifests, which tells them apart from files served by
+// vaults that do not publish manifests
+const manifestType = "application/x-tonika-manifest"
+
+// SetSigKey gives the vault the key to sign manifests with
+func (v *Vault0) SetSigKey(sk *sys.SigKey) {
+	v.lk.Lock()
+	v.sigkey = sk
+	v.lk.Unlock()
+}
+
+func (v *Vault0) getSigKey() *sys.SigKey {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	return v.sigkey
+}
+
+// manifest returns the manifest of fpath, found at full in the home
+// directory
+func (v *Vault0) manifest(fpath, full string) (*sys.Manifest, os.Error) {
+	sk := v.getSigKey()
+	if sk == nil {
+		return nil, os.ErrorString("no signature key")
+	}
+	fi, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	v.lk.Lock()
+	m, ok := v.manifests[fpath]
+	v.lk.Unlock()
+	if ok && m.Size == fi.Size && m.Mtime == fi.Mtime_ns {
+		return m, nil
+	}
+
+	if err = v.fdlim.LockOrTimeout(10e9); err != nil {
+		return nil, os.ErrorString("file descriptor starvation")
+	}
+	file, err := os.Open(full, os.O_RDONLY, 0)
+	if err != nil {
+		v.fdlim.Unlock()
+		return nil, err
+	}
+	m, err = sys.MakeManifest(sk, fpath, fi.Size, fi.Mtime_ns, chunkSize, file)
+	file.Close()
+	v.fdlim.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// The file may have changed while it was read
+	if fi2, err := os.Stat(full); err != nil || fi2.Size != fi.Size || fi2.Mtime_ns != fi.Mtime_ns {
+		return nil, os.ErrorString("file changed")
+	}
+
+	v.lk.Lock()
+	if len(v.manifests) >= maxManifests {
+		for k, _ := range v.manifests {
+			v.manifests[k] = nil, false
+			break
+		}
+	}
+	v.manifests[fpath] = m
+	v.lk.Unlock()
+	return m, nil
+}
+
+// serveManifest answers a request for the manifest of fpath
+func (v *Vault0) serveManifest(fpath, full string) (*http.Response, os.Error) {
+	m, err := v.manifest(fpath, full)
+	if err != nil {
+		v.reportError(err)
+		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
+	}
+	n, body := http.BytesToBody(m.Bytes())
+	resp := buildRespFromBody(body, int64(n))
+	resp.Header = make(map[string]string)
+	resp.Header["Content-Type"] = manifestType
+	return resp, nil
+}
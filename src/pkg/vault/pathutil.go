@@ -19,8 +19,20 @@ package vault
 
 import (
 	"os"
+	"strings"
 )
 
+// isHidden returns true if a component of fpath, other than ".", starts
+// with a dot. Hidden files are neither listed nor served, see listing.go.
+func isHidden(fpath string) bool {
+	for _, c := range strings.Split(fpath, "/", -1) {
+		if c != "." && strings.HasPrefix(c, ".") {
+			return true
+		}
+	}
+	return false
+}
+
 func isFile(fpath string) bool {
 	dir, err := os.Lstat(fpath)
 	if err != nil {
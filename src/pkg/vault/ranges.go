@@ -0,0 +1,267 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"tonika/http"
+)
+
+// Time format of the Last-Modified and If-Range headers
+const httpTime = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// byteRange is a part of a file, as asked for in a Range header
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var errUnsatisfiable = os.ErrorString("range not satisfiable")
+
+// A Range header with more ranges than this is ignored, and the whole file
+// is served
+const maxRanges = 16
+
+type rangeSorter []byteRange
+
+func (s rangeSorter) Len() int           { return len(s) }
+func (s rangeSorter) Less(i, j int) bool { return s[i].start < s[j].start }
+func (s rangeSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// parseRange parses the value of a Range header, like "bytes=0-99,-500",
+// for a file of size bytes. It returns nil for a malformed header, or one
+// with more than maxRanges ranges, in which case the whole file is served,
+// and errUnsatisfiable if none of the ranges overlap the file. Ranges that
+// overlap or touch are merged, so no byte is sent twice, and the result is
+// in file order.
+func parseRange(s string, size int64) ([]byteRange, os.Error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil, nil
+	}
+	specs := strings.Split(s[len("bytes="):], ",", -1)
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+	r := make([]byteRange, 0, len(specs))
+	for _, spec := range specs {
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, nil
+		}
+		first, last := strings.TrimSpace(spec[0:i]), strings.TrimSpace(spec[i+1:])
+		var br byteRange
+		if first == "" {
+			// the last n bytes
+			n, err := strconv.Atoi64(last)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{size - n, n}
+		} else {
+			a, err := strconv.Atoi64(first)
+			if err != nil || a < 0 {
+				return nil, nil
+			}
+			b := size - 1
+			if last != "" {
+				b, err = strconv.Atoi64(last)
+				if err != nil || b < a {
+					return nil, nil
+				}
+				if b >= size {
+					b = size - 1
+				}
+			}
+			if a >= size {
+				continue
+			}
+			br = byteRange{a, b - a + 1}
+		}
+		r = r[0 : len(r)+1]
+		r[len(r)-1] = br
+	}
+	if len(r) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return mergeRanges(r), nil
+}
+
+// mergeRanges sorts r and merges the ranges that overlap or touch
+func mergeRanges(r []byteRange) []byteRange {
+	sort.Sort(rangeSorter(r))
+	n := 0
+	for _, br := range r[1:] {
+		last := &r[n]
+		if br.start <= last.start+last.length {
+			if end := br.start + br.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		n++
+		r[n] = br
+	}
+	return r[0 : n+1]
+}
+
+// fileBody reads from a file and closes it when it is closed
+type fileBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (b *fileBody) Close() os.Error { return b.file.Close() }
+
+// partsReader reads its readers one after the other
+type partsReader []io.Reader
+
+func (p *partsReader) Read(b []byte) (int, os.Error) {
+	for len(*p) > 0 {
+		n, err := (*p)[0].Read(b)
+		if err == os.EOF {
+			*p = (*p)[1:]
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+	return 0, os.EOF
+}
+
+// serveFile answers req with the file full. Responses carry the file's
+// Last-Modified and ETag, and conditional requests for a current copy get
+// 304 Not Modified. If req has a Range header, and an If-Range header that
+// matches one of the validators if any, only the ranges asked for are sent,
+// with status 206 Partial Content. Several ranges are sent as
+// multipart/byteranges.
+func serveFile(req *http.Request, full string) (*http.Response, os.Error) {
+	file, err := os.Open(full, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size := fi.Size
+	modified := time.SecondsToUTC(fi.Mtime_ns / 1e9).Format(httpTime)
+	etag := fileETag(fi)
+
+	if notModified(req, etag, fi.Mtime_ns/1e9) {
+		file.Close()
+		resp := newRespNotModified()
+		resp.Header["Etag"] = etag
+		resp.Header["Last-Modified"] = modified
+		return resp, nil
+	}
+
+	var ranges []byteRange
+	if h, ok := req.Header["Range"]; ok {
+		ir, ok := req.Header["If-Range"]
+		ir = strings.TrimSpace(ir)
+		if !ok || ir == modified || ir == etag {
+			ranges, err = parseRange(h, size)
+			if err != nil {
+				file.Close()
+				resp := newRespRangeNotSatisfiable()
+				if resp.Header == nil {
+					resp.Header = make(map[string]string)
+				}
+				resp.Header["Content-Range"] = fmt.Sprintf("bytes */%d", size)
+				return resp, nil
+			}
+		}
+	}
+
+	var resp *http.Response
+	switch len(ranges) {
+	case 0:
+		resp = buildRespFromBody(&fileBody{io.NewSectionReader(file, 0, size), file}, size)
+	case 1:
+		r := ranges[0]
+		resp = buildPartialResp(&fileBody{io.NewSectionReader(file, r.start, r.length), file}, r.length)
+		resp.Header["Content-Range"] = r.contentRange(size)
+	default:
+		boundary := fmt.Sprintf("tonika%x", time.Nanoseconds())
+		parts := make(partsReader, 0, 2*len(ranges)+1)
+		bodylen := int64(0)
+		add := func(rd io.Reader, n int64) {
+			parts = parts[0 : len(parts)+1]
+			parts[len(parts)-1] = rd
+			bodylen += n
+		}
+		for _, r := range ranges {
+			var w bytes.Buffer
+			fmt.Fprintf(&w, "\r\n--%s\r\nContent-Type: application/octet-stream\r\n"+
+				"Content-Range: %s\r\n\r\n", boundary, r.contentRange(size))
+			add(bytes.NewBuffer(w.Bytes()), int64(w.Len()))
+			add(io.NewSectionReader(file, r.start, r.length), r.length)
+		}
+		end := "\r\n--" + boundary + "--\r\n"
+		add(strings.NewReader(end), int64(len(end)))
+		resp = buildPartialResp(&fileBody{&parts, file}, bodylen)
+		resp.Header["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+	}
+	if resp.Header == nil {
+		resp.Header = make(map[string]string)
+	}
+	resp.Header["Accept-Ranges"] = "bytes"
+	resp.Header["Last-Modified"] = modified
+	resp.Header["Etag"] = etag
+	return resp, nil
+}
+
+// ParseContentRange parses the value of a Content-Range header,
+// "bytes first-last/total"
+func ParseContentRange(s string) (first, total int64, ok bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, false
+	}
+	s = s[len("bytes "):]
+	i, j := strings.Index(s, "-"), strings.Index(s, "/")
+	if i < 0 || j < i {
+		return 0, 0, false
+	}
+	first, err1 := strconv.Atoi64(s[0:i])
+	total, err2 := strconv.Atoi64(s[j+1:])
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return first, total, true
+}
@@ -0,0 +1,64 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package vault
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	type rangeTest struct {
+		s    string
+		want []byteRange
+	}
+	tests := []rangeTest{
+		rangeTest{"bytes=0-9", []byteRange{byteRange{0, 10}}},
+		rangeTest{"bytes=90-", []byteRange{byteRange{90, 10}}},
+		rangeTest{"bytes=-5", []byteRange{byteRange{95, 5}}},
+		rangeTest{"bytes=0-0, 50-200", []byteRange{byteRange{0, 1}, byteRange{50, 50}}},
+		rangeTest{"bytes=-500", []byteRange{byteRange{0, 100}}},
+		rangeTest{"lines=1-2", nil},
+		rangeTest{"bytes=5-1", nil},
+		rangeTest{"bytes=x-", nil},
+		rangeTest{"bytes=50-59,0-9", []byteRange{byteRange{0, 10}, byteRange{50, 10}}},
+		rangeTest{"bytes=0-49,10-19,40-", []byteRange{byteRange{0, 100}}},
+		rangeTest{"bytes=0-9,10-19,-10", []byteRange{byteRange{0, 20}, byteRange{90, 10}}},
+		rangeTest{"bytes=0-0,0-0,0-0,0-0", []byteRange{byteRange{0, 1}}},
+		rangeTest{"bytes=" + strings.Repeat("0-0,", maxRanges) + "1-1", nil},
+	}
+	for _, tt := range tests {
+		r, err := parseRange(tt.s, 100)
+		if err != nil {
+			t.Errorf("%s: %s", tt.s, err)
+			continue
+		}
+		if len(r) != len(tt.want) {
+			t.Errorf("%s: got %v", tt.s, r)
+			continue
+		}
+		for i := range r {
+			if r[i].start != tt.want[i].start || r[i].length != tt.want[i].length {
+				t.Errorf("%s: got %v", tt.s, r)
+			}
+		}
+	}
+	if _, err := parseRange("bytes=100-", 100); err != errUnsatisfiable {
+		t.Errorf("range past the end accepted")
+	}
+}
@@ -0,0 +1,378 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"io"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+	"tonika/crypto"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// Searches are answered on the dialer subject "search". A query is a GET
+// request with the arguments
+//
+//	q=<words>	the words that must all appear in a file's name or text
+//	id=<query id>	the same for every copy of a query
+//	hops=<n>	how many more hops the query is passed on
+//
+// and is answered with a JSON list of SearchHit. Every vault answers from
+// its index (see index.go), with the files the origin of the query may read,
+// and passes the query on to its online friends while hops remain. A vault
+// that sees a query id for the second time answers with no hits. A friend
+// asking more than maxPeerSearches queries a minute is answered 503.
+
+const (
+	searchSubject    = "search"
+	MaxSearchHops    = 3
+	maxSearchWords   = 8
+	maxSearchHits    = 50    // hits of one vault
+	maxSearchResults = 200   // hits passed back
+	searchWait       = 4e9   // ns to wait for friends, per hop left
+	searchMemory     = 120e9 // ns a query id is remembered
+	maxSearchAnswer  = 256 * 1024
+	maxPeerSearches  = 30   // queries of one friend per searchWindow
+	searchWindow     = 60e9 // ns
+)
+
+// SearchHit is a file found by a search
+type SearchHit struct {
+	Owner string // Id of the vault holding the file
+	Path  string
+	Size  int64
+	Mtime int64 // seconds
+	Score int
+}
+
+// URL returns the address of the file, as reached by the local identity
+// via, or "" if Owner is not an Id
+func (h *SearchHit) URL(via sys.Id) string {
+	id, err := sys.ParseId(h.Owner)
+	if err != nil {
+		return ""
+	}
+	return sys.MakeViaURL(id, via, http.URLPathEscape(h.Path))
+}
+
+type searchHitSorter []*SearchHit
+
+func (s searchHitSorter) Len() int           { return len(s) }
+func (s searchHitSorter) Less(i, j int) bool { return s[i].Score > s[j].Score }
+func (s searchHitSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Search looks for files holding all the words of query, in my vault and
+// in those of friends up to hops away, and returns them best first
+func (v *Vault0) Search(query string, hops int) ([]*SearchHit, os.Error) {
+	words := splitWords(query)
+	if len(words) == 0 {
+		return nil, os.ErrorString("nothing to search for")
+	}
+	if len(words) > maxSearchWords {
+		return nil, os.ErrorString("too many words")
+	}
+	if hops < 0 || hops > MaxSearchHops {
+		return nil, os.ErrorString("bad number of hops")
+	}
+	qid := strconv.Itoa64(crypto.NewRand().Int63())
+	v.seenQuery(qid)
+	return v.search(words, query, qid, hops, v.id, v.id), nil
+}
+
+// search answers a query from origin, handed over by peer
+func (v *Vault0) search(words []string, query, qid string, hops int, origin, peer sys.Id) []*SearchHit {
+	acls := make(aclCache)
+	canRead := func(fpath string) bool { return v.canReadCached(fpath, origin, peer, acls) }
+	hits := v.index.search(words, canRead, maxSearchHits)
+	r := make([]*SearchHit, len(hits))
+	for i, h := range hits {
+		r[i] = &SearchHit{v.id.String(), h.path, h.size, h.mtime / 1e9, h.score}
+	}
+	if hops > 0 {
+		r = mergeHits(r, v.askFriends(query, qid, hops-1, origin, peer))
+	}
+	return r
+}
+
+// mergeHits joins a and b, dropping duplicates, and keeps the best
+// maxSearchResults
+func mergeHits(a, b []*SearchHit) []*SearchHit {
+	seen := make(map[string]bool)
+	r := make([]*SearchHit, 0, len(a)+len(b))
+	for _, l := range [][]*SearchHit{a, b} {
+		for _, h := range l {
+			key := h.Owner + "/" + h.Path
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			r = r[0 : len(r)+1]
+			r[len(r)-1] = h
+		}
+	}
+	sort.Sort(searchHitSorter(r))
+	if len(r) > maxSearchResults {
+		r = r[0:maxSearchResults]
+	}
+	return r
+}
+
+// seenQuery remembers qid, and returns true if it was seen before
+func (v *Vault0) seenQuery(qid string) bool {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	now := time.Nanoseconds()
+	for id, t := range v.queries {
+		if now-t > searchMemory {
+			v.queries[id] = 0, false
+		}
+	}
+	if _, ok := v.queries[qid]; ok {
+		return true
+	}
+	v.queries[qid] = now
+	return false
+}
+
+// peerSearches counts the queries of a friend since start
+type peerSearches struct {
+	start int64
+	n     int
+}
+
+// allowSearch counts a query of peer, and returns false if peer has asked
+// too many within searchWindow
+func (v *Vault0) allowSearch(peer sys.Id) bool {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	now := time.Nanoseconds()
+	for id, s := range v.searches {
+		if now-s.start > searchWindow {
+			v.searches[id] = nil, false
+		}
+	}
+	s, ok := v.searches[peer]
+	if !ok {
+		s = &peerSearches{start: now}
+		v.searches[peer] = s
+	}
+	s.n++
+	return s.n <= maxPeerSearches
+}
+
+// askFriends passes a query on to my online friends, except origin and
+// peer, and collects the hits they send back within the time allowed
+func (v *Vault0) askFriends(query, qid string, hops int, origin, peer sys.Id) []*SearchHit {
+	var friends []sys.Id
+	for _, id := range v.onlineNeighbors(origin) {
+		if id != peer {
+			friends = friendAppend(friends, id)
+		}
+	}
+	if len(friends) == 0 {
+		return nil
+	}
+	ch := make(chan []*SearchHit, len(friends))
+	for _, id := range friends {
+		go func(id sys.Id) {
+			hits, err := v.askSearch(id, query, qid, hops, origin)
+			if err != nil {
+				v.log().With(id).Debugf("Search not answered: %s", err)
+			}
+			ch <- hits
+		}(id)
+	}
+	// Friends wait for their own friends a hop's time less than I do
+	timeout := make(chan bool, 1)
+	go func() {
+		time.Sleep(int64(hops+1) * searchWait)
+		timeout <- true
+	}()
+	var r []*SearchHit
+	for k := 0; k < len(friends); k++ {
+		select {
+		case hits := <-ch:
+			r = mergeHits(r, hits)
+		case <-timeout:
+			return r
+		}
+	}
+	return r
+}
+
+func friendAppend(l []sys.Id, id sys.Id) []sys.Id {
+	r := make([]sys.Id, len(l)+1)
+	copy(r, l)
+	r[len(l)] = id
+	return r
+}
+
+// askSearch sends a query to the friend id
+func (v *Vault0) askSearch(id sys.Id, query, qid string, hops int, origin sys.Id) ([]*SearchHit, os.Error) {
+	d := v.isHealthy()
+	if d == nil {
+		return nil, os.ErrorString("service unavailable")
+	}
+	conn := d.Dial(id, searchSubject)
+	if conn == nil {
+		return nil, os.ErrorString("cannot reach friend")
+	}
+	acc := http.NewAsyncClientConn(conn)
+	defer func() {
+		acc.Close()
+		conn.Close()
+	}()
+	req := &http.Request{
+		Method: "GET",
+		URL: &http.URL{Path: "/", RawQuery: "q=" + http.URLEscape(query) +
+			"&id=" + http.URLEscape(qid) + "&hops=" + strconv.Itoa(hops)},
+		Host:       sys.MakeHost("", id),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(map[string]string),
+	}
+	setOrigin(req, origin)
+	setReqVersion(req)
+	resp, err := acc.Fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Body == nil {
+		return nil, os.ErrorString("empty answer")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, os.ErrorString(resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSearchAnswer+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSearchAnswer {
+		return nil, os.ErrorString("answer too long")
+	}
+	var hits []*SearchHit
+	if err = json.Unmarshal(data, &hits); err != nil {
+		return nil, err
+	}
+	return saneHits(hits, id, hops, v.id), nil
+}
+
+// saneHits drops the hits that make no sense, coming from the friend id
+// that was asked to pass the query on hops more times. Such a friend
+// cannot answer for me, nor for anyone else when no hops are left.
+func saneHits(hits []*SearchHit, id sys.Id, hops int, me sys.Id) []*SearchHit {
+	r := make([]*SearchHit, 0, len(hits))
+	for _, h := range hits {
+		if h == nil || h.Path == "" || path.Clean("/"+h.Path) != "/"+h.Path {
+			continue
+		}
+		owner, err := sys.ParseId(h.Owner)
+		if err != nil || owner == me || (hops == 0 && owner != id) {
+			continue
+		}
+		r = r[0 : len(r)+1]
+		r[len(r)-1] = h
+	}
+	return r
+}
+
+func (v *Vault0) acceptSearch() {
+	for {
+		d := v.isHealthy()
+		if d == nil {
+			return
+		}
+		peer, conn := d.Accept(searchSubject)
+		if conn == nil {
+			continue
+		}
+		go v.serveSearch(peer, conn)
+	}
+}
+
+// serveSearch answers a query from the friend peer
+func (v *Vault0) serveSearch(peer sys.Id, c net.Conn) {
+	asc := http.NewAsyncServerConn(c)
+	defer func() {
+		asc.Close()
+		c.Close()
+	}()
+	req, err := asc.Read()
+	if err != nil {
+		return
+	}
+	asc.Write(req, v.answerSearch(req, peer))
+}
+
+// parseSearch returns the arguments of a query from a friend. A friend
+// cannot ask for more hops than I would.
+func parseSearch(req *http.Request) (query, qid string, hops int, err os.Error) {
+	args, err := http.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if len(args["q"]) != 1 || len(args["id"]) != 1 || len(args["hops"]) != 1 {
+		return "", "", 0, os.EINVAL
+	}
+	hops, err = strconv.Atoi(args["hops"][0])
+	if err != nil || hops < 0 {
+		return "", "", 0, os.EINVAL
+	}
+	if hops > MaxSearchHops-1 {
+		hops = MaxSearchHops - 1
+	}
+	return args["q"][0], args["id"][0], hops, nil
+}
+
+func (v *Vault0) answerSearch(req *http.Request, peer sys.Id) *http.Response {
+	if !v.allowSearch(peer) {
+		return newRespServiceUnavailable()
+	}
+	origin, err := parseOrigin(req)
+	if err != nil {
+		origin = peer
+	}
+	query, qid, hops, err := parseSearch(req)
+	if err != nil {
+		return newRespBadRequest()
+	}
+	words := splitWords(query)
+	if len(words) > maxSearchWords {
+		return newRespBadRequest()
+	}
+	hits := []*SearchHit{}
+	if len(words) > 0 && !v.seenQuery(qid) {
+		v.log().With(origin).Infof("Search for %q (via %s)", query, peer.Eye())
+		hits = v.search(words, query, qid, hops, origin, peer)
+	}
+	data, err := json.Marshal(hits)
+	if err != nil {
+		return newRespServiceUnavailable()
+	}
+	resp := buildResp(string(data))
+	setRespVersion(resp)
+	return resp
+}
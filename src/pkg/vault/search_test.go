@@ -0,0 +1,140 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"testing"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// searchVault returns a vault indexing dir
+func searchVault(t *testing.T, me sys.Id, dir string) *Vault0 {
+	v := &Vault0{
+		id:       me,
+		hdir:     dir,
+		queries:  make(map[string]int64),
+		searches: make(map[sys.Id]*peerSearches),
+	}
+	v.fdlim.Init(4)
+	v.index = makeIndex(&v.fdlim)
+	v.index.scan(dir, v.indexable)
+	return v
+}
+
+func searchReq(query string, origin sys.Id) *http.Request {
+	req := &http.Request{Method: "GET", URL: &http.URL{Path: "/", RawQuery: query}}
+	setOrigin(req, origin)
+	return req
+}
+
+// searchPaths returns the paths of the hits in resp
+func searchPaths(t *testing.T, resp *http.Response) []string {
+	if resp.StatusCode != 200 {
+		t.Fatalf("search answered %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	var hits []*SearchHit
+	if err = json.Unmarshal(data, &hits); err != nil {
+		t.Fatalf("bad answer %q: %s", data, err)
+	}
+	r := make([]string, len(hits))
+	for i, h := range hits {
+		r[i] = h.Path
+	}
+	return r
+}
+
+func TestAnswerSearch(t *testing.T) {
+	me, alice, bob := sys.Id(1), sys.Id(2), sys.Id(3)
+	dir := makeACLHome(t, alice, bob)
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"a/moon.txt", "a/b/moon.txt", "open/moon.txt"} {
+		ioutil.WriteFile(path.Join(dir, p), []byte("blue moon"), 0600)
+	}
+	v := searchVault(t, me, dir)
+
+	// bob may read a/b/ but asks through alice, who may not
+	r := searchPaths(t, v.answerSearch(searchReq("q=moon&id=1&hops=0", bob), alice))
+	if len(r) != 1 || r[0] != "open/moon.txt" {
+		t.Errorf("forwarded search: got %v", r)
+	}
+	r = searchPaths(t, v.answerSearch(searchReq("q=moon&id=2&hops=0", alice), alice))
+	if len(r) != 2 {
+		t.Errorf("direct search: got %v", r)
+	}
+	// A query is answered once
+	r = searchPaths(t, v.answerSearch(searchReq("q=moon&id=2&hops=0", bob), bob))
+	if len(r) != 0 {
+		t.Errorf("query answered twice: %v", r)
+	}
+	if resp := v.answerSearch(searchReq("q=a+b+c+d+e+f+g+h+i&id=3&hops=0", bob), bob); resp.StatusCode != 400 {
+		t.Errorf("too many words answered %s", resp.Status)
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	q, qid, hops, err := parseSearch(searchReq("q=blue+moon&id=7&hops=100", 1))
+	if err != nil || q != "blue moon" || qid != "7" || hops != MaxSearchHops-1 {
+		t.Errorf("got %q %q %d %v", q, qid, hops, err)
+	}
+	for _, query := range []string{"q=moon&id=7", "q=moon&id=7&hops=-1", "q=moon&id=7&hops=x", "q=a&q=b&id=7&hops=1"} {
+		if _, _, _, err = parseSearch(searchReq(query, 1)); err == nil {
+			t.Errorf("%s accepted", query)
+		}
+	}
+}
+
+func TestAllowSearch(t *testing.T) {
+	v := &Vault0{searches: make(map[sys.Id]*peerSearches)}
+	for i := 0; i < maxPeerSearches; i++ {
+		if !v.allowSearch(2) {
+			t.Fatalf("query %d refused", i)
+		}
+	}
+	if v.allowSearch(2) {
+		t.Errorf("too many queries allowed")
+	}
+	if !v.allowSearch(3) {
+		t.Errorf("another friend refused")
+	}
+}
+
+func TestSaneHits(t *testing.T) {
+	me, alice, bob := sys.Id(1), sys.Id(2), sys.Id(3)
+	hits := []*SearchHit{
+		&SearchHit{Owner: alice.String(), Path: "a.txt"},
+		&SearchHit{Owner: bob.String(), Path: "b.txt"},
+		&SearchHit{Owner: me.String(), Path: "c.txt"},
+		&SearchHit{Owner: alice.String(), Path: "../d.txt"},
+		&SearchHit{Owner: "x", Path: "e.txt"},
+		nil,
+	}
+	if r := saneHits(hits, alice, 1, me); len(r) != 2 || r[0].Path != "a.txt" || r[1].Path != "b.txt" {
+		t.Errorf("hops left: got %v", r)
+	}
+	if r := saneHits(hits, alice, 0, me); len(r) != 1 || r[0].Path != "a.txt" {
+		t.Errorf("no hops left: got %v", r)
+	}
+}
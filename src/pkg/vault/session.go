@@ -0,0 +1,356 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"tonika/http"
+	"tonika/prof"
+	"tonika/sys"
+)
+
+// Dialer sessions between vaults carry more than one request. A session
+// accepted from a neighbor serves pipelined requests until it has been idle
+// for sessionIdle. Sessions to a neighbor are kept in a pool when their
+// response is done, and reused by the next request to the same neighbor
+// within poolIdle, well before the neighbor gives up on them. Pooled
+// sessions are closed when the vault shuts down.
+
+const (
+	sessionIdle   = 60e9 // ns an accepted session may be idle
+	poolIdle      = 30e9 // ns a pooled session is kept
+	maxPipeline   = 8    // requests served at the same time on a session
+	maxIdlePerHop = 4    // pooled sessions per neighbor
+)
+
+// idleTimer closes a connection once no request has been in progress on it
+// for idle nanoseconds
+type idleTimer struct {
+	c     io.Closer
+	idle  int64
+	busy  int
+	stamp int64 // counts the times the connection got busy
+	lk    sync.Mutex
+}
+
+func newIdleTimer(c io.Closer, idle int64) *idleTimer {
+	t := &idleTimer{c: c, idle: idle, busy: 1}
+	t.end()
+	return t
+}
+
+func (t *idleTimer) begin() {
+	t.lk.Lock()
+	t.busy++
+	t.stamp++
+	t.lk.Unlock()
+}
+
+func (t *idleTimer) end() {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.busy--
+	if t.busy > 0 {
+		return
+	}
+	stamp := t.stamp
+	go func() {
+		time.Sleep(t.idle)
+		t.lk.Lock()
+		idle := t.busy == 0 && t.stamp == stamp
+		t.lk.Unlock()
+		if idle {
+			t.c.Close()
+		}
+	}()
+}
+
+// serveOnBehalf serves the requests of a session accepted from peer
+func (v *Vault0) serveOnBehalf(peer sys.Id, c net.Conn) {
+	serveSession(c, sessionIdle, func(asc *http.AsyncServerConn, req *http.Request) {
+		v.serveOne(peer, asc, req)
+	})
+}
+
+// serveSession has serve answer the requests read from c, at most
+// maxPipeline at a time. Since dialer connections have no read timeouts,
+// c is closed by an idleTimer after idle nanoseconds without a request in
+// progress. The responses are written in the order of the requests.
+func serveSession(c net.Conn, idle int64, serve func(*http.AsyncServerConn, *http.Request)) {
+	asc := http.NewAsyncServerConn(c)
+	timer := newIdleTimer(c, idle)
+	pending := make(chan bool, maxPipeline)
+	for {
+		req, err := asc.Read()
+		if err != nil {
+			break
+		}
+		timer.begin()
+		pending <- true
+		go func() {
+			serve(asc, req)
+			timer.end()
+			<-pending
+		}()
+	}
+	// wait for the responses in progress
+	for i := 0; i < maxPipeline; i++ {
+		pending <- true
+	}
+	asc.Close()
+	c.Close()
+}
+
+func (v *Vault0) serveOne(peer sys.Id, asc *http.AsyncServerConn, req *http.Request) {
+	// Increase the hop count, due to successful arrival
+	hop, err := parseReqHop(req)
+	if err == nil {
+		setReqHop(req, hop+1)
+	} else {
+		setReqHop(req, 0)
+	}
+
+	closing := req.Close
+	resp, err := v.serve(req, false, peer)
+	if resp != nil {
+		setRespVersion(resp)
+		// Whether to keep the session open is up to this hop
+		resp.Close = closing
+	}
+
+	asc.Write(req, resp)
+
+	if err != nil {
+		v.w.IncErrOnBehalfReqs()
+	} else {
+		v.w.IncOKOnBehalfReqs()
+	}
+}
+
+// session is a connection to the vault of a neighbor
+type session struct {
+	hop   sys.Id
+	conn  *prof.Conn
+	acc   *http.AsyncClientConn
+	in    int64 // traffic before the current request
+	out   int64
+	start int64 // ns, when the current request was sent
+	idle  int64 // ns, when the session was put in the pool
+}
+
+func (s *session) close() {
+	s.acc.Close()
+	s.conn.Close()
+}
+
+// sessionPool keeps idle sessions, by neighbor
+type sessionPool struct {
+	idle   map[sys.Id][]*session
+	closed bool // sessions are no longer kept
+	lk     sync.Mutex
+}
+
+// get returns the most recently used session to hop, or nil
+func (p *sessionPool) get(hop sys.Id) *session {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	l := p.idle[hop]
+	if len(l) == 0 {
+		return nil
+	}
+	s := l[len(l)-1]
+	p.setIdle(hop, l[0:len(l)-1])
+	return s
+}
+
+// put keeps s for reuse, for at most poolIdle
+func (p *sessionPool) put(s *session) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[sys.Id][]*session)
+	}
+	l := p.idle[s.hop]
+	if p.closed || len(l) >= maxIdlePerHop {
+		s.close()
+		return
+	}
+	s.idle = time.Nanoseconds()
+	r := make([]*session, len(l)+1)
+	copy(r, l)
+	r[len(l)] = s
+	p.idle[s.hop] = r
+	go func() {
+		time.Sleep(poolIdle)
+		p.expire(s)
+	}()
+}
+
+// expire closes s, if it is still in the pool and has been idle for
+// poolIdle
+func (p *sessionPool) expire(s *session) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	l := p.idle[s.hop]
+	for i, t := range l {
+		if t != s {
+			continue
+		}
+		if time.Nanoseconds()-s.idle < poolIdle {
+			return
+		}
+		r := make([]*session, len(l)-1)
+		copy(r, l[0:i])
+		copy(r[i:], l[i+1:])
+		p.setIdle(s.hop, r)
+		s.close()
+		return
+	}
+}
+
+// close closes the pooled sessions, and those put in the pool from now on
+func (p *sessionPool) close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.closed = true
+	for hop, l := range p.idle {
+		for _, s := range l {
+			s.close()
+		}
+		p.idle[hop] = nil, false
+	}
+}
+
+// setIdle sets the idle sessions to hop. The caller holds p.lk.
+func (p *sessionPool) setIdle(hop sys.Id, l []*session) {
+	if len(l) == 0 {
+		p.idle[hop] = nil, false
+	} else {
+		p.idle[hop] = l
+	}
+}
+
+// dialSession opens a new session to hop, or returns nil
+func (v *Vault0) dialSession(hop sys.Id) *session {
+	d := v.isHealthy()
+	if d == nil {
+		return nil
+	}
+	c := d.Dial(hop, "vault0")
+	if c == nil {
+		return nil
+	}
+	pc := prof.NewConn(c)
+	return &session{hop: hop, conn: pc, acc: http.NewAsyncClientConn(pc)}
+}
+
+// fetchOnSession sends req to the neighbor hop, on a pooled session if there
+// is one. Requests with a body always get a new session, since the body
+// cannot be sent again if a pooled session turns out to be closed. The
+// session must be given back with releaseSession when the response is done.
+func (v *Vault0) fetchOnSession(hop sys.Id, req *http.Request) (*http.Response, *session, os.Error) {
+	req.Close = false
+	var s *session
+	if req.Body == nil {
+		s = v.pool.get(hop)
+	}
+	v.w.IncFwdSession(hop, s != nil)
+	if s != nil {
+		if resp, err := s.fetch(req); err == nil {
+			return resp, s, nil
+		}
+		s.close()
+	}
+	if s = v.dialSession(hop); s == nil {
+		return nil, nil, os.ErrorString("service unavailable")
+	}
+	resp, err := s.fetch(req)
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+	return resp, s, nil
+}
+
+func (s *session) fetch(req *http.Request) (*http.Response, os.Error) {
+	s.in, s.out = s.conn.InTraffic(), s.conn.OutTraffic()
+	s.start = time.Nanoseconds()
+	return s.acc.Fetch(req)
+}
+
+// releaseSession records the traffic of the request on s, and pools s if
+// the response was read to the end and the neighbor keeps the session open
+func (v *Vault0) releaseSession(s *session, my, reuse bool) {
+	in, out := s.conn.InTraffic()-s.in, s.conn.OutTraffic()-s.out
+	if my {
+		v.w.IncFwdMyInTraffic(s.hop, in)
+		v.w.IncFwdMyOutTraffic(s.hop, out)
+	} else {
+		v.w.IncFwdBehalfInTraffic(s.hop, in)
+		v.w.IncFwdBehalfOutTraffic(s.hop, out)
+	}
+	v.w.RecFwdLatencyPerByte(s.hop, float64(time.Nanoseconds()-s.start)/float64(in))
+	if reuse {
+		v.pool.put(s)
+	} else {
+		s.close()
+	}
+}
+
+// sessionBody is the body of a response fetched on a session. The session
+// is released when the body is closed, and only reused if the body was read
+// to the end; otherwise it is closed first, rather than reading the rest.
+type sessionBody struct {
+	io.ReadCloser
+	v     *Vault0
+	s     *session
+	my    bool
+	reuse bool // the neighbor keeps the session open
+	eof   bool
+	lk    sync.Mutex
+}
+
+func (b *sessionBody) Read(p []byte) (int, os.Error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == os.EOF {
+		b.lk.Lock()
+		b.eof = true
+		b.lk.Unlock()
+	}
+	return n, err
+}
+
+func (b *sessionBody) Close() os.Error {
+	b.lk.Lock()
+	s := b.s
+	b.s = nil
+	reuse := b.reuse && b.eof
+	b.lk.Unlock()
+	if s == nil {
+		return nil
+	}
+	if !reuse {
+		s.conn.Close()
+	}
+	err := b.ReadCloser.Close()
+	b.v.releaseSession(s, b.my, reuse && err == nil)
+	return err
+}
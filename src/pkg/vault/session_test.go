@@ -0,0 +1,284 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tonika/http"
+	"tonika/prof"
+	"tonika/sys"
+)
+
+// nopConn is a net.Conn that only remembers being closed
+type nopConn struct {
+	closed bool
+}
+
+func (c *nopConn) Read(p []byte) (int, os.Error)        { return 0, os.EOF }
+func (c *nopConn) Write(p []byte) (int, os.Error)       { return len(p), nil }
+func (c *nopConn) Close() os.Error                      { c.closed = true; return nil }
+func (c *nopConn) LocalAddr() net.Addr                  { return nil }
+func (c *nopConn) RemoteAddr() net.Addr                 { return nil }
+func (c *nopConn) SetTimeout(nsec int64) os.Error       { return nil }
+func (c *nopConn) SetReadTimeout(nsec int64) os.Error   { return nil }
+func (c *nopConn) SetWriteTimeout(nsec int64) os.Error  { return nil }
+
+func newTestSession(hop sys.Id) (*session, *nopConn) {
+	c := &nopConn{}
+	pc := prof.NewConn(c)
+	return &session{hop: hop, conn: pc, acc: http.NewAsyncClientConn(pc)}, c
+}
+
+func TestSessionPool(t *testing.T) {
+	var p sessionPool
+	hop := sys.Id(7)
+	if p.get(hop) != nil {
+		t.Fatalf("empty pool returned a session")
+	}
+	l := make([]*session, maxIdlePerHop+1)
+	conns := make([]*nopConn, maxIdlePerHop+1)
+	for i := range l {
+		l[i], conns[i] = newTestSession(hop)
+		p.put(l[i])
+	}
+	// The pool is full, so the last session is closed
+	if !conns[maxIdlePerHop].closed {
+		t.Errorf("session beyond the pool limit not closed")
+	}
+	if p.get(sys.Id(8)) != nil {
+		t.Errorf("session to the wrong hop")
+	}
+	// Most recently used first
+	for i := maxIdlePerHop - 1; i >= 0; i-- {
+		if s := p.get(hop); s != l[i] {
+			t.Errorf("get %d: wrong session", i)
+		}
+		if conns[i].closed {
+			t.Errorf("pooled session %d closed", i)
+		}
+	}
+	if p.get(hop) != nil || len(p.idle) != 0 {
+		t.Errorf("pool not empty")
+	}
+
+	// A session that has been idle long enough is expired
+	s, c := newTestSession(hop)
+	p.put(s)
+	p.expire(s)
+	if c.closed {
+		t.Errorf("fresh session expired")
+	}
+	p.lk.Lock()
+	s.idle -= poolIdle
+	p.lk.Unlock()
+	p.expire(s)
+	if !c.closed || p.get(hop) != nil {
+		t.Errorf("idle session not expired")
+	}
+}
+
+func TestSessionPoolClose(t *testing.T) {
+	var p sessionPool
+	s, c := newTestSession(7)
+	p.put(s)
+	p.close()
+	if !c.closed || p.get(7) != nil {
+		t.Errorf("pooled session not closed")
+	}
+	s, c = newTestSession(7)
+	p.put(s)
+	if !c.closed || p.get(7) != nil {
+		t.Errorf("session kept by a closed pool")
+	}
+}
+
+// startSession listens on a local port, and serves the first connection
+// made to it with serveSession. It returns the address to dial.
+func startSession(t *testing.T, idle int64, serve func(*http.AsyncServerConn, *http.Request)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err == nil {
+			serveSession(c, idle, serve)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// answer answers req with its path
+func answer(asc *http.AsyncServerConn, req *http.Request) {
+	asc.Write(req, buildResp(req.URL.Path))
+}
+
+// pipeline sends a GET request for each of paths on c at once, and returns
+// the bodies of the responses in the order they came
+func pipeline(t *testing.T, c net.Conn, paths []string) []string {
+	for _, p := range paths {
+		if _, err := c.Write([]byte("GET " + p + " HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+	}
+	r := bufio.NewReader(c)
+	bodies := make([]string, len(paths))
+	for i := range paths {
+		resp, err := http.ReadResponse(r, "GET")
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		bodies[i] = string(data)
+	}
+	return bodies
+}
+
+func TestServeSessionOrder(t *testing.T) {
+	addr := startSession(t, 10e9, func(asc *http.AsyncServerConn, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(2e8)
+		}
+		answer(asc, req)
+	})
+	c, err := net.Dial("tcp", "", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer c.Close()
+	paths := []string{"/slow", "/a", "/b"}
+	got := pipeline(t, c, paths)
+	if strings.Join(got, " ") != strings.Join(paths, " ") {
+		t.Errorf("responses out of order: %v", got)
+	}
+}
+
+func TestServeSessionLimit(t *testing.T) {
+	var lk sync.Mutex
+	busy, most := 0, 0
+	release := make(chan bool)
+	addr := startSession(t, 10e9, func(asc *http.AsyncServerConn, req *http.Request) {
+		lk.Lock()
+		busy++
+		if busy > most {
+			most = busy
+		}
+		lk.Unlock()
+		<-release
+		lk.Lock()
+		busy--
+		lk.Unlock()
+		answer(asc, req)
+	})
+	c, err := net.Dial("tcp", "", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer c.Close()
+	n := maxPipeline + 3
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = "/" + strings.Repeat("x", i+1)
+	}
+	done := make(chan []string, 1)
+	go func() { done <- pipeline(t, c, paths) }()
+	time.Sleep(3e8)
+	lk.Lock()
+	b := busy
+	lk.Unlock()
+	if b != maxPipeline {
+		t.Errorf("%d requests served at once, want %d", b, maxPipeline)
+	}
+	for i := 0; i < n; i++ {
+		release <- true
+	}
+	got := <-done
+	if most != maxPipeline || strings.Join(got, " ") != strings.Join(paths, " ") {
+		t.Errorf("at most %d at once, responses %v", most, got)
+	}
+}
+
+func TestServeSessionIdle(t *testing.T) {
+	addr := startSession(t, 1e8, func(asc *http.AsyncServerConn, req *http.Request) {
+		// a request in progress keeps the session open
+		time.Sleep(3e8)
+		answer(asc, req)
+	})
+	c, err := net.Dial("tcp", "", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer c.Close()
+	if got := pipeline(t, c, []string{"/a"}); got[0] != "/a" {
+		t.Fatalf("response %q", got[0])
+	}
+	c.SetReadTimeout(5e9)
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err != os.EOF {
+		t.Errorf("idle session not closed: %d, %v", n, err)
+	}
+}
+
+// testDialer dials addr for every Dial
+type testDialer struct {
+	addr  string
+	dials int
+}
+
+func (d *testDialer) Dial(id sys.Id, subject string) net.Conn {
+	d.dials++
+	c, err := net.Dial("tcp", "", d.addr)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+func (d *testDialer) Accept(subject string) (sys.Id, net.Conn) { select {} }
+func (d *testDialer) WaitForArrival() sys.Id                    { select {} }
+
+// A pooled session the neighbor has closed is replaced by a new one
+func TestStaleSession(t *testing.T) {
+	hop := sys.Id(7)
+	d := &testDialer{addr: startSession(t, 10e9, answer)}
+	v := &Vault0{d: d}
+	v.w.Init(&v.fdlim)
+	stale, c := newTestSession(hop)
+	v.pool.put(stale)
+
+	req := &http.Request{Method: "GET", Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Host: "x", Header: make(map[string]string)}
+	req.URL, _ = http.ParseURL("/fresh")
+	resp, s, err := v.fetchOnSession(hop, req)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "/fresh" || s == stale || !c.closed || d.dials != 1 {
+		t.Errorf("stale session not replaced: %q, %d dials", data, d.dials)
+	}
+	s.close()
+}
@@ -0,0 +1,405 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// ServeSwarm fetches a file like ServeVerified, but the chunks missing
+// from my chunk store are fetched in parallel, from the owner of the file
+// and from online friends whose chunk stores hold them. Friends are asked
+// which chunks they hold, and for the chunks themselves, under chunksDir:
+//
+//	/.tonika-chunks?have=<hash>,<hash>,...	a '1' or '0' per chunk
+//	/.tonika-chunks/<hash>			the chunk
+//
+// Only direct neighbors are answered, and only with chunks that may be
+// shared (see chunks.go).
+
+const chunksDir = ".tonika-chunks"
+
+const (
+	swarmWorkers = 4   // chunks fetched at the same time
+	swarmWindow  = 16  // chunks fetched ahead of the reader
+	swarmAsk     = 128 // chunks asked about in one request
+	swarmWait    = 5e9 // ns to wait for friends to say which chunks they hold
+)
+
+// Neighbors tells the vault about my friends, to ask them for chunks
+type Neighbors interface {
+	Enumerate() []sys.View
+}
+
+// SetNeighbors tells the vault where to look up my friends
+func (v *Vault0) SetNeighbors(n Neighbors) {
+	v.lk.Lock()
+	v.neighbors = n
+	v.lk.Unlock()
+}
+
+// onlineNeighbors returns the Ids of the friends who are online, except id
+func (v *Vault0) onlineNeighbors(except sys.Id) []sys.Id {
+	v.lk.Lock()
+	n := v.neighbors
+	v.lk.Unlock()
+	if n == nil {
+		return nil
+	}
+	views := n.Enumerate()
+	r := make([]sys.Id, 0, len(views))
+	for _, f := range views {
+		if !f.IsOnline() || f.IsRevoked() || f.GetId() == nil || *f.GetId() == except {
+			continue
+		}
+		r = r[0 : len(r)+1]
+		r[len(r)-1] = *f.GetId()
+	}
+	return r
+}
+
+// serveChunks answers a neighbor's question about, or request for, chunks
+// in my chunk store. rest is the path below chunksDir.
+func (v *Vault0) serveChunks(rest, query string, origin, peer sys.Id) (*http.Response, os.Error) {
+	if origin != peer {
+		return newRespForbidden(), os.ErrorString("forbidden")
+	}
+	if rest != "" {
+		sum, err := hex.DecodeString(rest)
+		if err != nil || len(sum) != sys.ChunkHashLen {
+			return newRespBadRequest(), os.ErrorString("bad request")
+		}
+		data := v.chunks.get(sum, true)
+		if data == nil {
+			return newRespNotFound(), os.ErrorString("not found")
+		}
+		n, body := http.BytesToBody(data)
+		resp := buildRespFromBody(body, int64(n))
+		setPrivate(resp)
+		return resp, nil
+	}
+	args, err := http.ParseQuery(query)
+	if err != nil || len(args["have"]) != 1 {
+		return newRespBadRequest(), os.ErrorString("bad request")
+	}
+	sums := strings.Split(args["have"][0], ",", -1)
+	if len(sums) > swarmAsk {
+		return newRespBadRequest(), os.ErrorString("bad request")
+	}
+	held := make([]byte, len(sums))
+	for i, s := range sums {
+		held[i] = '0'
+		if sum, err := hex.DecodeString(s); err == nil && v.chunks.has(sum, true) {
+			held[i] = '1'
+		}
+	}
+	resp := buildResp(string(held))
+	setPrivate(resp)
+	return resp, nil
+}
+
+// askNeighbor sends a GET request for fpath?query to the vault of peer,
+// and returns the body of its answer, which may be at most limit bytes
+func (v *Vault0) askNeighbor(peer sys.Id, fpath, query string, limit int64) ([]byte, os.Error) {
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &http.URL{Path: "/" + fpath, RawQuery: query},
+		Host:       sys.MakeHost("", peer),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(map[string]string),
+	}
+	setReqHop(req, 0)
+	setOrigin(req, v.id)
+	setReqVersion(req)
+	resp, s, err := v.fetchOnSession(peer, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Body == nil {
+		v.releaseSession(s, true, !resp.Close)
+		return nil, os.ErrorString("empty answer")
+	}
+	body := &sessionBody{ReadCloser: resp.Body, v: v, s: s, my: true, reuse: !resp.Close}
+	defer body.Close()
+	if resp.StatusCode != 200 {
+		return nil, os.ErrorString(resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, os.ErrorString("answer too long")
+	}
+	return data, nil
+}
+
+// ServeSwarm answers a GET request of mine for a file in a friend's vault,
+// like ServeVerified. If count is not nil, it is called for every chunk
+// passed on, with its source and the number of its bytes passed on. The
+// source is my own Id for chunks from my chunk store.
+func (v *Vault0) ServeSwarm(req *http.Request, count func(src sys.Id, n int64)) (*http.Response, os.Error) {
+	f, resp, err := v.openVerified(req)
+	if f == nil {
+		return resp, err
+	}
+	return v.respondVerified(f, func(start, end int64) io.ReadCloser {
+		return v.startSwarm(f, start, end, count)
+	}), nil
+}
+
+type swarmResult struct {
+	data []byte
+	src  sys.Id
+	err  os.Error
+}
+
+// swarmBody reads the bytes off to end of f from the chunks fetched by the
+// workers of the swarm
+type swarmBody struct {
+	v        *Vault0
+	f        *verifiedFile
+	off, end int64
+	first    int                // first chunk needed
+	results  []chan swarmResult // per chunk, from first on
+	holders  map[int][]sys.Id   // friends holding each missing chunk
+	bad      map[sys.Id]bool    // friends who sent bad chunks
+	count    func(src sys.Id, n int64)
+	window   chan bool
+	found    chan bool // closed when the friends have answered, or after swarmWait
+	done     chan bool
+	buf      []byte
+	err      os.Error
+	lk       sync.Mutex
+}
+
+func (v *Vault0) startSwarm(f *verifiedFile, start, end int64,
+	count func(src sys.Id, n int64)) *swarmBody {
+
+	b := &swarmBody{
+		v:       v,
+		f:       f,
+		off:     start,
+		end:     end,
+		holders: make(map[int][]sys.Id),
+		bad:     make(map[sys.Id]bool),
+		count:   count,
+		window:  make(chan bool, swarmWindow),
+		found:   make(chan bool),
+		done:    make(chan bool),
+	}
+	if start >= end {
+		return b
+	}
+	b.first = int(start / f.m.ChunkSize)
+	last := int((end - 1) / f.m.ChunkSize)
+	b.results = make([]chan swarmResult, last-b.first+1)
+	for i := range b.results {
+		b.results[i] = make(chan swarmResult, 1)
+	}
+	jobs := make(chan int)
+	go b.discover(last)
+	go func() {
+		defer close(jobs)
+		for i := b.first; i <= last; i++ {
+			select {
+			case b.window <- true:
+			case <-b.done:
+				return
+			}
+			jobs <- i
+		}
+	}()
+	for k := 0; k < swarmWorkers; k++ {
+		go func() {
+			for i := range jobs {
+				b.results[i-b.first] <- b.fetch(i)
+			}
+		}()
+	}
+	return b
+}
+
+// discover asks the online friends which of the chunks up to last,
+// missing from my chunk store, they hold
+func (b *swarmBody) discover(last int) {
+	m := b.f.m
+	var missing []int
+	for i := b.first; i <= last; i++ {
+		if !b.v.chunks.has(m.ChunkHash(i), false) {
+			if missing == nil {
+				missing = make([]int, 0, last-i+1)
+			}
+			missing = missing[0 : len(missing)+1]
+			missing[len(missing)-1] = i
+		}
+	}
+	peers := b.v.onlineNeighbors(b.f.tid)
+	if len(missing) == 0 || len(peers) == 0 {
+		close(b.found)
+		return
+	}
+	answered := make(chan bool, len(peers)+1)
+	go func() {
+		time.Sleep(swarmWait)
+		answered <- false
+	}()
+	go func() {
+		for k := 0; k < len(peers); k++ {
+			if !<-answered {
+				break
+			}
+		}
+		close(b.found)
+	}()
+	for _, peer := range peers {
+		go func(peer sys.Id) {
+			defer func() { answered <- true }()
+			for k := 0; k < len(missing); k += swarmAsk {
+				batch := missing[k:]
+				if len(batch) > swarmAsk {
+					batch = batch[0:swarmAsk]
+				}
+				sums := make([]string, len(batch))
+				for j, i := range batch {
+					sums[j] = hex.EncodeToString(m.ChunkHash(i))
+				}
+				held, err := b.v.askNeighbor(peer, chunksDir,
+					"have="+strings.Join(sums, ","), int64(len(batch)))
+				if err != nil || len(held) != len(batch) {
+					return
+				}
+				b.lk.Lock()
+				for j, i := range batch {
+					if held[j] == '1' {
+						b.holders[i] = appendId(b.holders[i], peer)
+					}
+				}
+				b.lk.Unlock()
+			}
+		}(peer)
+	}
+}
+
+func appendId(l []sys.Id, id sys.Id) []sys.Id {
+	r := make([]sys.Id, len(l)+1)
+	copy(r, l)
+	r[len(l)] = id
+	return r
+}
+
+// fetch gets the i-th chunk from my chunk store, a friend holding it, or
+// else the owner of the file
+func (b *swarmBody) fetch(i int) swarmResult {
+	select {
+	case <-b.done:
+		return swarmResult{err: os.EOF}
+	default:
+	}
+	m := b.f.m
+	sum := m.ChunkHash(i)
+	if data := b.v.chunks.get(sum, false); data != nil {
+		return swarmResult{data, b.v.id, nil}
+	}
+	select {
+	case <-b.found:
+	case <-b.done:
+		return swarmResult{err: os.EOF}
+	}
+
+	// Friends holding the chunk, starting with a different one for each
+	// chunk to spread the load
+	b.lk.Lock()
+	holders := b.holders[i]
+	b.lk.Unlock()
+	for k := range holders {
+		peer := holders[(i+k)%len(holders)]
+		b.lk.Lock()
+		bad := b.bad[peer]
+		b.lk.Unlock()
+		if bad {
+			continue
+		}
+		data, err := b.v.askNeighbor(peer, chunksDir+"/"+hex.EncodeToString(sum), "", m.ChunkSize)
+		if err != nil {
+			continue
+		}
+		data, err = b.v.readChunk(b.f, i, bytes.NewBuffer(data), peer)
+		if err == nil {
+			return swarmResult{data, peer, nil}
+		}
+		b.lk.Lock()
+		b.bad[peer] = true
+		b.lk.Unlock()
+	}
+
+	resp, err := b.v.fetchChunks(b.f, i, i)
+	if err != nil {
+		return swarmResult{err: err}
+	}
+	data, err := b.v.readChunk(b.f, i, resp.Body, b.f.tid)
+	resp.Body.Close()
+	return swarmResult{data, b.f.tid, err}
+}
+
+func (b *swarmBody) Read(p []byte) (int, os.Error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.off >= b.end {
+			return 0, os.EOF
+		}
+		i := int(b.off / b.f.m.ChunkSize)
+		r := <-b.results[i-b.first]
+		<-b.window
+		if r.err != nil {
+			b.err = r.err
+			return 0, r.err
+		}
+		b.buf = chunkPart(b.f.m, i, r.data, b.off, b.end)
+		if b.count != nil {
+			b.count(r.src, int64(len(b.buf)))
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.off += int64(n)
+	return n, nil
+}
+
+// Close stops the workers. Chunks they are fetching are still stored.
+func (b *swarmBody) Close() os.Error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.err != os.EOF {
+		b.err = os.EOF
+		close(b.done)
+	}
+	return nil
+}
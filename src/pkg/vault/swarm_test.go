@@ -0,0 +1,78 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"tonika/sys"
+)
+
+func TestServeChunks(t *testing.T) {
+	dir := path.Join(os.TempDir(), "tonika-swarm-test")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	s, err := makeChunkStore(dir)
+	if err != nil {
+		t.Fatalf("makeChunkStore: %s", err)
+	}
+	v := &Vault0{id: 1, chunks: s}
+	a, p := []byte("aaaaaaaaaa"), []byte("pppppppppp")
+	ha, hp := sys.HashChunk(a), sys.HashChunk(p)
+	s.put(ha, a, true)
+	s.put(hp, p, false)
+	missing := sys.HashChunk([]byte("missing"))
+	friend := sys.Id(2)
+
+	query := "have=" + hex.EncodeToString(ha) + "," + hex.EncodeToString(hp) +
+		"," + hex.EncodeToString(missing)
+	resp, err := v.serveChunks("", query, friend, friend)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("have: %v", err)
+	}
+	held, _ := ioutil.ReadAll(resp.Body)
+	if string(held) != "100" {
+		t.Errorf("have: expected 100, got %s", held)
+	}
+
+	resp, err = v.serveChunks(hex.EncodeToString(ha), "", friend, friend)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("get: %v", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(data, a) {
+		t.Errorf("get: wrong chunk")
+	}
+
+	// Private chunks are not given out, and only neighbors are answered
+	resp, _ = v.serveChunks(hex.EncodeToString(hp), "", friend, friend)
+	if resp.StatusCode != 404 {
+		t.Errorf("private chunk: got %d", resp.StatusCode)
+	}
+	resp, _ = v.serveChunks(hex.EncodeToString(ha), "", sys.Id(3), friend)
+	if resp.StatusCode != 403 {
+		t.Errorf("forwarded request: got %d", resp.StatusCode)
+	}
+	resp, _ = v.serveChunks("", "have=xyz", friend, friend)
+	if resp.StatusCode != 200 {
+		t.Errorf("bad hash: got %d", resp.StatusCode)
+	}
+}
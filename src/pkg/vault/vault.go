@@ -19,19 +19,27 @@ package vault
 
 import (
 	//"fmt"
-	"net"
 	"os"
 	"path"
+	"strings"
 	//"sync"
+	"time"
 	"tonika/dialer"
 	"tonika/compass"
 	"tonika/http"
 	"tonika/prof"
+	"tonika/slog"
 	"tonika/sys"
 )
 
+var logger = slog.For("vault")
+
 type Vault interface {
 	Serve(req *http.Request) (*http.Response, os.Error)
+	ServeVerified(req *http.Request) (*http.Response, os.Error)
+	ServeSwarm(req *http.Request, count func(src sys.Id, n int64)) (*http.Response, os.Error)
+	Search(query string, hops int) ([]*SearchHit, os.Error)
+	Inbox() ([]*InboxFile, os.Error)
 }
 
 type Vault0 struct {
@@ -42,6 +50,20 @@ type Vault0 struct {
 	c         compass.Compass
 	lk        prof.Mutex
 	fdlim     http.FDLimiter
+	errch     chan os.Error
+	groups    sys.Groups      // for ACL files, see acl.go
+	inbox     inboxConfig     // see inbox.go
+	uploading map[sys.Id]bool // senders with an upload in progress
+	cache     *cache          // copies of friends' content, see cache.go
+	chunks    *chunkStore     // verified chunks, see chunks.go
+	sigkey    *sys.SigKey     // signs manifests, see manifest.go
+	manifests map[string]*sys.Manifest
+	signed    map[string]int64 // newest manifest seen of friends' files, see verify.go
+	neighbors Neighbors // friends to ask for chunks, see swarm.go
+	pool      sessionPool // idle sessions to neighbors, see session.go
+	index     *index           // words of the files, see index.go
+	queries   map[string]int64 // ids of recent searches, see search.go
+	searches  map[sys.Id]*peerSearches // queries per friend, see search.go
 }
 
 const maxHops = 10
@@ -56,20 +78,43 @@ func MakeVault0(id sys.Id, hdir,cdir string, fdlim int,
 		return nil, os.ErrorString("Bad cache directory")
 	}
 	v := &Vault0{
-		id:      id,
-		hdir:    hdir,
-		cdir:    cdir,
-		d:       d,
-		c:       c,
+		id:        id,
+		hdir:      hdir,
+		cdir:      cdir,
+		d:         d,
+		c:         c,
+		errch:     make(chan os.Error, 5),
+		inbox:     inboxConfig{quota: DefaultInboxQuota},
+		uploading: make(map[sys.Id]bool),
+		manifests: make(map[string]*sys.Manifest),
+		signed:    make(map[string]int64),
+		queries:   make(map[string]int64),
+		searches:  make(map[sys.Id]*peerSearches),
+	}
+	vc, err := makeCache(path.Join(cdir, "vault-cache", id.Eye()))
+	if err != nil {
+		return nil, err
+	}
+	v.cache = vc
+	cs, err := makeChunkStore(path.Join(cdir, "chunks"))
+	if err != nil {
+		return nil, err
 	}
+	v.chunks = cs
 	v.fdlim.Init(fdlim)
 	v.w.Init(&v.fdlim)
+	v.index = makeIndex(&v.fdlim)
 	go v.accept()
+	go v.acceptSearch()
+	go v.indexLoop()
 	return v,nil
 }
 
 func (v *Vault0) String() string { return v.w.String() }
 
+// log returns the logger of this vault's identity
+func (v *Vault0) log() *slog.Logger { return logger.Local(v.id) }
+
 func (v *Vault0) MarshalJSON() ([]byte, os.Error) { return v.w.MarshalJSON() }
 
 func (v *Vault0) accept() {
@@ -78,45 +123,11 @@ func (v *Vault0) accept() {
 		if d == nil {
 			return
 		}
-		_, conn := d.Accept("vault0")
+		peer, conn := d.Accept("vault0")
 		if conn == nil {
 			continue
 		}
-		go v.serveOnBehalf(conn)
-	}
-}
-
-// Serve connections coming from Dialer (i.e. from neighbors on the network)
-func (v *Vault0) serveOnBehalf(c net.Conn) {
-	asc := http.NewAsyncServerConn(c)
-	req,err := asc.Read()
-	if err != nil {
-		asc.Close()
-		c.Close()
-		return
-	}
-
-	// Increase the hop count, due to successful arrival
-	hop,err := parseReqHop(req)
-	if err == nil {
-		setReqHop(req, hop+1)
-	} else {
-		setReqHop(req, 0)
-	}
-
-	resp,err := v.serve(req, false)
-	if resp != nil {
-		setRespVersion(resp)
-	}
-
-	asc.Write(req, resp)
-	asc.Close()
-	c.Close()
-
-	if err != nil {
-		v.w.IncErrOnBehalfReqs()
-	} else {
-		v.w.IncOKOnBehalfReqs()
+		go v.serveOnBehalf(peer, conn)
 	}
 }
 
@@ -124,7 +135,7 @@ func (v *Vault0) Serve(req *http.Request) (*http.Response, os.Error) {
 	setReqHop(req, 0)
 	setOrigin(req, v.id)
 
-	resp,err := v.serve(req, true)
+	resp,err := v.serve(req, true, v.id)
 	if err != nil {
 		v.w.IncErrMyReqs()
 	} else {
@@ -145,16 +156,18 @@ func (v *Vault0) Serve(req *http.Request) (*http.Response, os.Error) {
 // to the number of hops the request/response had already travelled by the time
 // it was received at its origin.
 
-func (v *Vault0) serve(req *http.Request, my bool) (*http.Response, os.Error) {
-	// We don't expect a body in requests (at this stage, there are no POSTs)
-	if req.Body != nil {
-		req.Body.Close()
-		req.Body = nil
+// peer is the neighbor that handed us the request, or our own id.
+func (v *Vault0) serve(req *http.Request, my bool, peer sys.Id) (*http.Response, os.Error) {
+	// Only uploads to an inbox carry a body (see inbox.go), which is streamed
+	// on to the destination
+	if req.Method != "PUT" && req.Method != "POST" {
+		discardBody(req)
 	}
 
 	// Parse the URL
 	tid,fpath,query,err := parseURL(req)
 	if err != nil {
+		discardBody(req)
 		return newRespBadRequest(), os.ErrorString("bad request")
 	}
 
@@ -164,7 +177,11 @@ func (v *Vault0) serve(req *http.Request, my bool) (*http.Response, os.Error) {
 		if err == nil {
 			v.w.AddHopsFwd(h)  // Stat hop count at destination
 		}
-		resp,err := v.serveLocal(fpath,query)
+		oid,err := parseOrigin(req)
+		if err != nil {
+			oid = peer
+		}
+		resp,err := v.serveLocal(req,fpath,query,oid,peer)
 		if err == nil {
 			setRespHop(resp,0)
 		}
@@ -174,10 +191,16 @@ func (v *Vault0) serve(req *http.Request, my bool) (*http.Response, os.Error) {
 	// Stop if too many hops or hops not included
 	h,err := parseReqHop(req)
 	if err != nil || h > maxHops {
+		discardBody(req)
 		v.w.IncTooManyHops()
 		return newRespServiceUnavailable(), os.ErrorString("too many hops")
 	}
 
+	return v.serveCached(req, my, tid, fpath, query)
+}
+
+// forward passes req on to the next hop towards tid
+func (v *Vault0) forward(req *http.Request, my bool, tid sys.Id) (*http.Response, os.Error) {
 	// Parse the HTTP header
 	sid,err := parseOrigin(req)
 	if err != nil {
@@ -185,37 +208,32 @@ func (v *Vault0) serve(req *http.Request, my bool) (*http.Response, os.Error) {
 	}
 	hid := v.c.QueryQuantize(sid,tid)
 	if hid == nil {
+		discardBody(req)
 		return newRespServiceUnavailable(), os.ErrorString("no route to destination")
 	}
-	d := v.isHealthy()
-	if d == nil {
-		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
-	}
-	cc := d.Dial(*hid, "vault0")
-	if cc == nil {
+	if v.isHealthy() == nil {
+		discardBody(req)
 		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
 	}
-	pcc := prof.NewConn(cc)
-	acc := http.NewAsyncClientConn(pcc)
 
-	// Pre-fetch
+	// Pre-fetch. Headers like Range and If-Range are passed on untouched, so
+	// that the destination can answer them.
 	_,err = parseReqHop(req)
 	if err != nil {
 		setReqHop(req, 0)
 	}
 	setReqVersion(req)
 
-	// Fetch and post-fetch
-	resp,err := acc.Fetch(req)
+	// Fetch and post-fetch, on a pooled session if possible (see session.go)
+	resp,s,err := v.fetchOnSession(*hid, req)
 	if err != nil {
-		acc.Close()
-		pcc.Close()
+		discardBody(req)
 		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
 	}
 
 	// Update hop
 	setRespVersion(resp)
-	h,err = parseRespHop(resp)
+	h,err := parseRespHop(resp)
 	if err == nil {
 		setRespHop(resp, h+1)
 	} else {
@@ -224,88 +242,193 @@ func (v *Vault0) serve(req *http.Request, my bool) (*http.Response, os.Error) {
 
 	// Do we understand the response?
 	if !statusCodeSupported(resp.StatusCode) {
-		acc.Close()
-		pcc.Close()
+		if resp.Body != nil {
+			s.conn.Close()
+			resp.Body.Close()
+		}
+		v.releaseSession(s, my, false)
 		return newRespUnsupported(), nil
 	}
 
-	// Set hooks for when body is fully read
+	// Release the session when the body is fully read
 	if resp.Body == nil {
-		// Update traffic stats
-		if my {
-			v.w.IncFwdMyInTraffic(*hid, pcc.InTraffic())
-			v.w.IncFwdMyOutTraffic(*hid, pcc.OutTraffic())
-		} else {
-			v.w.IncFwdBehalfInTraffic(*hid, pcc.InTraffic())
-			v.w.IncFwdBehalfOutTraffic(*hid, pcc.OutTraffic())
-		}
-		v.w.RecFwdLatencyPerByte(*hid, float64(pcc.Duration())/float64(pcc.InTraffic()))
-
-		acc.Close()
-		pcc.Close()
+		v.releaseSession(s, my, !resp.Close)
 	} else {
-		resp.Body = http.NewRunOnClose(resp.Body, func() {
-			// Update traffic stats
-			if my {
-				v.w.IncFwdMyInTraffic(*hid, pcc.InTraffic())
-				v.w.IncFwdMyOutTraffic(*hid, pcc.OutTraffic())
-			} else {
-				v.w.IncFwdBehalfInTraffic(*hid, pcc.InTraffic())
-				v.w.IncFwdBehalfOutTraffic(*hid, pcc.OutTraffic())
-			}
-			v.w.RecFwdLatencyPerByte(*hid, float64(pcc.Duration())/float64(pcc.InTraffic()))
-
-			acc.Close()
-			pcc.Close()
-		})
+		resp.Body = &sessionBody{ReadCloser: resp.Body, v: v, s: s, my: my, reuse: !resp.Close}
 	}
 
 	return resp, nil
 }
 
-func (v *Vault0) serveLocal(fpath, query string) (*http.Response, os.Error) {
+func (v *Vault0) serveLocal(req *http.Request, fpath, query string, origin, peer sys.Id) (*http.Response, os.Error) {
 	fpath = path.Clean(fpath)
 	if len(fpath) > 0 && fpath[0] == '/' {
 		fpath = fpath[1:]
 	}
 	if fpath == "" {
-		fpath = "index.html"
+		fpath = "."
+	}
+	// Friends may only upload, and only into the inbox
+	if rest, ok := v.inInbox(fpath); ok && (origin != v.id || peer != v.id) {
+		return v.serveInbox(req, rest, origin, peer)
+	}
+	if req.Method != "" && req.Method != "GET" && req.Method != "HEAD" {
+		discardBody(req)
+		return newRespMethodNotAllowed(), os.ErrorString("method not allowed")
+	}
+	// Neighbors may ask for chunks of my chunk store (see swarm.go)
+	if fpath == chunksDir {
+		return v.serveChunks("", query, origin, peer)
 	}
-	full := path.Join(v.hdir, fpath)
+	if strings.HasPrefix(fpath, chunksDir+"/") {
+		return v.serveChunks(fpath[len(chunksDir)+1:], query, origin, peer)
+	}
+	// A directory is served by its index.html, or else by a listing
+	if isDirectory(path.Join(v.getHomeDir(), fpath)) {
+		fpath = path.Join(fpath, "index.html")
+	}
+	if !v.canRead(fpath, origin, peer) {
+		v.log().With(origin).Infof("Denied %s (via %s)", fpath, peer.Eye())
+		return newRespForbidden(), os.ErrorString("forbidden")
+	}
+	// What not everyone may read must not be kept by caches along the way
+	private := !v.isPublic(fpath)
+	full := path.Join(v.getHomeDir(), fpath)
 	if !isFile(full) {
-		if fpath == "index.html" {
-			return newRespNoIndexHTML(), nil
-		} else {
-			return newRespNotFound(), os.ErrorString("not found")
+		dir, file := path.Split(fpath)
+		dir = path.Clean(dir)
+		if file == "index.html" && query != "manifest" && isDirectory(path.Join(v.getHomeDir(), dir)) {
+			// A listing leaves out what the requester may not read, so
+			// it differs from one friend to the next
+			resp, err := v.serveListing(dir, query, origin, peer)
+			setPrivate(resp)
+			return resp, err
+		}
+		return newRespNotFound(), os.ErrorString("not found")
+	}
+
+	if query == "manifest" {
+		resp, err := v.serveManifest(fpath, full)
+		if err == nil && private {
+			setPrivate(resp)
 		}
+		return resp, err
 	}
 
 	// Serve file if we can allocate a file descriptor in time
 	if v.fdlim.LockOrTimeout(10e9) == nil {
-		body, bodylen, err := http.FileToBody(full)
+		resp, err := serveFile(req, full)
 		if err != nil {
-			if body != nil {
-				body.Close()
-			}
 			v.fdlim.Unlock()
+			v.reportError(err)
 			return newRespServiceUnavailable(), os.ErrorString("service unavailable")
 		}
-		body = http.NewRunOnClose(body, func() { v.fdlim.Unlock() })
-		return buildRespFromBody(body, bodylen), nil
+		if resp.Body == nil {
+			v.fdlim.Unlock()
+		} else {
+			resp.Body = http.NewRunOnClose(resp.Body, func() { v.fdlim.Unlock() })
+		}
+		if private {
+			setPrivate(resp)
+		}
+		return resp, nil
 	} else {
+		v.reportError(os.ErrorString("file descriptor starvation"))
 		return newRespServiceUnavailable(), os.ErrorString("service unavailable")
 	}
 	panic("unreach")
 }
 
+// SetFDLimit changes the number of file descriptors used to serve files
+func (v *Vault0) SetFDLimit(fdlim int) { v.fdlim.SetLimit(fdlim) }
+
+// SetHomeDir changes the directory whose files are served to others
+func (v *Vault0) SetHomeDir(hdir string) os.Error {
+	if !isDirectory(hdir) {
+		return os.ErrorString("Bad home directory")
+	}
+	v.lk.Lock()
+	v.hdir = hdir
+	v.lk.Unlock()
+	return nil
+}
+
+// SetGroups tells the vault where to look up the groups named in ACL files
+func (v *Vault0) SetGroups(g sys.Groups) {
+	v.lk.Lock()
+	v.groups = g
+	v.lk.Unlock()
+}
+
+// SetCacheSize sets the size limit, in bytes, of the copies of friends'
+// content kept in the cache directory, and separately of the chunk store.
+// Zero turns caching off.
+func (v *Vault0) SetCacheSize(n int64) {
+	v.cache.setMax(n)
+	v.chunks.setMax(n)
+}
+
+func (v *Vault0) getGroups() groups {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	if v.groups == nil {
+		return nil
+	}
+	return friendGroups{v, v.groups}
+}
+
+// friendGroups resolves the short Id of a friend to its fingerprint before
+// looking up its groups, so that membership follows the friend's key
+type friendGroups struct {
+	v *Vault0
+	g sys.Groups
+}
+
+func (fg friendGroups) InGroup(id sys.Id, name string) bool {
+	fp := fg.v.friendFingerprint(id)
+	return fp != nil && fg.g.InGroup(fp, name)
+}
+
+func (v *Vault0) getHomeDir() string {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	return v.hdir
+}
+
+// WaitForError returns the next error the vault ran into while serving
+func (v *Vault0) WaitForError() os.Error {
+	return <-v.errch
+}
+
+func (v *Vault0) reportError(err os.Error) {
+	v.log().Errorf("%s", err)
+	_ = v.errch <- err
+}
+
 func (v *Vault0) isHealthy() dialer.Dialer {
 	v.lk.Lock()
 	defer v.lk.Unlock()
 	return v.d
 }
 
+// Drain waits until all files being served are closed, or until ns
+// nanoseconds pass, in which case it returns os.EAGAIN
+func (v *Vault0) Drain(ns int64) os.Error {
+	const poll = 1e8
+	for waited := int64(0); v.fdlim.LockCount() > 0; waited += poll {
+		if waited >= ns {
+			return os.EAGAIN
+		}
+		time.Sleep(poll)
+	}
+	return nil
+}
+
+// ShutDown stops the vault from dialing neighbors, and closes the pooled
+// sessions to them
 func (v *Vault0) ShutDown() {
 	v.lk.Lock()
 	v.d = nil
 	v.lk.Unlock()
+	v.pool.close()
 }
@@ -0,0 +1,377 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"tonika/http"
+	"tonika/sys"
+)
+
+// ServeVerified fetches files from friends' vaults like Serve, but checks
+// them against the manifest signed by their owner: every chunk is hashed as
+// it arrives, and a chunk that does not match ends the transfer with an
+// error, before any of its bytes are passed on. Verified chunks are kept in
+// the chunk store, and chunks found there are not fetched again. Files
+// without a manifest, or with one that does not check out, are not served
+// at all: the answer is 502 Bad Gateway.
+
+// How many missing chunks are asked for with one Range request
+const maxChunkRun = 64
+
+// Manifests larger than this are refused
+const maxManifestLen = 1 << 20
+
+// How many files of friends the signing time of the newest manifest is
+// remembered for
+const maxSigned = 10000
+
+var errTampered = os.ErrorString("chunk does not match its manifest")
+
+// verifiedFile is a file in a friend's vault, described by a verified
+// manifest
+type verifiedFile struct {
+	req    *http.Request // for the file, with the requester's headers
+	tid    sys.Id
+	m      *sys.Manifest
+	etag   string
+	shared bool // everyone may read the file, so its chunks may be shared
+}
+
+// ServeVerified answers a GET request of mine for a file in a friend's
+// vault, verifying its content. A single Range in the request is honored.
+func (v *Vault0) ServeVerified(req *http.Request) (*http.Response, os.Error) {
+	f, resp, err := v.openVerified(req)
+	if f == nil {
+		return resp, err
+	}
+	return v.respondVerified(f, func(start, end int64) io.ReadCloser {
+		return &verifiedBody{v: v, f: f, off: start, end: end}
+	}), nil
+}
+
+// openVerified fetches and checks the manifest of the file req asks for.
+// If it returns a nil verifiedFile, the response or error it returns is
+// the answer to req.
+func (v *Vault0) openVerified(req *http.Request) (*verifiedFile, *http.Response, os.Error) {
+	tid, fpath, _, err := parseURL(req)
+	if err != nil || tid == v.id || (req.Method != "" && req.Method != "GET") {
+		resp, err := v.Serve(req)
+		return nil, resp, err
+	}
+	discardBody(req)
+
+	mresp, err := v.Serve(v.chunkReq(req, "manifest"))
+	if err != nil || mresp.StatusCode != 200 {
+		return nil, mresp, err
+	}
+	if mresp.Header["Content-Type"] != manifestType {
+		if mresp.Body != nil {
+			mresp.Body.Close()
+		}
+		v.log().With(tid).Warnf("No manifest for %s, not serving it", fpath)
+		return nil, newRespBadGateway(), os.ErrorString("no manifest")
+	}
+	_, private := cacheControl(mresp.Header["Cache-Control"])["private"]
+	data, err := ioutil.ReadAll(io.LimitReader(mresp.Body, maxManifestLen+1))
+	mresp.Body.Close()
+	if err != nil {
+		return nil, newRespServiceUnavailable(), err
+	}
+	if len(data) > maxManifestLen {
+		return nil, newRespServiceUnavailable(), os.ErrorString("manifest too large")
+	}
+	m, err := sys.ParseManifest(data)
+	if err == nil {
+		if fp := v.friendFingerprint(tid); fp != nil {
+			err = m.Verify(fp)
+		} else {
+			err = os.ErrorString("owner is not a friend")
+		}
+	}
+	if err == nil {
+		// A directory is served by its index.html
+		p := fpath[1:]
+		if m.Path != p && m.Path != path.Join(p, "index.html") {
+			err = os.ErrorString("manifest is for another file")
+		}
+	}
+	if err == nil {
+		err = v.checkSigned(tid, m)
+	}
+	if err != nil {
+		v.log().With(tid).Warnf("Bad manifest for %s: %s", fpath, err)
+		return nil, newRespBadGateway(), err
+	}
+	f := &verifiedFile{
+		req:    req,
+		tid:    tid,
+		m:      m,
+		etag:   fmt.Sprintf("\"%x-%x\"", m.Size, m.Mtime),
+		shared: !private,
+	}
+	return f, nil, nil
+}
+
+// friendFingerprint returns the fingerprint of my friend id, or nil
+func (v *Vault0) friendFingerprint(id sys.Id) *sys.Fingerprint {
+	v.lk.Lock()
+	n := v.neighbors
+	v.lk.Unlock()
+	if n == nil {
+		return nil
+	}
+	for _, f := range n.Enumerate() {
+		if f.GetId() != nil && *f.GetId() == id && !f.IsRevoked() {
+			return f.GetFingerprint()
+		}
+	}
+	return nil
+}
+
+// checkSigned refuses m if a manifest of the same file of friend tid,
+// signed later, was seen before. Otherwise m becomes the newest.
+func (v *Vault0) checkSigned(tid sys.Id, m *sys.Manifest) os.Error {
+	key := tid.String() + "/" + m.Path
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	if newest, ok := v.signed[key]; ok && m.Signed < newest {
+		return os.ErrorString("manifest older than one seen before")
+	}
+	if _, ok := v.signed[key]; !ok && len(v.signed) >= maxSigned {
+		for k, _ := range v.signed {
+			v.signed[k] = 0, false
+			break
+		}
+	}
+	v.signed[key] = m.Signed
+	return nil
+}
+
+// respondVerified answers the request for f, with the body made by body
+// for the bytes start to end of the file
+func (v *Vault0) respondVerified(f *verifiedFile, body func(start, end int64) io.ReadCloser) *http.Response {
+	req, m := f.req, f.m
+	modified := time.SecondsToUTC(m.Mtime / 1e9).Format(httpTime)
+	if notModified(req, f.etag, m.Mtime/1e9) {
+		resp := newRespNotModified()
+		resp.Header["Etag"] = f.etag
+		resp.Header["Last-Modified"] = modified
+		return resp
+	}
+	start, length := int64(0), m.Size
+	partial := false
+	if h, ok := req.Header["Range"]; ok {
+		ir, ok := req.Header["If-Range"]
+		ir = strings.TrimSpace(ir)
+		if !ok || ir == modified || ir == f.etag {
+			ranges, err := parseRange(h, m.Size)
+			if err != nil {
+				resp := newRespRangeNotSatisfiable()
+				if resp.Header == nil {
+					resp.Header = make(map[string]string)
+				}
+				resp.Header["Content-Range"] = fmt.Sprintf("bytes */%d", m.Size)
+				return resp
+			}
+			if len(ranges) == 1 {
+				start, length = ranges[0].start, ranges[0].length
+				partial = true
+			}
+		}
+	}
+
+	var resp *http.Response
+	if partial {
+		resp = buildPartialResp(body(start, start+length), length)
+		resp.Header["Content-Range"] = byteRange{start, length}.contentRange(m.Size)
+	} else {
+		resp = buildRespFromBody(body(start, start+length), length)
+		resp.Header = make(map[string]string)
+	}
+	resp.Header["Accept-Ranges"] = "bytes"
+	resp.Header["Last-Modified"] = modified
+	resp.Header["Etag"] = f.etag
+	return resp
+}
+
+// chunkReq returns a GET request for the same file as req, with the given
+// query
+func (v *Vault0) chunkReq(req *http.Request, query string) *http.Request {
+	u := *req.URL
+	u.RawQuery = query
+	return &http.Request{
+		Method:     "GET",
+		URL:        &u,
+		Host:       req.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(map[string]string),
+		UserAgent:  req.UserAgent,
+	}
+}
+
+// fetchChunks asks the owner of f for chunks first to last
+func (v *Vault0) fetchChunks(f *verifiedFile, first, last int) (*http.Response, os.Error) {
+	start, _ := f.m.ChunkSpan(first)
+	off, n := f.m.ChunkSpan(last)
+	req := v.chunkReq(f.req, f.req.URL.RawQuery)
+	req.Header["Range"] = fmt.Sprintf("bytes=%d-%d", start, off+n-1)
+	req.Header["If-Range"] = f.etag
+	resp, err := v.Serve(req)
+	if err != nil {
+		return nil, err
+	}
+	ok := resp.StatusCode == 206 || (resp.StatusCode == 200 && start == 0)
+	if ok && resp.StatusCode == 206 {
+		s, _, good := ParseContentRange(resp.Header["Content-Range"])
+		ok = good && s == start
+	}
+	if !ok || resp.Body == nil {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, os.ErrorString("file changed or cannot be fetched: " + resp.Status)
+	}
+	return resp, nil
+}
+
+// readChunk reads the i-th chunk of f from r, and verifies and stores it
+func (v *Vault0) readChunk(f *verifiedFile, i int, r io.Reader, src sys.Id) ([]byte, os.Error) {
+	_, n := f.m.ChunkSpan(i)
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	sum := f.m.ChunkHash(i)
+	if !bytes.Equal(sys.HashChunk(data), sum) {
+		v.log().With(src).Warnf("Chunk %d of %s does not match its manifest", i, f.m.Path)
+		return nil, errTampered
+	}
+	v.chunks.put(sum, data, f.shared)
+	return data, nil
+}
+
+// verifiedBody reads the bytes off to end of f, chunk by chunk, from the
+// chunk store or else from the friend's vault
+type verifiedBody struct {
+	v        *Vault0
+	f        *verifiedFile
+	off, end int64
+	buf      []byte // rest of the current chunk, up to end
+	run      *http.Response
+	next     int // chunk the run continues with
+	last     int // last chunk of the run
+	err      os.Error
+}
+
+func (b *verifiedBody) Read(p []byte) (int, os.Error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.off >= b.end {
+			return 0, os.EOF
+		}
+		i := int(b.off / b.f.m.ChunkSize)
+		data, err := b.chunk(i)
+		if err != nil {
+			b.err = err
+			return 0, err
+		}
+		b.buf = chunkPart(b.f.m, i, data, b.off, b.end)
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.off += int64(n)
+	return n, nil
+}
+
+// chunkPart returns the part of the i-th chunk, data, from off up to end
+func chunkPart(m *sys.Manifest, i int, data []byte, off, end int64) []byte {
+	coff, _ := m.ChunkSpan(i)
+	to := int64(len(data))
+	if coff+to > end {
+		to = end - coff
+	}
+	return data[off-coff : to]
+}
+
+// chunk returns the verified i-th chunk
+func (b *verifiedBody) chunk(i int) ([]byte, os.Error) {
+	if b.run == nil || b.next != i {
+		if data := b.v.chunks.get(b.f.m.ChunkHash(i), false); data != nil {
+			return data, nil
+		}
+		if err := b.startRun(i); err != nil {
+			return nil, err
+		}
+	}
+	data, err := b.v.readChunk(b.f, i, b.run.Body, b.f.tid)
+	if err != nil {
+		b.closeRun()
+		return nil, err
+	}
+	b.next = i + 1
+	if b.next > b.last {
+		b.closeRun()
+	}
+	return data, nil
+}
+
+// startRun asks the friend's vault for the chunks from i on that are
+// missing from the chunk store, up to maxChunkRun of them
+func (b *verifiedBody) startRun(i int) os.Error {
+	b.closeRun()
+	last := i
+	lastNeeded := int((b.end - 1) / b.f.m.ChunkSize)
+	for last+1 <= lastNeeded && last+1-i < maxChunkRun &&
+		!b.v.chunks.has(b.f.m.ChunkHash(last+1), false) {
+		last++
+	}
+	resp, err := b.v.fetchChunks(b.f, i, last)
+	if err != nil {
+		return err
+	}
+	b.run, b.next, b.last = resp, i, last
+	return nil
+}
+
+func (b *verifiedBody) closeRun() {
+	if b.run != nil {
+		if b.run.Body != nil {
+			b.run.Body.Close()
+		}
+		b.run = nil
+	}
+}
+
+func (b *verifiedBody) Close() os.Error {
+	b.closeRun()
+	if b.err == nil {
+		b.err = os.EOF
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Tonika: A distributed social networking platform
+// Copyright (C) 2010 Petar Maymounkov <petar@5ttt.org>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"testing"
+	"tonika/sys"
+)
+
+func TestCheckSigned(t *testing.T) {
+	v := &Vault0{signed: make(map[string]int64)}
+	m := &sys.Manifest{Path: "a.txt", Signed: 20}
+	if v.checkSigned(2, m) != nil {
+		t.Fatalf("first manifest refused")
+	}
+	if v.checkSigned(2, m) != nil {
+		t.Errorf("same manifest refused")
+	}
+	old := &sys.Manifest{Path: "a.txt", Signed: 10}
+	if v.checkSigned(2, old) == nil {
+		t.Errorf("older manifest accepted")
+	}
+	if v.checkSigned(3, old) != nil || v.checkSigned(2, &sys.Manifest{Path: "b.txt", Signed: 10}) != nil {
+		t.Errorf("manifest of another file refused")
+	}
+	if v.checkSigned(2, &sys.Manifest{Path: "a.txt", Signed: 30}) != nil || v.checkSigned(2, m) == nil {
+		t.Errorf("newer manifest did not replace the old one")
+	}
+}
@@ -45,6 +45,8 @@ type watchFwd struct {
 	OnBehalfInTraffic  int64
 	OnBehalfOutTraffic int64
 	LatencyPerByte math.AvgVar
+	PoolHits   int // requests sent on a pooled session
+	PoolMisses int // requests that needed a new session
 }
 
 func (v *watch) Init(fdlim *http.FDLimiter) {
@@ -131,6 +133,17 @@ func (v *watch) IncFwdBehalfOutTraffic(id sys.Id, amt int64) {
 	v.getFwd(id).OnBehalfOutTraffic += amt 
 }
 
+func (v *watch) IncFwdSession(id sys.Id, pooled bool) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+	f := v.getFwd(id)
+	if pooled {
+		f.PoolHits++
+	} else {
+		f.PoolMisses++
+	}
+}
+
 func (v *watch) RecFwdLatencyPerByte(id sys.Id, lpb float64) { 
 	v.lk.Lock()
 	defer v.lk.Unlock()
@@ -203,19 +216,32 @@ func (f *watchFwd) String(id sys.Id) string {
 	fmt.Fprintf(&w, 
 		"    Id:%s\n" +
 		"      MyInTraffic: %d, MyOutTraffic: %d\n" +
-		"      BehalfInTraffic: %d, BehalfOutTraffic: %d, LatencyPerByte: %g\n",
+		"      BehalfInTraffic: %d, BehalfOutTraffic: %d, LatencyPerByte: %g\n" +
+		"      PoolHits: %d, PoolMisses: %d, PoolHitRate: %g\n",
 		id.Eye(), f.MyInTraffic, f.MyOutTraffic, 
-		f.OnBehalfInTraffic, f.OnBehalfOutTraffic, f.LatencyPerByte.GetAvg())
+		f.OnBehalfInTraffic, f.OnBehalfOutTraffic, f.LatencyPerByte.GetAvg(),
+		f.PoolHits, f.PoolMisses, f.poolHitRate())
 	return w.String()
 }
 
+// poolHitRate returns the fraction of requests sent on pooled sessions
+func (f *watchFwd) poolHitRate() float64 {
+	n := f.PoolHits + f.PoolMisses
+	if n == 0 {
+		return 0
+	}
+	return float64(f.PoolHits) / float64(n)
+}
+
 func (f *watchFwd) toJSON(id sys.Id) string {
 	var w bytes.Buffer
 	fmt.Fprintf(&w, 
 		"{\"Id\":%s,\"MyInTraffic\":%d,\"MyOutTraffic\":%d," +
-		"\"BehalfInTraffic\":%d,\"BehalfOutTraffic\":%d",
+		"\"BehalfInTraffic\":%d,\"BehalfOutTraffic\":%d," +
+		"\"PoolHits\":%d,\"PoolMisses\":%d,\"PoolHitRate\":%g",
 		id.ToJSON(), f.MyInTraffic, f.MyOutTraffic, 
-		f.OnBehalfInTraffic, f.OnBehalfOutTraffic)
+		f.OnBehalfInTraffic, f.OnBehalfOutTraffic,
+		f.PoolHits, f.PoolMisses, f.poolHitRate())
 	lat := f.LatencyPerByte.GetAvg()
 	if math.IsNum(lat) {
 		fmt.Fprintf(&w, ",\"LatencyPerByte\":%g}", lat)